@@ -0,0 +1,165 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"rmd-server/user"
+)
+
+// Server administration, for the accounts listed in AdminUsers.
+// Other accounts get "403 Forbidden".
+//
+//	PUT  /admin/invites         body: {"IDT": <token>}                       -> list the invites (inviteData)
+//	POST /admin/invites         body: inviteCreateData                       -> inviteCreatedReply
+//	POST /admin/invites/delete  body: {"IDT": <token>, "Data": <invite id>}  -> delete an invite
+//
+// The same can be done with the CLI: "rmd-server invite list|create|delete".
+
+const ERR_NOT_ADMIN = "Only admins can do this"
+
+type inviteData struct {
+	Id             uint64
+	Username       string // if set, the invite can only register this username
+	Note           string
+	MaxUses        int64
+	Uses           int64
+	CreatedTime    int64    // unix time in seconds
+	ExpirationTime int64    // unix time in seconds, 0 if the invite does not expire
+	Valid          bool     // not expired and not used up
+	Users          []string // the accounts registered with this invite
+}
+
+type inviteCreateData struct {
+	IDT          string
+	MaxUses      int64 // default 1
+	ValidSeconds int64 // 0 for an invite that does not expire
+	Username     string
+	Note         string
+}
+
+type inviteCreatedReply struct {
+	Code   string // only returned once, the server only stores its hash
+	Invite inviteData
+}
+
+func toInviteData(invite *user.Invite) inviteData {
+	return inviteData{
+		Id:             invite.Id,
+		Username:       invite.Username,
+		Note:           invite.Note,
+		MaxUses:        invite.MaxUses,
+		Uses:           invite.Uses,
+		CreatedTime:    invite.CreatedTime,
+		ExpirationTime: invite.ExpirationTime,
+		Valid:          invite.IsValid(time.Now()),
+		Users:          uio.GetInviteUsers(invite),
+	}
+}
+
+// Returns the admin of the access token.
+// If the token is invalid or the account is not an admin, replies with the error and returns nil.
+func checkAdmin(w http.ResponseWriter, accessToken string) *user.RMDUser {
+	u, err := uio.CheckAccessTokenAndGetUser(accessToken, user.ScopeAccountAdmin)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return nil
+	}
+	if !uio.IsAdmin(u) {
+		http.Error(w, ERR_NOT_ADMIN, http.StatusForbidden)
+		return nil
+	}
+	return u
+}
+
+func mainAdminInvites(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/invites"), "/")
+
+	switch {
+	case action == "" && r.Method == http.MethodPut:
+		getInvites(w, r)
+	case action == "" && r.Method == http.MethodPost:
+		postInvite(w, r)
+	case action == "delete" && r.Method == http.MethodPost:
+		deleteInvite(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func getInvites(w http.ResponseWriter, r *http.Request) {
+	var request DataPackage
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	if checkAdmin(w, request.IDT) == nil {
+		return
+	}
+
+	reply := []inviteData{}
+	for _, invite := range uio.GetInvites() {
+		reply = append(reply, toInviteData(&invite))
+	}
+	result, _ := json.Marshal(reply)
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Write(result)
+}
+
+func postInvite(w http.ResponseWriter, r *http.Request) {
+	var data inviteCreateData
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	if checkAdmin(w, data.IDT) == nil {
+		return
+	}
+
+	if data.MaxUses == 0 {
+		data.MaxUses = 1
+	}
+	if data.ValidSeconds < 0 {
+		http.Error(w, "ValidSeconds must not be negative", http.StatusBadRequest)
+		return
+	}
+	code, invite, err := uio.CreateInvite(data.MaxUses, time.Duration(data.ValidSeconds)*time.Second, data.Username, data.Note)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, _ := json.Marshal(inviteCreatedReply{Code: code, Invite: toInviteData(invite)})
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Write(result)
+}
+
+func deleteInvite(w http.ResponseWriter, r *http.Request) {
+	var request DataPackage
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	if checkAdmin(w, request.IDT) == nil {
+		return
+	}
+
+	id, err := strconv.ParseUint(request.Data, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid invite id", http.StatusBadRequest)
+		return
+	}
+	err = uio.DeleteInvite(id)
+	if errors.Is(err, user.ErrInviteNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
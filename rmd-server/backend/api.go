@@ -5,7 +5,9 @@ import (
 	"net/http"
 	conf "rmd-server/config"
 	frontend "rmd-server/web"
+	"time"
 
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 )
 
@@ -52,18 +54,33 @@ func buildServeMux(config *viper.Viper) *http.ServeMux {
 
 	tileServerUrl, tileServerOrigin := conf.ValidateTileServerUrl(config.GetString(conf.CONF_TILE_SERVER_URL))
 
-	mainDeviceHandler := mainDeviceHandler{createDeviceHandler{config.GetString(conf.CONF_REGISTRATION_TOKEN)}}
+	authLimiter := NewRateLimiter(config.GetInt(conf.CONF_RATE_LIMIT_AUTH_PER_MINUTE), config.GetInt(conf.CONF_RATE_LIMIT_AUTH_BURST))
+	inviteOnly := config.GetBool(conf.CONF_REGISTRATION_INVITE_ONLY)
+	if config.GetString(conf.CONF_REGISTRATION_TOKEN) != "" {
+		// The token was migrated to an invite by initDb
+		log.Warn().Msg("RegistrationToken is deprecated, registration is invite-only and the token works as an invite. Create invites with \"rmd-server invite create\" and set RegistrationInviteOnly instead.")
+		inviteOnly = true
+	}
+	createDevice := authLimiter.Middleware("device", createDeviceHandler{InviteOnly: inviteOnly})
+	mainDeviceHandler := mainDeviceHandler{createDevice}
+	maxCommandWait := time.Duration(config.GetInt(conf.CONF_MAX_COMMAND_WAIT_SECONDS)) * time.Second
+	mainCommandHandler := mainCommandHandler{getCommandHandler{maxCommandWait}}
 
 	apiV1Mux := http.NewServeMux()
-	apiV1Mux.HandleFunc("/command", mainCommand)
-	apiV1Mux.HandleFunc("/command/", mainCommand)
-	//Disabled Feature: CommandLogs
-	//apiV1Mux.HandleFunc("/commandLogs", getCommandLog)
-	//apiV1Mux.HandleFunc("/commandLogs/", getCommandLog)
+	apiV1Mux.Handle("/command", mainCommandHandler)
+	apiV1Mux.Handle("/command/", mainCommandHandler)
+	apiV1Mux.HandleFunc("/commands", getAllCommands)
+	apiV1Mux.HandleFunc("/commands/", getAllCommands)
+	apiV1Mux.HandleFunc("/commandStatus", mainCommandStatus)
+	apiV1Mux.HandleFunc("/commandStatus/", mainCommandStatus)
+	apiV1Mux.HandleFunc("/commandLogs", getCommandLog)
+	apiV1Mux.HandleFunc("/commandLogs/", getCommandLog)
 	apiV1Mux.HandleFunc("/location", mainLocation)
 	apiV1Mux.HandleFunc("/location/", mainLocation)
 	apiV1Mux.HandleFunc("/locations", getAllLocations)
 	apiV1Mux.HandleFunc("/locations/", getAllLocations)
+	apiV1Mux.HandleFunc("/locationPage", getLocationPage)
+	apiV1Mux.HandleFunc("/locationPage/", getLocationPage)
 	apiV1Mux.HandleFunc("/locationDataSize", getLocationDataSize)
 	apiV1Mux.HandleFunc("/locationDataSize/", getLocationDataSize)
 	apiV1Mux.HandleFunc("/picture", mainPicture)
@@ -72,20 +89,48 @@ func buildServeMux(config *viper.Viper) *http.ServeMux {
 	apiV1Mux.HandleFunc("/pictures/", getAllPictures)
 	apiV1Mux.HandleFunc("/pictureSize", getPictureSize)
 	apiV1Mux.HandleFunc("/pictureSize/", getPictureSize)
+	apiV1Mux.HandleFunc("/pictureUpload", mainPictureUpload)
+	apiV1Mux.HandleFunc("/pictureUpload/", mainPictureUpload)
+	apiV1Mux.HandleFunc("/usage", getStorageUsage)
+	apiV1Mux.HandleFunc("/usage/", getStorageUsage)
+	apiV1Mux.HandleFunc("/events", mainEvents)
+	apiV1Mux.HandleFunc("/events/", mainEvents)
+	apiV1Mux.HandleFunc("/export", getExport)
+	apiV1Mux.HandleFunc("/export/", getExport)
+	apiV1Mux.HandleFunc("/deviceSocket", getDeviceSocket)
+	apiV1Mux.HandleFunc("/deviceSocket/", getDeviceSocket)
 	apiV1Mux.HandleFunc("/key", getPrivKey)
 	apiV1Mux.HandleFunc("/key/", getPrivKey)
 	apiV1Mux.HandleFunc("/pubKey", getPubKey)
 	apiV1Mux.HandleFunc("/pubKey/", getPubKey)
 	apiV1Mux.Handle("/device", mainDeviceHandler)
 	apiV1Mux.Handle("/device/", mainDeviceHandler)
+	apiV1Mux.HandleFunc("/devices", mainDevices)
+	apiV1Mux.HandleFunc("/devices/", mainDevices)
 	apiV1Mux.HandleFunc("/password", postPassword)
 	apiV1Mux.HandleFunc("/password/", postPassword)
 	apiV1Mux.HandleFunc("/push", mainPushUrl)
 	apiV1Mux.HandleFunc("/push/", mainPushUrl)
-	apiV1Mux.HandleFunc("/salt", requestSalt)
-	apiV1Mux.HandleFunc("/salt/", requestSalt)
-	apiV1Mux.HandleFunc("/requestAccess", requestAccess)
-	apiV1Mux.HandleFunc("/requestAccess/", requestAccess)
+	apiV1Mux.HandleFunc("/sessions", mainSessions)
+	apiV1Mux.HandleFunc("/sessions/", mainSessions)
+	apiV1Mux.HandleFunc("/grants", mainGrants)
+	apiV1Mux.HandleFunc("/grants/", mainGrants)
+	apiV1Mux.Handle("/salt", authLimiter.Middleware("salt", http.HandlerFunc(requestSalt)))
+	apiV1Mux.Handle("/salt/", authLimiter.Middleware("salt", http.HandlerFunc(requestSalt)))
+	apiV1Mux.Handle("/requestAccess", authLimiter.Middleware("requestAccess", http.HandlerFunc(requestAccess)))
+	apiV1Mux.Handle("/requestAccess/", authLimiter.Middleware("requestAccess", http.HandlerFunc(requestAccess)))
+	apiV1Mux.Handle("/verifyTotp", authLimiter.Middleware("verifyTotp", http.HandlerFunc(verifyTotp)))
+	apiV1Mux.Handle("/verifyTotp/", authLimiter.Middleware("verifyTotp", http.HandlerFunc(verifyTotp)))
+	apiV1Mux.HandleFunc("/totp", mainTotp)
+	apiV1Mux.HandleFunc("/totp/", mainTotp)
+	apiV1Mux.Handle("/passkeyLogin", authLimiter.Middleware("passkeyLogin", http.HandlerFunc(mainPasskeyLogin)))
+	apiV1Mux.Handle("/passkeyLogin/", authLimiter.Middleware("passkeyLogin", http.HandlerFunc(mainPasskeyLogin)))
+	apiV1Mux.HandleFunc("/passkeys", mainPasskeys)
+	apiV1Mux.HandleFunc("/passkeys/", mainPasskeys)
+	apiV1Mux.HandleFunc("/admin/invites", mainAdminInvites)
+	apiV1Mux.HandleFunc("/admin/invites/", mainAdminInvites)
+	apiV1Mux.Handle("/refreshAccess", authLimiter.Middleware("refreshAccess", http.HandlerFunc(refreshAccess)))
+	apiV1Mux.Handle("/refreshAccess/", authLimiter.Middleware("refreshAccess", http.HandlerFunc(refreshAccess)))
 	apiV1Mux.HandleFunc("/version", getVersion)
 	apiV1Mux.HandleFunc("/version/", getVersion)
 
@@ -3,10 +3,12 @@ package backend
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"crypto/aes"
 	"crypto/cipher"
@@ -26,6 +28,7 @@ const CT_APPLICATION_JSON = "application/json"
 const CT_TEXT_JAVASCRIPT = "text/javascript"
 
 const ERR_ACCESS_TOKEN_INVALID = "Access token not valid"
+const ERR_ACCESS_TOKEN_SCOPE = "Access token lacks the required scope"
 const ERR_JSON_INVALID = "Invalid JSON"
 
 type registrationData struct {
@@ -34,7 +37,7 @@ type registrationData struct {
 	PubKey            string
 	PrivKey           string
 	RequestedUsername string
-	RegistrationToken string
+	RegistrationToken string // the invite code (see /admin/invites), historically a static token
 	PlainPassword     string
 }
 
@@ -52,6 +55,25 @@ type loginData struct {
 	PasswordHash           string `json:"Data"`
 	SessionDurationSeconds uint64
 	PlainPassword          string
+	RequestRefreshToken    bool     // also return a refresh token, for use with /refreshAccess
+	Scopes                 []string // scopes of the access token (see user.Scope), empty for all scopes
+	DeviceCredential       string   // skips the TOTP step, but limits the scopes (see /devices/credential)
+}
+
+type refreshAccessData struct {
+	RefreshToken           string
+	SessionDurationSeconds uint64 // lifetime of the new access token
+}
+
+// Reply to /requestAccess and /refreshAccess.
+// This is a superset of DataPackage for backwards compatibility.
+type accessTokenReply struct {
+	IDT                   string // user id
+	Data                  string // access token
+	ExpirationTime        int64  // unix time in seconds when the access token expires
+	RefreshToken          string `json:",omitempty"`
+	RefreshExpirationTime int64  `json:",omitempty"` // unix time in seconds when the refresh token expires
+	Scopes                []user.Scope
 }
 
 // suboptimal naming for backwards compatibility
@@ -60,14 +82,46 @@ type commandData struct {
 	Data     string // plaintext command
 	UnixTime uint64 // unix time in milliseconds
 	CmdSig   string // base64-encoded signature over "UnixTime:Data"
+	CmdId    uint64 // server-assigned command ID, used to report the command status
+	Device   string `json:",omitempty"` // device selector, see DataPackage
+}
+
+type commandFetchRequest struct {
+	IDT string // access token
+	// Optional: if no command is queued, wait up to this many seconds for one (long-polling).
+	// The server caps this at its configured maximum.
+	WaitSeconds uint64
+	Device      string // device selector, see DataPackage
+}
+
+type commandStatusData struct {
+	IDT         string // access token
+	CmdId       uint64
+	Data        string // plaintext command
+	Status      string // queued, delivered, acknowledged, executed, failed
+	Result      string // optional result message from the device
+	CreatedTime int64  // unix time in seconds
+	UpdatedTime int64  // unix time in seconds
+	Device      string `json:",omitempty"` // device selector, see DataPackage
 }
 
 // universal package for string transfer
 // IDT = DeviceID or AccessToken
 // If both will be send. ID is always IDT
 type DataPackage struct {
-	IDT  string
-	Data string
+	IDT    string
+	Data   string
+	Device string `json:",omitempty"` // optional device selector (see /devices), empty for the default device
+}
+
+// Reply with the error for a failed CheckAccessTokenAndGetUser.
+// A valid token without the required scope gets 403, so that clients don't try to log in again.
+func writeAccessTokenError(w http.ResponseWriter, err error) {
+	if errors.Is(err, user.ErrScopeMissing) {
+		http.Error(w, ERR_ACCESS_TOKEN_SCOPE, http.StatusForbidden)
+		return
+	}
+	http.Error(w, ERR_ACCESS_TOKEN_INVALID, http.StatusUnauthorized)
 }
 
 // ------- Location -------
@@ -79,18 +133,28 @@ func getLocation(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
 		return
 	}
-	user, err := uio.CheckAccessTokenAndGetUser(request.IDT)
+	user, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeLocationsRead)
 	if err != nil {
-		http.Error(w, ERR_ACCESS_TOKEN_INVALID, http.StatusUnauthorized)
+		writeAccessTokenError(w, err)
+		return
+	}
+	device := getDeviceOrError(w, user, request.Device)
+	if device == nil {
 		return
 	}
 	index, _ := strconv.Atoi(request.Data)
 	if index == -1 {
-		index = uio.GetLocationSize(user)
+		index = uio.GetLocationSize(device)
 	}
-	data := uio.GetLocation(user, index)
+	data := uio.GetLocation(device, index)
+	if data == "" {
+		// out of bounds, keep the historic empty reply
+		w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+		return
+	}
+	result, _ := json.Marshal(DataPackage{Data: data})
 	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
-	w.Write([]byte(fmt.Sprint(string(data))))
+	w.Write(result)
 }
 
 func getAllLocations(w http.ResponseWriter, r *http.Request) {
@@ -100,13 +164,23 @@ func getAllLocations(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
 		return
 	}
-	user, err := uio.CheckAccessTokenAndGetUser(request.IDT)
+	user, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeLocationsRead)
 	if err != nil {
-		http.Error(w, ERR_ACCESS_TOKEN_INVALID, http.StatusUnauthorized)
+		writeAccessTokenError(w, err)
 		return
 	}
-	data := uio.GetAllLocations(user)
-	jsonData, err := json.Marshal(data)
+	device := getDeviceOrError(w, user, request.Device)
+	if device == nil {
+		return
+	}
+	// For compatibility, each location is a string-encoded DataPackage
+	data := uio.GetAllLocations(device)
+	locations := make([]string, len(data))
+	for i, loc := range data {
+		locAsString, _ := json.Marshal(DataPackage{Data: loc})
+		locations[i] = string(locAsString)
+	}
+	jsonData, err := json.Marshal(locations)
 	if err != nil {
 		http.Error(w, "Failed to export data", http.StatusConflict)
 		return
@@ -115,21 +189,86 @@ func getAllLocations(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(fmt.Sprint(string(jsonData))))
 }
 
+type locationPageRequest struct {
+	IDT    string // access token
+	Cursor uint64 // ID of the last location that the client has seen, 0 to start with the oldest location
+	Limit  int    // page size, 0 for the default
+	Since  int64  // unix time in seconds (server-side received time), 0 for no lower bound
+	Until  int64  // unix time in seconds (server-side received time), 0 for no upper bound
+	Device string // device selector, see DataPackage
+}
+
+type locationData struct {
+	Id           uint64 // stable row ID, can be used as Cursor
+	ReceivedTime int64  // unix time in seconds, 0 if unknown
+	Data         string // encrypted location, as sent by the device
+}
+
+type locationPageReply struct {
+	IDT        string
+	Locations  []locationData
+	NextCursor uint64 // ID of the last location in this page (or the request cursor if the page is empty)
+	HasMore    bool   // whether there are more locations after this page
+}
+
+func getLocationPage(w http.ResponseWriter, r *http.Request) {
+	var request locationPageRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	user, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeLocationsRead)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+	device := getDeviceOrError(w, user, request.Device)
+	if device == nil {
+		return
+	}
+
+	locations, hasMore := uio.GetLocationPage(device, request.Cursor, request.Limit, request.Since, request.Until)
+
+	reply := locationPageReply{
+		IDT:        request.IDT,
+		Locations:  make([]locationData, len(locations)),
+		NextCursor: request.Cursor,
+		HasMore:    hasMore,
+	}
+	for i, loc := range locations {
+		reply.Locations[i] = locationData{Id: loc.Id, ReceivedTime: loc.ReceivedTime, Data: loc.Position}
+		reply.NextCursor = loc.Id
+	}
+
+	result, _ := json.Marshal(reply)
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Write(result)
+}
+
 func postLocation(w http.ResponseWriter, r *http.Request) {
+	limitRequestBody(w, r)
 	var request DataPackage
 	err := json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
-		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		writeDecodeError(w, err)
 		return
 	}
-	user, err := uio.CheckAccessTokenAndGetUser(request.IDT)
+	user, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeDeviceUpload)
 	if err != nil {
-		http.Error(w, ERR_ACCESS_TOKEN_INVALID, http.StatusUnauthorized)
+		writeAccessTokenError(w, err)
+		return
+	}
+	device := getDeviceOrError(w, user, request.Device)
+	if device == nil {
 		return
 	}
 
-	locationAsString, _ := json.MarshalIndent(request, "", " ")
-	uio.AddLocation(user, string(locationAsString))
+	// Only store the encrypted location, not the access token
+	err = uio.AddLocation(user, device, request.Data)
+	if writeStorageError(w, err) {
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -140,13 +279,17 @@ func getLocationDataSize(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
 		return
 	}
-	user, err := uio.CheckAccessTokenAndGetUser(request.IDT)
+	user, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeLocationsRead)
 	if err != nil {
-		http.Error(w, ERR_ACCESS_TOKEN_INVALID, http.StatusUnauthorized)
+		writeAccessTokenError(w, err)
+		return
+	}
+	device := getDeviceOrError(w, user, request.Device)
+	if device == nil {
 		return
 	}
 
-	size := uio.GetLocationSize(user)
+	size := uio.GetLocationSize(device)
 
 	dataSize := DataPackage{Data: strconv.Itoa(size)}
 	result, _ := json.Marshal(dataSize)
@@ -163,17 +306,21 @@ func getPicture(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
 		return
 	}
-	user, err := uio.CheckAccessTokenAndGetUser(request.IDT)
+	user, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopePicturesRead)
 	if err != nil {
-		http.Error(w, ERR_ACCESS_TOKEN_INVALID, http.StatusUnauthorized)
+		writeAccessTokenError(w, err)
+		return
+	}
+	device := getDeviceOrError(w, user, request.Device)
+	if device == nil {
 		return
 	}
 
 	index, _ := strconv.Atoi(request.Data)
 	if index == -1 {
-		index = uio.GetPictureSize(user)
+		index = uio.GetPictureSize(device)
 	}
-	data := uio.GetPicture(user, index)
+	data := uio.GetPicture(device, index)
 	w.Header().Set(HEADER_CONTENT_TYPE, "text/plain")
 	w.Write([]byte(fmt.Sprint(string(data))))
 }
@@ -185,12 +332,16 @@ func getAllPictures(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
 		return
 	}
-	user, err := uio.CheckAccessTokenAndGetUser(request.IDT)
+	user, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopePicturesRead)
 	if err != nil {
-		http.Error(w, ERR_ACCESS_TOKEN_INVALID, http.StatusUnauthorized)
+		writeAccessTokenError(w, err)
 		return
 	}
-	data := uio.GetAllPictures(user)
+	device := getDeviceOrError(w, user, request.Device)
+	if device == nil {
+		return
+	}
+	data := uio.GetAllPictures(device)
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		http.Error(w, "Failed to export data", http.StatusConflict)
@@ -207,13 +358,17 @@ func getPictureSize(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
 		return
 	}
-	user, err := uio.CheckAccessTokenAndGetUser(request.IDT)
+	user, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopePicturesRead)
 	if err != nil {
-		http.Error(w, ERR_ACCESS_TOKEN_INVALID, http.StatusUnauthorized)
+		writeAccessTokenError(w, err)
+		return
+	}
+	device := getDeviceOrError(w, user, request.Device)
+	if device == nil {
 		return
 	}
 
-	highest := uio.GetPictureSize(user)
+	highest := uio.GetPictureSize(device)
 
 	dataSize := DataPackage{Data: strconv.Itoa(highest)}
 	result, _ := json.Marshal(dataSize)
@@ -222,20 +377,28 @@ func getPictureSize(w http.ResponseWriter, r *http.Request) {
 }
 
 func postPicture(w http.ResponseWriter, r *http.Request) {
+	limitRequestBody(w, r)
 	var data DataPackage
 	err := json.NewDecoder(r.Body).Decode(&data)
 	if err != nil {
-		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		writeDecodeError(w, err)
 		return
 	}
-	user, err := uio.CheckAccessTokenAndGetUser(data.IDT)
+	user, err := uio.CheckAccessTokenAndGetUser(data.IDT, user.ScopeDeviceUpload)
 	if err != nil {
-		http.Error(w, ERR_ACCESS_TOKEN_INVALID, http.StatusUnauthorized)
+		writeAccessTokenError(w, err)
+		return
+	}
+	device := getDeviceOrError(w, user, data.Device)
+	if device == nil {
 		return
 	}
 
 	picture := data.Data
-	uio.AddPicture(user, picture)
+	err = uio.AddPicture(user, device, picture)
+	if writeStorageError(w, err) {
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -248,9 +411,9 @@ func getPrivKey(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
 		return
 	}
-	user, err := uio.CheckAccessTokenAndGetUser(request.IDT)
+	user, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeKeyRead)
 	if err != nil {
-		http.Error(w, ERR_ACCESS_TOKEN_INVALID, http.StatusUnauthorized)
+		writeAccessTokenError(w, err)
 		return
 	}
 
@@ -267,9 +430,9 @@ func getPubKey(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
 		return
 	}
-	user, err := uio.CheckAccessTokenAndGetUser(request.IDT)
+	user, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeAny)
 	if err != nil {
-		http.Error(w, ERR_ACCESS_TOKEN_INVALID, http.StatusUnauthorized)
+		writeAccessTokenError(w, err)
 		return
 	}
 
@@ -281,22 +444,89 @@ func getPubKey(w http.ResponseWriter, r *http.Request) {
 
 // ------- Commands -------
 
-func getCommand(w http.ResponseWriter, r *http.Request) {
+func toCommandData(idt string, cmd *user.Command) commandData {
+	return commandData{IDT: idt, Data: cmd.Command, UnixTime: cmd.CommandTime, CmdSig: cmd.CommandSig, CmdId: cmd.Id}
+}
+
+func toCommandStatusData(idt string, cmd *user.Command) commandStatusData {
+	return commandStatusData{
+		IDT:         idt,
+		CmdId:       cmd.Id,
+		Data:        cmd.Command,
+		Status:      cmd.Status,
+		Result:      cmd.Result,
+		CreatedTime: cmd.CreatedTime,
+		UpdatedTime: cmd.UpdatedTime,
+	}
+}
+
+type getCommandHandler struct {
+	MaxWait time.Duration
+}
+
+func (h getCommandHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var data commandFetchRequest
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	u, err := uio.CheckAccessTokenAndGetUser(data.IDT, user.ScopeDeviceUpload)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+	device := getDeviceOrError(w, u, data.Device)
+	if device == nil {
+		return
+	}
+
+	var cmd *user.Command
+	if data.WaitSeconds > 0 && h.MaxWait > 0 {
+		wait := min(time.Duration(data.WaitSeconds)*time.Second, h.MaxWait)
+		cmd, err = uio.WaitForCommand(r.Context(), u, device, wait)
+		if err == user.ErrTooManyWaiters {
+			w.Header().Set("Retry-After", strconv.Itoa(int(h.MaxWait.Seconds())))
+			http.Error(w, "Too many waiting requests", http.StatusTooManyRequests)
+			return
+		}
+	} else {
+		cmd = uio.GetCommandToUser(u, device)
+	}
+
+	// If no command is queued, reply with an empty command. That's fine.
+	reply := commandData{IDT: data.IDT}
+	if cmd != nil {
+		reply = toCommandData(data.IDT, cmd)
+	}
+	result, _ := json.Marshal(reply)
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Write([]byte(result))
+}
+
+func getAllCommands(w http.ResponseWriter, r *http.Request) {
 	var data DataPackage
 	err := json.NewDecoder(r.Body).Decode(&data)
 	if err != nil {
 		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
 		return
 	}
-	user, err := uio.CheckAccessTokenAndGetUser(data.IDT)
+	// Fetching delivers the commands, thus only the device may do it (like getCommandHandler)
+	user, err := uio.CheckAccessTokenAndGetUser(data.IDT, user.ScopeDeviceUpload)
 	if err != nil {
-		http.Error(w, ERR_ACCESS_TOKEN_INVALID, http.StatusUnauthorized)
+		writeAccessTokenError(w, err)
+		return
+	}
+	device := getDeviceOrError(w, user, data.Device)
+	if device == nil {
 		return
 	}
-	cmd, time, sig := uio.GetCommandToUser(user)
 
-	// commandAsString may be an empty string, that's fine
-	reply := commandData{IDT: data.IDT, Data: cmd, UnixTime: time, CmdSig: sig}
+	cmds := uio.GetAllCommandsToUser(user, device)
+	reply := make([]commandData, len(cmds))
+	for i := range cmds {
+		reply[i] = toCommandData(data.IDT, &cmds[i])
+	}
 	result, _ := json.Marshal(reply)
 	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
 	w.Write([]byte(result))
@@ -309,38 +539,156 @@ func postCommand(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
 		return
 	}
-	user, err := uio.CheckAccessTokenAndGetUser(data.IDT)
+	user, err := uio.CheckAccessTokenAndGetUser(data.IDT, user.ScopeCommandsSend)
 	if err != nil {
-		http.Error(w, ERR_ACCESS_TOKEN_INVALID, http.StatusUnauthorized)
+		writeAccessTokenError(w, err)
 		return
 	}
-	uio.SetCommandToUser(user, data.Data, data.UnixTime, data.CmdSig)
-	w.WriteHeader(http.StatusOK)
+	device := getDeviceOrError(w, user, data.Device)
+	if device == nil {
+		return
+	}
+
+	// Older apps POST an empty command to clear the pending command after fetching it.
+	// Fetching already removes the command from the queue, so there is nothing to do.
+	if data.Data == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	cmd := uio.AddCommandToUser(user, device, data.Data, data.UnixTime, data.CmdSig)
+
+	// Reply with the command ID, so that the sender can follow the command status.
+	result, _ := json.Marshal(toCommandStatusData(data.IDT, cmd))
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Write(result)
 }
 
-/*
-func getCommandLog(w http.ResponseWriter, r *http.Request) {
+// Get the status of a single command (if Data is a command ID), or of all recent commands (if Data is empty).
+func getCommandStatus(w http.ResponseWriter, r *http.Request) {
 	var data DataPackage
 	err := json.NewDecoder(r.Body).Decode(&data)
 	if err != nil {
 		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
 		return
 	}
-	user, err := uio.CheckAccessTokenAndGetUser(data.IDT)
+	u, err := uio.CheckAccessTokenAndGetUser(data.IDT, user.ScopeCommandsSend)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	var result []byte
+	if data.Data == "" {
+		cmds := uio.GetRecentCommands(u)
+		reply := make([]commandStatusData, len(cmds))
+		for i := range cmds {
+			reply[i] = toCommandStatusData(data.IDT, &cmds[i])
+		}
+		result, _ = json.Marshal(reply)
+	} else {
+		id, err := strconv.ParseUint(data.Data, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid command ID", http.StatusBadRequest)
+			return
+		}
+		cmd, err := uio.GetCommandStatus(u, id)
+		if err != nil {
+			http.Error(w, "Command not found", http.StatusNotFound)
+			return
+		}
+		result, _ = json.Marshal(toCommandStatusData(data.IDT, cmd))
+	}
+
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Write(result)
+}
+
+// The device reports the status (and optionally a result message) of a delivered command.
+func postCommandStatus(w http.ResponseWriter, r *http.Request) {
+	var data commandStatusData
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	u, err := uio.CheckAccessTokenAndGetUser(data.IDT, user.ScopeDeviceUpload)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+	device := getDeviceOrError(w, u, data.Device)
+	if device == nil {
+		return
+	}
+
+	cmd, err := uio.SetCommandStatus(u, device, data.CmdId, data.Status, data.Result)
+	if err == user.ErrCommandNotFound {
+		http.Error(w, "Command not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid command status", http.StatusConflict)
+		return
+	}
+
+	result, _ := json.Marshal(toCommandStatusData(data.IDT, cmd))
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Write(result)
+}
+
+type commandLogRequest struct {
+	IDT    string // access token
+	Cursor uint64 // ID of the last entry of the previous page, 0 to start with the newest entry
+	Limit  int    // page size, 0 for the default
+	Since  int64  // unix time in seconds, 0 for no lower bound
+	Until  int64  // unix time in seconds, 0 for no upper bound
+}
+
+type commandLogEntryData struct {
+	Id        uint64
+	Timestamp int64
+	Content   string // encrypted
+}
+
+type commandLogReply struct {
+	IDT        string
+	Data       string // newline-separated encrypted entries, for older clients
+	Entries    []commandLogEntryData
+	NextCursor uint64 // pass as Cursor to get the next (older) page, 0 if this is the last page
+}
+
+func getCommandLog(w http.ResponseWriter, r *http.Request) {
+	var data commandLogRequest
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	user, err := uio.CheckAccessTokenAndGetUser(data.IDT, user.ScopeCommandsSend)
 	if err != nil {
-		http.Error(w, ERR_ACCESS_TOKEN_INVALID, http.StatusUnauthorized)
+		writeAccessTokenError(w, err)
 		return
 	}
 
-	commandLog := uio.GetCommandLog(user)
+	logEntries, hasMore := uio.GetCommandLog(user, data.Cursor, data.Limit, data.Since, data.Until)
 
 	// commandLogs may be empty, that's fine
-	reply := DataPackage{IDT: data.IDT, Data: commandLog}
+	reply := commandLogReply{IDT: data.IDT, Entries: make([]commandLogEntryData, len(logEntries))}
+	contents := make([]string, len(logEntries))
+	for i, entry := range logEntries {
+		reply.Entries[i] = commandLogEntryData{Id: entry.Id, Timestamp: entry.Timestamp, Content: entry.Content}
+		contents[i] = entry.Content
+	}
+	reply.Data = strings.Join(contents, "\n")
+	if hasMore {
+		reply.NextCursor = logEntries[len(logEntries)-1].Id
+	}
+
 	result, _ := json.Marshal(reply)
 	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
 	w.Write([]byte(result))
 }
-*/
 
 // ------- Push -------
 
@@ -351,20 +699,29 @@ func getPushUrl(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
 		return
 	}
-	user, err := uio.CheckAccessTokenAndGetUser(data.IDT)
+	// Reading the endpoint is allowed for senders of commands, setting it only for the device (like postPushUrl)
+	endpoint := strings.TrimSpace(data.Data)
+	scope := user.ScopeCommandsSend
+	if endpoint != "" {
+		scope = user.ScopeDeviceUpload
+	}
+	user, err := uio.CheckAccessTokenAndGetUser(data.IDT, scope)
 	if err != nil {
-		http.Error(w, ERR_ACCESS_TOKEN_INVALID, http.StatusUnauthorized)
+		writeAccessTokenError(w, err)
+		return
+	}
+	device := getDeviceOrError(w, user, data.Device)
+	if device == nil {
 		return
 	}
 
-	endpoint := strings.TrimSpace(data.Data)
 	if endpoint != "" {
-		uio.SetPushUrl(user, endpoint)
+		uio.SetPushUrl(device, endpoint)
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	url := uio.GetPushUrl(user)
+	url := uio.GetPushUrl(device)
 	w.Write([]byte(fmt.Sprint(url)))
 }
 
@@ -375,13 +732,17 @@ func postPushUrl(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
 		return
 	}
-	user, err := uio.CheckAccessTokenAndGetUser(data.IDT)
+	user, err := uio.CheckAccessTokenAndGetUser(data.IDT, user.ScopeDeviceUpload)
 	if err != nil {
-		http.Error(w, ERR_ACCESS_TOKEN_INVALID, http.StatusUnauthorized)
+		writeAccessTokenError(w, err)
+		return
+	}
+	device := getDeviceOrError(w, user, data.Device)
+	if device == nil {
 		return
 	}
 
-	uio.SetPushUrl(user, strings.TrimSpace(data.Data))
+	uio.SetPushUrl(device, strings.TrimSpace(data.Data))
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -434,19 +795,67 @@ func requestAccess(w http.ResponseWriter, r *http.Request) {
 		pwHash = innerHash
 	}
 
-	accessToken, err := uio.RequestAccess(data.IDT, pwHash, data.SessionDurationSeconds, getRemoteIp(r))
+	scopes, err := user.EncodeScopes(data.Scopes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	accessToken, challenge, err := uio.RequestAccess(data.IDT, pwHash, data.DeviceCredential, user.SessionRequest{
+		DurationSeconds:  data.SessionDurationSeconds,
+		WithRefreshToken: data.RequestRefreshToken,
+		Scopes:           scopes,
+		RemoteIp:         getRemoteIp(r),
+		UserAgent:        r.UserAgent(),
+	})
 
 	if err == user.ErrAccountLocked {
 		http.Error(w, "Account is locked", http.StatusLocked)
 		return
 	}
+	if errors.Is(err, user.ErrScopeInvalid) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Access denied", http.StatusForbidden)
 		return
 	}
+	if challenge != nil {
+		writeTotpChallengeReply(w, challenge)
+		return
+	}
+
+	writeAccessTokenReply(w, accessToken)
+}
+
+func refreshAccess(w http.ResponseWriter, r *http.Request) {
+	var data refreshAccessData
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+
+	accessToken, err := uio.RefreshAccess(data.RefreshToken, data.SessionDurationSeconds, getRemoteIp(r))
+	if err != nil {
+		http.Error(w, "Refresh token not valid", http.StatusUnauthorized)
+		return
+	}
 
-	accessTokenReply := DataPackage{IDT: data.IDT, Data: accessToken.Token}
-	result, _ := json.Marshal(accessTokenReply)
+	writeAccessTokenReply(w, accessToken)
+}
+
+func writeAccessTokenReply(w http.ResponseWriter, accessToken *user.AccessToken) {
+	reply := accessTokenReply{
+		IDT:                   accessToken.DeviceId,
+		Data:                  accessToken.Token,
+		ExpirationTime:        accessToken.ExpirationTime,
+		RefreshToken:          accessToken.RefreshToken,
+		RefreshExpirationTime: accessToken.RefreshExpirationTime,
+		Scopes:                accessToken.Scopes,
+	}
+	result, _ := json.Marshal(reply)
 	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
 	w.Write(result)
 }
@@ -458,9 +867,9 @@ func postPassword(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
 		return
 	}
-	user, err := uio.CheckAccessTokenAndGetUser(data.IDT)
+	user, err := uio.CheckAccessTokenAndGetUser(data.IDT, user.ScopeAccountAdmin)
 	if err != nil {
-		http.Error(w, ERR_ACCESS_TOKEN_INVALID, http.StatusUnauthorized)
+		writeAccessTokenError(w, err)
 		return
 	}
 
@@ -488,6 +897,9 @@ func postPassword(w http.ResponseWriter, r *http.Request) {
 
 	uio.UpdateUserPassword(user, data.PrivKey, data.Salt, data.HashedPassword)
 
+	// Other sessions might belong to whoever knew the old password
+	uio.RevokeOtherSessions(user, data.IDT)
+
 	dataReply := DataPackage{IDT: data.IDT, Data: "true"}
 	result, _ := json.Marshal(dataReply)
 	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
@@ -503,9 +915,9 @@ func deleteDevice(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
 		return
 	}
-	user, err := uio.CheckAccessTokenAndGetUser(data.IDT)
+	user, err := uio.CheckAccessTokenAndGetUser(data.IDT, user.ScopeAccountAdmin)
 	if err != nil {
-		http.Error(w, ERR_ACCESS_TOKEN_INVALID, http.StatusUnauthorized)
+		writeAccessTokenError(w, err)
 		return
 	}
 	uio.DeleteUser(user)
@@ -513,7 +925,7 @@ func deleteDevice(w http.ResponseWriter, r *http.Request) {
 }
 
 type createDeviceHandler struct {
-	RegistrationToken string
+	InviteOnly bool // registering requires an invite code
 }
 
 func (h createDeviceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -533,14 +945,32 @@ func (h createDeviceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if h.RegistrationToken != "" && h.RegistrationToken != reg.RegistrationToken {
-		log.Error().Msg("invalid RegistrationToken")
-		http.Error(w, "Registration Token not valid", http.StatusUnauthorized)
-		return
+	var invite *user.Invite
+	if h.InviteOnly || reg.RegistrationToken != "" {
+		redeemed, username, err := uio.RedeemInvite(reg.RegistrationToken, reg.RequestedUsername)
+		if errors.Is(err, user.ErrInviteUsernameMismatch) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err == nil {
+			invite = redeemed
+			reg.RequestedUsername = username
+		} else if h.InviteOnly {
+			log.Warn().Str("remoteIp", getRemoteIp(r)).Msg("invalid invite code")
+			http.Error(w, "Invite code not valid", http.StatusUnauthorized)
+			return
+		}
+		// Registration is open, thus an invalid code is ignored (e.g., a stale token that the client still sends)
 	}
 
-	id, err := uio.CreateNewUser(reg.PrivKey, reg.PubKey, reg.Salt, reg.HashedPassword, reg.RequestedUsername)
+	inviteId := uint64(0)
+	if invite != nil {
+		inviteId = invite.Id
+	}
+	id, err := uio.CreateNewUser(reg.PrivKey, reg.PubKey, reg.Salt, reg.HashedPassword, reg.RequestedUsername, inviteId)
 	if err != nil {
+		if invite != nil {
+			uio.ReleaseInvite(invite)
+		}
 		http.Error(w, fmt.Sprintf("Failed to create username: %s", err.Error()), http.StatusBadRequest)
 		return
 	}
@@ -673,15 +1103,29 @@ func mainPicture(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func mainCommand(w http.ResponseWriter, r *http.Request) {
+type mainCommandHandler struct {
+	getCommandHandler getCommandHandler
+}
+
+func (h mainCommandHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// PUT delivers the oldest queued command, POST queues a new command.
 	switch r.Method {
 	case http.MethodPut:
-		getCommand(w, r)
+		h.getCommandHandler.ServeHTTP(w, r)
 	case http.MethodPost:
 		postCommand(w, r)
 	}
 }
 
+func mainCommandStatus(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPut:
+		getCommandStatus(w, r)
+	case http.MethodPost:
+		postCommandStatus(w, r)
+	}
+}
+
 func mainPushUrl(w http.ResponseWriter, r *http.Request) {
 	// Historically, POST is used to fetch the push URL (with an empty body)
 	// and PUT was used to set it. We now also accept POST with Data=<endpoint>
@@ -695,7 +1139,7 @@ func mainPushUrl(w http.ResponseWriter, r *http.Request) {
 }
 
 type mainDeviceHandler struct {
-	createDeviceHandler createDeviceHandler
+	createDeviceHandler http.Handler
 }
 
 func (h mainDeviceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
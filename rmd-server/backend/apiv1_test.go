@@ -0,0 +1,242 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"rmd-server/blobstore"
+	"rmd-server/user"
+
+	"github.com/rs/zerolog"
+)
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	os.Exit(m.Run())
+}
+
+// Base64-encoded PKIX public key, as the clients send it
+func testPublicKey(t *testing.T) string {
+	t.Helper()
+	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+// Point uio to a repository with an empty database, and return an access token of a new account
+func setupTestRepository(t *testing.T, maxCommandWaiters int) string {
+	t.Helper()
+	dir := t.TempDir()
+	blobs, err := blobstore.NewLocalBlobStore(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uio = user.NewUserRepository(dir, blobs, 8, 100, 100, 100, maxCommandWaiters, 0)
+	t.Cleanup(uio.Shutdown)
+
+	id, err := uio.CreateNewUser("privKey", testPublicKey(t), "salt", "pwHash", "alice", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uio.ACC.CreateNewAccessToken(id, user.SessionRequest{}).Token
+}
+
+func fetchCommand(h getCommandHandler, token string, waitSeconds uint64) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(commandFetchRequest{IDT: token, WaitSeconds: waitSeconds})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/command", bytes.NewReader(body)))
+	return w
+}
+
+func TestGetCommandTooManyWaiters(t *testing.T) {
+	token := setupTestRepository(t, 1)
+	h := getCommandHandler{MaxWait: 30 * time.Second}
+
+	waiting := make(chan *httptest.ResponseRecorder, 1)
+	go func() { waiting <- fetchCommand(h, token, 30) }()
+
+	// Notify only succeeds once the request waits
+	u, _ := uio.UB.GetByID("alice")
+	device, _ := uio.GetDevice(u, "")
+	key := device.Key()
+	deadline := time.Now().Add(5 * time.Second)
+	for !uio.Waiters.Notify(key) {
+		if time.Now().After(deadline) {
+			t.Fatal("request did not wait")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	w := fetchCommand(h, token, 30)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "30" {
+		t.Errorf("unexpected Retry-After: %q", w.Header().Get("Retry-After"))
+	}
+
+	uio.Shutdown()
+	select {
+	case w := <-waiting:
+		if w.Code != http.StatusOK {
+			t.Errorf("released request failed with %d", w.Code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting request was not released by the shutdown")
+	}
+}
+
+func register(t *testing.T, h createDeviceHandler, username string, code string) *httptest.ResponseRecorder {
+	t.Helper()
+	body, _ := json.Marshal(registrationData{
+		Salt:              "salt",
+		HashedPassword:    "pwHash",
+		PubKey:            testPublicKey(t),
+		PrivKey:           "privKey",
+		RequestedUsername: username,
+		RegistrationToken: code,
+	})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/device", bytes.NewReader(body)))
+	return w
+}
+
+func TestRegisterWithInvite(t *testing.T) {
+	setupTestRepository(t, 0)
+	code, _, err := uio.CreateInvite(1, 0, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, h := range []createDeviceHandler{{InviteOnly: false}, {InviteOnly: true}} {
+		if w := register(t, h, "", "stale"); h.InviteOnly && w.Code != http.StatusUnauthorized {
+			t.Errorf("invite-only: unknown code was accepted: %d", w.Code)
+		} else if !h.InviteOnly && w.Code != http.StatusOK {
+			t.Errorf("open registration: unknown code was rejected: %d %s", w.Code, w.Body)
+		}
+	}
+
+	h := createDeviceHandler{InviteOnly: true}
+	if w := register(t, h, "bob", code); w.Code != http.StatusOK {
+		t.Fatalf("registering with the invite failed: %d %s", w.Code, w.Body)
+	}
+	bob, _ := uio.UB.GetByID("bob")
+	invite := uio.GetInvites()[0]
+	if bob == nil || bob.InviteID != invite.Id || invite.Uses != 1 {
+		t.Error("the account was not registered with the invite")
+	}
+	if w := register(t, h, "carol", code); w.Code != http.StatusUnauthorized {
+		t.Errorf("used up invite was accepted: %d", w.Code)
+	}
+}
+
+func TestRegisterReleasesInvite(t *testing.T) {
+	setupTestRepository(t, 0)
+	code, invite, err := uio.CreateInvite(1, 0, "alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// alice exists already
+	if w := register(t, createDeviceHandler{InviteOnly: true}, "", code); w.Code != http.StatusBadRequest {
+		t.Errorf("registering an existing username: expected 400, got %d", w.Code)
+	}
+	if stored := uio.UB.GetInviteByHash(invite.CodeHash); stored.Uses != 0 {
+		t.Error("failed registration used up the invite")
+	}
+}
+
+func postStatus(token string, cmdId uint64, status string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(commandStatusData{IDT: token, CmdId: cmdId, Status: status, Result: "done"})
+	w := httptest.NewRecorder()
+	postCommandStatus(w, httptest.NewRequest(http.MethodPost, "/commandStatus", bytes.NewReader(body)))
+	return w
+}
+
+func TestPostCommandStatus(t *testing.T) {
+	token := setupTestRepository(t, 0)
+	u, _ := uio.UB.GetByID("alice")
+	device, _ := uio.GetDevice(u, "")
+	uio.AddCommandToUser(u, device, "locate", 1, "sig")
+	cmd := uio.GetCommandToUser(u, device)
+
+	tests := []struct {
+		cmdId  uint64
+		status string
+		code   int
+	}{
+		{cmd.Id, user.CommandStatusAcknowledged, http.StatusOK},
+		{cmd.Id, user.CommandStatusDelivered, http.StatusConflict},
+		{cmd.Id, user.CommandStatusExecuted, http.StatusOK},
+		{cmd.Id, user.CommandStatusFailed, http.StatusConflict},
+		{cmd.Id + 1, user.CommandStatusExecuted, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := postStatus(token, tt.cmdId, tt.status)
+		if w.Code != tt.code {
+			t.Fatalf("%s: expected %d, got %d %s", tt.status, tt.code, w.Code, w.Body)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var reply commandStatusData
+		if err := json.NewDecoder(w.Body).Decode(&reply); err != nil || reply.Status != tt.status || reply.Result != "done" {
+			t.Errorf("%s: unexpected reply %+v %v", tt.status, reply, err)
+		}
+	}
+
+	if w := postStatus("invalid", cmd.Id, user.CommandStatusExecuted); w.Code != http.StatusUnauthorized {
+		t.Errorf("invalid token: expected 401, got %d", w.Code)
+	}
+}
+
+func TestPictureQuota(t *testing.T) {
+	token := setupTestRepository(t, 0)
+	uio.Limits = user.StorageLimits{PictureQuota: 100, MaxUploadSize: 80}
+
+	post := func(handler http.HandlerFunc, body any) *httptest.ResponseRecorder {
+		encoded, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(encoded)))
+		return w
+	}
+	picture := func(size int) DataPackage {
+		return DataPackage{IDT: token, Data: string(bytes.Repeat([]byte("a"), size))}
+	}
+
+	if w := post(postPicture, picture(60)); w.Code != http.StatusOK {
+		t.Fatalf("picture within the quota: %d %s", w.Code, w.Body)
+	}
+	if w := post(postPicture, picture(41)); w.Code != http.StatusInsufficientStorage {
+		t.Errorf("picture over the quota: expected 507, got %d", w.Code)
+	}
+	if w := post(postPicture, picture(81)); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("picture over the upload size: expected 413, got %d", w.Code)
+	}
+	if w := post(postPictureUpload, pictureUploadRequest{IDT: token, Size: 41}); w.Code != http.StatusInsufficientStorage {
+		t.Errorf("upload over the quota: expected 507, got %d", w.Code)
+	}
+
+	w := post(getStorageUsage, DataPackage{IDT: token})
+	var usage storageUsageData
+	if err := json.NewDecoder(w.Body).Decode(&usage); err != nil {
+		t.Fatal(err)
+	}
+	expected := storageUsageData{Pictures: 1, PictureBytes: 60, PictureQuota: 100, MaxUploadSize: 80}
+	if usage != expected {
+		t.Errorf("unexpected usage: %+v, expected %+v", usage, expected)
+	}
+}
@@ -1,15 +1,23 @@
 package backend
 
 import (
+	"context"
+	"errors"
 	"io/fs"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"rmd-server/blobstore"
 	conf "rmd-server/config"
 	"rmd-server/metrics"
 	"rmd-server/user"
 	"rmd-server/version"
+	"rmd-server/webauthn"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
@@ -17,6 +25,9 @@ import (
 
 var uio user.UserRepository
 
+// How long to wait for running requests when shutting down
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
 func handleRequests(config *viper.Viper) {
 	mux := buildServeMux(config)
 
@@ -42,8 +53,10 @@ func handleRequests(config *viper.Viper) {
 			Str(conf.CONF_SERVER_CERT, serverCrt).
 			Int(conf.CONF_PORT_SECURE, portSecure).
 			Msg("listening on secure port")
-		securePort := ":" + strconv.Itoa(portSecure)
-		err := http.ListenAndServeTLS(securePort, serverCrt, serverKey, mux)
+		server := &http.Server{Addr: ":" + strconv.Itoa(portSecure), Handler: mux}
+		err := serveUntilSignal(server, func() error {
+			return server.ListenAndServeTLS(serverCrt, serverKey)
+		})
 		if err != nil {
 			log.Fatal().Err(err).Msg("failed to serve with TLS")
 		}
@@ -51,8 +64,8 @@ func handleRequests(config *viper.Viper) {
 		log.Info().
 			Int(conf.CONF_PORT_INSECURE, portInsecure).
 			Msg("listening on insecure port")
-		insecureAddr := ":" + strconv.Itoa(portInsecure)
-		err := http.ListenAndServe(insecureAddr, mux)
+		server := &http.Server{Addr: ":" + strconv.Itoa(portInsecure), Handler: mux}
+		err := serveUntilSignal(server, server.ListenAndServe)
 		if err != nil {
 			log.Fatal().Err(err).Msg("failed to serve with HTTP")
 		}
@@ -92,8 +105,10 @@ func handleRequestsSocket(mux *http.ServeMux, socketPath string, socketChmod int
 			Msg("error modifying unix socket permissions")
 	}
 
-	server := http.Server{Handler: mux}
-	err = server.Serve(unixListener)
+	server := &http.Server{Handler: mux}
+	err = serveUntilSignal(server, func() error {
+		return server.Serve(unixListener)
+	})
 	if err != nil {
 		log.Error().Err(err).Msg("error serving unix server")
 	}
@@ -104,20 +119,132 @@ func handleRequestsSocket(mux *http.ServeMux, socketPath string, socketChmod int
 	}
 
 	err = unixListener.Close()
-	if err != nil {
+	if err != nil && !errors.Is(err, net.ErrClosed) {
 		log.Error().Err(err).Msg("error closing unix listener")
 	}
 	// ignore error for now
 	os.Remove(socketPath)
 }
 
-func initDb(config *viper.Viper) {
+// Run serve() until SIGINT or SIGTERM is received, then shut down gracefully:
+// stop waiting requests (e.g., long-polling) and let running requests finish.
+func serveUntilSignal(server *http.Server, serve func() error) error {
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		log.Info().Msg("shutting down")
+
+		uio.Shutdown()
+
+		ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+		err := server.Shutdown(ctx)
+		if err != nil {
+			log.Error().Err(err).Msg("error shutting down server")
+		}
+		close(done)
+	}()
+
+	err := serve()
+	if errors.Is(err, http.ErrServerClosed) {
+		<-done
+		return nil
+	}
+	return err
+}
+
+func initBlobStore(config *viper.Viper) blobstore.BlobStore {
+	driver := config.GetString(conf.CONF_BLOB_STORAGE)
+	log.Info().Str(conf.CONF_BLOB_STORAGE, driver).Msg("loading blob storage")
+
+	switch driver {
+	case blobstore.DRIVER_LOCAL:
+		store, err := blobstore.NewLocalBlobStore(config.GetString(conf.CONF_DATABASE_DIR))
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to initialise local blob storage")
+		}
+		return store
+	case blobstore.DRIVER_S3:
+		store, err := blobstore.NewS3BlobStore(blobstore.S3Config{
+			Endpoint:  config.GetString(conf.CONF_S3_ENDPOINT),
+			Bucket:    config.GetString(conf.CONF_S3_BUCKET),
+			Region:    config.GetString(conf.CONF_S3_REGION),
+			AccessKey: config.GetString(conf.CONF_S3_ACCESS_KEY),
+			SecretKey: config.GetString(conf.CONF_S3_SECRET_KEY),
+			UseSSL:    config.GetBool(conf.CONF_S3_USE_SSL),
+			Prefix:    config.GetString(conf.CONF_S3_PREFIX),
+		})
+		if err != nil {
+			log.Fatal().Err(err).Str(conf.CONF_S3_ENDPOINT, config.GetString(conf.CONF_S3_ENDPOINT)).Msg("failed to initialise S3 blob storage")
+		}
+		return store
+	default:
+		log.Fatal().Str(conf.CONF_BLOB_STORAGE, driver).Msg("unknown blob storage")
+		os.Exit(1) // make nilaway happy
+		return nil
+	}
+}
+
+// Open the database and the blob storage.
+// This is also used by CLI commands that work on the database of a (possibly running) server.
+func OpenUserRepository(config *viper.Viper) user.UserRepository {
+	blobs := initBlobStore(config)
+
 	log.Info().Msg("loading database")
-	uio = user.NewUserRepository(
+	repo := user.NewUserRepository(
 		config.GetString(conf.CONF_DATABASE_DIR),
+		blobs,
 		config.GetInt(conf.CONF_USER_ID_LENGTH),
 		config.GetInt(conf.CONF_MAX_SAVED_LOC),
 		config.GetInt(conf.CONF_MAX_SAVED_PIC),
+		config.GetInt(conf.CONF_MAX_SAVED_COMMAND_LOGS),
+		config.GetInt(conf.CONF_MAX_COMMAND_WAITERS),
+		config.GetInt(conf.CONF_MAX_COMMAND_WAITERS_PER_ACCOUNT),
+	)
+
+	const mb = 1024 * 1024
+	repo.Limits = user.StorageLimits{
+		MaxUploadSize: config.GetInt64(conf.CONF_MAX_UPLOAD_SIZE_MB) * mb,
+		LocationQuota: config.GetInt64(conf.CONF_LOCATION_QUOTA_MB) * mb,
+		PictureQuota:  config.GetInt64(conf.CONF_PICTURE_QUOTA_MB) * mb,
+	}
+
+	totpKeyFile := config.GetString(conf.CONF_TOTP_KEY_FILE)
+	if totpKeyFile == "" {
+		totpKeyFile = filepath.Join(config.GetString(conf.CONF_DATABASE_DIR), "totp.key")
+	}
+	totp, err := user.LoadTotpCipher(totpKeyFile)
+	if err != nil {
+		log.Fatal().Err(err).Str("keyFile", totpKeyFile).Msg("failed to load the TOTP key")
+	}
+	repo.Totp = totp
+	repo.Admins = config.GetStringSlice(conf.CONF_ADMIN_USERS)
+
+	webAuthnOrigin := config.GetString(conf.CONF_WEBAUTHN_ORIGIN)
+	if webAuthnOrigin != "" {
+		rp, err := webauthn.NewRelyingParty(webAuthnOrigin)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid WebAuthnOrigin")
+		}
+		repo.WebAuthn = rp
+	}
+	return repo
+}
+
+func initDb(config *viper.Viper) {
+	uio = OpenUserRepository(config)
+
+	registrationToken := config.GetString(conf.CONF_REGISTRATION_TOKEN)
+	if registrationToken != "" {
+		uio.MigrateRegistrationToken(registrationToken)
+	}
+
+	day := 24 * time.Hour
+	uio.StartRetention(
+		time.Duration(config.GetInt(conf.CONF_MAX_LOCATION_AGE_DAYS))*day,
+		time.Duration(config.GetInt(conf.CONF_MAX_PICTURE_AGE_DAYS))*day,
 	)
 }
 
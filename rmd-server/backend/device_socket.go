@@ -0,0 +1,207 @@
+package backend
+
+import (
+	"net/http"
+	"time"
+
+	"rmd-server/user"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+// WebSocket channel for devices, as an alternative to UnifiedPush.
+//
+// The device authenticates with its access token in the "Authorization: Bearer <token>" header and keeps the socket open.
+// Devices other than the account's default device add their id as query parameter "Device".
+// The server sends every queued command immediately, and the device can report the command status back.
+// All messages are JSON-encoded deviceSocketMessages in text frames.
+//
+// Reconnecting: a device should reconnect whenever the socket is closed.
+// Commands that were queued while the device was offline are sent right after connecting.
+// If the device opens a new socket, the old one is closed.
+// When the access token expires, the server sends an "expired" message and closes the socket;
+// the device should log in again before reconnecting.
+
+const (
+	DEVICE_SOCKET_MSG_COMMAND        = "command"       // server -> device
+	DEVICE_SOCKET_MSG_COMMAND_STATUS = "commandStatus" // device -> server, and the server's reply
+	DEVICE_SOCKET_MSG_ERROR          = "error"         // server -> device
+	DEVICE_SOCKET_MSG_EXPIRED        = "expired"       // server -> device
+)
+
+const (
+	// Interval of WebSocket pings. Also used to check whether the access token is still valid.
+	DEVICE_SOCKET_PING_INTERVAL = 30 * time.Second
+	// The connection is considered dead if the device did not answer a ping within this time.
+	DEVICE_SOCKET_PONG_WAIT     = 2*DEVICE_SOCKET_PING_INTERVAL + 10*time.Second
+	DEVICE_SOCKET_WRITE_WAIT    = 10 * time.Second
+	DEVICE_SOCKET_MAX_MSG_BYTES = 64 * 1024
+)
+
+type deviceSocketMessage struct {
+	Type     string
+	CmdId    uint64 `json:",omitempty"`
+	Data     string `json:",omitempty"` // plaintext command, or the error message
+	UnixTime uint64 `json:",omitempty"` // unix time in milliseconds
+	CmdSig   string `json:",omitempty"` // base64-encoded signature over "UnixTime:Data"
+	Status   string `json:",omitempty"`
+	Result   string `json:",omitempty"`
+}
+
+// Devices are not browsers, so the default origin check (same origin if the header is present) is sufficient.
+var deviceSocketUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+func getDeviceSocket(w http.ResponseWriter, r *http.Request) {
+	accessToken := getAccessTokenFromRequest(r)
+	u, err := uio.CheckAccessTokenAndGetUser(accessToken, user.ScopeDeviceUpload)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+	device := getDeviceOrError(w, u, r.URL.Query().Get("Device"))
+	if device == nil {
+		return
+	}
+
+	ws, err := deviceSocketUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already replied with an error
+		log.Debug().Err(err).Msg("failed to upgrade device socket")
+		return
+	}
+	defer ws.Close()
+
+	conn := uio.Devices.Connect(device.Key())
+	defer uio.Devices.Disconnect(conn)
+	log.Info().Str("userId", u.UID).Str("deviceId", device.DeviceId).Msg("device connected via WebSocket")
+	defer log.Info().Str("userId", u.UID).Str("deviceId", device.DeviceId).Msg("device disconnected from WebSocket")
+
+	// Only this goroutine writes to the socket. The reader forwards its replies.
+	replies := make(chan deviceSocketMessage, 8)
+	readerDone := make(chan struct{})
+	writerDone := make(chan struct{})
+	defer close(writerDone)
+	go readDeviceSocket(ws, u, device, replies, readerDone, writerDone)
+
+	ping := time.NewTicker(DEVICE_SOCKET_PING_INTERVAL)
+	defer ping.Stop()
+
+	if !sendQueuedCommands(ws, u, device) {
+		return
+	}
+
+	for {
+		select {
+		case <-readerDone:
+			return
+		case <-conn.Closed:
+			if uio.Devices.IsShutdown() {
+				writeDeviceSocketClose(ws, websocket.CloseGoingAway, "server shutting down")
+			} else {
+				writeDeviceSocketClose(ws, websocket.ClosePolicyViolation, "connection superseded")
+			}
+			return
+		case <-conn.Wake:
+			if !sendQueuedCommands(ws, u, device) {
+				return
+			}
+		case msg := <-replies:
+			if !writeDeviceSocketMessage(ws, msg) {
+				return
+			}
+		case <-ping.C:
+			_, err := uio.ACC.CheckAccessToken(accessToken)
+			if err != nil {
+				writeDeviceSocketMessage(ws, deviceSocketMessage{Type: DEVICE_SOCKET_MSG_EXPIRED})
+				writeDeviceSocketClose(ws, websocket.ClosePolicyViolation, ERR_ACCESS_TOKEN_INVALID)
+				return
+			}
+			ws.SetWriteDeadline(time.Now().Add(DEVICE_SOCKET_WRITE_WAIT))
+			if err := ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func readDeviceSocket(ws *websocket.Conn, u *user.RMDUser, device *user.Device, replies chan<- deviceSocketMessage, done chan<- struct{}, writerDone <-chan struct{}) {
+	defer close(done)
+
+	ws.SetReadLimit(DEVICE_SOCKET_MAX_MSG_BYTES)
+	ws.SetReadDeadline(time.Now().Add(DEVICE_SOCKET_PONG_WAIT))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(DEVICE_SOCKET_PONG_WAIT))
+	})
+
+	for {
+		var msg deviceSocketMessage
+		err := ws.ReadJSON(&msg)
+		if err != nil {
+			if _, ok := err.(*websocket.CloseError); !ok {
+				log.Debug().Err(err).Msg("failed to read from device socket")
+			}
+			return
+		}
+		ws.SetReadDeadline(time.Now().Add(DEVICE_SOCKET_PONG_WAIT))
+
+		var reply deviceSocketMessage
+		switch msg.Type {
+		case DEVICE_SOCKET_MSG_COMMAND_STATUS:
+			cmd, err := uio.SetCommandStatus(u, device, msg.CmdId, msg.Status, msg.Result)
+			if err == user.ErrCommandNotFound {
+				reply = deviceSocketMessage{Type: DEVICE_SOCKET_MSG_ERROR, CmdId: msg.CmdId, Data: "Command not found"}
+			} else if err != nil {
+				reply = deviceSocketMessage{Type: DEVICE_SOCKET_MSG_ERROR, CmdId: msg.CmdId, Data: "Invalid command status"}
+			} else {
+				reply = deviceSocketMessage{Type: DEVICE_SOCKET_MSG_COMMAND_STATUS, CmdId: cmd.Id, Status: cmd.Status, Result: cmd.Result}
+			}
+		default:
+			reply = deviceSocketMessage{Type: DEVICE_SOCKET_MSG_ERROR, Data: "Unknown message type"}
+		}
+		select {
+		case replies <- reply:
+		case <-writerDone:
+			return
+		}
+	}
+}
+
+// Send all queued commands to the device.
+// Commands that could not be sent are put back into the queue.
+// Returns false if the socket is broken.
+func sendQueuedCommands(ws *websocket.Conn, u *user.RMDUser, device *user.Device) bool {
+	cmds := uio.GetAllCommandsToUser(u, device)
+	for i := range cmds {
+		msg := deviceSocketMessage{
+			Type:     DEVICE_SOCKET_MSG_COMMAND,
+			CmdId:    cmds[i].Id,
+			Data:     cmds[i].Command,
+			UnixTime: cmds[i].CommandTime,
+			CmdSig:   cmds[i].CommandSig,
+		}
+		if !writeDeviceSocketMessage(ws, msg) {
+			uio.RequeueCommands(device, cmds[i:])
+			return false
+		}
+	}
+	return true
+}
+
+func writeDeviceSocketMessage(ws *websocket.Conn, msg deviceSocketMessage) bool {
+	ws.SetWriteDeadline(time.Now().Add(DEVICE_SOCKET_WRITE_WAIT))
+	err := ws.WriteJSON(msg)
+	if err != nil {
+		log.Debug().Err(err).Msg("failed to write to device socket")
+		return false
+	}
+	return true
+}
+
+func writeDeviceSocketClose(ws *websocket.Conn, code int, text string) {
+	msg := websocket.FormatCloseMessage(code, text)
+	ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(DEVICE_SOCKET_WRITE_WAIT))
+}
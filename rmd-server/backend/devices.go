@@ -0,0 +1,210 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"rmd-server/user"
+)
+
+// The devices of the caller's account.
+// Every account has the default device (user.DEFAULT_DEVICE_ID). Further devices share the account's key pair,
+// but have their own push URL, commands, locations and pictures.
+// Requests to /location, /picture, /command, /push etc. select the device with the optional "Device" field.
+//
+//	PUT  /devices         body: {"IDT": <token>}                       -> list the devices
+//	POST /devices         body: {"IDT": <token>, "Data": <name>}       -> add a device, returns its deviceData
+//	POST /devices/delete  body: {"IDT": <token>, "Device": <device id>} -> delete a device and all its data
+//
+// Device credentials let a device log in with the password but without TOTP (see /totp).
+// The device passes the credential as "DeviceCredential" to /requestAccess, and gets a session with limited scopes
+// (user.DeviceCredentialScopes). A new credential replaces the device's previous one.
+//
+//	POST /devices/credential         body: {"IDT": <token>, "Device": <device id>} -> deviceCredentialReply
+//	POST /devices/credential/delete  body: {"IDT": <token>, "Device": <device id>} -> revoke the credential
+
+type deviceCredentialReply struct {
+	Device     string
+	Credential string // only returned once, the server only stores its hash
+	Scopes     []user.Scope
+}
+
+type deviceData struct {
+	DeviceId      string
+	Name          string
+	HasPushUrl    bool
+	HasCredential bool
+	LastSeenTime  int64 // unix time in seconds, 0 if the device never contacted the server
+	CreatedTime   int64 // unix time in seconds
+}
+
+func toDeviceData(device *user.Device) deviceData {
+	return deviceData{
+		DeviceId:      device.DeviceId,
+		Name:          device.Name,
+		HasPushUrl:    device.PushUrl != "",
+		HasCredential: uio.HasDeviceCredential(device),
+		LastSeenTime:  device.LastSeenTime,
+		CreatedTime:   device.CreatedTime,
+	}
+}
+
+// Returns the device with the given id (empty for the default device).
+// If the device does not exist, replies with 404 and returns nil.
+func getDeviceOrError(w http.ResponseWriter, u *user.RMDUser, deviceId string) *user.Device {
+	device, err := uio.GetDevice(u, deviceId)
+	if err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return nil
+	}
+	return device
+}
+
+func mainDevices(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/devices"), "/")
+
+	switch {
+	case action == "" && r.Method == http.MethodPut:
+		getDevices(w, r)
+	case action == "" && r.Method == http.MethodPost:
+		postDevice(w, r)
+	case action == "delete" && r.Method == http.MethodPost:
+		removeDevice(w, r)
+	case action == "credential" && r.Method == http.MethodPost:
+		postDeviceCredential(w, r)
+	case action == "credential/delete" && r.Method == http.MethodPost:
+		deleteDeviceCredential(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func getDevices(w http.ResponseWriter, r *http.Request) {
+	var request DataPackage
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	u, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeAny)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	reply := []deviceData{}
+	for _, device := range uio.GetDevices(u) {
+		reply = append(reply, toDeviceData(&device))
+	}
+
+	result, _ := json.Marshal(reply)
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Write(result)
+}
+
+// A new device (that logged in with the account's password) registers itself.
+func postDevice(w http.ResponseWriter, r *http.Request) {
+	var request DataPackage
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	u, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeDeviceUpload)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	device, err := uio.CreateDevice(u, strings.TrimSpace(request.Data))
+	if errors.Is(err, user.ErrDeviceNameTooLong) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	result, _ := json.Marshal(toDeviceData(device))
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Write(result)
+}
+
+func removeDevice(w http.ResponseWriter, r *http.Request) {
+	var request DataPackage
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	u, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeAccountAdmin)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	err = uio.DeleteDevice(u, request.Device)
+	if errors.Is(err, user.ErrDeviceIsDefault) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func postDeviceCredential(w http.ResponseWriter, r *http.Request) {
+	var request DataPackage
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	u, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeAccountAdmin)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+	device := getDeviceOrError(w, u, request.Device)
+	if device == nil {
+		return
+	}
+
+	credential, _ := uio.CreateDeviceCredential(u, device)
+
+	result, _ := json.Marshal(deviceCredentialReply{
+		Device:     device.DeviceId,
+		Credential: credential,
+		Scopes:     user.DeviceCredentialScopes,
+	})
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Write(result)
+}
+
+func deleteDeviceCredential(w http.ResponseWriter, r *http.Request) {
+	var request DataPackage
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	u, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeAccountAdmin)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+	device := getDeviceOrError(w, u, request.Device)
+	if device == nil {
+		return
+	}
+
+	err = uio.DeleteDeviceCredential(u, device)
+	if err != nil {
+		http.Error(w, "Device credential not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,151 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"rmd-server/user"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Server-Sent Events stream with live account events (new locations, new pictures, command status changes).
+// Each event is only sent if the access token has its scope (locations:read, pictures:read, commands:send).
+//
+//	POST /events/ticket  body: {"IDT": <token>}  -> {"Ticket": <ticket>}
+//	GET  /events                                 -> the event stream
+//
+// The access token is passed in the "Authorization: Bearer <token>" header.
+// Browsers' EventSource cannot send headers, thus it exchanges the token for a ticket (see user.EventTickets)
+// and passes the ticket in the "ticket" query parameter. Each ticket can only be used once, and only briefly.
+
+const CT_TEXT_EVENT_STREAM = "text/event-stream"
+
+// Send a comment regularly to keep proxies from closing idle connections,
+// and to check whether the access token is still valid.
+const SSE_HEARTBEAT_INTERVAL = 15 * time.Second
+
+type eventTicketReply struct {
+	Ticket string
+}
+
+// Returns the access token from the "Authorization: Bearer <token>" header.
+func getAccessTokenFromRequest(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if token, found := strings.CutPrefix(auth, "Bearer "); found {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+func mainEvents(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/events"), "/")
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		getEvents(w, r)
+	case action == "ticket" && r.Method == http.MethodPost:
+		postEventTicket(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func postEventTicket(w http.ResponseWriter, r *http.Request) {
+	var request DataPackage
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	_, err = uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeAny)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	ticket, err := uio.EventTickets.Create(request.IDT)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	result, _ := json.Marshal(eventTicketReply{Ticket: ticket})
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Write(result)
+}
+
+func getEvents(w http.ResponseWriter, r *http.Request) {
+	accessToken := getAccessTokenFromRequest(r)
+	if ticket := r.URL.Query().Get("ticket"); accessToken == "" && ticket != "" {
+		token, ok := uio.EventTickets.Take(ticket)
+		if !ok {
+			http.Error(w, "Ticket not valid", http.StatusUnauthorized)
+			return
+		}
+		accessToken = token
+	}
+	u, err := uio.CheckAccessTokenAndGetUser(accessToken, user.ScopeAny)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+	session := uio.ACC.GetSession(accessToken)
+	if session == nil || !hasAnyEventScope(session) {
+		http.Error(w, ERR_ACCESS_TOKEN_SCOPE, http.StatusForbidden)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Error().Msg("streaming is not supported by the response writer")
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_TEXT_EVENT_STREAM)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // disable buffering in nginx
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	sub := uio.Events.Subscribe(u.UID)
+	defer uio.Events.Unsubscribe(sub)
+
+	heartbeat := time.NewTicker(SSE_HEARTBEAT_INTERVAL)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-sub.C:
+			if !ok {
+				// Subscription was ended by the server (e.g., the account was deleted)
+				return
+			}
+			if !session.HasScope(event.Scope) {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, event.Data)
+			flusher.Flush()
+		case <-heartbeat.C:
+			_, err := uio.ACC.CheckAccessToken(accessToken)
+			if err != nil {
+				fmt.Fprint(w, "event: expired\ndata: {}\n\n")
+				flusher.Flush()
+				return
+			}
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func hasAnyEventScope(session *user.Session) bool {
+	return session.HasScope(user.ScopeLocationsRead) ||
+		session.HasScope(user.ScopePicturesRead) ||
+		session.HasScope(user.ScopeCommandsSend)
+}
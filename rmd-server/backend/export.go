@@ -0,0 +1,224 @@
+package backend
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"rmd-server/user"
+	"rmd-server/version"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The export is a ZIP archive that is streamed to the client.
+// The data is read from the database in small pages, such that memory usage stays flat
+// regardless of how many locations and pictures an account has.
+//
+// Layout of the archive:
+//
+//	manifest.json                  server version, account and device metadata
+//	locations.ndjson               one exportLocation per line, grouped by device, oldest first
+//	commandLogs.ndjson             one exportCommandLogEntry per line, newest first
+//	pictures/<device>/<id>.txt     one file per picture, containing the encrypted picture, oldest first
+//
+// Format version 2 added the devices (see /devices). Version 1 had the PushUrl in the account
+// and no device directory for the pictures.
+//
+// All locations, pictures and command log entries are encrypted, exactly as stored on the server.
+// They can be decrypted with the (password-wrapped) private key in the manifest.
+
+const EXPORT_FORMAT_VERSION = 2
+
+// Pictures can be large, thus read fewer of them at once.
+const EXPORT_LOCATION_PAGE_SIZE = 500
+const EXPORT_PICTURE_PAGE_SIZE = 5
+const EXPORT_COMMAND_LOG_PAGE_SIZE = 500
+
+type exportManifest struct {
+	FormatVersion int
+	ServerVersion string
+	ExportTime    int64 // unix time in seconds
+	Account       exportAccount
+	Devices       []exportDevice
+}
+
+type exportAccount struct {
+	Id           string
+	PublicKey    string
+	PrivateKey   string // wrapped with the password
+	LastSeenTime int64
+	Locations    int // sum over all devices
+	Pictures     int // sum over all devices
+}
+
+type exportDevice struct {
+	Id           string
+	Name         string
+	PushUrl      string
+	LastSeenTime int64
+	CreatedTime  int64
+	Locations    int
+	Pictures     int
+}
+
+type exportLocation struct {
+	Id           uint64
+	Device       string
+	ReceivedTime int64
+	Data         string
+}
+
+type exportCommandLogEntry struct {
+	Id        uint64
+	Timestamp int64
+	Content   string
+}
+
+func getExport(w http.ResponseWriter, r *http.Request) {
+	var request DataPackage
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	user, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeAccountAdmin)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	log.Info().Str("userid", user.UID).Msg("exporting account data")
+
+	now := time.Now()
+	filename := fmt.Sprintf("rmd-export-%s-%s.zip", user.UID, now.UTC().Format("2006-01-02"))
+	w.Header().Set(HEADER_CONTENT_TYPE, "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+
+	// From here on, the status code has been sent.
+	// Errors can only be logged, the client will receive a truncated archive.
+	zw := zip.NewWriter(w)
+	err = writeExport(zw, user, now)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		log.Error().Err(err).Str("userid", user.UID).Msg("failed to write export")
+	}
+}
+
+func writeExport(zw *zip.Writer, u *user.RMDUser, now time.Time) error {
+	manifest := exportManifest{
+		FormatVersion: EXPORT_FORMAT_VERSION,
+		ServerVersion: version.VERSION,
+		ExportTime:    now.Unix(),
+		Account: exportAccount{
+			Id:           u.UID,
+			PublicKey:    u.PublicKey,
+			PrivateKey:   u.PrivateKey,
+			LastSeenTime: u.LastSeenTime,
+		},
+	}
+	// Only count the locations and pictures here, they are streamed page by page below
+	devices := uio.GetDevices(u)
+	for i := range devices {
+		d := exportDevice{
+			Id:           devices[i].DeviceId,
+			Name:         devices[i].Name,
+			PushUrl:      devices[i].PushUrl,
+			LastSeenTime: devices[i].LastSeenTime,
+			CreatedTime:  devices[i].CreatedTime,
+			Locations:    uio.GetLocationSize(&devices[i]),
+			Pictures:     uio.GetPictureSize(&devices[i]),
+		}
+		manifest.Account.Locations += d.Locations
+		manifest.Account.Pictures += d.Pictures
+		manifest.Devices = append(manifest.Devices, d)
+	}
+	f, err := zw.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(manifest)
+	if err != nil {
+		return err
+	}
+
+	// Locations
+	f, err = zw.Create("locations.ndjson")
+	if err != nil {
+		return err
+	}
+	enc = json.NewEncoder(f)
+	var cursor uint64
+	for i := range devices {
+		cursor = 0
+		for hasMore := true; hasMore; {
+			var locations []user.Location
+			locations, hasMore = uio.GetLocationPage(&devices[i], cursor, EXPORT_LOCATION_PAGE_SIZE, 0, 0)
+			for _, loc := range locations {
+				err = enc.Encode(exportLocation{Id: loc.Id, Device: devices[i].DeviceId, ReceivedTime: loc.ReceivedTime, Data: loc.Position})
+				if err != nil {
+					return err
+				}
+				cursor = loc.Id
+			}
+		}
+	}
+
+	// Command logs
+	f, err = zw.Create("commandLogs.ndjson")
+	if err != nil {
+		return err
+	}
+	enc = json.NewEncoder(f)
+	cursor = 0
+	for hasMore := true; hasMore; {
+		var entries []user.CommandLogEntry
+		entries, hasMore = uio.GetCommandLog(u, cursor, EXPORT_COMMAND_LOG_PAGE_SIZE, 0, 0)
+		for _, entry := range entries {
+			err = enc.Encode(exportCommandLogEntry{Id: entry.Id, Timestamp: entry.Timestamp, Content: entry.Content})
+			if err != nil {
+				return err
+			}
+			cursor = entry.Id
+		}
+	}
+
+	// Pictures
+	for i := range devices {
+		cursor = 0
+		for hasMore := true; hasMore; {
+			var pictures []user.Picture
+			pictures, hasMore = uio.GetPicturePage(&devices[i], cursor, EXPORT_PICTURE_PAGE_SIZE)
+			for _, pic := range pictures {
+				f, err = zw.Create(fmt.Sprintf("pictures/%s/%d.txt", devices[i].DeviceId, pic.Id))
+				if err != nil {
+					return err
+				}
+				err = copyPicture(f, &pic)
+				if err != nil {
+					return err
+				}
+				cursor = pic.Id
+			}
+		}
+	}
+
+	return nil
+}
+
+func copyPicture(w io.Writer, pic *user.Picture) error {
+	r, err := uio.OpenPicture(pic)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
@@ -0,0 +1,234 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"rmd-server/user"
+)
+
+// Delegated access: an owner grants another account (the grantee) access to the owner's data.
+//
+// The server cannot decrypt the data. Therefore, the owner's client wraps the owner's private key
+// for the grantee's public key, and the server stores this WrappedKey with the grant.
+//
+//	PUT  /grants            body: {"IDT": <token>}                                          -> list the grants given and received
+//	POST /grants            body: {"IDT": <token>, "GranteeId", "Scopes", "WrappedKey"}     -> create or replace a grant
+//	POST /grants/revoke     body: {"IDT": <token>, "Data": <grant id>}                      -> revoke a grant (as owner or grantee)
+//	PUT  /grants/publicKey  body: {"IDT": <token>, "Data": <grantee id>}                    -> get the grantee's public key
+//	PUT  /grants/access     body: {"IDT": <token>, "Data": <owner id>, "SessionDurationSeconds"} -> get a session on the owner's account
+
+type grantData struct {
+	Id          uint64
+	OwnerId     string
+	GranteeId   string
+	Scopes      []user.Scope
+	CreatedTime int64  // unix time in seconds
+	WrappedKey  string `json:",omitempty"` // only for received grants
+}
+
+type grantsReply struct {
+	Given    []grantData
+	Received []grantData
+}
+
+type createGrantData struct {
+	IDT        string
+	GranteeId  string
+	Scopes     []string // a subset of user.GrantableScopes, empty for all of them
+	WrappedKey string
+}
+
+type delegatedAccessData struct {
+	IDT                    string
+	OwnerId                string `json:"Data"`
+	SessionDurationSeconds uint64
+}
+
+type delegatedAccessReply struct {
+	accessTokenReply
+	WrappedKey string // the owner's private key, wrapped for the grantee
+}
+
+func toGrantData(grant *user.Grant, withWrappedKey bool) grantData {
+	s := user.Session{Scopes: grant.Scopes}
+	data := grantData{
+		Id:          grant.Id,
+		OwnerId:     grant.OwnerUID,
+		GranteeId:   grant.GranteeUID,
+		Scopes:      s.GetScopes(),
+		CreatedTime: grant.CreatedTime,
+	}
+	if withWrappedKey {
+		data.WrappedKey = grant.WrappedKey
+	}
+	return data
+}
+
+func mainGrants(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/grants"), "/")
+
+	switch {
+	case action == "" && r.Method == http.MethodPut:
+		getGrants(w, r)
+	case action == "" && r.Method == http.MethodPost:
+		postGrant(w, r)
+	case action == "revoke" && r.Method == http.MethodPost:
+		revokeGrant(w, r)
+	case action == "publicKey" && r.Method == http.MethodPut:
+		getGranteePublicKey(w, r)
+	case action == "access" && r.Method == http.MethodPut:
+		getDelegatedAccess(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func getGrants(w http.ResponseWriter, r *http.Request) {
+	var request DataPackage
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	u, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeAccountAdmin)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	reply := grantsReply{Given: []grantData{}, Received: []grantData{}}
+	for _, grant := range uio.GetGrantsByOwner(u) {
+		reply.Given = append(reply.Given, toGrantData(&grant, false))
+	}
+	for _, grant := range uio.GetGrantsForGrantee(u) {
+		reply.Received = append(reply.Received, toGrantData(&grant, true))
+	}
+
+	result, _ := json.Marshal(reply)
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Write(result)
+}
+
+func postGrant(w http.ResponseWriter, r *http.Request) {
+	var request createGrantData
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	u, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeAccountAdmin)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	grant, err := uio.CreateGrant(u, request.GranteeId, request.Scopes, request.WrappedKey)
+	if err != nil {
+		if errors.Is(err, user.ErrScopeInvalid) || errors.Is(err, user.ErrGrantToSelf) || errors.Is(err, user.ErrGrantWrappedKeyMissing) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, "Grantee not found", http.StatusNotFound)
+		}
+		return
+	}
+
+	result, _ := json.Marshal(toGrantData(grant, false))
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Write(result)
+}
+
+func revokeGrant(w http.ResponseWriter, r *http.Request) {
+	var request DataPackage
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	u, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeAccountAdmin)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	grantId, err := strconv.ParseUint(request.Data, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid grant id", http.StatusBadRequest)
+		return
+	}
+	err = uio.RevokeGrant(u, grantId)
+	if err != nil {
+		http.Error(w, "Grant not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func getGranteePublicKey(w http.ResponseWriter, r *http.Request) {
+	var request DataPackage
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	_, err = uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeAccountAdmin)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	grantee := uio.GetUser(request.Data)
+	if grantee == nil {
+		http.Error(w, "Grantee not found", http.StatusNotFound)
+		return
+	}
+
+	dataReply := DataPackage{IDT: request.IDT, Data: uio.GetPublicKey(grantee)}
+	result, _ := json.Marshal(dataReply)
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Write(result)
+}
+
+func getDelegatedAccess(w http.ResponseWriter, r *http.Request) {
+	var request delegatedAccessData
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	u, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeAccountAdmin)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	accessToken, grant, err := uio.CreateDelegatedAccess(u, request.IDT, request.OwnerId, user.SessionRequest{
+		DurationSeconds: request.SessionDurationSeconds,
+		RemoteIp:        getRemoteIp(r),
+		UserAgent:       r.UserAgent(),
+	})
+	if err != nil {
+		if errors.Is(err, user.ErrGrantNotFound) {
+			http.Error(w, "Grant not found", http.StatusNotFound)
+		} else {
+			writeAccessTokenError(w, err)
+		}
+		return
+	}
+
+	reply := delegatedAccessReply{
+		accessTokenReply: accessTokenReply{
+			IDT:            accessToken.DeviceId,
+			Data:           accessToken.Token,
+			ExpirationTime: accessToken.ExpirationTime,
+			Scopes:         accessToken.Scopes,
+		},
+		WrappedKey: grant.WrappedKey,
+	}
+	result, _ := json.Marshal(reply)
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Write(result)
+}
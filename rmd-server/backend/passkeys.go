@@ -0,0 +1,356 @@
+package backend
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"rmd-server/user"
+	"rmd-server/webauthn"
+)
+
+// Passkeys (WebAuthn) to log in to the web interface without typing the password.
+// Only available if WebAuthnOrigin is configured, otherwise all endpoints reply "404 Not Found".
+// Binary WebAuthn values (challenges, credential ids, and the authenticator's responses) are base64url-encoded.
+//
+// Login (next to /salt and /requestAccess):
+//
+//	PUT  /passkeyLogin/begin   body: {"IDT": <RMD ID>}       -> passkeyLoginOptions, for navigator.credentials.get()
+//	PUT  /passkeyLogin/finish  body: passkeyLoginData        -> like /requestAccess
+//
+// The session has all scopes (or the requested scopes), but key:read only if the passkey was registered with
+// "ReleaseKey". The password is still needed to decrypt the private key.
+//
+// Managing the passkeys of the caller's account:
+//
+//	PUT  /passkeys                  body: {"IDT": <token>}                  -> list the passkeys
+//	POST /passkeys/register/begin   body: {"IDT": <token>}                  -> passkeyRegistrationOptions, for navigator.credentials.create()
+//	POST /passkeys/register/finish  body: passkeyRegistrationData           -> the new passkey's passkeyData
+//	POST /passkeys/delete           body: {"IDT": <token>, "Data": <id>}    -> delete a passkey
+
+const PASSKEY_TIMEOUT_MILLIS = user.PASSKEY_CHALLENGE_VALID_SECS * 1000
+
+type passkeyData struct {
+	Id           string // the credential id
+	Name         string
+	ReleaseKey   bool
+	CreatedTime  int64 // unix time in seconds
+	LastUsedTime int64 // unix time in seconds, 0 if never used
+}
+
+type passkeyRegistrationOptions struct {
+	Challenge          string
+	RpId               string
+	UserHandle         string // the RMD ID
+	UserName           string
+	Algorithms         []int64 // COSE algorithm identifiers, for pubKeyCredParams
+	ExcludeCredentials []string
+	Timeout            int64 // milliseconds
+}
+
+type passkeyRegistrationData struct {
+	IDT               string
+	Challenge         string
+	Name              string
+	ReleaseKey        bool // allow sessions of this passkey to read the (password-wrapped) private key
+	ClientDataJSON    string
+	AttestationObject string
+}
+
+type passkeyLoginOptions struct {
+	Challenge        string
+	RpId             string
+	AllowCredentials []string
+	Timeout          int64 // milliseconds
+}
+
+type passkeyLoginData struct {
+	Challenge              string
+	CredentialId           string
+	ClientDataJSON         string
+	AuthenticatorData      string
+	Signature              string
+	SessionDurationSeconds uint64
+	RequestRefreshToken    bool
+	Scopes                 []string
+}
+
+func toPasskeyData(passkey *user.Passkey) passkeyData {
+	return passkeyData{
+		Id:           passkey.CredentialId,
+		Name:         passkey.Name,
+		ReleaseKey:   passkey.ReleaseKey,
+		CreatedTime:  passkey.CreatedTime,
+		LastUsedTime: passkey.LastUsedTime,
+	}
+}
+
+func credentialIds(passkeys []user.Passkey) []string {
+	ids := []string{}
+	for _, passkey := range passkeys {
+		ids = append(ids, passkey.CredentialId)
+	}
+	return ids
+}
+
+// Browsers' base64url encoders differ in whether they add padding
+func decodeBase64Url(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func mainPasskeys(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/passkeys"), "/")
+
+	switch {
+	case action == "" && r.Method == http.MethodPut:
+		getPasskeys(w, r)
+	case action == "register/begin" && r.Method == http.MethodPost:
+		beginPasskeyRegistration(w, r)
+	case action == "register/finish" && r.Method == http.MethodPost:
+		finishPasskeyRegistration(w, r)
+	case action == "delete" && r.Method == http.MethodPost:
+		deletePasskey(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func getPasskeys(w http.ResponseWriter, r *http.Request) {
+	var request DataPackage
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	if !uio.PasskeysEnabled() {
+		writePasskeyError(w, user.ErrPasskeysDisabled)
+		return
+	}
+	u, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeAccountAdmin)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	reply := []passkeyData{}
+	for _, passkey := range uio.GetPasskeys(u) {
+		reply = append(reply, toPasskeyData(&passkey))
+	}
+	result, _ := json.Marshal(reply)
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Write(result)
+}
+
+func beginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	var request DataPackage
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	if !uio.PasskeysEnabled() {
+		writePasskeyError(w, user.ErrPasskeysDisabled)
+		return
+	}
+	u, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeAccountAdmin)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	challenge, passkeys, err := uio.BeginPasskeyRegistration(u)
+	if err != nil {
+		writePasskeyError(w, err)
+		return
+	}
+
+	reply := passkeyRegistrationOptions{
+		Challenge:          challenge,
+		RpId:               uio.WebAuthn.ID,
+		UserHandle:         base64.RawURLEncoding.EncodeToString([]byte(u.UID)),
+		UserName:           u.UID,
+		Algorithms:         webauthn.SupportedAlgorithms,
+		ExcludeCredentials: credentialIds(passkeys),
+		Timeout:            PASSKEY_TIMEOUT_MILLIS,
+	}
+	result, _ := json.Marshal(reply)
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Write(result)
+}
+
+func finishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	var data passkeyRegistrationData
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	if !uio.PasskeysEnabled() {
+		writePasskeyError(w, user.ErrPasskeysDisabled)
+		return
+	}
+	u, err := uio.CheckAccessTokenAndGetUser(data.IDT, user.ScopeAccountAdmin)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	clientDataJSON, err1 := decodeBase64Url(data.ClientDataJSON)
+	attestationObject, err2 := decodeBase64Url(data.AttestationObject)
+	if err1 != nil || err2 != nil {
+		http.Error(w, "Invalid base64url encoding", http.StatusBadRequest)
+		return
+	}
+
+	passkey, err := uio.FinishPasskeyRegistration(u, data.Challenge, strings.TrimSpace(data.Name), data.ReleaseKey, clientDataJSON, attestationObject)
+	if err != nil {
+		writePasskeyError(w, err)
+		return
+	}
+
+	result, _ := json.Marshal(toPasskeyData(passkey))
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Write(result)
+}
+
+func deletePasskey(w http.ResponseWriter, r *http.Request) {
+	var request DataPackage
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	if !uio.PasskeysEnabled() {
+		writePasskeyError(w, user.ErrPasskeysDisabled)
+		return
+	}
+	u, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeAccountAdmin)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	err = uio.DeletePasskey(u, request.Data)
+	if err != nil {
+		writePasskeyError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func mainPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/passkeyLogin"), "/")
+
+	switch {
+	case action == "begin" && r.Method == http.MethodPut:
+		beginPasskeyLogin(w, r)
+	case action == "finish" && r.Method == http.MethodPut:
+		finishPasskeyLogin(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func beginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	var request DataPackage
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	if !user.IsUserIdValid(request.IDT) {
+		http.Error(w, "Invalid RMD ID", http.StatusBadRequest)
+		return
+	}
+
+	challenge, passkeys, err := uio.BeginPasskeyLogin(request.IDT)
+	if err != nil {
+		writePasskeyError(w, err)
+		return
+	}
+
+	reply := passkeyLoginOptions{
+		Challenge:        challenge,
+		RpId:             uio.WebAuthn.ID,
+		AllowCredentials: credentialIds(passkeys),
+		Timeout:          PASSKEY_TIMEOUT_MILLIS,
+	}
+	result, _ := json.Marshal(reply)
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Write(result)
+}
+
+func finishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	var data passkeyLoginData
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	if !uio.PasskeysEnabled() {
+		writePasskeyError(w, user.ErrPasskeysDisabled)
+		return
+	}
+
+	clientDataJSON, err1 := decodeBase64Url(data.ClientDataJSON)
+	authenticatorData, err2 := decodeBase64Url(data.AuthenticatorData)
+	signature, err3 := decodeBase64Url(data.Signature)
+	if err1 != nil || err2 != nil || err3 != nil {
+		http.Error(w, "Invalid base64url encoding", http.StatusBadRequest)
+		return
+	}
+	scopes, err := user.EncodeScopes(data.Scopes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	accessToken, err := uio.FinishPasskeyLogin(data.Challenge, data.CredentialId, clientDataJSON, authenticatorData, signature, user.SessionRequest{
+		DurationSeconds:  data.SessionDurationSeconds,
+		WithRefreshToken: data.RequestRefreshToken,
+		Scopes:           scopes,
+		RemoteIp:         getRemoteIp(r),
+		UserAgent:        r.UserAgent(),
+	})
+	if errors.Is(err, user.ErrPasskeyChallengeInvalid) {
+		http.Error(w, "Login expired, please log in again", http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, user.ErrAccountLocked) {
+		http.Error(w, "Account is locked", http.StatusLocked)
+		return
+	}
+	if errors.Is(err, user.ErrScopeInvalid) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	writeAccessTokenReply(w, accessToken)
+}
+
+func writePasskeyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, user.ErrPasskeysDisabled), errors.Is(err, user.ErrPasskeyNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, user.ErrTooManyPasskeyChallenges):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, user.ErrTooManyPasskeys), errors.Is(err, user.ErrPasskeyExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, user.ErrPasskeyNameTooLong),
+		errors.Is(err, user.ErrPasskeyChallengeInvalid),
+		errors.Is(err, webauthn.ErrClientDataInvalid),
+		errors.Is(err, webauthn.ErrAuthenticatorDataInvalid),
+		errors.Is(err, webauthn.ErrAttestationInvalid),
+		errors.Is(err, webauthn.ErrAlgorithmUnsupported),
+		errors.Is(err, webauthn.ErrUserNotVerified):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,172 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"rmd-server/user"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Chunked, resumable upload of pictures as raw bytes.
+// This avoids the base64-in-JSON overhead of POST /picture, and lets devices resume after a broken connection.
+//
+// The access token is passed in the "Authorization: Bearer <token>" header (see getAccessTokenFromRequest).
+// The uploaded bytes are the encrypted picture, in the same format as DataPackage.Data of POST /picture.
+//
+//	POST   /pictureUpload        body: {"Size": <total bytes>}  -> start an upload, returns pictureUploadData
+//	                                   (optionally with "Device": <device id>, see /devices)
+//	GET    /pictureUpload/<id>                                  -> current state (to resume after a broken connection)
+//	PATCH  /pictureUpload/<id>   body: raw bytes                -> append a chunk at the offset given in the Upload-Offset header
+//	DELETE /pictureUpload/<id>                                  -> cancel the upload
+//
+// Once all bytes are received, the picture is added and the reply has Complete=true and the PictureId.
+// If the Upload-Offset does not match the received bytes, the server replies 409 with the expected Offset.
+
+const HEADER_UPLOAD_OFFSET = "Upload-Offset"
+
+type pictureUploadRequest struct {
+	IDT  string // access token, alternatively passed in the Authorization header
+	Size int64  // total size of the encrypted picture in bytes
+	// The device that took the picture. Empty for the default device.
+	Device string `json:",omitempty"`
+}
+
+type pictureUploadData struct {
+	UploadId  string
+	Size      int64
+	Offset    int64 // number of bytes received so far
+	Complete  bool
+	PictureId uint64 `json:",omitempty"`
+}
+
+func mainPictureUpload(w http.ResponseWriter, r *http.Request) {
+	uploadId := strings.Trim(strings.TrimPrefix(r.URL.Path, "/pictureUpload"), "/")
+	if uploadId == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		postPictureUpload(w, r)
+		return
+	}
+
+	u, err := uio.CheckAccessTokenAndGetUser(getAccessTokenFromRequest(r), user.ScopeDeviceUpload)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		getPictureUpload(w, u, uploadId)
+	case http.MethodPatch:
+		patchPictureUpload(w, r, u, uploadId)
+	case http.MethodDelete:
+		deletePictureUpload(w, u, uploadId)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func postPictureUpload(w http.ResponseWriter, r *http.Request) {
+	var data pictureUploadRequest
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	accessToken := getAccessTokenFromRequest(r)
+	if accessToken == "" {
+		accessToken = data.IDT
+	}
+	u, err := uio.CheckAccessTokenAndGetUser(accessToken, user.ScopeDeviceUpload)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	device := getDeviceOrError(w, u, data.Device)
+	if device == nil {
+		return
+	}
+
+	upload, err := uio.StartPictureUpload(u, device, data.Size)
+	if errors.Is(err, user.ErrUploadSizeInvalid) {
+		http.Error(w, "Invalid picture size", http.StatusBadRequest)
+		return
+	}
+	if writeStorageError(w, err) {
+		return
+	}
+
+	writePictureUploadData(w, http.StatusCreated, pictureUploadData{UploadId: upload.Id, Size: upload.Size})
+}
+
+func getPictureUpload(w http.ResponseWriter, u *user.RMDUser, uploadId string) {
+	upload, offset, err := uio.GetPictureUpload(u, uploadId)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	writePictureUploadData(w, http.StatusOK, pictureUploadData{UploadId: upload.Id, Size: upload.Size, Offset: offset})
+}
+
+func patchPictureUpload(w http.ResponseWriter, r *http.Request, u *user.RMDUser, uploadId string) {
+	offset, err := strconv.ParseInt(r.Header.Get(HEADER_UPLOAD_OFFSET), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Missing or invalid "+HEADER_UPLOAD_OFFSET+" header", http.StatusBadRequest)
+		return
+	}
+
+	newOffset, pic, err := uio.AppendPictureUpload(u, uploadId, offset, r.Body)
+	reply := pictureUploadData{UploadId: uploadId, Offset: newOffset}
+	if pic != nil {
+		reply.Size = pic.Size
+		reply.Complete = true
+		reply.PictureId = pic.Id
+	} else if upload, _, getErr := uio.GetPictureUpload(u, uploadId); getErr == nil {
+		reply.Size = upload.Size
+	}
+
+	switch {
+	case err == nil:
+		writePictureUploadData(w, http.StatusOK, reply)
+	case errors.Is(err, user.ErrUploadNotFound):
+		http.Error(w, "Upload not found", http.StatusNotFound)
+	case errors.Is(err, user.ErrDeviceNotFound):
+		http.Error(w, "Device not found", http.StatusNotFound)
+	case errors.Is(err, user.ErrUploadOffsetMismatch), errors.Is(err, user.ErrUploadBusy):
+		writePictureUploadData(w, http.StatusConflict, reply)
+	case errors.Is(err, user.ErrUploadTooLarge):
+		http.Error(w, "Chunk exceeds the announced size", http.StatusRequestEntityTooLarge)
+	default:
+		// Most likely, the connection broke. The client can resume from the returned offset.
+		log.Warn().Err(err).Str("uploadId", uploadId).Msg("failed to receive picture chunk")
+		writePictureUploadData(w, http.StatusBadRequest, reply)
+	}
+}
+
+func deletePictureUpload(w http.ResponseWriter, u *user.RMDUser, uploadId string) {
+	err := uio.CancelPictureUpload(u, uploadId)
+	if errors.Is(err, user.ErrUploadNotFound) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("uploadId", uploadId).Msg("failed to cancel picture upload")
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func writePictureUploadData(w http.ResponseWriter, status int, data pictureUploadData) {
+	result, _ := json.Marshal(data)
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Header().Set(HEADER_UPLOAD_OFFSET, strconv.FormatInt(data.Offset, 10))
+	w.WriteHeader(status)
+	w.Write(result)
+}
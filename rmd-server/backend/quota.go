@@ -0,0 +1,87 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"rmd-server/user"
+)
+
+const ERR_PAYLOAD_TOO_LARGE = "Payload too large"
+const ERR_QUOTA_EXCEEDED = "Storage quota exceeded"
+
+// Allowance for the JSON around the payload (access token, field names, ...)
+const REQUEST_BODY_OVERHEAD = 64 * 1024
+
+type storageUsageData struct {
+	Locations     int64
+	LocationBytes int64
+	LocationQuota int64 // in bytes, 0 means unlimited
+	Pictures      int64
+	PictureBytes  int64
+	PictureQuota  int64 // in bytes, 0 means unlimited
+	MaxUploadSize int64 // in bytes, 0 means unlimited
+}
+
+// Reject request bodies that cannot contain a payload within the maximum upload size,
+// before decoding them into memory.
+func limitRequestBody(w http.ResponseWriter, r *http.Request) {
+	if uio.Limits.MaxUploadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, uio.Limits.MaxUploadSize+REQUEST_BODY_OVERHEAD)
+	}
+}
+
+// Reply with the error for a failed JSON decoding, distinguishing bodies that were too large.
+func writeDecodeError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, ERR_PAYLOAD_TOO_LARGE, http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+}
+
+// Reply with the error for a payload that could not be stored.
+// Returns false if err is nil.
+func writeStorageError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, user.ErrPayloadTooLarge):
+		http.Error(w, ERR_PAYLOAD_TOO_LARGE, http.StatusRequestEntityTooLarge)
+	case errors.Is(err, user.ErrQuotaExceeded):
+		http.Error(w, ERR_QUOTA_EXCEEDED, http.StatusInsufficientStorage)
+	default:
+		http.Error(w, "Failed to store data", http.StatusInternalServerError)
+	}
+	return true
+}
+
+func getStorageUsage(w http.ResponseWriter, r *http.Request) {
+	var request DataPackage
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	u, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeAny)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	usage := uio.GetStorageUsage(u)
+	reply := storageUsageData{
+		Locations:     usage.Locations,
+		LocationBytes: usage.LocationBytes,
+		LocationQuota: usage.LocationQuota,
+		Pictures:      usage.Pictures,
+		PictureBytes:  usage.PictureBytes,
+		PictureQuota:  usage.PictureQuota,
+		MaxUploadSize: usage.MaxUploadSize,
+	}
+	result, _ := json.Marshal(reply)
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Write(result)
+}
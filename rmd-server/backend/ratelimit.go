@@ -0,0 +1,143 @@
+package backend
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"rmd-server/metrics"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Token-bucket rate limiter keyed on the client IP.
+//
+// This complements the per-account lock in the AccessController:
+// it stops a single IP from trying salts and passwords against many accounts.
+//
+// Each IP has a bucket of `burst` tokens, which refills at `perMinute` tokens per minute.
+// Each request takes one token. Requests without a token are rejected with 429 and a Retry-After header.
+type RateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	perSecond float64
+	burst     float64
+	now       func() time.Time
+}
+
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// Buckets that have been full for this long are removed
+const RATE_LIMIT_CLEANUP_INTERVAL = 10 * time.Minute
+
+// Returns nil if perMinute <= 0, which disables rate limiting.
+func NewRateLimiter(perMinute int, burst int) *RateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	l := &RateLimiter{
+		buckets:   make(map[string]*tokenBucket),
+		perSecond: float64(perMinute) / 60,
+		burst:     float64(burst),
+		now:       time.Now,
+	}
+	go l.cronRemoveIdle()
+	return l
+}
+
+// Take a token for the key.
+// If there is none, returns false and how long to wait until the next token is available.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &tokenBucket{tokens: l.burst, lastSeen: now}
+		l.buckets[key] = b
+	}
+
+	// Refill
+	elapsed := now.Sub(b.lastSeen).Seconds()
+	b.tokens = math.Min(l.burst, b.tokens+elapsed*l.perSecond)
+	b.lastSeen = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := (1 - b.tokens) / l.perSecond
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// Wrap the handler so that requests exceeding the rate limit are rejected.
+// endpoint is used as label in the metrics.
+func (l *RateLimiter) Middleware(endpoint string, next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientIp := getRemoteIp(r)
+		allowed, wait := l.Allow(rateLimitKey(clientIp))
+		if !allowed {
+			metrics.RateLimitedRequests.WithLabelValues(endpoint).Inc()
+			log.Warn().
+				Str("remoteIp", clientIp).
+				Str("endpoint", endpoint).
+				Msg("rate limited request")
+
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Normalise the client IP: remove the port, and group IPv6 addresses by their /64 prefix
+// (a single client usually controls a whole /64).
+func rateLimitKey(remoteIp string) string {
+	host, _, err := net.SplitHostPort(remoteIp)
+	if err != nil {
+		host = remoteIp
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip.To4() != nil {
+		return ip.String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+func (l *RateLimiter) cronRemoveIdle() {
+	for range time.Tick(RATE_LIMIT_CLEANUP_INTERVAL) {
+		l.removeIdle()
+	}
+}
+
+func (l *RateLimiter) removeIdle() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	// A bucket is full again after this time, so it is equivalent to a new bucket
+	refillTime := time.Duration(l.burst / l.perSecond * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.lastSeen) > refillTime {
+			delete(l.buckets, key)
+		}
+	}
+}
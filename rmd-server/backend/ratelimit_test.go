@@ -0,0 +1,97 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestRateLimiter(perMinute int, burst int) (*RateLimiter, *time.Time) {
+	now := time.Unix(1000, 0)
+	l := &RateLimiter{
+		buckets:   make(map[string]*tokenBucket),
+		perSecond: float64(perMinute) / 60,
+		burst:     float64(burst),
+		now:       func() time.Time { return now },
+	}
+	return l, &now
+}
+
+func TestRateLimiterBurstAndRefill(t *testing.T) {
+	l, now := newTestRateLimiter(60, 3)
+
+	for i := 0; i < 3; i++ {
+		if allowed, _ := l.Allow("a"); !allowed {
+			t.Fatalf("request %d within the burst was rejected", i)
+		}
+	}
+	allowed, wait := l.Allow("a")
+	if allowed {
+		t.Fatal("request after the burst was allowed")
+	}
+	if wait <= 0 || wait > time.Second {
+		t.Errorf("unexpected wait=%s", wait)
+	}
+
+	// Other keys have their own bucket
+	if allowed, _ := l.Allow("b"); !allowed {
+		t.Error("request from another key was rejected")
+	}
+
+	*now = now.Add(time.Second)
+	if allowed, _ := l.Allow("a"); !allowed {
+		t.Error("request after refill was rejected")
+	}
+}
+
+func TestRateLimiterRemoveIdle(t *testing.T) {
+	l, now := newTestRateLimiter(60, 3)
+	l.Allow("a")
+
+	*now = now.Add(time.Minute)
+	l.removeIdle()
+	if len(l.buckets) != 0 {
+		t.Errorf("idle bucket was not removed")
+	}
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	l, _ := newTestRateLimiter(1, 1)
+	handler := l.Middleware("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, "/salt", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := request("10.0.0.1:1234"); w.Code != http.StatusOK {
+		t.Fatalf("first request: code=%d", w.Code)
+	}
+	// Same IP, different port
+	w := request("10.0.0.1:5678")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request: code=%d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "60" {
+		t.Errorf("Retry-After=%s", w.Header().Get("Retry-After"))
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	cases := map[string]string{
+		"10.0.0.1:1234":                    "10.0.0.1",
+		"10.0.0.1":                         "10.0.0.1",
+		"[2001:db8:1:2:3:4:5:6]:443":       "2001:db8:1:2::/64",
+		"2001:db8:1:2:ffff:ffff:ffff:ffff": "2001:db8:1:2::/64",
+		"not-an-ip":                        "not-an-ip",
+	}
+	for input, expected := range cases {
+		if actual := rateLimitKey(input); actual != expected {
+			t.Errorf(`rateLimitKey(%s)=%s != expected=%s`, input, actual, expected)
+		}
+	}
+}
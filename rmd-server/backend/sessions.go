@@ -0,0 +1,119 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"rmd-server/user"
+)
+
+// Listing and revoking the sessions of the caller's account.
+//
+//	PUT  /sessions         body: {"IDT": <token>}                       -> list the sessions
+//	POST /sessions         body: {"IDT": <token>, "Data": <session id>} -> revoke one session
+//	POST /sessions/others  body: {"IDT": <token>}                       -> revoke all sessions except the caller's
+
+type sessionData struct {
+	Id             string
+	CreationTime   int64 // unix time in seconds
+	ExpirationTime int64 // unix time in seconds
+	RemoteIp       string
+	UserAgent      string
+	Scopes         []user.Scope
+	Current        bool   // whether this is the session of the token used for the request
+	GrantId        uint64 `json:",omitempty"` // set if this is a grantee's session on this account (see /grants)
+}
+
+type revokeSessionsReply struct {
+	Revoked int
+}
+
+func mainSessions(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/sessions"), "/")
+
+	switch {
+	case action == "" && r.Method == http.MethodPut:
+		getSessions(w, r)
+	case action == "" && r.Method == http.MethodPost:
+		revokeSession(w, r)
+	case action == "others" && r.Method == http.MethodPost:
+		revokeOtherSessions(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func getSessions(w http.ResponseWriter, r *http.Request) {
+	var request DataPackage
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	u, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeAccountAdmin)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	current := uio.ACC.GetSession(request.IDT)
+
+	reply := []sessionData{}
+	for _, s := range uio.GetSessions(u) {
+		reply = append(reply, sessionData{
+			Id:             s.Id,
+			CreationTime:   s.CreationTime,
+			ExpirationTime: s.ExpirationTime,
+			RemoteIp:       s.RemoteIp,
+			UserAgent:      s.UserAgent,
+			Scopes:         s.GetScopes(),
+			Current:        current != nil && current.Id == s.Id,
+			GrantId:        s.GrantId,
+		})
+	}
+
+	result, _ := json.Marshal(reply)
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Write(result)
+}
+
+func revokeSession(w http.ResponseWriter, r *http.Request) {
+	var request DataPackage
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	u, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeAccountAdmin)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	if !uio.RevokeSession(u, request.Data) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func revokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	var request DataPackage
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+	u, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeAccountAdmin)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	count := uio.RevokeOtherSessions(u, request.IDT)
+
+	result, _ := json.Marshal(revokeSessionsReply{Revoked: count})
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Write(result)
+}
@@ -0,0 +1,213 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"rmd-server/user"
+)
+
+// TOTP as optional second factor for logins with the password.
+//
+// If TOTP is enabled, /requestAccess replies "401 Unauthorized" with a totpChallengeReply instead of the access token.
+// The client then sends the code from the authenticator app (or a recovery code) with the challenge to /verifyTotp,
+// which replies like /requestAccess.
+//
+//	PUT  /verifyTotp            body: {"Challenge": <challenge>, "Code": <code>}  -> finish the login
+//
+// Managing TOTP of the caller's account:
+//
+//	PUT  /totp                  body: {"IDT": <token>}                  -> totpStatusReply
+//	POST /totp/setup            body: {"IDT": <token>}                  -> new secret (totpSetupReply), not yet enabled
+//	POST /totp/enable           body: {"IDT": <token>, "Data": <code>}  -> enable TOTP, returns the recovery codes
+//	POST /totp/disable          body: {"IDT": <token>, "Data": <code>}  -> disable TOTP (code or recovery code)
+//	POST /totp/recoveryCodes    body: {"IDT": <token>, "Data": <code>}  -> replace the recovery codes
+//
+// Devices can skip the TOTP step with a device credential (see /devices/credential).
+
+type totpChallengeReply struct {
+	TotpRequired   bool
+	Challenge      string
+	ExpirationTime int64 // unix time in seconds
+}
+
+type verifyTotpData struct {
+	Challenge string
+	Code      string // TOTP code or recovery code
+}
+
+type totpStatusReply struct {
+	Enabled       bool
+	RecoveryCodes int64 // number of unused recovery codes
+}
+
+type totpSetupReply struct {
+	Secret string // base32-encoded, for entering it manually
+	Uri    string // otpauth:// URI, for QR codes
+}
+
+type recoveryCodesReply struct {
+	RecoveryCodes []string
+}
+
+func writeTotpChallengeReply(w http.ResponseWriter, challenge *user.TotpChallenge) {
+	reply := totpChallengeReply{
+		TotpRequired:   true,
+		Challenge:      challenge.Id,
+		ExpirationTime: challenge.ExpirationTime,
+	}
+	result, _ := json.Marshal(reply)
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write(result)
+}
+
+func verifyTotp(w http.ResponseWriter, r *http.Request) {
+	var data verifyTotpData
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+
+	accessToken, err := uio.VerifyTotp(data.Challenge, data.Code)
+	if errors.Is(err, user.ErrTotpChallengeInvalid) {
+		http.Error(w, "Login expired, please log in again", http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, user.ErrAccountLocked) {
+		http.Error(w, "Account is locked", http.StatusLocked)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	writeAccessTokenReply(w, accessToken)
+}
+
+func mainTotp(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/totp"), "/")
+
+	var request DataPackage
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, ERR_JSON_INVALID, http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodPut:
+		getTotpStatus(w, request)
+	case action == "setup" && r.Method == http.MethodPost:
+		setupTotp(w, request)
+	case action == "enable" && r.Method == http.MethodPost:
+		enableTotp(w, request)
+	case action == "disable" && r.Method == http.MethodPost:
+		disableTotp(w, request)
+	case action == "recoveryCodes" && r.Method == http.MethodPost:
+		regenerateRecoveryCodes(w, request)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func getTotpStatus(w http.ResponseWriter, request DataPackage) {
+	u, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeAccountAdmin)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	reply := totpStatusReply{Enabled: uio.IsTotpEnabled(u)}
+	if reply.Enabled {
+		reply.RecoveryCodes = uio.CountRecoveryCodes(u)
+	}
+	result, _ := json.Marshal(reply)
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Write(result)
+}
+
+func setupTotp(w http.ResponseWriter, request DataPackage) {
+	u, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeAccountAdmin)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	secret, uri, err := uio.SetupTotp(u)
+	if err != nil {
+		writeTotpError(w, err)
+		return
+	}
+	result, _ := json.Marshal(totpSetupReply{Secret: secret, Uri: uri})
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Write(result)
+}
+
+func enableTotp(w http.ResponseWriter, request DataPackage) {
+	u, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeAccountAdmin)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	codes, err := uio.EnableTotp(u, request.Data)
+	if err != nil {
+		writeTotpError(w, err)
+		return
+	}
+	writeRecoveryCodes(w, codes)
+}
+
+func disableTotp(w http.ResponseWriter, request DataPackage) {
+	u, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeAccountAdmin)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	err = uio.DisableTotp(u, request.Data)
+	if err != nil {
+		writeTotpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func regenerateRecoveryCodes(w http.ResponseWriter, request DataPackage) {
+	u, err := uio.CheckAccessTokenAndGetUser(request.IDT, user.ScopeAccountAdmin)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	codes, err := uio.RegenerateRecoveryCodes(u, request.Data)
+	if err != nil {
+		writeTotpError(w, err)
+		return
+	}
+	writeRecoveryCodes(w, codes)
+}
+
+func writeRecoveryCodes(w http.ResponseWriter, codes []string) {
+	result, _ := json.Marshal(recoveryCodesReply{RecoveryCodes: codes})
+	w.Header().Set(HEADER_CONTENT_TYPE, CT_APPLICATION_JSON)
+	w.Write(result)
+}
+
+func writeTotpError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, user.ErrTotpInvalid):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, user.ErrAccountLocked):
+		http.Error(w, "Account is locked", http.StatusLocked)
+	case errors.Is(err, user.ErrTotpAlreadyEnabled), errors.Is(err, user.ErrTotpNotEnabled), errors.Is(err, user.ErrTotpNotSetUp):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
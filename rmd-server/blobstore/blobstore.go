@@ -0,0 +1,24 @@
+// Package blobstore stores large, opaque blobs (e.g., encrypted pictures) outside of the SQLite database.
+package blobstore
+
+import (
+	"errors"
+	"io"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+const DRIVER_LOCAL = "local"
+const DRIVER_S3 = "s3"
+
+// A key-value store for blobs.
+// Keys are slash-separated paths, e.g., "pictures/<name>".
+type BlobStore interface {
+	// Store the blob under the key, replacing an existing blob.
+	// size is the number of bytes that r will return.
+	Put(key string, r io.Reader, size int64) error
+	// Open the blob for reading. Returns ErrNotFound if the blob does not exist.
+	Get(key string) (io.ReadCloser, error)
+	// Delete the blob. Deleting a blob that does not exist is not an error.
+	Delete(key string) error
+}
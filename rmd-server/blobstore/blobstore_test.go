@@ -0,0 +1,209 @@
+package blobstore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Minimal stand-in for an S3-compatible server (like MinIO), with a single bucket.
+// It ignores the signatures, and only supports what S3BlobStore uses.
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if key == "" {
+		// BucketExists
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		body, err := readS3Body(r)
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		f.objects[key] = body
+		w.Header().Set("ETag", `"etag"`)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet, http.MethodHead:
+		obj, ok := f.objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj)))
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(obj)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Decode the body, which is "aws-chunked" when using streaming signatures over plain HTTP.
+func readS3Body(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+
+	var body bytes.Buffer
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return body.Bytes(), nil
+		}
+		_, err = io.CopyN(&body, br, size)
+		if err != nil {
+			return nil, err
+		}
+		br.ReadString('\n') // CRLF after the chunk
+	}
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>` + code + `</Code><Message>` + code + `</Message></Error>`))
+}
+
+func testBlobStore(t *testing.T, store BlobStore) {
+	content := []byte("encrypted picture")
+
+	err := store.Put("pictures/abc", bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	r, err := store.Get("pictures/abc")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	actual, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatalf("reading blob failed: %v", err)
+	}
+	if !bytes.Equal(actual, content) {
+		t.Errorf(`actual=%s != expected=%s`, actual, content)
+	}
+
+	err = store.Delete("pictures/abc")
+	if err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	_, err = store.Get("pictures/abc")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf(`expected ErrNotFound after Delete, got %v`, err)
+	}
+
+	err = store.Delete("pictures/abc")
+	if err != nil {
+		t.Errorf("deleting a missing blob failed: %v", err)
+	}
+}
+
+func TestLocalBlobStore(t *testing.T) {
+	store, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, store)
+}
+
+func TestLocalBlobStoreRejectsPathTraversal(t *testing.T) {
+	store, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Put("../outside", strings.NewReader("x"), 1)
+	if err == nil {
+		t.Error("expected an error for a key outside of the directory")
+	}
+}
+
+func newFakeS3BlobStore(t *testing.T, prefix string) (*S3BlobStore, *fakeS3) {
+	fake := &fakeS3{bucket: "rmd", objects: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	store, err := NewS3BlobStore(S3Config{
+		Endpoint:  strings.TrimPrefix(server.URL, "http://"),
+		Bucket:    "rmd",
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+		UseSSL:    false,
+		Prefix:    prefix,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, fake
+}
+
+func TestS3BlobStore(t *testing.T) {
+	store, _ := newFakeS3BlobStore(t, "")
+	testBlobStore(t, store)
+}
+
+func TestS3BlobStorePrefix(t *testing.T) {
+	store, fake := newFakeS3BlobStore(t, "instance1")
+
+	err := store.Put("pictures/abc", strings.NewReader("x"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.objects["instance1/pictures/abc"]; !ok {
+		t.Errorf("expected object under the prefix, got %v", fake.objects)
+	}
+}
+
+func TestS3BlobStoreMissingBucket(t *testing.T) {
+	server := httptest.NewServer(&fakeS3{bucket: "other", objects: make(map[string][]byte)})
+	defer server.Close()
+
+	_, err := NewS3BlobStore(S3Config{
+		Endpoint: strings.TrimPrefix(server.URL, "http://"),
+		Bucket:   "rmd",
+		Region:   "us-east-1",
+	})
+	if err == nil {
+		t.Error("expected an error for a missing bucket")
+	}
+}
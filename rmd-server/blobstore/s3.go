@@ -0,0 +1,87 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"path"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Stores blobs in an S3-compatible object storage (e.g., AWS S3, MinIO, Garage).
+type S3BlobStore struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+type S3Config struct {
+	Endpoint  string // host[:port], without scheme
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+	// Optional prefix for all keys, e.g., to share one bucket between several instances
+	Prefix string
+}
+
+func NewS3BlobStore(conf S3Config) (*S3BlobStore, error) {
+	client, err := minio.New(conf.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(conf.AccessKey, conf.SecretKey, ""),
+		Secure: conf.UseSSL,
+		Region: conf.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Fail early if the bucket is not reachable
+	exists, err := client.BucketExists(context.Background(), conf.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, minio.ErrorResponse{Code: "NoSuchBucket", BucketName: conf.Bucket, Message: "bucket does not exist"}
+	}
+
+	return &S3BlobStore{client: client, bucket: conf.Bucket, prefix: conf.Prefix}, nil
+}
+
+func (s *S3BlobStore) objectName(key string) string {
+	return path.Join(s.prefix, key)
+}
+
+func (s *S3BlobStore) Put(key string, r io.Reader, size int64) error {
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.objectName(key), r, size, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	return err
+}
+
+func (s *S3BlobStore) Get(key string) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(context.Background(), s.bucket, s.objectName(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s.convertError(err)
+	}
+	// GetObject is lazy, check that the object exists
+	_, err = obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, s.convertError(err)
+	}
+	return obj, nil
+}
+
+func (s *S3BlobStore) Delete(key string) error {
+	// S3 does not return an error when deleting a missing object
+	return s.client.RemoveObject(context.Background(), s.bucket, s.objectName(key), minio.RemoveObjectOptions{})
+}
+
+func (s *S3BlobStore) convertError(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"rmd-server/user"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	inviteMaxUses   int64
+	inviteValidDays int
+	inviteUsername  string
+	inviteNote      string
+	inviteJson      bool
+
+	inviteCmd = &cobra.Command{
+		Use:   "invite",
+		Short: "Manage the invite codes for registering accounts",
+	}
+
+	inviteCreateCmd = &cobra.Command{
+		Use:   "create",
+		Short: "Create an invite code",
+		Long: `Create an invite code.
+The code is only shown once. Give it to the person who should register,
+they enter it as "registration token" in the RMD app or as "invite code" in the web interface.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			repo := openRepositoryForCli()
+			validFor := time.Duration(inviteValidDays) * 24 * time.Hour
+			code, invite, err := repo.CreateInvite(inviteMaxUses, validFor, inviteUsername, inviteNote)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to create invite: %s\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Invite %d: %s\n", invite.Id, code)
+		},
+	}
+
+	inviteListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List the invites",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			repo := openRepositoryForCli()
+			invites := repo.GetInvites()
+			if inviteJson {
+				printInvitesJson(&repo, invites)
+			} else {
+				printInvitesTable(&repo, invites)
+			}
+		},
+	}
+
+	inviteDeleteCmd = &cobra.Command{
+		Use:   "delete <inviteId>",
+		Short: "Delete an invite, such that its code cannot be used anymore",
+		Long: `Delete an invite, such that its code cannot be used anymore.
+Accounts that were registered with the invite are not affected.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			id, err := strconv.ParseUint(args[0], 10, 64)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid invite id: %s\n", args[0])
+				os.Exit(1)
+			}
+			repo := openRepositoryForCli()
+			err = repo.DeleteInvite(id)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invite %d not found\n", id)
+				os.Exit(1)
+			}
+			fmt.Printf("Deleted invite %d\n", id)
+		},
+	}
+)
+
+func formatUnixTime(t int64, zero string) string {
+	if t == 0 {
+		return zero
+	}
+	return time.Unix(t, 0).Format(time.RFC3339)
+}
+
+func printInvitesTable(repo *user.UserRepository, invites []user.Invite) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tUSES\tEXPIRES\tUSERNAME\tSTATUS\tUSERS\tNOTE")
+	now := time.Now()
+	for _, invite := range invites {
+		status := "valid"
+		if invite.IsExpired(now) {
+			status = "expired"
+		} else if !invite.IsValid(now) {
+			status = "used up"
+		}
+		fmt.Fprintf(tw, "%d\t%d/%d\t%s\t%s\t%s\t%s\t%s\n",
+			invite.Id,
+			invite.Uses, invite.MaxUses,
+			formatUnixTime(invite.ExpirationTime, "never"),
+			invite.Username,
+			status,
+			strings.Join(repo.GetInviteUsers(&invite), ","),
+			invite.Note,
+		)
+	}
+	tw.Flush()
+}
+
+type inviteJsonEntry struct {
+	Id             uint64
+	Username       string
+	Note           string
+	MaxUses        int64
+	Uses           int64
+	CreatedTime    int64
+	ExpirationTime int64
+	Valid          bool
+	Users          []string
+}
+
+func printInvitesJson(repo *user.UserRepository, invites []user.Invite) {
+	entries := []inviteJsonEntry{}
+	for _, invite := range invites {
+		entries = append(entries, inviteJsonEntry{
+			Id:             invite.Id,
+			Username:       invite.Username,
+			Note:           invite.Note,
+			MaxUses:        invite.MaxUses,
+			Uses:           invite.Uses,
+			CreatedTime:    invite.CreatedTime,
+			ExpirationTime: invite.ExpirationTime,
+			Valid:          invite.IsValid(time.Now()),
+			Users:          repo.GetInviteUsers(&invite),
+		})
+	}
+	printJson(entries)
+}
+
+func printJson(value any) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
+
+func init() {
+	rootCmd.AddCommand(inviteCmd)
+	inviteCmd.AddCommand(inviteCreateCmd)
+	inviteCmd.AddCommand(inviteListCmd)
+	inviteCmd.AddCommand(inviteDeleteCmd)
+
+	inviteCmd.PersistentFlags().StringVarP(&configPath, "config", "c", "", "Path to the config file")
+	inviteCmd.PersistentFlags().StringVarP(&cliDbDir, "db-dir", "d", "", "Path to the database directory")
+
+	inviteCreateCmd.Flags().Int64Var(&inviteMaxUses, "max-uses", 1, "How many accounts can be registered with the code")
+	inviteCreateCmd.Flags().IntVar(&inviteValidDays, "valid-days", 0, "Days until the code expires, 0 for never")
+	inviteCreateCmd.Flags().StringVar(&inviteUsername, "username", "", "Only allow registering this RMD ID")
+	inviteCreateCmd.Flags().StringVar(&inviteNote, "note", "", "A note for yourself, e.g., whom you sent the code to")
+
+	inviteListCmd.Flags().BoolVar(&inviteJson, "json", false, "Output JSON instead of a table")
+}
@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"rmd-server/backend"
+	conf "rmd-server/config"
+	"rmd-server/user"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cliDbDir string
+
+	quotaLocations string
+	quotaPictures  string
+
+	quotaCmd = &cobra.Command{
+		Use:   "quota",
+		Short: "Show or override the storage quotas of an account",
+	}
+
+	quotaShowCmd = &cobra.Command{
+		Use:   "show <userId>",
+		Short: "Show the storage usage and quotas of an account",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			repo := openRepositoryForCli()
+			u := getUserForCli(&repo, args[0])
+			printStorageUsage(u, repo.GetStorageUsage(u))
+		},
+	}
+
+	quotaSetCmd = &cobra.Command{
+		Use:   "set <userId>",
+		Short: "Override the storage quotas of an account",
+		Long: `Override the storage quotas of an account.
+Each quota is a size in MB, "default" to use the server-wide quota from the config, or "unlimited".
+Quotas that are not passed stay unchanged.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			repo := openRepositoryForCli()
+			u := getUserForCli(&repo, args[0])
+
+			locationQuota := u.LocationQuota
+			if cmd.Flags().Changed("locations") {
+				locationQuota = parseQuotaFlag("locations", quotaLocations)
+			}
+			pictureQuota := u.PictureQuota
+			if cmd.Flags().Changed("pictures") {
+				pictureQuota = parseQuotaFlag("pictures", quotaPictures)
+			}
+
+			repo.SetQuotas(u, locationQuota, pictureQuota)
+			printStorageUsage(u, repo.GetStorageUsage(u))
+		},
+	}
+)
+
+// Open the database of the server for an admin command.
+// This is safe while the server is running, because SQLite handles concurrent access.
+func openRepositoryForCli() user.UserRepository {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339})
+
+	conf.ReadConfigFile(&config, configPath)
+	if cliDbDir != "" {
+		config.Set(conf.CONF_DATABASE_DIR, cliDbDir)
+	}
+	return backend.OpenUserRepository(&config)
+}
+
+func getUserForCli(repo *user.UserRepository, userId string) *user.RMDUser {
+	u, err := repo.UB.GetByID(userId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "User %s not found\n", userId)
+		os.Exit(1)
+	}
+	return u
+}
+
+func parseQuotaFlag(name string, value string) int64 {
+	switch value {
+	case "default":
+		return user.QuotaDefault
+	case "unlimited":
+		return user.QuotaUnlimited
+	}
+	mb, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || mb <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid value for --%s: %s\n", name, value)
+		os.Exit(1)
+	}
+	return mb * 1024 * 1024
+}
+
+func formatQuota(override int64, effective int64) string {
+	limit := "unlimited"
+	if effective > 0 {
+		limit = formatMB(effective)
+	}
+	if override == user.QuotaDefault {
+		return limit + " (server default)"
+	}
+	return limit + " (override)"
+}
+
+func formatMB(bytes int64) string {
+	return fmt.Sprintf("%.2f MB", float64(bytes)/(1024*1024))
+}
+
+func printStorageUsage(u *user.RMDUser, usage user.StorageUsage) {
+	fmt.Printf("User:      %s\n", u.UID)
+	fmt.Printf("Locations: %d, %s of %s\n", usage.Locations, formatMB(usage.LocationBytes), formatQuota(u.LocationQuota, usage.LocationQuota))
+	fmt.Printf("Pictures:  %d, %s of %s\n", usage.Pictures, formatMB(usage.PictureBytes), formatQuota(u.PictureQuota, usage.PictureQuota))
+}
+
+func init() {
+	rootCmd.AddCommand(quotaCmd)
+	quotaCmd.AddCommand(quotaShowCmd)
+	quotaCmd.AddCommand(quotaSetCmd)
+
+	quotaCmd.PersistentFlags().StringVarP(&configPath, "config", "c", "", "Path to the config file")
+	quotaCmd.PersistentFlags().StringVarP(&cliDbDir, "db-dir", "d", "", "Path to the database directory")
+
+	quotaSetCmd.Flags().StringVar(&quotaLocations, "locations", "", `Quota for locations in MB, "default" or "unlimited"`)
+	quotaSetCmd.Flags().StringVar(&quotaPictures, "pictures", "", `Quota for pictures in MB, "default" or "unlimited"`)
+}
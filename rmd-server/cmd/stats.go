@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	statsJson bool
+
+	statsCmd = &cobra.Command{
+		Use:   "stats",
+		Short: "Show statistics about the accounts and the stored data",
+		Long: `Show statistics about the accounts and the stored data.
+This reads the database and can be used while the server is running.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			repo := openRepositoryForCli()
+			stats := repo.GetStats()
+			if statsJson {
+				printJson(stats)
+				return
+			}
+
+			tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintf(tw, "Accounts:\t%d\n", stats.Accounts)
+			fmt.Fprintf(tw, "  locked by an admin:\t%d\n", stats.LockedAccounts)
+			fmt.Fprintf(tw, "  with failed logins:\t%d\n", stats.FailedLoginAccounts)
+			fmt.Fprintf(tw, "  with TOTP:\t%d\n", stats.TotpAccounts)
+			fmt.Fprintf(tw, "  with passkeys:\t%d\n", stats.PasskeyAccounts)
+			fmt.Fprintf(tw, "Devices:\t%d\n", stats.Devices)
+			fmt.Fprintf(tw, "Sessions:\t%d\n", stats.Sessions)
+			fmt.Fprintf(tw, "Locations:\t%d, %s\n", stats.Locations, formatMB(stats.LocationBytes))
+			fmt.Fprintf(tw, "Pictures:\t%d, %s\n", stats.Pictures, formatMB(stats.PictureBytes))
+			fmt.Fprintf(tw, "Pending commands:\t%d\n", stats.PendingCommands)
+			fmt.Fprintf(tw, "Valid invites:\t%d\n", stats.ValidInvites)
+			tw.Flush()
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(statsCmd)
+
+	statsCmd.Flags().StringVarP(&configPath, "config", "c", "", "Path to the config file")
+	statsCmd.Flags().StringVarP(&cliDbDir, "db-dir", "d", "", "Path to the database directory")
+	statsCmd.Flags().BoolVar(&statsJson, "json", false, "Output JSON instead of a table")
+}
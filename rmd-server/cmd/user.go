@@ -0,0 +1,365 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"rmd-server/user"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	userJson       bool
+	userDeleteYes  bool
+	userLockReason string
+
+	userCmd = &cobra.Command{
+		Use:   "user",
+		Short: "Manage the accounts",
+		Long: `Manage the accounts.
+These commands can be used while the server is running.
+Locks take effect immediately. Revoked sessions stop working within a minute,
+when the server reloads its sessions from the database.`,
+	}
+
+	userListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List the accounts",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			repo := openRepositoryForCli()
+			users := repo.GetUsers()
+			if userJson {
+				entries := []userJsonEntry{}
+				for _, u := range users {
+					entries = append(entries, toUserJsonEntry(&repo, &u))
+				}
+				printJson(entries)
+			} else {
+				printUsersTable(&repo, users)
+			}
+		},
+	}
+
+	userShowCmd = &cobra.Command{
+		Use:   "show <userId>",
+		Short: "Show the details of an account",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			repo := openRepositoryForCli()
+			u := getUserForCli(&repo, args[0])
+			if userJson {
+				printJson(toUserDetailsJsonEntry(&repo, u))
+			} else {
+				printUserDetails(&repo, u)
+			}
+		},
+	}
+
+	userDeleteCmd = &cobra.Command{
+		Use:   "delete <userId>",
+		Short: "Delete an account and all its data",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			repo := openRepositoryForCli()
+			u := getUserForCli(&repo, args[0])
+			if !userDeleteYes && !confirm(fmt.Sprintf("Delete %s with all its devices, locations and pictures?", u.UID)) {
+				fmt.Println("Aborted")
+				os.Exit(1)
+			}
+			repo.DeleteUser(u)
+			fmt.Printf("Deleted %s\n", u.UID)
+		},
+	}
+
+	userLockCmd = &cobra.Command{
+		Use:   "lock <userId>",
+		Short: "Lock an account until it is unlocked",
+		Long: `Lock an account until it is unlocked.
+Logging in is refused and all sessions of the account are revoked.
+The data of the account is kept.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			repo := openRepositoryForCli()
+			u := getUserForCli(&repo, args[0])
+			err := repo.LockUser(u, userLockReason)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to lock %s: %s\n", u.UID, err)
+				os.Exit(1)
+			}
+			fmt.Printf("Locked %s\n", u.UID)
+		},
+	}
+
+	userUnlockCmd = &cobra.Command{
+		Use:   "unlock <userId>",
+		Short: "Unlock an account",
+		Long: `Unlock an account.
+This lifts a lock by an admin and resets the failed login attempts.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			repo := openRepositoryForCli()
+			u := getUserForCli(&repo, args[0])
+			repo.UnlockUser(u)
+			fmt.Printf("Unlocked %s\n", u.UID)
+		},
+	}
+
+	userRevokeSessionsCmd = &cobra.Command{
+		Use:   "revoke-sessions <userId>",
+		Short: "Log out an account everywhere",
+		Long: `Log out an account everywhere.
+This revokes all sessions and refresh tokens of the account,
+and the sessions that it opened on other accounts with a grant.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			repo := openRepositoryForCli()
+			u := getUserForCli(&repo, args[0])
+			count := repo.RevokeAllSessions(u)
+			fmt.Printf("Revoked %d sessions of %s\n", count, u.UID)
+		},
+	}
+)
+
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func userStatus(repo *user.UserRepository, u *user.RMDUser) string {
+	if u.LockedTime != 0 {
+		return "locked"
+	}
+	if repo.ACC.IsLocked(u.UID) {
+		return "locked (failed logins)"
+	}
+	return "active"
+}
+
+func printUsersTable(repo *user.UserRepository, users []user.RMDUser) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATUS\tADMIN\tLAST SEEN\tDEVICES\tSESSIONS\tTOTP\tPASSKEYS\tSTORAGE")
+	for _, u := range users {
+		usage := repo.GetStorageUsage(&u)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%s\t%d\t%s\n",
+			u.UID,
+			userStatus(repo, &u),
+			yesNo(repo.IsAdmin(&u)),
+			formatUnixTime(u.LastSeenTime, "never"),
+			len(repo.GetDevices(&u)),
+			len(repo.GetSessions(&u)),
+			yesNo(repo.IsTotpEnabled(&u)),
+			len(repo.GetPasskeys(&u)),
+			formatMB(usage.LocationBytes+usage.PictureBytes),
+		)
+	}
+	tw.Flush()
+}
+
+func printUserDetails(repo *user.UserRepository, u *user.RMDUser) {
+	printStorageUsage(u, repo.GetStorageUsage(u))
+	fmt.Printf("Status:    %s\n", userStatus(repo, u))
+	if u.LockedTime != 0 {
+		fmt.Printf("Locked:    %s %s\n", formatUnixTime(u.LockedTime, ""), u.LockReason)
+	}
+	if lock := repo.ACC.GetLoginLock(u.UID); lock != nil {
+		fmt.Printf("Failed:    %d login attempts, counted until %s\n", lock.FailedCount, formatUnixTime(lock.ExpirationTime, ""))
+	}
+	fmt.Printf("Admin:     %s\n", yesNo(repo.IsAdmin(u)))
+	fmt.Printf("Last seen: %s\n", formatUnixTime(u.LastSeenTime, "never"))
+	if u.InviteID != 0 {
+		fmt.Printf("Invite:    %d\n", u.InviteID)
+	}
+	fmt.Printf("TOTP:      %s\n", yesNo(repo.IsTotpEnabled(u)))
+
+	fmt.Println()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEVICE\tNAME\tCREATED\tLAST SEEN\tPUSH")
+	for _, device := range repo.GetDevices(u) {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			device.DeviceId,
+			device.Name,
+			formatUnixTime(device.CreatedTime, "-"),
+			formatUnixTime(device.LastSeenTime, "never"),
+			yesNo(device.PushUrl != ""),
+		)
+	}
+	tw.Flush()
+
+	fmt.Println()
+	tw = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SESSION\tCREATED\tEXPIRES\tREMOTE IP\tUSER AGENT")
+	for _, session := range repo.GetSessions(u) {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			session.Id,
+			formatUnixTime(session.CreationTime, "-"),
+			formatUnixTime(max(session.ExpirationTime, session.RefreshExpirationTime), "-"),
+			session.RemoteIp,
+			session.UserAgent,
+		)
+	}
+	tw.Flush()
+
+	passkeys := repo.GetPasskeys(u)
+	if len(passkeys) > 0 {
+		fmt.Println()
+		tw = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "PASSKEY\tCREATED\tLAST USED\tRELEASES KEY")
+		for _, passkey := range passkeys {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n",
+				passkey.Name,
+				formatUnixTime(passkey.CreatedTime, "-"),
+				formatUnixTime(passkey.LastUsedTime, "never"),
+				yesNo(passkey.ReleaseKey),
+			)
+		}
+		tw.Flush()
+	}
+}
+
+func yesNo(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
+
+type userJsonEntry struct {
+	Id           string
+	Status       string
+	Admin        bool
+	LockedTime   int64  `json:",omitempty"`
+	LockReason   string `json:",omitempty"`
+	LastSeenTime int64
+	InviteId     uint64 `json:",omitempty"`
+	Devices      int
+	Sessions     int
+	TotpEnabled  bool
+	Passkeys     int
+	Storage      user.StorageUsage
+}
+
+func toUserJsonEntry(repo *user.UserRepository, u *user.RMDUser) userJsonEntry {
+	return userJsonEntry{
+		Id:           u.UID,
+		Status:       userStatus(repo, u),
+		Admin:        repo.IsAdmin(u),
+		LockedTime:   u.LockedTime,
+		LockReason:   u.LockReason,
+		LastSeenTime: u.LastSeenTime,
+		InviteId:     u.InviteID,
+		Devices:      len(repo.GetDevices(u)),
+		Sessions:     len(repo.GetSessions(u)),
+		TotpEnabled:  repo.IsTotpEnabled(u),
+		Passkeys:     len(repo.GetPasskeys(u)),
+		Storage:      repo.GetStorageUsage(u),
+	}
+}
+
+type userDetailsJsonEntry struct {
+	userJsonEntry
+	FailedLogins   *user.LoginLock `json:",omitempty"`
+	DeviceList     []deviceJsonEntry
+	SessionList    []sessionJsonEntry
+	PasskeyList    []passkeyJsonEntry
+	GrantsGiven    []string // ids of the accounts that can access this account
+	GrantsReceived []string // ids of the accounts that this account can access
+}
+
+type deviceJsonEntry struct {
+	DeviceId     string
+	Name         string
+	CreatedTime  int64
+	LastSeenTime int64
+	Push         bool
+}
+
+type sessionJsonEntry struct {
+	Id                    string
+	CreationTime          int64
+	ExpirationTime        int64
+	RefreshExpirationTime int64 `json:",omitempty"`
+	RemoteIp              string
+	UserAgent             string
+	Scopes                []user.Scope
+	GrantId               uint64 `json:",omitempty"`
+}
+
+type passkeyJsonEntry struct {
+	Name         string
+	CreatedTime  int64
+	LastUsedTime int64
+	ReleaseKey   bool
+}
+
+func toUserDetailsJsonEntry(repo *user.UserRepository, u *user.RMDUser) userDetailsJsonEntry {
+	entry := userDetailsJsonEntry{
+		userJsonEntry:  toUserJsonEntry(repo, u),
+		FailedLogins:   repo.ACC.GetLoginLock(u.UID),
+		DeviceList:     []deviceJsonEntry{},
+		SessionList:    []sessionJsonEntry{},
+		PasskeyList:    []passkeyJsonEntry{},
+		GrantsGiven:    []string{},
+		GrantsReceived: []string{},
+	}
+	for _, device := range repo.GetDevices(u) {
+		entry.DeviceList = append(entry.DeviceList, deviceJsonEntry{
+			DeviceId:     device.DeviceId,
+			Name:         device.Name,
+			CreatedTime:  device.CreatedTime,
+			LastSeenTime: device.LastSeenTime,
+			Push:         device.PushUrl != "",
+		})
+	}
+	for _, session := range repo.GetSessions(u) {
+		entry.SessionList = append(entry.SessionList, sessionJsonEntry{
+			Id:                    session.Id,
+			CreationTime:          session.CreationTime,
+			ExpirationTime:        session.ExpirationTime,
+			RefreshExpirationTime: session.RefreshExpirationTime,
+			RemoteIp:              session.RemoteIp,
+			UserAgent:             session.UserAgent,
+			Scopes:                session.GetScopes(),
+			GrantId:               session.GrantId,
+		})
+	}
+	for _, passkey := range repo.GetPasskeys(u) {
+		entry.PasskeyList = append(entry.PasskeyList, passkeyJsonEntry{
+			Name:         passkey.Name,
+			CreatedTime:  passkey.CreatedTime,
+			LastUsedTime: passkey.LastUsedTime,
+			ReleaseKey:   passkey.ReleaseKey,
+		})
+	}
+	for _, grant := range repo.GetGrantsByOwner(u) {
+		entry.GrantsGiven = append(entry.GrantsGiven, grant.GranteeUID)
+	}
+	for _, grant := range repo.GetGrantsForGrantee(u) {
+		entry.GrantsReceived = append(entry.GrantsReceived, grant.OwnerUID)
+	}
+	return entry
+}
+
+func init() {
+	rootCmd.AddCommand(userCmd)
+	userCmd.AddCommand(userListCmd)
+	userCmd.AddCommand(userShowCmd)
+	userCmd.AddCommand(userDeleteCmd)
+	userCmd.AddCommand(userLockCmd)
+	userCmd.AddCommand(userUnlockCmd)
+	userCmd.AddCommand(userRevokeSessionsCmd)
+
+	userCmd.PersistentFlags().StringVarP(&configPath, "config", "c", "", "Path to the config file")
+	userCmd.PersistentFlags().StringVarP(&cliDbDir, "db-dir", "d", "", "Path to the database directory")
+
+	userListCmd.Flags().BoolVar(&userJson, "json", false, "Output JSON instead of a table")
+	userShowCmd.Flags().BoolVar(&userJson, "json", false, "Output JSON instead of a table")
+	userDeleteCmd.Flags().BoolVarP(&userDeleteYes, "yes", "y", false, "Do not ask for confirmation")
+	userLockCmd.Flags().StringVar(&userLockReason, "reason", "", "A note why the account was locked")
+}
@@ -24,8 +24,40 @@ const CONF_USER_ID_LENGTH = "UserIdLength"
 
 const CONF_MAX_SAVED_LOC = "MaxSavedLoc"
 const CONF_MAX_SAVED_PIC = "MaxSavedPic"
+const CONF_MAX_SAVED_COMMAND_LOGS = "MaxSavedCommandLogs"
 
+const CONF_MAX_UPLOAD_SIZE_MB = "MaxUploadSizeMB"
+const CONF_LOCATION_QUOTA_MB = "LocationQuotaMB"
+const CONF_PICTURE_QUOTA_MB = "PictureQuotaMB"
+
+const CONF_MAX_LOCATION_AGE_DAYS = "MaxLocationAgeDays"
+const CONF_MAX_PICTURE_AGE_DAYS = "MaxPictureAgeDays"
+
+const CONF_MAX_COMMAND_WAIT_SECONDS = "MaxCommandWaitSeconds"
+const CONF_MAX_COMMAND_WAITERS = "MaxCommandWaiters"
+const CONF_MAX_COMMAND_WAITERS_PER_ACCOUNT = "MaxCommandWaitersPerAccount"
+
+const CONF_BLOB_STORAGE = "BlobStorage"
+const CONF_S3_ENDPOINT = "S3Endpoint"
+const CONF_S3_BUCKET = "S3Bucket"
+const CONF_S3_REGION = "S3Region"
+const CONF_S3_ACCESS_KEY = "S3AccessKey"
+const CONF_S3_SECRET_KEY = "S3SecretKey"
+const CONF_S3_USE_SSL = "S3UseSSL"
+const CONF_S3_PREFIX = "S3Prefix"
+
+// Deprecated: replaced by invites (CONF_REGISTRATION_INVITE_ONLY). Only read to migrate it to an invite.
 const CONF_REGISTRATION_TOKEN = "RegistrationToken"
+const CONF_REGISTRATION_INVITE_ONLY = "RegistrationInviteOnly"
+
+const CONF_ADMIN_USERS = "AdminUsers"
+
+const CONF_TOTP_KEY_FILE = "TotpKeyFile"
+
+const CONF_WEBAUTHN_ORIGIN = "WebAuthnOrigin"
+
+const CONF_RATE_LIMIT_AUTH_PER_MINUTE = "RateLimitAuthPerMinute"
+const CONF_RATE_LIMIT_AUTH_BURST = "RateLimitAuthBurst"
 
 const CONF_SERVER_CERT = "ServerCrt"
 const CONF_SERVER_KEY = "ServerKey"
@@ -58,8 +90,39 @@ func setDefaults(config *viper.Viper) {
 
 	config.SetDefault(CONF_MAX_SAVED_LOC, 1000)
 	config.SetDefault(CONF_MAX_SAVED_PIC, 10)
+	config.SetDefault(CONF_MAX_SAVED_COMMAND_LOGS, 500)
+
+	config.SetDefault(CONF_MAX_UPLOAD_SIZE_MB, 32)
+	config.SetDefault(CONF_LOCATION_QUOTA_MB, 0)
+	config.SetDefault(CONF_PICTURE_QUOTA_MB, 0)
+
+	config.SetDefault(CONF_MAX_LOCATION_AGE_DAYS, 0)
+	config.SetDefault(CONF_MAX_PICTURE_AGE_DAYS, 0)
+
+	config.SetDefault(CONF_MAX_COMMAND_WAIT_SECONDS, 60)
+	config.SetDefault(CONF_MAX_COMMAND_WAITERS, 2)
+	config.SetDefault(CONF_MAX_COMMAND_WAITERS_PER_ACCOUNT, 10)
+
+	config.SetDefault(CONF_BLOB_STORAGE, "local")
+	config.SetDefault(CONF_S3_ENDPOINT, "")
+	config.SetDefault(CONF_S3_BUCKET, "")
+	config.SetDefault(CONF_S3_REGION, "")
+	config.SetDefault(CONF_S3_ACCESS_KEY, "")
+	config.SetDefault(CONF_S3_SECRET_KEY, "")
+	config.SetDefault(CONF_S3_USE_SSL, true)
+	config.SetDefault(CONF_S3_PREFIX, "")
 
 	config.SetDefault(CONF_REGISTRATION_TOKEN, "")
+	config.SetDefault(CONF_REGISTRATION_INVITE_ONLY, false)
+
+	config.SetDefault(CONF_ADMIN_USERS, []string{})
+
+	config.SetDefault(CONF_TOTP_KEY_FILE, "")
+
+	config.SetDefault(CONF_WEBAUTHN_ORIGIN, "")
+
+	config.SetDefault(CONF_RATE_LIMIT_AUTH_PER_MINUTE, 20)
+	config.SetDefault(CONF_RATE_LIMIT_AUTH_BURST, 10)
 
 	config.SetDefault(CONF_SERVER_CERT, "")
 	config.SetDefault(CONF_SERVER_KEY, "")
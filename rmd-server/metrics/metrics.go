@@ -40,6 +40,21 @@ var (
 		Help: "Number of pending commands",
 	})
 
+	EventSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "rmd_event_subscribers",
+		Help: "Number of open event streams",
+	})
+
+	DeviceConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "rmd_device_connections",
+		Help: "Number of devices connected via WebSocket",
+	})
+
+	RateLimitedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rmd_rate_limited_requests_total",
+		Help: "Number of requests rejected by the IP-based rate limiter",
+	}, []string{"endpoint"})
+
 	PushServers = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "rmd_push_server",
 		Help: "Number of used push servers",
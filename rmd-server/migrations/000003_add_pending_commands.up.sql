@@ -0,0 +1,18 @@
+-- pending_commands
+CREATE TABLE IF NOT EXISTS `pending_commands` (
+  `id` integer PRIMARY KEY AUTOINCREMENT,
+  `user_id` integer,
+  `command` text,
+  `command_time` integer,
+  `command_sig` text,
+  CONSTRAINT `fk_rmd_users_pending_commands` FOREIGN KEY (`user_id`) REFERENCES `rmd_users` (`id`) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS `idx_pending_commands_user_id` ON `pending_commands` (`user_id`);
+
+-- Move the single command slot of each user into the queue.
+-- The legacy columns are kept (but emptied) to avoid rebuilding the rmd_users table.
+INSERT INTO `pending_commands` (`user_id`, `command`, `command_time`, `command_sig`)
+  SELECT `id`, `command_to_user`, `command_time`, `command_sig` FROM `rmd_users`
+  WHERE `command_to_user` IS NOT NULL AND `command_to_user` <> '';
+UPDATE `rmd_users` SET `command_to_user` = '', `command_time` = 0, `command_sig` = ''
+  WHERE `command_to_user` IS NOT NULL AND `command_to_user` <> '';
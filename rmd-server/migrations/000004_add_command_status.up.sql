@@ -0,0 +1,11 @@
+-- Keep delivered commands to track their status
+ALTER TABLE `pending_commands` RENAME TO `commands`;
+ALTER TABLE `commands` ADD COLUMN `status` text NOT NULL DEFAULT 'queued';
+ALTER TABLE `commands` ADD COLUMN `result` text NOT NULL DEFAULT '';
+ALTER TABLE `commands` ADD COLUMN `created_time` integer NOT NULL DEFAULT 0;
+ALTER TABLE `commands` ADD COLUMN `updated_time` integer NOT NULL DEFAULT 0;
+UPDATE `commands` SET `created_time` = strftime('%s', 'now'), `updated_time` = strftime('%s', 'now');
+
+DROP INDEX IF EXISTS `idx_pending_commands_user_id`;
+CREATE INDEX IF NOT EXISTS `idx_commands_user_id` ON `commands` (`user_id`);
+CREATE INDEX IF NOT EXISTS `idx_commands_status` ON `commands` (`status`);
@@ -0,0 +1,10 @@
+-- command_log_entries
+CREATE TABLE IF NOT EXISTS `command_log_entries` (
+  `id` integer PRIMARY KEY AUTOINCREMENT,
+  `user_id` integer,
+  `timestamp` integer,
+  `content` text,
+  CONSTRAINT `fk_rmd_users_command_logs` FOREIGN KEY (`user_id`) REFERENCES `rmd_users` (`id`) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS `idx_command_log_entries_user_id` ON `command_log_entries` (`user_id`);
+CREATE INDEX IF NOT EXISTS `idx_command_log_entries_timestamp` ON `command_log_entries` (`timestamp`);
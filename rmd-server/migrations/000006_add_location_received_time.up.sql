@@ -0,0 +1,3 @@
+-- Existing locations have no known received time, they keep 0
+ALTER TABLE `locations` ADD COLUMN `received_time` integer NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS `idx_locations_user_id_received_time` ON `locations` (`user_id`, `received_time`);
@@ -0,0 +1 @@
+ALTER TABLE `locations` ADD COLUMN `size` integer NOT NULL DEFAULT 0;
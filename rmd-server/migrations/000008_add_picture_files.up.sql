@@ -0,0 +1,14 @@
+-- Pictures are moved from `content` into files, the table only keeps the file name
+ALTER TABLE `pictures` ADD COLUMN `blob_name` text NOT NULL DEFAULT '';
+ALTER TABLE `pictures` ADD COLUMN `size` integer NOT NULL DEFAULT 0;
+
+-- picture_uploads
+CREATE TABLE IF NOT EXISTS `picture_uploads` (
+  `id` text,
+  `user_id` integer,
+  `size` integer,
+  `created_time` integer,
+  PRIMARY KEY (`id`),
+  CONSTRAINT `fk_rmd_users_picture_uploads` FOREIGN KEY (`user_id`) REFERENCES `rmd_users` (`id`) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS `idx_picture_uploads_user_id` ON `picture_uploads` (`user_id`);
@@ -0,0 +1,8 @@
+ALTER TABLE `pictures` ADD COLUMN `received_time` integer NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS `idx_pictures_received_time` ON `pictures` (`received_time`);
+CREATE INDEX IF NOT EXISTS `idx_locations_received_time` ON `locations` (`received_time`);
+
+-- The received time of old rows is unknown. Use the time of the migration,
+-- so that age-based retention deletes them at the latest after the maximum age.
+UPDATE `pictures` SET `received_time` = CAST(strftime('%s', 'now') AS integer) WHERE `received_time` = 0;
+UPDATE `locations` SET `received_time` = CAST(strftime('%s', 'now') AS integer) WHERE `received_time` = 0;
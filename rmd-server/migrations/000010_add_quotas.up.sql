@@ -0,0 +1,3 @@
+-- Per-account quota overrides in bytes. 0: use the server default, -1: unlimited
+ALTER TABLE `rmd_users` ADD COLUMN `location_quota` integer NOT NULL DEFAULT 0;
+ALTER TABLE `rmd_users` ADD COLUMN `picture_quota` integer NOT NULL DEFAULT 0;
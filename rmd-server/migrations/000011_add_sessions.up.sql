@@ -0,0 +1,18 @@
+-- sessions: only the SHA-256 hash of the access token is stored
+CREATE TABLE IF NOT EXISTS `sessions` (
+  `token_hash` text,
+  `user_id` text,
+  `creation_time` integer,
+  `expiration_time` integer,
+  PRIMARY KEY (`token_hash`)
+);
+CREATE INDEX IF NOT EXISTS `idx_sessions_user_id` ON `sessions` (`user_id`);
+CREATE INDEX IF NOT EXISTS `idx_sessions_expiration_time` ON `sessions` (`expiration_time`);
+
+-- login_locks: failed login attempts per account
+CREATE TABLE IF NOT EXISTS `login_locks` (
+  `user_id` text,
+  `failed_count` integer,
+  `expiration_time` integer,
+  PRIMARY KEY (`user_id`)
+);
@@ -0,0 +1 @@
+--- Deliberately not implemented
\ No newline at end of file
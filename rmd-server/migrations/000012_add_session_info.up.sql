@@ -0,0 +1,5 @@
+-- Public session id (for listing and revoking sessions), and where the session was created
+ALTER TABLE `sessions` ADD COLUMN `id` text NOT NULL DEFAULT '';
+ALTER TABLE `sessions` ADD COLUMN `remote_ip` text NOT NULL DEFAULT '';
+ALTER TABLE `sessions` ADD COLUMN `user_agent` text NOT NULL DEFAULT '';
+UPDATE `sessions` SET `id` = substr(`token_hash`, 1, 16) WHERE `id` = '';
@@ -0,0 +1,17 @@
+-- A session with a refresh token stays alive after its access token expired, until the refresh token expires
+ALTER TABLE `sessions` ADD COLUMN `refresh_expiration_time` integer NOT NULL DEFAULT 0;
+
+-- refresh_tokens: only the SHA-256 hash of the refresh token is stored.
+-- Used tokens are kept until they expire, to detect their reuse.
+CREATE TABLE IF NOT EXISTS `refresh_tokens` (
+  `token_hash` text,
+  `session_id` text,
+  `user_id` text,
+  `used` numeric NOT NULL DEFAULT false,
+  `creation_time` integer,
+  `expiration_time` integer,
+  PRIMARY KEY (`token_hash`)
+);
+CREATE INDEX IF NOT EXISTS `idx_refresh_tokens_session_id` ON `refresh_tokens` (`session_id`);
+CREATE INDEX IF NOT EXISTS `idx_refresh_tokens_user_id` ON `refresh_tokens` (`user_id`);
+CREATE INDEX IF NOT EXISTS `idx_refresh_tokens_expiration_time` ON `refresh_tokens` (`expiration_time`);
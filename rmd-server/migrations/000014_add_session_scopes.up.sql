@@ -0,0 +1,2 @@
+-- Space-separated scopes of the session. Empty means all scopes (this includes all existing sessions).
+ALTER TABLE `sessions` ADD COLUMN `scopes` text NOT NULL DEFAULT '';
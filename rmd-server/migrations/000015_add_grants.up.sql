@@ -0,0 +1,18 @@
+-- grants: delegated access of another account (grantee) to the owner's data
+CREATE TABLE IF NOT EXISTS `grants` (
+  `id` integer PRIMARY KEY AUTOINCREMENT,
+  `owner_id` integer,
+  `owner_uid` text,
+  `grantee_id` integer,
+  `grantee_uid` text,
+  `scopes` text,
+  `wrapped_key` text,
+  `created_time` integer,
+  CONSTRAINT `fk_rmd_users_grants` FOREIGN KEY (`owner_id`) REFERENCES `rmd_users` (`id`) ON DELETE CASCADE,
+  CONSTRAINT `fk_rmd_users_received_grants` FOREIGN KEY (`grantee_id`) REFERENCES `rmd_users` (`id`) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_grants_owner_grantee` ON `grants` (`owner_id`, `grantee_id`);
+CREATE INDEX IF NOT EXISTS `idx_grants_grantee_id` ON `grants` (`grantee_id`);
+
+-- Sessions of a grantee on the owner's account reference the grant
+ALTER TABLE `sessions` ADD COLUMN `grant_id` integer NOT NULL DEFAULT 0;
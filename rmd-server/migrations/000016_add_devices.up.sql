@@ -0,0 +1,31 @@
+-- devices: an account can have several devices, each with its own push URL, commands, locations and pictures
+CREATE TABLE IF NOT EXISTS `devices` (
+  `id` integer PRIMARY KEY AUTOINCREMENT,
+  `user_id` integer,
+  `device_id` text,
+  `name` text,
+  `push_url` text,
+  `last_seen_time` integer,
+  `created_time` integer,
+  CONSTRAINT `fk_rmd_users_devices` FOREIGN KEY (`user_id`) REFERENCES `rmd_users` (`id`) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_devices_user_device` ON `devices` (`user_id`, `device_id`);
+
+-- Every existing account gets a default device, which takes over the account's push URL and last seen time
+INSERT INTO `devices` (`user_id`, `device_id`, `name`, `push_url`, `last_seen_time`, `created_time`)
+  SELECT `id`, 'default', '', COALESCE(`push_url`, ''), `last_seen_time`, strftime('%s', 'now') FROM `rmd_users`;
+
+ALTER TABLE `locations` ADD COLUMN `device_id` integer NOT NULL DEFAULT 0;
+ALTER TABLE `pictures` ADD COLUMN `device_id` integer NOT NULL DEFAULT 0;
+ALTER TABLE `picture_uploads` ADD COLUMN `device_id` integer NOT NULL DEFAULT 0;
+ALTER TABLE `commands` ADD COLUMN `device_id` integer NOT NULL DEFAULT 0;
+
+UPDATE `locations` SET `device_id` = (SELECT `d`.`id` FROM `devices` `d` WHERE `d`.`user_id` = `locations`.`user_id` AND `d`.`device_id` = 'default');
+UPDATE `pictures` SET `device_id` = (SELECT `d`.`id` FROM `devices` `d` WHERE `d`.`user_id` = `pictures`.`user_id` AND `d`.`device_id` = 'default');
+UPDATE `picture_uploads` SET `device_id` = (SELECT `d`.`id` FROM `devices` `d` WHERE `d`.`user_id` = `picture_uploads`.`user_id` AND `d`.`device_id` = 'default');
+UPDATE `commands` SET `device_id` = (SELECT `d`.`id` FROM `devices` `d` WHERE `d`.`user_id` = `commands`.`user_id` AND `d`.`device_id` = 'default');
+
+CREATE INDEX IF NOT EXISTS `idx_locations_device_id` ON `locations` (`device_id`);
+CREATE INDEX IF NOT EXISTS `idx_pictures_device_id` ON `pictures` (`device_id`);
+CREATE INDEX IF NOT EXISTS `idx_picture_uploads_device_id` ON `picture_uploads` (`device_id`);
+CREATE INDEX IF NOT EXISTS `idx_commands_device_id` ON `commands` (`device_id`);
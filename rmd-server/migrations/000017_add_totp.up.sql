@@ -0,0 +1,29 @@
+-- TOTP second factor: the secret is encrypted with the server's TOTP key (see TotpKeyFile)
+ALTER TABLE `rmd_users` ADD COLUMN `totp_secret` text NOT NULL DEFAULT '';
+ALTER TABLE `rmd_users` ADD COLUMN `totp_enabled_time` integer NOT NULL DEFAULT 0;
+ALTER TABLE `rmd_users` ADD COLUMN `totp_last_counter` integer NOT NULL DEFAULT 0;
+
+-- recovery_codes: single-use codes to log in without the TOTP app
+CREATE TABLE IF NOT EXISTS `recovery_codes` (
+  `id` integer PRIMARY KEY AUTOINCREMENT,
+  `user_id` integer,
+  `code_hash` text,
+  `used_time` integer,
+  CONSTRAINT `fk_rmd_users_recovery_codes` FOREIGN KEY (`user_id`) REFERENCES `rmd_users` (`id`) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS `idx_recovery_codes_user_id` ON `recovery_codes` (`user_id`);
+
+-- device_credentials: let a device log in without TOTP, with limited scopes
+CREATE TABLE IF NOT EXISTS `device_credentials` (
+  `id` integer PRIMARY KEY AUTOINCREMENT,
+  `user_id` integer,
+  `device_id` integer,
+  `token_hash` text,
+  `scopes` text,
+  `created_time` integer,
+  `last_used_time` integer,
+  CONSTRAINT `fk_rmd_users_device_credentials` FOREIGN KEY (`user_id`) REFERENCES `rmd_users` (`id`) ON DELETE CASCADE,
+  CONSTRAINT `fk_devices_credential` FOREIGN KEY (`device_id`) REFERENCES `devices` (`id`) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_device_credentials_device_id` ON `device_credentials` (`device_id`);
+CREATE INDEX IF NOT EXISTS `idx_device_credentials_user_id` ON `device_credentials` (`user_id`);
@@ -0,0 +1,16 @@
+-- passkeys: WebAuthn credentials to log in without the password
+CREATE TABLE IF NOT EXISTS `passkeys` (
+  `id` integer PRIMARY KEY AUTOINCREMENT,
+  `user_id` integer,
+  `credential_id` text,
+  `public_key` text,
+  `algorithm` integer,
+  `sign_count` integer,
+  `name` text,
+  `release_key` numeric,
+  `created_time` integer,
+  `last_used_time` integer,
+  CONSTRAINT `fk_rmd_users_passkeys` FOREIGN KEY (`user_id`) REFERENCES `rmd_users` (`id`) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_passkeys_credential_id` ON `passkeys` (`credential_id`);
+CREATE INDEX IF NOT EXISTS `idx_passkeys_user_id` ON `passkeys` (`user_id`);
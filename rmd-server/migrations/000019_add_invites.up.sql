@@ -0,0 +1,15 @@
+-- invites: codes to register an account, replacing the single RegistrationToken
+CREATE TABLE IF NOT EXISTS `invites` (
+  `id` integer PRIMARY KEY AUTOINCREMENT,
+  `code_hash` text,
+  `username` text,
+  `note` text,
+  `max_uses` integer,
+  `uses` integer,
+  `created_time` integer,
+  `expiration_time` integer
+);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_invites_code_hash` ON `invites` (`code_hash`);
+
+-- The invite that an account was registered with (0 for none). Not a foreign key: deleting an invite keeps the record.
+ALTER TABLE `rmd_users` ADD COLUMN `invite_id` integer NOT NULL DEFAULT 0;
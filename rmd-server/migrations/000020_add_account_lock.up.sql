@@ -0,0 +1,3 @@
+-- Accounts that an admin locked (see "rmd-server user lock"). This is independent of the locks after failed logins.
+ALTER TABLE `rmd_users` ADD COLUMN `locked_time` integer NOT NULL DEFAULT 0;
+ALTER TABLE `rmd_users` ADD COLUMN `lock_reason` text NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- Sessions of a grantee on the owner's account reference the grantee's own session, they are revoked together with it
+ALTER TABLE `sessions` ADD COLUMN `parent_token_hash` text NOT NULL DEFAULT '';
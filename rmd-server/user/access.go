@@ -1,31 +1,92 @@
 package user
 
 import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"net"
 	"rmd-server/metrics"
+	"slices"
+	"sync"
 	"time"
+
+	"github.com/rs/zerolog/log"
 )
 
+// The AccessController is used concurrently by all HTTP handlers.
+//
+// Checking a token is by far the most common operation, it only takes the read lock.
+// Creating and removing sessions takes the write lock, but only to change the cache.
+// The store is written after releasing the lock, such that checking tokens does not wait for the database.
 type AccessController struct {
-	// map token values to token structs
+	// Sessions and locks are persisted in the store, so that they survive restarts.
+	// The maps below are a cache of the store. Every change is written through to the store.
+	// Other processes (the admin CLI) can also change the store, thus the cache is reloaded periodically.
+	store SessionStore
+
+	// Returns the current time. Injectable for tests.
+	now func() time.Time
+
+	// Serialises the writes to the store. It is taken before sessionsMu or locksMu, and held until
+	// the changes are written, such that the store sees them in the same order as the cache.
+	// While it is held, the changes to the store are queued in storeWrites (see persist).
+	storeMu     sync.Mutex
+	storeWrites []func()
+
+	sessionsMu sync.RWMutex
+
+	// map token hashes to sessions
 	// This is because a given user id can have multiple active sessions
 	// in parallel, for example, Android and web.
-	accessTokens map[string]AccessToken
+	sessions map[string]Session
+
+	// map user ids to the token hashes of their sessions
+	sessionsByUser tokenHashIndex
+
+	// map the token hashes of grantees' sessions to the token hashes of the sessions
+	// that were delegated from them (see CreateDelegatedAccess)
+	sessionsByParent tokenHashIndex
+
+	locksMu sync.Mutex
 
 	// map user ids to locks
-	lockedIDs map[string]LockedId
+	lockedIDs map[string]LoginLock
+
+	// Only one reload at a time
+	reloadMu sync.Mutex
+
+	// While reload reads the store, it does not hold sessionsMu and locksMu.
+	// Meanwhile, the changes to the cache are recorded here (nil for a removal), and replayed on top of what was read.
+	// Both are nil if no reload is running. They are protected by sessionsMu and locksMu, respectively.
+	reloadSessions map[string]*Session
+	reloadLocks    map[string]*LoginLock
 }
 
+// The access token as it is handed out to the client.
+// Only the hash of Token is stored on the server.
 type AccessToken struct {
 	DeviceId       string
 	Token          string
 	CreationTime   int64
 	ExpirationTime int64
+
+	// Only set if a refresh token was requested
+	RefreshToken          string `json:",omitempty"`
+	RefreshExpirationTime int64  `json:",omitempty"`
+
+	Scopes []Scope `json:",omitempty"`
 }
 
-type LockedId struct {
-	FailedCount    int
-	ExpirationTime int64
+// Parameters for creating a new session
+type SessionRequest struct {
+	DurationSeconds  uint64 // lifetime of the access token, 0 for the default
+	WithRefreshToken bool   // also create a refresh token (see RefreshAccessToken)
+	Scopes           string // encoded with EncodeScopes, empty for all scopes
+	RemoteIp         string
+	UserAgent        string
+	GrantId          uint64 // set if this is a grantee's session on the owner's account (see CreateDelegatedAccess)
+	ParentTokenHash  string // set together with GrantId: the TokenHash of the grantee's own session
 }
 
 const MAX_ALLOWED_ATTEMPTS = 5
@@ -34,17 +95,156 @@ const DURATION_LOCKED_SECS = 10 * 60          // 10 mins
 const DEFAULT_TOKEN_VALID_SECS = 15 * 60      // 15 mins
 const MAX_TOKEN_VALID_SECS = 7 * 24 * 60 * 60 // 1 week
 
-func NewAccessController() AccessController {
-	controller := AccessController{
-		accessTokens: make(map[string]AccessToken),
-		lockedIDs:    make(map[string]LockedId),
-	}
+// How often the cache is reloaded from the store (see reload)
+const RELOAD_INTERVAL = time.Minute
+
+// Every refresh issues a new refresh token, so a session that is refreshed regularly does not expire.
+const REFRESH_TOKEN_VALID_SECS = 30 * 24 * 60 * 60 // 30 days
+
+var ErrTokenNotFound = errors.New("token not found")
+var ErrTokenExpired = errors.New("token expired")
+var ErrRefreshTokenReused = errors.New("refresh token was already used")
+
+func NewAccessController(store SessionStore) *AccessController {
+	controller := newAccessController(store, time.Now)
 	go controller.cronRemoveExpired()
+	go controller.cronReload()
 	return controller
 }
 
+func newAccessController(store SessionStore, now func() time.Time) *AccessController {
+	controller := &AccessController{
+		store:            store,
+		now:              now,
+		sessions:         make(map[string]Session),
+		sessionsByUser:   make(tokenHashIndex),
+		sessionsByParent: make(tokenHashIndex),
+		lockedIDs:        make(map[string]LoginLock),
+	}
+	controller.removeExpired()
+	controller.load()
+	return controller
+}
+
+// Load the sessions and locks from the store, and initialise the metrics.
+func (a *AccessController) load() {
+	sessionCount, lockCount := a.reload()
+
+	log.Info().
+		Int("sessions", sessionCount).
+		Int("lockedIDs", lockCount).
+		Msg("loaded sessions")
+}
+
+// Replace the cache with the content of the store.
+// This picks up changes that other processes made to the store,
+// e.g., the admin CLI revoking the sessions of an account while the server is running.
+// Returns the number of sessions and locks.
+//
+// The store is read without holding the locks, such that checking tokens is not blocked by the database.
+func (a *AccessController) reload() (int, int) {
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+
+	// Changes made before this point are already written to the store
+	a.storeMu.Lock()
+	a.sessionsMu.Lock()
+	a.reloadSessions = make(map[string]*Session)
+	a.sessionsMu.Unlock()
+	a.locksMu.Lock()
+	a.reloadLocks = make(map[string]*LoginLock)
+	a.locksMu.Unlock()
+	a.storeMu.Unlock()
+
+	sessions := make(map[string]Session)
+	sessionsByUser := make(tokenHashIndex)
+	sessionsByParent := make(tokenHashIndex)
+	for _, session := range a.store.GetSessions() {
+		addSession(sessions, sessionsByUser, sessionsByParent, session)
+	}
+	lockedIDs := make(map[string]LoginLock)
+	for _, lock := range a.store.GetLoginLocks() {
+		lockedIDs[lock.UserID] = lock
+	}
+
+	a.sessionsMu.Lock()
+	for tokenHash, session := range a.reloadSessions {
+		if session != nil {
+			addSession(sessions, sessionsByUser, sessionsByParent, *session)
+		} else if removed, exists := sessions[tokenHash]; exists {
+			forgetSession(sessions, sessionsByUser, sessionsByParent, removed)
+		}
+	}
+	a.reloadSessions = nil
+	a.sessions = sessions
+	a.sessionsByUser = sessionsByUser
+	a.sessionsByParent = sessionsByParent
+	sessionCount := len(a.sessions)
+	a.sessionsMu.Unlock()
+
+	a.locksMu.Lock()
+	for userId, lock := range a.reloadLocks {
+		if lock != nil {
+			lockedIDs[userId] = *lock
+		} else {
+			delete(lockedIDs, userId)
+		}
+	}
+	a.reloadLocks = nil
+	a.lockedIDs = lockedIDs
+	lockCount := len(a.lockedIDs)
+	a.locksMu.Unlock()
+
+	metrics.ActiveSessions.Set(float64(sessionCount))
+	metrics.FailedLoginAccounts.Set(float64(lockCount))
+	return sessionCount, lockCount
+}
+
+// The caller must hold locksMu.
+func (a *AccessController) setLockLocked(lock LoginLock) {
+	a.lockedIDs[lock.UserID] = lock
+	if a.reloadLocks != nil {
+		a.reloadLocks[lock.UserID] = &lock
+	}
+}
+
+// The caller must hold locksMu.
+func (a *AccessController) deleteLockLocked(userId string) {
+	delete(a.lockedIDs, userId)
+	if a.reloadLocks != nil {
+		a.reloadLocks[userId] = nil
+	}
+}
+
+// Queue a write to the store, it is run by unlockStore.
+// The caller must hold storeMu.
+func (a *AccessController) persist(write func()) {
+	a.storeWrites = append(a.storeWrites, write)
+}
+
+// Run the queued writes to the store, and release storeMu.
+// The caller must not hold sessionsMu or locksMu anymore.
+func (a *AccessController) unlockStore() {
+	writes := a.storeWrites
+	a.storeWrites = nil
+	for _, write := range writes {
+		write()
+	}
+	a.storeMu.Unlock()
+}
+
+func hashAccessToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
 func (a *AccessController) IncrementLock(userId string) {
-	now := time.Now().Unix()
+	a.storeMu.Lock()
+	defer a.unlockStore()
+	a.locksMu.Lock()
+	defer a.locksMu.Unlock()
+
+	now := a.now().Unix()
 	lId, exists := a.lockedIDs[userId]
 
 	if exists {
@@ -55,14 +255,16 @@ func (a *AccessController) IncrementLock(userId string) {
 			lId.FailedCount++
 		}
 	} else {
-		lId = LockedId{
+		lId = LoginLock{
+			UserID:      userId,
 			FailedCount: 1,
 		}
 	}
 	// Extend lock time
 	lId.ExpirationTime = now + DURATION_LOCKED_SECS
 
-	a.lockedIDs[userId] = lId
+	a.setLockLocked(lId)
+	a.persist(func() { a.store.SaveLoginLock(&lId) })
 
 	// It is fiddly to distinguish between "locked accounts" (attemps >= 5)
 	// and "accounts with failed login attempts".
@@ -71,12 +273,41 @@ func (a *AccessController) IncrementLock(userId string) {
 }
 
 func (a *AccessController) ResetLock(userId string) {
-	delete(a.lockedIDs, userId)
+	a.resetLock(userId, false)
+}
+
+// Remove the lock of the user. If onlyExpired is set, an unexpired lock is kept.
+func (a *AccessController) resetLock(userId string, onlyExpired bool) {
+	a.storeMu.Lock()
+	defer a.unlockStore()
+	a.locksMu.Lock()
+	defer a.locksMu.Unlock()
+
+	lock, exists := a.lockedIDs[userId]
+	if !exists || (onlyExpired && lock.ExpirationTime >= a.now().Unix()) {
+		return
+	}
+	a.deleteLockLocked(userId)
+	a.persist(func() { a.store.DeleteLoginLock(userId) })
 	metrics.FailedLoginAccounts.Set(float64(len(a.lockedIDs)))
 }
 
+// Returns the failed login attempts of the user, or nil if there are none.
+func (a *AccessController) GetLoginLock(userId string) *LoginLock {
+	a.locksMu.Lock()
+	defer a.locksMu.Unlock()
+
+	lock, exists := a.lockedIDs[userId]
+	if !exists || lock.ExpirationTime < a.now().Unix() {
+		return nil
+	}
+	return &lock
+}
+
 func (a *AccessController) IsLocked(id string) bool {
+	a.locksMu.Lock()
 	lId, exists := a.lockedIDs[id]
+	a.locksMu.Unlock()
 
 	if !exists {
 		return false
@@ -86,10 +317,10 @@ func (a *AccessController) IsLocked(id string) bool {
 		return false
 	}
 
-	lockExpired := lId.ExpirationTime < time.Now().Unix()
+	lockExpired := lId.ExpirationTime < a.now().Unix()
 	if lockExpired {
-		delete(a.lockedIDs, id)
-		metrics.FailedLoginAccounts.Set(float64(len(a.lockedIDs)))
+		// The lock may have been renewed in the meantime
+		a.resetLock(id, true)
 		return false
 	}
 
@@ -97,78 +328,496 @@ func (a *AccessController) IsLocked(id string) bool {
 }
 
 func (a *AccessController) CheckAccessToken(tokenToCheck string) (string, error) {
-	tk, exists := a.accessTokens[tokenToCheck]
+	session, err := a.checkSession(tokenToCheck)
+	if err != nil {
+		return "", err
+	}
+	return session.UserID, nil
+}
+
+// Like CheckAccessToken, but the token must also have the scope.
+// Returns ErrScopeMissing if the token is valid but lacks the scope.
+func (a *AccessController) CheckAccessTokenScope(tokenToCheck string, scope Scope) (string, error) {
+	session, err := a.checkSession(tokenToCheck)
+	if err != nil {
+		return "", err
+	}
+	if !session.HasScope(scope) {
+		return "", ErrScopeMissing
+	}
+	return session.UserID, nil
+}
+
+func (a *AccessController) checkSession(tokenToCheck string) (*Session, error) {
+	tokenHash := hashAccessToken(tokenToCheck)
+
+	a.sessionsMu.RLock()
+	session, exists := a.sessions[tokenHash]
+	a.sessionsMu.RUnlock()
 
 	if !exists {
-		return "", errors.New("token not found")
+		return nil, ErrTokenNotFound
 	}
 
-	tokenExpired := tk.ExpirationTime < time.Now().Unix()
+	now := a.now().Unix()
+	tokenExpired := session.ExpirationTime < now
 	if tokenExpired {
-		delete(a.accessTokens, tokenToCheck)
-		metrics.ActiveSessions.Set(float64(len(a.accessTokens)))
-		return "", errors.New("token expired")
+		// Keep the session if it can still be refreshed
+		if session.isExpired(now) {
+			a.storeMu.Lock()
+			a.sessionsMu.Lock()
+			a.removeSessionLocked(tokenHash)
+			a.sessionsMu.Unlock()
+			a.unlockStore()
+		}
+		return nil, ErrTokenExpired
 	}
 
-	return tk.DeviceId, nil
+	return &session, nil
 }
 
-func (a *AccessController) CreateNewAccessToken(id string, sessionDurationSeconds uint64) AccessToken {
+// Longer User-Agents are truncated
+const MAX_USER_AGENT_LENGTH = 256
+
+// Whether neither the access token nor the refresh token of the session can be used anymore
+func (s *Session) isExpired(now int64) bool {
+	return s.ExpirationTime < now && s.RefreshExpirationTime < now
+}
+
+func clampSessionDuration(sessionDurationSeconds uint64) int64 {
 	if sessionDurationSeconds == 0 {
-		sessionDurationSeconds = DEFAULT_TOKEN_VALID_SECS
+		return DEFAULT_TOKEN_VALID_SECS
 	} else if sessionDurationSeconds > MAX_TOKEN_VALID_SECS {
-		sessionDurationSeconds = MAX_TOKEN_VALID_SECS
+		return MAX_TOKEN_VALID_SECS
 	}
+	return int64(sessionDurationSeconds)
+}
 
+// Create a new session for the user id.
+func (a *AccessController) CreateNewAccessToken(id string, request SessionRequest) AccessToken {
 	// long enough to be guaranteed to be unique
 	tokenValue := genRandomString(32)
-	now := time.Now().Unix()
+	now := a.now().Unix()
+
+	// Only keep the IP, the port is meaningless to the user
+	remoteIp := request.RemoteIp
+	host, _, err := net.SplitHostPort(remoteIp)
+	if err == nil {
+		remoteIp = host
+	}
+	userAgent := request.UserAgent
+	if len(userAgent) > MAX_USER_AGENT_LENGTH {
+		userAgent = userAgent[:MAX_USER_AGENT_LENGTH]
+	}
+
+	session := Session{
+		TokenHash:       hashAccessToken(tokenValue),
+		Id:              genRandomString(16),
+		UserID:          id,
+		CreationTime:    now,
+		ExpirationTime:  now + clampSessionDuration(request.DurationSeconds),
+		RemoteIp:        remoteIp,
+		UserAgent:       userAgent,
+		Scopes:          request.Scopes,
+		GrantId:         request.GrantId,
+		ParentTokenHash: request.ParentTokenHash,
+	}
+
+	refreshTokenValue := ""
+	if request.WithRefreshToken {
+		refreshTokenValue = genRandomString(32)
+		session.RefreshExpirationTime = now + REFRESH_TOKEN_VALID_SECS
+	}
+
+	a.storeMu.Lock()
+	a.sessionsMu.Lock()
+	a.addSessionLocked(session)
+	a.persistSession(session)
+	if request.WithRefreshToken {
+		a.persistRefreshToken(session, refreshTokenValue)
+	}
+	metrics.ActiveSessions.Set(float64(len(a.sessions)))
+	a.sessionsMu.Unlock()
+	a.unlockStore()
+
+	return newAccessToken(&session, tokenValue, refreshTokenValue)
+}
 
+func newAccessToken(session *Session, tokenValue string, refreshTokenValue string) AccessToken {
 	token := AccessToken{
-		DeviceId:       id,
+		DeviceId:       session.UserID,
 		Token:          tokenValue,
-		CreationTime:   now,
-		ExpirationTime: now + int64(sessionDurationSeconds),
+		CreationTime:   session.CreationTime,
+		ExpirationTime: session.ExpirationTime,
+		Scopes:         session.GetScopes(),
+	}
+	if refreshTokenValue != "" {
+		token.RefreshToken = refreshTokenValue
+		token.RefreshExpirationTime = session.RefreshExpirationTime
 	}
-
-	a.accessTokens[tokenValue] = token
-	metrics.ActiveSessions.Set(float64(len(a.accessTokens)))
 	return token
 }
 
-// Remove expired tokens and locks from the controller.
+// The caller must hold storeMu.
+func (a *AccessController) persistSession(session Session) {
+	a.persist(func() { a.store.SaveSession(&session) })
+}
+
+// The caller must hold storeMu.
+func (a *AccessController) persistRefreshToken(session Session, refreshTokenValue string) {
+	refreshToken := RefreshToken{
+		TokenHash:      hashAccessToken(refreshTokenValue),
+		SessionId:      session.Id,
+		UserID:         session.UserID,
+		CreationTime:   a.now().Unix(),
+		ExpirationTime: session.RefreshExpirationTime,
+	}
+	a.persist(func() { a.store.SaveRefreshToken(&refreshToken) })
+}
+
+// Exchange a refresh token for a new access token and a new refresh token.
+// The session keeps its id, but the old access token and refresh token become invalid.
+//
+// A refresh token can only be used once. If a used refresh token is presented again,
+// either the legitimate client or an attacker has a stolen copy.
+// Since the server cannot know which one it is talking to, the whole session is revoked.
+func (a *AccessController) RefreshAccessToken(refreshTokenValue string, sessionDurationSeconds uint64) (AccessToken, error) {
+	// Holding storeMu, the refresh token cannot be used concurrently
+	a.storeMu.Lock()
+	defer a.unlockStore()
+
+	now := a.now().Unix()
+	refreshToken := a.store.GetRefreshToken(hashAccessToken(refreshTokenValue))
+	if refreshToken == nil {
+		return AccessToken{}, ErrTokenNotFound
+	}
+
+	a.sessionsMu.Lock()
+	defer a.sessionsMu.Unlock()
+
+	oldSession := a.findSessionLocked(refreshToken.UserID, refreshToken.SessionId)
+
+	if refreshToken.Used {
+		log.Warn().
+			Str("userid", refreshToken.UserID).
+			Str("sessionId", refreshToken.SessionId).
+			Msg("refresh token reused, revoking session")
+		if oldSession != nil {
+			a.removeSessionLocked(oldSession.TokenHash)
+		} else {
+			a.persist(func() { a.store.DeleteRefreshTokensOfSession(refreshToken.SessionId) })
+		}
+		return AccessToken{}, ErrRefreshTokenReused
+	}
+	if refreshToken.ExpirationTime < now {
+		return AccessToken{}, ErrTokenExpired
+	}
+	if oldSession == nil {
+		// The session was revoked
+		return AccessToken{}, ErrTokenNotFound
+	}
+
+	refreshToken.Used = true
+	a.persist(func() { a.store.SaveRefreshToken(refreshToken) })
+
+	tokenValue := genRandomString(32)
+	newRefreshTokenValue := genRandomString(32)
+
+	session := *oldSession
+	session.TokenHash = hashAccessToken(tokenValue)
+	session.ExpirationTime = now + clampSessionDuration(sessionDurationSeconds)
+	session.RefreshExpirationTime = now + REFRESH_TOKEN_VALID_SECS
+
+	a.forgetSessionLocked(*oldSession)
+	a.persist(func() { a.store.DeleteSession(oldSession.TokenHash) })
+	a.addSessionLocked(session)
+	a.persistSession(session)
+	a.persistRefreshToken(session, newRefreshTokenValue)
+
+	// The delegated sessions stay linked to the session
+	for _, tokenHash := range a.sessionsByParent.get(oldSession.TokenHash) {
+		delegated := a.sessions[tokenHash]
+		delegated.ParentTokenHash = session.TokenHash
+		a.addSessionLocked(delegated)
+		a.persistSession(delegated)
+	}
+
+	return newAccessToken(&session, tokenValue, newRefreshTokenValue), nil
+}
+
+// Returns the session with the given (public) id, or nil.
+// The caller must hold sessionsMu.
+func (a *AccessController) findSessionLocked(userId string, sessionId string) *Session {
+	for tokenHash := range a.sessionsByUser[userId] {
+		session := a.sessions[tokenHash]
+		if session.Id == sessionId {
+			return &session
+		}
+	}
+	return nil
+}
+
+// Returns the session of the token, or nil if the token is not valid.
+func (a *AccessController) GetSession(token string) *Session {
+	a.sessionsMu.RLock()
+	defer a.sessionsMu.RUnlock()
+
+	session, exists := a.sessions[hashAccessToken(token)]
+	if !exists || session.ExpirationTime < a.now().Unix() {
+		return nil
+	}
+	return &session
+}
+
+// Returns the unexpired sessions of the user, oldest first.
+func (a *AccessController) GetSessionsOfUser(userId string) []Session {
+	a.sessionsMu.RLock()
+	defer a.sessionsMu.RUnlock()
+
+	now := a.now().Unix()
+	sessions := []Session{}
+	for tokenHash := range a.sessionsByUser[userId] {
+		session := a.sessions[tokenHash]
+		if !session.isExpired(now) {
+			sessions = append(sessions, session)
+		}
+	}
+	slices.SortFunc(sessions, func(x, y Session) int {
+		return cmp.Compare(x.CreationTime, y.CreationTime)
+	})
+	return sessions
+}
+
+// Revoke the session with the given (public) id.
+// Returns false if the user has no such session.
+func (a *AccessController) RevokeSession(userId string, sessionId string) bool {
+	a.storeMu.Lock()
+	defer a.unlockStore()
+	a.sessionsMu.Lock()
+	defer a.sessionsMu.Unlock()
+
+	session := a.findSessionLocked(userId, sessionId)
+	if session == nil {
+		return false
+	}
+	a.removeSessionLocked(session.TokenHash)
+	return true
+}
+
+// Revoke all sessions of the user, except the session of the given token.
+// Returns the number of revoked sessions.
+func (a *AccessController) RevokeOtherSessions(userId string, keepToken string) int {
+	a.storeMu.Lock()
+	defer a.unlockStore()
+	a.sessionsMu.Lock()
+	defer a.sessionsMu.Unlock()
+
+	keepTokenHash := hashAccessToken(keepToken)
+	revoked := make(map[string]struct{})
+	for tokenHash := range a.sessionsByUser[userId] {
+		if tokenHash != keepTokenHash {
+			session := a.sessions[tokenHash]
+			a.forgetSessionLocked(session)
+			a.persist(func() { a.store.DeleteRefreshTokensOfSession(session.Id) })
+			revoked[tokenHash] = struct{}{}
+		}
+	}
+	a.persist(func() { a.store.DeleteSessionsOfUserExcept(userId, keepTokenHash) })
+	a.removeDelegatedSessionsLocked(revoked)
+
+	metrics.ActiveSessions.Set(float64(len(a.sessions)))
+	return len(revoked)
+}
+
+// Revoke all sessions that were created for the grant.
+// Returns the number of revoked sessions.
+func (a *AccessController) RevokeGrantSessions(userId string, grantId uint64) int {
+	a.storeMu.Lock()
+	defer a.unlockStore()
+	a.sessionsMu.Lock()
+	defer a.sessionsMu.Unlock()
+
+	tokenHashes := []string{}
+	for tokenHash := range a.sessionsByUser[userId] {
+		if a.sessions[tokenHash].GrantId == grantId {
+			tokenHashes = append(tokenHashes, tokenHash)
+		}
+	}
+	for _, tokenHash := range tokenHashes {
+		a.removeSessionLocked(tokenHash)
+	}
+	return len(tokenHashes)
+}
+
+// The caller must hold sessionsMu for writing.
+func (a *AccessController) addSessionLocked(session Session) {
+	addSession(a.sessions, a.sessionsByUser, a.sessionsByParent, session)
+	if a.reloadSessions != nil {
+		a.reloadSessions[session.TokenHash] = &session
+	}
+}
+
+func addSession(sessions map[string]Session, sessionsByUser tokenHashIndex, sessionsByParent tokenHashIndex, session Session) {
+	if previous, exists := sessions[session.TokenHash]; exists {
+		// The session is updated, e.g., it was linked to another parent
+		forgetSession(sessions, sessionsByUser, sessionsByParent, previous)
+	}
+	sessions[session.TokenHash] = session
+	sessionsByUser.add(session.UserID, session.TokenHash)
+	if session.ParentTokenHash != "" {
+		sessionsByParent.add(session.ParentTokenHash, session.TokenHash)
+	}
+}
+
+// Remove the session and its delegated sessions from the cache and from the store.
+// The caller must hold storeMu, and sessionsMu for writing.
+func (a *AccessController) removeSessionLocked(tokenHash string) {
+	session, exists := a.sessions[tokenHash]
+	if !exists {
+		// Already removed by a concurrent request
+		return
+	}
+	a.deleteSessionLocked(session)
+	a.removeDelegatedSessionsLocked(map[string]struct{}{tokenHash: {}})
+	metrics.ActiveSessions.Set(float64(len(a.sessions)))
+}
+
+// Remove the session from the cache and from the store.
+// The caller must hold storeMu, and sessionsMu for writing.
+func (a *AccessController) deleteSessionLocked(session Session) {
+	a.forgetSessionLocked(session)
+	a.persist(func() {
+		a.store.DeleteSession(session.TokenHash)
+		a.store.DeleteRefreshTokensOfSession(session.Id)
+	})
+}
+
+// Remove the sessions that were delegated from one of the given sessions (see CreateDelegatedAccess).
+// The caller must hold storeMu, and sessionsMu for writing.
+func (a *AccessController) removeDelegatedSessionsLocked(parentTokenHashes map[string]struct{}) {
+	for parentTokenHash := range parentTokenHashes {
+		for _, tokenHash := range a.sessionsByParent.get(parentTokenHash) {
+			a.deleteSessionLocked(a.sessions[tokenHash])
+		}
+	}
+}
+
+// Remove the session from the cache only.
+// The caller must hold sessionsMu for writing.
+func (a *AccessController) forgetSessionLocked(session Session) {
+	forgetSession(a.sessions, a.sessionsByUser, a.sessionsByParent, session)
+	if a.reloadSessions != nil {
+		a.reloadSessions[session.TokenHash] = nil
+	}
+}
+
+func forgetSession(sessions map[string]Session, sessionsByUser tokenHashIndex, sessionsByParent tokenHashIndex, session Session) {
+	delete(sessions, session.TokenHash)
+	sessionsByUser.remove(session.UserID, session.TokenHash)
+	if session.ParentTokenHash != "" {
+		sessionsByParent.remove(session.ParentTokenHash, session.TokenHash)
+	}
+}
+
+// Maps a key (e.g., a user id) to a set of token hashes
+type tokenHashIndex map[string]map[string]struct{}
+
+func (i tokenHashIndex) add(key string, tokenHash string) {
+	tokenHashes, exists := i[key]
+	if !exists {
+		tokenHashes = make(map[string]struct{})
+		i[key] = tokenHashes
+	}
+	tokenHashes[tokenHash] = struct{}{}
+}
+
+func (i tokenHashIndex) remove(key string, tokenHash string) {
+	tokenHashes := i[key]
+	delete(tokenHashes, tokenHash)
+	if len(tokenHashes) == 0 {
+		delete(i, key)
+	}
+}
+
+// Returns a copy of the token hashes of the key, such that the index can be changed while iterating over them.
+func (i tokenHashIndex) get(key string) []string {
+	tokenHashes := make([]string, 0, len(i[key]))
+	for tokenHash := range i[key] {
+		tokenHashes = append(tokenHashes, tokenHash)
+	}
+	return tokenHashes
+}
+
 func (a *AccessController) cronRemoveExpired() {
 	for range time.Tick(15 * time.Minute) {
-		now := time.Now().Unix()
-
-		// Remove expired access tokens
-		// Note the deleting elements while iterating over the map is safe:
-		// https://stackoverflow.com/a/23230406/11076036
-		for key, value := range a.accessTokens {
-			if value.ExpirationTime < now {
-				delete(a.accessTokens, key)
-			}
-		}
+		a.removeExpired()
+	}
+}
+
+func (a *AccessController) cronReload() {
+	for range time.Tick(RELOAD_INTERVAL) {
+		a.reload()
+	}
+}
+
+// Remove expired sessions and locks from the store and from the controller.
+func (a *AccessController) removeExpired() {
+	now := a.now().Unix()
+
+	a.storeMu.Lock()
+	defer a.storeMu.Unlock()
 
-		// Remove expired locks
-		for key, value := range a.lockedIDs {
-			if value.ExpirationTime < now {
-				delete(a.lockedIDs, key)
-			}
+	a.sessionsMu.Lock()
+	// Note the deleting elements while iterating over the map is safe:
+	// https://stackoverflow.com/a/23230406/11076036
+	for _, session := range a.sessions {
+		if session.isExpired(now) {
+			a.forgetSessionLocked(session)
 		}
+	}
+	sessionCount := len(a.sessions)
+	a.sessionsMu.Unlock()
 
-		metrics.ActiveSessions.Set(float64(len(a.accessTokens)))
-		metrics.FailedLoginAccounts.Set(float64(len(a.lockedIDs)))
+	a.locksMu.Lock()
+	for key, value := range a.lockedIDs {
+		if value.ExpirationTime < now {
+			a.deleteLockLocked(key)
+		}
+	}
+	lockCount := len(a.lockedIDs)
+	a.locksMu.Unlock()
+
+	deletedSessions := a.store.DeleteSessionsExpiredBefore(now)
+	a.store.DeleteRefreshTokensExpiredBefore(now)
+	deletedLocks := a.store.DeleteLoginLocksExpiredBefore(now)
+
+	if deletedSessions > 0 || deletedLocks > 0 {
+		log.Debug().
+			Int64("sessions", deletedSessions).
+			Int64("lockedIDs", deletedLocks).
+			Msg("removed expired sessions")
 	}
+
+	metrics.ActiveSessions.Set(float64(sessionCount))
+	metrics.FailedLoginAccounts.Set(float64(lockCount))
 }
 
 func (a *AccessController) ResetTokensForUser(userId string) {
-	// XXX: This is not very efficient
-	for key, value := range a.accessTokens {
-		if value.DeviceId == userId {
-			delete(a.accessTokens, key)
-		}
+	a.storeMu.Lock()
+	defer a.unlockStore()
+	a.sessionsMu.Lock()
+	defer a.sessionsMu.Unlock()
+
+	revoked := make(map[string]struct{})
+	for tokenHash := range a.sessionsByUser[userId] {
+		a.forgetSessionLocked(a.sessions[tokenHash])
+		revoked[tokenHash] = struct{}{}
 	}
+	a.persist(func() {
+		a.store.DeleteSessionsOfUser(userId)
+		a.store.DeleteRefreshTokensOfUser(userId)
+	})
+	a.removeDelegatedSessionsLocked(revoked)
 
-	metrics.ActiveSessions.Set(float64(len(a.accessTokens)))
+	metrics.ActiveSessions.Set(float64(len(a.sessions)))
 }
@@ -0,0 +1,893 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"rmd-server/blobstore"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	os.Exit(m.Run())
+}
+
+// In-memory SessionStore for testing the AccessController without a database
+type memorySessionStore struct {
+	mu            sync.Mutex
+	sessions      map[string]Session
+	refreshTokens map[string]RefreshToken
+	locks         map[string]LoginLock
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{
+		sessions:      make(map[string]Session),
+		refreshTokens: make(map[string]RefreshToken),
+		locks:         make(map[string]LoginLock),
+	}
+}
+
+func (m *memorySessionStore) GetSessions() []Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sessions := []Session{}
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+func (m *memorySessionStore) SaveSession(session *Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[session.TokenHash] = *session
+}
+
+func (m *memorySessionStore) DeleteSession(tokenHash string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, tokenHash)
+}
+
+func (m *memorySessionStore) DeleteSessionsOfUser(userId string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, s := range m.sessions {
+		if s.UserID == userId {
+			delete(m.sessions, key)
+		}
+	}
+}
+
+func (m *memorySessionStore) DeleteSessionsOfUserExcept(userId string, keepTokenHash string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, s := range m.sessions {
+		if s.UserID == userId && key != keepTokenHash {
+			delete(m.sessions, key)
+		}
+	}
+}
+
+func (m *memorySessionStore) DeleteSessionsExpiredBefore(before int64) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var count int64
+	for key, s := range m.sessions {
+		if s.isExpired(before) {
+			delete(m.sessions, key)
+			count++
+		}
+	}
+	return count
+}
+
+func (m *memorySessionStore) GetRefreshToken(tokenHash string) *RefreshToken {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token, exists := m.refreshTokens[tokenHash]
+	if !exists {
+		return nil
+	}
+	return &token
+}
+
+func (m *memorySessionStore) SaveRefreshToken(token *RefreshToken) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refreshTokens[token.TokenHash] = *token
+}
+
+func (m *memorySessionStore) DeleteRefreshTokensOfSession(sessionId string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, t := range m.refreshTokens {
+		if t.SessionId == sessionId {
+			delete(m.refreshTokens, key)
+		}
+	}
+}
+
+func (m *memorySessionStore) DeleteRefreshTokensOfUser(userId string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, t := range m.refreshTokens {
+		if t.UserID == userId {
+			delete(m.refreshTokens, key)
+		}
+	}
+}
+
+func (m *memorySessionStore) DeleteRefreshTokensExpiredBefore(before int64) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var count int64
+	for key, t := range m.refreshTokens {
+		if t.ExpirationTime < before {
+			delete(m.refreshTokens, key)
+			count++
+		}
+	}
+	return count
+}
+
+func (m *memorySessionStore) GetLoginLocks() []LoginLock {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	locks := []LoginLock{}
+	for _, l := range m.locks {
+		locks = append(locks, l)
+	}
+	return locks
+}
+
+func (m *memorySessionStore) SaveLoginLock(lock *LoginLock) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.locks[lock.UserID] = *lock
+}
+
+func (m *memorySessionStore) DeleteLoginLock(userId string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.locks, userId)
+}
+
+func (m *memorySessionStore) DeleteLoginLocksExpiredBefore(before int64) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var count int64
+	for key, l := range m.locks {
+		if l.ExpirationTime < before {
+			delete(m.locks, key)
+			count++
+		}
+	}
+	return count
+}
+
+// SessionStore that does not store anything.
+// Used for benchmarking the AccessController itself.
+type discardSessionStore struct{}
+
+func (discardSessionStore) GetSessions() []Session                                         { return nil }
+func (discardSessionStore) SaveSession(session *Session)                                   {}
+func (discardSessionStore) DeleteSession(tokenHash string)                                 {}
+func (discardSessionStore) DeleteSessionsOfUser(userId string)                             {}
+func (discardSessionStore) DeleteSessionsOfUserExcept(userId string, keepTokenHash string) {}
+func (discardSessionStore) DeleteSessionsExpiredBefore(before int64) int64                 { return 0 }
+func (discardSessionStore) GetRefreshToken(tokenHash string) *RefreshToken                 { return nil }
+func (discardSessionStore) SaveRefreshToken(token *RefreshToken)                           {}
+func (discardSessionStore) DeleteRefreshTokensOfSession(sessionId string)                  {}
+func (discardSessionStore) DeleteRefreshTokensOfUser(userId string)                        {}
+func (discardSessionStore) DeleteRefreshTokensExpiredBefore(before int64) int64 {
+	return 0
+}
+func (discardSessionStore) GetLoginLocks() []LoginLock                       { return nil }
+func (discardSessionStore) SaveLoginLock(lock *LoginLock)                    {}
+func (discardSessionStore) DeleteLoginLock(userId string)                    {}
+func (discardSessionStore) DeleteLoginLocksExpiredBefore(before int64) int64 { return 0 }
+
+// A clock that only moves when the test says so
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestAccessController() (*AccessController, *memorySessionStore, *fakeClock) {
+	store := newMemorySessionStore()
+	clock := &fakeClock{now: time.Unix(1_000_000, 0)}
+	return newAccessController(store, clock.Now), store, clock
+}
+
+func TestAccessTokenExpiry(t *testing.T) {
+	a, store, clock := newTestAccessController()
+
+	token := a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: 60})
+	if _, exists := store.sessions[token.Token]; exists {
+		t.Fatal("store contains the plaintext token")
+	}
+
+	userId, err := a.CheckAccessToken(token.Token)
+	if err != nil || userId != "alice" {
+		t.Fatalf("userId=%s err=%v", userId, err)
+	}
+
+	clock.Advance(61 * time.Second)
+	_, err = a.CheckAccessToken(token.Token)
+	if err != ErrTokenExpired {
+		t.Errorf("expected ErrTokenExpired, got %v", err)
+	}
+	if len(store.sessions) != 0 {
+		t.Errorf("expired session was not removed from the store")
+	}
+
+	_, err = a.CheckAccessToken(token.Token)
+	if err != ErrTokenNotFound {
+		t.Errorf("expected ErrTokenNotFound, got %v", err)
+	}
+}
+
+func TestAccessTokenDuration(t *testing.T) {
+	a, _, clock := newTestAccessController()
+	now := clock.Now().Unix()
+
+	token := a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: 0})
+	if token.ExpirationTime != now+DEFAULT_TOKEN_VALID_SECS {
+		t.Errorf("default duration: ExpirationTime=%d", token.ExpirationTime)
+	}
+
+	token = a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: MAX_TOKEN_VALID_SECS + 1})
+	if token.ExpirationTime != now+MAX_TOKEN_VALID_SECS {
+		t.Errorf("max duration: ExpirationTime=%d", token.ExpirationTime)
+	}
+}
+
+func TestAccessControllerLoadsFromStore(t *testing.T) {
+	a, store, clock := newTestAccessController()
+	token := a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: 60})
+	expired := a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: 10})
+	for i := 0; i <= MAX_ALLOWED_ATTEMPTS; i++ {
+		a.IncrementLock("bob")
+	}
+
+	// Simulate a restart
+	clock.Advance(30 * time.Second)
+	b := newAccessController(store, clock.Now)
+
+	if _, err := b.CheckAccessToken(token.Token); err != nil {
+		t.Errorf("session did not survive the restart: %v", err)
+	}
+	if _, err := b.CheckAccessToken(expired.Token); err != ErrTokenNotFound {
+		t.Errorf("expired session was loaded: %v", err)
+	}
+	if !b.IsLocked("bob") {
+		t.Error("lock did not survive the restart")
+	}
+}
+
+func TestReloadFromStore(t *testing.T) {
+	a, store, _ := newTestAccessController()
+	token := a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: 60})
+	a.IncrementLock("bob")
+
+	// Another process changes the store
+	store.DeleteSessionsOfUser("alice")
+	store.DeleteLoginLock("bob")
+	store.SaveLoginLock(&LoginLock{UserID: "carol", FailedCount: MAX_ALLOWED_ATTEMPTS + 1, ExpirationTime: a.now().Unix() + 60})
+
+	if _, err := a.CheckAccessToken(token.Token); err != nil {
+		t.Fatalf("session was removed before the reload: %v", err)
+	}
+	a.reload()
+
+	if _, err := a.CheckAccessToken(token.Token); err != ErrTokenNotFound {
+		t.Errorf("revoked session is still valid after the reload: %v", err)
+	}
+	if len(a.sessionsByUser) != 0 {
+		t.Error("revoked session is still in the user index")
+	}
+	if a.GetLoginLock("bob") != nil {
+		t.Error("deleted lock is still cached")
+	}
+	if !a.IsLocked("carol") {
+		t.Error("new lock was not loaded")
+	}
+}
+
+// Runs a function after reading the locks (reload reads them last),
+// to simulate requests while reload reads the store
+type slowSessionStore struct {
+	*memorySessionStore
+	afterRead func()
+}
+
+func (s *slowSessionStore) GetLoginLocks() []LoginLock {
+	locks := s.memorySessionStore.GetLoginLocks()
+	if s.afterRead != nil {
+		s.afterRead()
+	}
+	return locks
+}
+
+func TestReloadKeepsConcurrentChanges(t *testing.T) {
+	store := &slowSessionStore{memorySessionStore: newMemorySessionStore()}
+	clock := &fakeClock{now: time.Unix(1_000_000, 0)}
+	a := newAccessController(store, clock.Now)
+	revoked := a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: 60})
+	for i := 0; i <= MAX_ALLOWED_ATTEMPTS; i++ {
+		a.IncrementLock("bob")
+	}
+
+	var created AccessToken
+	store.afterRead = func() {
+		// This would deadlock if reload held the locks while reading the store
+		created = a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: 60})
+		a.ResetTokensForUser("alice")
+		created = a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: 60})
+		a.ResetLock("bob")
+		a.IncrementLock("carol")
+	}
+	a.reload()
+
+	if _, err := a.CheckAccessToken(created.Token); err != nil {
+		t.Errorf("session created during the reload was lost: %v", err)
+	}
+	if _, err := a.CheckAccessToken(revoked.Token); err != ErrTokenNotFound {
+		t.Errorf("session revoked during the reload was restored: %v", err)
+	}
+	if a.GetLoginLock("bob") != nil {
+		t.Error("lock reset during the reload was restored")
+	}
+	if a.GetLoginLock("carol") == nil {
+		t.Error("lock created during the reload was lost")
+	}
+	if a.reloadSessions != nil || a.reloadLocks != nil {
+		t.Error("changes are still recorded after the reload")
+	}
+}
+
+// Blocks writing sessions until release is closed
+type blockingSessionStore struct {
+	*memorySessionStore
+	saving  chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingSessionStore) SaveSession(session *Session) {
+	s.saving <- struct{}{}
+	<-s.release
+	s.memorySessionStore.SaveSession(session)
+}
+
+func TestCheckAccessTokenDuringStoreWrite(t *testing.T) {
+	store := &blockingSessionStore{
+		memorySessionStore: newMemorySessionStore(),
+		saving:             make(chan struct{}, 2),
+		release:            make(chan struct{}),
+	}
+	clock := &fakeClock{now: time.Unix(1_000_000, 0)}
+	a := newAccessController(store, clock.Now)
+
+	close(store.release)
+	existing := a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: 60})
+	<-store.saving
+	store.release = make(chan struct{})
+
+	created := make(chan AccessToken)
+	go func() {
+		created <- a.CreateNewAccessToken("bob", SessionRequest{DurationSeconds: 60})
+	}()
+	<-store.saving
+
+	// The store is blocked, but the cache is not
+	if _, err := a.CheckAccessToken(existing.Token); err != nil {
+		t.Errorf("existing token was rejected: %v", err)
+	}
+	if len(a.GetSessionsOfUser("bob")) != 1 {
+		t.Error("new session is not cached before it is stored")
+	}
+
+	close(store.release)
+	token := <-created
+	if _, exists := store.sessions[hashAccessToken(token.Token)]; !exists {
+		t.Error("new session was not stored")
+	}
+}
+
+func TestLockExpiry(t *testing.T) {
+	a, store, clock := newTestAccessController()
+
+	for i := 0; i < MAX_ALLOWED_ATTEMPTS; i++ {
+		a.IncrementLock("alice")
+	}
+	if a.IsLocked("alice") {
+		t.Fatalf("locked after %d attempts", MAX_ALLOWED_ATTEMPTS)
+	}
+	a.IncrementLock("alice")
+	if !a.IsLocked("alice") {
+		t.Fatalf("not locked after %d attempts", MAX_ALLOWED_ATTEMPTS+1)
+	}
+
+	clock.Advance(DURATION_LOCKED_SECS*time.Second + time.Second)
+	if a.IsLocked("alice") {
+		t.Error("lock did not expire")
+	}
+	if len(store.locks) != 0 {
+		t.Error("expired lock was not removed from the store")
+	}
+}
+
+func TestRemoveExpired(t *testing.T) {
+	a, store, clock := newTestAccessController()
+	short := a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: 10})
+	long := a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: 100})
+	a.IncrementLock("bob")
+
+	clock.Advance(DURATION_LOCKED_SECS*time.Second + time.Second)
+	a.removeExpired()
+
+	if _, err := a.CheckAccessToken(short.Token); err != ErrTokenNotFound {
+		t.Errorf("expired session was not removed: %v", err)
+	}
+	if len(a.lockedIDs) != 0 || len(store.locks) != 0 {
+		t.Error("expired lock was not removed")
+	}
+	if _, exists := a.sessionsByUser["alice"][hashAccessToken(long.Token)]; exists {
+		t.Error("expired session is still in the user index")
+	}
+}
+
+func TestResetTokensForUser(t *testing.T) {
+	a, store, _ := newTestAccessController()
+	alice1 := a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: 60})
+	alice2 := a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: 60})
+	bob := a.CreateNewAccessToken("bob", SessionRequest{DurationSeconds: 60})
+
+	a.ResetTokensForUser("alice")
+
+	for _, token := range []AccessToken{alice1, alice2} {
+		if _, err := a.CheckAccessToken(token.Token); err != ErrTokenNotFound {
+			t.Errorf("session of alice was not removed: %v", err)
+		}
+	}
+	if _, err := a.CheckAccessToken(bob.Token); err != nil {
+		t.Errorf("session of bob was removed: %v", err)
+	}
+	if len(store.sessions) != 1 {
+		t.Errorf("store has %d sessions, expected 1", len(store.sessions))
+	}
+	if _, exists := a.sessionsByUser["alice"]; exists {
+		t.Error("user index was not cleaned up")
+	}
+}
+
+func TestRevokeSessions(t *testing.T) {
+	a, store, _ := newTestAccessController()
+	current := a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: 60, RemoteIp: "192.0.2.1", UserAgent: "Firefox"})
+	other1 := a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: 60, RemoteIp: "192.0.2.2", UserAgent: "RMD Android"})
+	other2 := a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: 60, RemoteIp: "192.0.2.3", UserAgent: "Chrome"})
+	bob := a.CreateNewAccessToken("bob", SessionRequest{DurationSeconds: 60})
+
+	sessions := a.GetSessionsOfUser("alice")
+	if len(sessions) != 3 {
+		t.Fatalf("expected 3 sessions, got %d", len(sessions))
+	}
+	session := a.GetSession(other1.Token)
+	if session == nil || session.RemoteIp != "192.0.2.2" || session.UserAgent != "RMD Android" {
+		t.Fatalf("unexpected session %+v", session)
+	}
+
+	if a.RevokeSession("bob", session.Id) {
+		t.Error("bob revoked a session of alice")
+	}
+	if !a.RevokeSession("alice", session.Id) {
+		t.Error("failed to revoke session")
+	}
+	if _, err := a.CheckAccessToken(other1.Token); err != ErrTokenNotFound {
+		t.Errorf("revoked session is still valid: %v", err)
+	}
+
+	if count := a.RevokeOtherSessions("alice", current.Token); count != 1 {
+		t.Errorf("revoked %d other sessions, expected 1", count)
+	}
+	for token, valid := range map[string]bool{current.Token: true, other2.Token: false, bob.Token: true} {
+		_, err := a.CheckAccessToken(token)
+		if (err == nil) != valid {
+			t.Errorf("token valid=%t, expected %t", err == nil, valid)
+		}
+	}
+	if len(store.sessions) != 2 {
+		t.Errorf("store has %d sessions, expected 2", len(store.sessions))
+	}
+}
+
+func TestRefreshAccessToken(t *testing.T) {
+	a, store, clock := newTestAccessController()
+	first := a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: 60, WithRefreshToken: true})
+	if first.RefreshToken == "" {
+		t.Fatal("no refresh token")
+	}
+	if _, exists := store.refreshTokens[first.RefreshToken]; exists {
+		t.Fatal("store contains the plaintext refresh token")
+	}
+	sessionId := a.GetSession(first.Token).Id
+
+	// The session survives the expiry of the access token
+	clock.Advance(2 * time.Minute)
+	if _, err := a.CheckAccessToken(first.Token); err != ErrTokenExpired {
+		t.Errorf("expected ErrTokenExpired, got %v", err)
+	}
+	a.removeExpired()
+	if len(a.GetSessionsOfUser("alice")) != 1 {
+		t.Fatal("refreshable session was removed")
+	}
+
+	second, err := a.RefreshAccessToken(first.RefreshToken, 60)
+	if err != nil {
+		t.Fatalf("refresh failed: %v", err)
+	}
+	if second.RefreshToken == first.RefreshToken || second.Token == first.Token {
+		t.Error("tokens were not rotated")
+	}
+	if second.CreationTime != first.CreationTime {
+		t.Error("refresh changed the creation time of the session")
+	}
+	if userId, err := a.CheckAccessToken(second.Token); err != nil || userId != "alice" {
+		t.Errorf("new access token invalid: userId=%s err=%v", userId, err)
+	}
+	if session := a.GetSession(second.Token); session == nil || session.Id != sessionId {
+		t.Error("refresh changed the session id")
+	}
+
+	// Sliding expiry: refreshing regularly keeps the session alive beyond REFRESH_TOKEN_VALID_SECS
+	current := second
+	for i := 0; i < 3; i++ {
+		clock.Advance(REFRESH_TOKEN_VALID_SECS / 2 * time.Second)
+		current, err = a.RefreshAccessToken(current.RefreshToken, 60)
+		if err != nil {
+			t.Fatalf("refresh %d failed: %v", i, err)
+		}
+	}
+
+	clock.Advance(REFRESH_TOKEN_VALID_SECS*time.Second + time.Second)
+	if _, err := a.RefreshAccessToken(current.RefreshToken, 60); err != ErrTokenExpired {
+		t.Errorf("expected ErrTokenExpired, got %v", err)
+	}
+}
+
+func TestRefreshTokenReuse(t *testing.T) {
+	a, store, _ := newTestAccessController()
+	first := a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: 60, WithRefreshToken: true})
+	other := a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: 60, WithRefreshToken: true})
+
+	second, err := a.RefreshAccessToken(first.RefreshToken, 60)
+	if err != nil {
+		t.Fatalf("refresh failed: %v", err)
+	}
+
+	// An attacker replays the old refresh token
+	if _, err := a.RefreshAccessToken(first.RefreshToken, 60); err != ErrRefreshTokenReused {
+		t.Fatalf("expected ErrRefreshTokenReused, got %v", err)
+	}
+
+	// The whole family is revoked
+	if _, err := a.CheckAccessToken(second.Token); err != ErrTokenNotFound {
+		t.Errorf("access token of the revoked session is still valid: %v", err)
+	}
+	if _, err := a.RefreshAccessToken(second.RefreshToken, 60); err != ErrTokenNotFound {
+		t.Errorf("refresh token of the revoked session is still valid: %v", err)
+	}
+
+	// Other sessions are not affected
+	if _, err := a.CheckAccessToken(other.Token); err != nil {
+		t.Errorf("other session was revoked: %v", err)
+	}
+	if len(store.refreshTokens) != 1 {
+		t.Errorf("store has %d refresh tokens, expected 1", len(store.refreshTokens))
+	}
+}
+
+func TestRevokeSessionRevokesRefreshToken(t *testing.T) {
+	a, _, _ := newTestAccessController()
+	token := a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: 60, WithRefreshToken: true})
+
+	a.RevokeSession("alice", a.GetSession(token.Token).Id)
+	if _, err := a.RefreshAccessToken(token.RefreshToken, 60); err != ErrTokenNotFound {
+		t.Errorf("refresh token of the revoked session is still valid: %v", err)
+	}
+}
+
+func TestAccessTokenScopes(t *testing.T) {
+	a, _, _ := newTestAccessController()
+
+	scopes, err := EncodeScopes([]string{string(ScopeLocationsRead), string(ScopePicturesRead)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewer := a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: 60, Scopes: scopes})
+	full := a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: 60})
+
+	if _, err := a.CheckAccessTokenScope(viewer.Token, ScopeLocationsRead); err != nil {
+		t.Errorf("viewer cannot read locations: %v", err)
+	}
+	if _, err := a.CheckAccessTokenScope(viewer.Token, ScopeAccountAdmin); err != ErrScopeMissing {
+		t.Errorf("expected ErrScopeMissing, got %v", err)
+	}
+	if _, err := a.CheckAccessTokenScope(viewer.Token, ScopeAny); err != nil {
+		t.Errorf("viewer token is not valid for ScopeAny: %v", err)
+	}
+	for _, scope := range AllScopes {
+		if _, err := a.CheckAccessTokenScope(full.Token, scope); err != nil {
+			t.Errorf("full token lacks scope %s: %v", scope, err)
+		}
+	}
+	if len(viewer.Scopes) != 2 || len(full.Scopes) != len(AllScopes) {
+		t.Errorf("unexpected scopes viewer=%v full=%v", viewer.Scopes, full.Scopes)
+	}
+}
+
+func TestEncodeScopes(t *testing.T) {
+	if _, err := EncodeScopes([]string{"locations:write"}); !errors.Is(err, ErrScopeInvalid) {
+		t.Errorf("expected ErrScopeInvalid, got %v", err)
+	}
+	encoded, _ := EncodeScopes([]string{"commands:send", "device:upload", "commands:send"})
+	if encoded != "commands:send device:upload" {
+		t.Errorf("encoded=%s", encoded)
+	}
+	all := []string{}
+	for _, scope := range AllScopes {
+		all = append(all, string(scope))
+	}
+	if encoded, _ := EncodeScopes(all); encoded != "" {
+		t.Errorf("all scopes should be encoded as empty string, got %s", encoded)
+	}
+	if encoded, _ := EncodeScopes(nil); encoded != "" {
+		t.Errorf("no scopes should be encoded as empty string, got %s", encoded)
+	}
+}
+
+func TestRestrictScopes(t *testing.T) {
+	if scopes, _ := RestrictScopes("", "device:upload"); scopes != "device:upload" {
+		t.Errorf("no requested scopes should mean all allowed scopes, got %s", scopes)
+	}
+	if _, err := RestrictScopes("device:upload locations:read", "device:upload"); !errors.Is(err, ErrScopeInvalid) {
+		t.Errorf("expected ErrScopeInvalid, got %v", err)
+	}
+}
+
+func TestRevokeGrantSessions(t *testing.T) {
+	a, store, _ := newTestAccessController()
+	own := a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: 60})
+	bob := a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: 60, Scopes: "locations:read", GrantId: 1})
+	carol := a.CreateNewAccessToken("alice", SessionRequest{DurationSeconds: 60, Scopes: "locations:read", GrantId: 2})
+
+	if count := a.RevokeGrantSessions("alice", 1); count != 1 {
+		t.Errorf("revoked %d sessions, expected 1", count)
+	}
+	for token, valid := range map[string]bool{own.Token: true, bob.Token: false, carol.Token: true} {
+		_, err := a.CheckAccessToken(token)
+		if (err == nil) != valid {
+			t.Errorf("token valid=%t, expected %t", err == nil, valid)
+		}
+	}
+	if len(store.sessions) != 2 {
+		t.Errorf("store has %d sessions, expected 2", len(store.sessions))
+	}
+}
+
+func TestDelegatedSessionsRevokedWithParent(t *testing.T) {
+	a, store, _ := newTestAccessController()
+
+	// Bob has access to Alice's account with a grant
+	delegate := func(parent AccessToken) AccessToken {
+		return a.CreateNewAccessToken("alice", SessionRequest{
+			DurationSeconds: 60,
+			Scopes:          "locations:read",
+			GrantId:         1,
+			ParentTokenHash: hashAccessToken(parent.Token),
+		})
+	}
+	isValid := func(token AccessToken) bool {
+		_, err := a.CheckAccessToken(token.Token)
+		return err == nil
+	}
+
+	// Revoked by the grantee, e.g., when logging out
+	bob := a.CreateNewAccessToken("bob", SessionRequest{DurationSeconds: 60, WithRefreshToken: true})
+	delegated := delegate(bob)
+	other := delegate(a.CreateNewAccessToken("bob", SessionRequest{DurationSeconds: 60}))
+
+	// The link survives refreshing the grantee's session
+	bob, err := a.RefreshAccessToken(bob.RefreshToken, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isValid(delegated) {
+		t.Fatal("delegated session was revoked by refreshing")
+	}
+	// The link is also restored from the store
+	a.reload()
+	if !a.RevokeSession("bob", a.GetSession(bob.Token).Id) {
+		t.Fatal("session was not revoked")
+	}
+	if isValid(delegated) {
+		t.Error("delegated session is still valid")
+	}
+	if !isValid(other) {
+		t.Error("delegated session of another session was revoked")
+	}
+	if _, exists := store.sessions[hashAccessToken(delegated.Token)]; exists {
+		t.Error("delegated session is still in the store")
+	}
+
+	// Revoking the other sessions
+	current := a.CreateNewAccessToken("bob", SessionRequest{DurationSeconds: 60})
+	kept := delegate(current)
+	if count := a.RevokeOtherSessions("bob", current.Token); count != 1 {
+		t.Errorf("revoked %d sessions, expected 1", count)
+	}
+	if isValid(other) || !isValid(kept) {
+		t.Error("delegated sessions were not revoked together with their sessions")
+	}
+
+	// Revoking all sessions
+	a.ResetTokensForUser("bob")
+	if isValid(kept) {
+		t.Error("delegated session is still valid")
+	}
+	if len(store.sessions) != 0 {
+		t.Errorf("store has %d sessions, expected 0", len(store.sessions))
+	}
+	if len(a.sessionsByParent) != 0 {
+		t.Errorf("parent index has %d entries, expected 0", len(a.sessionsByParent))
+	}
+}
+
+func TestEncodeGrantScopes(t *testing.T) {
+	if _, err := EncodeGrantScopes([]string{string(ScopeAccountAdmin)}); !errors.Is(err, ErrScopeInvalid) {
+		t.Errorf("expected ErrScopeInvalid, got %v", err)
+	}
+	if encoded, _ := EncodeGrantScopes(nil); encoded != "locations:read pictures:read commands:send" {
+		t.Errorf("no scopes should be encoded as all grantable scopes, got %s", encoded)
+	}
+}
+
+// Run with -race to detect unsynchronised access
+func TestAccessControllerConcurrent(t *testing.T) {
+	a, _, clock := newTestAccessController()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			userId := fmt.Sprintf("user%d", w%3)
+			for i := 0; i < 200; i++ {
+				token := a.CreateNewAccessToken(userId, SessionRequest{DurationSeconds: 5})
+				a.CheckAccessToken(token.Token)
+				a.IncrementLock(userId)
+				a.IsLocked(userId)
+				if i%50 == 0 {
+					a.ResetTokensForUser(userId)
+					a.ResetLock(userId)
+					clock.Advance(time.Second)
+					a.removeExpired()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for userId, hashes := range a.sessionsByUser {
+		for hash := range hashes {
+			if _, exists := a.sessions[hash]; !exists {
+				t.Errorf("user index of %s references a removed session", userId)
+			}
+		}
+	}
+}
+
+func newBenchmarkAccessController() *AccessController {
+	return newAccessController(discardSessionStore{}, time.Now)
+}
+
+// With the SQLite store, the logins write to the disk
+func newBenchmarkDatabaseAccessController(b *testing.B) *AccessController {
+	dir := b.TempDir()
+	blobs, err := blobstore.NewLocalBlobStore(filepath.Join(dir, "blobs"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	return newAccessController(NewRMDDB(dir, blobs), time.Now)
+}
+
+func createBenchmarkTokens(a *AccessController, users int, tokensPerUser int) []AccessToken {
+	tokens := make([]AccessToken, 0, users*tokensPerUser)
+	for u := 0; u < users; u++ {
+		for i := 0; i < tokensPerUser; i++ {
+			tokens = append(tokens, a.CreateNewAccessToken(fmt.Sprintf("user%d", u), SessionRequest{DurationSeconds: MAX_TOKEN_VALID_SECS}))
+		}
+	}
+	return tokens
+}
+
+func BenchmarkCheckAccessTokenParallel(b *testing.B) {
+	a := newBenchmarkAccessController()
+	tokens := createBenchmarkTokens(a, 1000, 2)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			a.CheckAccessToken(tokens[i%len(tokens)].Token)
+			i++
+		}
+	})
+}
+
+// Mostly token checks, with a login every 100 requests
+func BenchmarkCheckAccessTokenWithLoginsParallel(b *testing.B) {
+	b.Run("store=discard", func(b *testing.B) {
+		benchmarkCheckAccessTokenWithLogins(b, newBenchmarkAccessController())
+	})
+	b.Run("store=sqlite", func(b *testing.B) {
+		benchmarkCheckAccessTokenWithLogins(b, newBenchmarkDatabaseAccessController(b))
+	})
+}
+
+func benchmarkCheckAccessTokenWithLogins(b *testing.B, a *AccessController) {
+	tokens := createBenchmarkTokens(a, 1000, 2)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if i%100 == 0 {
+				a.CreateNewAccessToken("user0", SessionRequest{DurationSeconds: 60})
+			} else {
+				a.CheckAccessToken(tokens[i%len(tokens)].Token)
+			}
+			i++
+		}
+	})
+}
+
+// With the per-user index, this does not depend on the total number of sessions
+func BenchmarkResetTokensForUser(b *testing.B) {
+	for _, users := range []int{100, 10_000} {
+		b.Run(fmt.Sprintf("users=%d", users), func(b *testing.B) {
+			a := newBenchmarkAccessController()
+			createBenchmarkTokens(a, users, 2)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				a.CreateNewAccessToken("target", SessionRequest{DurationSeconds: 60})
+				a.CreateNewAccessToken("target", SessionRequest{DurationSeconds: 60})
+				b.StartTimer()
+
+				a.ResetTokensForUser("target")
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package user
+
+import (
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Account administration with the CLI ("rmd-server user" and "rmd-server stats").
+//
+// The CLI runs in its own process, next to the server. Changes are written to the database:
+// - Locks by an admin are stored with the account, the server checks them on every request.
+// - Revoked sessions are picked up when the server reloads its session cache (see AccessController.reload).
+
+const LOCK_REASON_MAX_LENGTH = 256
+
+var ErrLockReasonTooLong = errors.New("the lock reason must be <= 256 characters")
+
+// Server-wide numbers for "rmd-server stats"
+type ServerStats struct {
+	Accounts            int64
+	LockedAccounts      int64 // locked by an admin
+	TotpAccounts        int64 // accounts with TOTP enabled
+	PasskeyAccounts     int64 // accounts with at least one passkey
+	Devices             int64
+	Locations           int64
+	LocationBytes       int64
+	Pictures            int64
+	PictureBytes        int64 // including unfinished uploads
+	PendingCommands     int64
+	Sessions            int64 // sessions that can still be used or refreshed
+	FailedLoginAccounts int64 // accounts with recent failed login attempts
+	ValidInvites        int64 // invites that are not expired or used up
+}
+
+// ------- Database -------
+
+func (db *RMDDB) GetUsers() []RMDUser {
+	users := []RMDUser{}
+	db.DB.Order("uid ASC").Find(&users)
+	return users
+}
+
+func (db *RMDDB) SetLocked(user *RMDUser, lockedTime int64, reason string) {
+	// Only update these columns, such that concurrent changes of the user are not overwritten
+	db.DB.Model(user).Updates(map[string]any{
+		"locked_time": lockedTime,
+		"lock_reason": reason,
+	})
+}
+
+func (db *RMDDB) GetStats(now int64) ServerStats {
+	var stats ServerStats
+	db.DB.Model(&RMDUser{}).Count(&stats.Accounts)
+	db.DB.Model(&RMDUser{}).Where("locked_time > 0").Count(&stats.LockedAccounts)
+	db.DB.Model(&RMDUser{}).Where("totp_enabled_time > 0").Count(&stats.TotpAccounts)
+	db.DB.Model(&Passkey{}).Distinct("user_id").Count(&stats.PasskeyAccounts)
+	db.DB.Model(&Device{}).Count(&stats.Devices)
+
+	db.DB.Model(&Location{}).Count(&stats.Locations)
+	db.DB.Model(&Location{}).Select("COALESCE(SUM(size), 0)").Scan(&stats.LocationBytes)
+	db.DB.Model(&Picture{}).Count(&stats.Pictures)
+
+	var pictureBytes, uploadBytes int64
+	db.DB.Model(&Picture{}).Select("COALESCE(SUM(size), 0)").Scan(&pictureBytes)
+	db.DB.Model(&PictureUpload{}).Select("COALESCE(SUM(size), 0)").Scan(&uploadBytes)
+	stats.PictureBytes = pictureBytes + uploadBytes
+
+	db.DB.Model(&Command{}).Where("status = ?", CommandStatusQueued).Count(&stats.PendingCommands)
+	db.DB.Model(&Session{}).
+		Where("expiration_time >= ? OR refresh_expiration_time >= ?", now, now).
+		Count(&stats.Sessions)
+	db.DB.Model(&LoginLock{}).Where("expiration_time >= ?", now).Count(&stats.FailedLoginAccounts)
+	db.DB.Model(&Invite{}).
+		Where("uses < max_uses AND (expiration_time = 0 OR expiration_time > ?)", now).
+		Count(&stats.ValidInvites)
+	return stats
+}
+
+// ------- Repository -------
+
+func (u *UserRepository) GetUsers() []RMDUser {
+	return u.UB.GetUsers()
+}
+
+func (u *UserRepository) GetStats() ServerStats {
+	return u.UB.GetStats(time.Now().Unix())
+}
+
+// Whether logging in to the account is currently not allowed
+func (u *UserRepository) isLoginBlocked(user *RMDUser) bool {
+	return user.LockedTime != 0 || u.ACC.IsLocked(user.UID)
+}
+
+// Lock the account until UnlockUser is called.
+// Logging in is refused and all sessions of the account are revoked (see RevokeAllSessions).
+func (u *UserRepository) LockUser(user *RMDUser, reason string) error {
+	if len(reason) > LOCK_REASON_MAX_LENGTH {
+		return ErrLockReasonTooLong
+	}
+	user.LockedTime = time.Now().Unix()
+	user.LockReason = reason
+	u.UB.SetLocked(user, user.LockedTime, user.LockReason)
+	u.RevokeAllSessions(user)
+
+	log.Info().Str("userid", user.UID).Msg("locked account")
+	return nil
+}
+
+// Unlock the account. This also resets the failed login attempts.
+func (u *UserRepository) UnlockUser(user *RMDUser) {
+	user.LockedTime = 0
+	user.LockReason = ""
+	u.UB.SetLocked(user, 0, "")
+	u.ACC.ResetLock(user.UID)
+
+	log.Info().Str("userid", user.UID).Msg("unlocked account")
+}
+
+// Revoke all sessions of the account (including its grantees' sessions on it),
+// and the sessions that the account opened on other accounts with a grant.
+// Returns the number of revoked sessions.
+func (u *UserRepository) RevokeAllSessions(user *RMDUser) int {
+	count := len(u.ACC.GetSessionsOfUser(user.UID))
+	u.ACC.ResetTokensForUser(user.UID)
+	for _, grant := range u.UB.GetGrantsForGrantee(user.Id) {
+		count += u.ACC.RevokeGrantSessions(grant.OwnerUID, grant.Id)
+	}
+
+	log.Info().Str("userid", user.UID).Int("count", count).Msg("revoked all sessions")
+	return count
+}
@@ -0,0 +1,109 @@
+package user
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrTooManyWaiters = errors.New("too many concurrent waiters for this device or account")
+
+// Notifies goroutines that are waiting for a new command to be queued for a device
+// (e.g., long-polling requests), so that they do not need to poll the database.
+// Waiters are keyed by Device.Key().
+type CommandWaiters struct {
+	mu sync.Mutex
+	// map device keys to their waiters, and the waiters to the account they belong to
+	waiters map[string]map[chan struct{}]string
+	// number of waiters per account
+	accountWaiters map[string]int
+	maxPerDevice   int
+	maxPerAccount  int
+	shutdown       chan struct{}
+	isShutdown     bool
+}
+
+// A limit of 0 means unlimited.
+func NewCommandWaiters(maxPerDevice int, maxPerAccount int) *CommandWaiters {
+	return &CommandWaiters{
+		waiters:        make(map[string]map[chan struct{}]string),
+		accountWaiters: make(map[string]int),
+		maxPerDevice:   maxPerDevice,
+		maxPerAccount:  maxPerAccount,
+		shutdown:       make(chan struct{}),
+	}
+}
+
+// Register a waiter for the device of the account.
+// The returned channel receives a value when a command is queued for the device.
+// The caller must call Remove once it stops waiting.
+func (c *CommandWaiters) Add(account string, key string) (chan struct{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	deviceWaiters := c.waiters[key]
+	if c.maxPerDevice > 0 && len(deviceWaiters) >= c.maxPerDevice {
+		return nil, ErrTooManyWaiters
+	}
+	if c.maxPerAccount > 0 && c.accountWaiters[account] >= c.maxPerAccount {
+		return nil, ErrTooManyWaiters
+	}
+
+	if deviceWaiters == nil {
+		deviceWaiters = make(map[chan struct{}]string)
+		c.waiters[key] = deviceWaiters
+	}
+	ch := make(chan struct{}, 1)
+	deviceWaiters[ch] = account
+	c.accountWaiters[account]++
+	return ch, nil
+}
+
+func (c *CommandWaiters) Remove(key string, ch chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	account, exists := c.waiters[key][ch]
+	if !exists {
+		return
+	}
+	delete(c.waiters[key], ch)
+	if len(c.waiters[key]) == 0 {
+		delete(c.waiters, key)
+	}
+	c.accountWaiters[account]--
+	if c.accountWaiters[account] == 0 {
+		delete(c.accountWaiters, account)
+	}
+}
+
+// Wake up all waiters of the device.
+// Returns false if nobody is waiting.
+func (c *CommandWaiters) Notify(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	deviceWaiters := c.waiters[key]
+	for ch := range deviceWaiters {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// a wake-up is already pending
+		}
+	}
+	return len(deviceWaiters) > 0
+}
+
+// Closed when the server is shutting down. Waiters should stop waiting then.
+func (c *CommandWaiters) Done() <-chan struct{} {
+	return c.shutdown
+}
+
+func (c *CommandWaiters) Shutdown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.isShutdown {
+		c.isShutdown = true
+		close(c.shutdown)
+	}
+}
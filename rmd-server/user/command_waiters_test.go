@@ -0,0 +1,218 @@
+package user
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Block until n goroutines wait for the device
+func waitForWaiters(t *testing.T, c *CommandWaiters, key string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		count := len(c.waiters[key])
+		c.mu.Unlock()
+		if count == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d waiters instead of %d", count, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type waitResult struct {
+	cmd *Command
+	err error
+}
+
+func waitInBackground(repo *UserRepository, user *RMDUser, device *Device, timeout time.Duration) <-chan waitResult {
+	result := make(chan waitResult, 1)
+	go func() {
+		cmd, err := repo.WaitForCommand(context.Background(), user, device, timeout)
+		result <- waitResult{cmd, err}
+	}()
+	return result
+}
+
+func TestCommandWaitersNotify(t *testing.T) {
+	c := NewCommandWaiters(0, 0)
+	if c.Notify("a") {
+		t.Error("Notify without waiters returned true")
+	}
+
+	ch, _ := c.Add("alice", "a")
+	other, _ := c.Add("alice", "b")
+	if !c.Notify("a") || !c.Notify("a") {
+		t.Fatal("Notify with a waiter returned false")
+	}
+	select {
+	case <-ch:
+	default:
+		t.Fatal("waiter was not woken up")
+	}
+	select {
+	case <-ch:
+		t.Error("wake-ups were not coalesced")
+	case <-other:
+		t.Error("waiter of another device was woken up")
+	default:
+	}
+
+	c.Remove("a", ch)
+	c.Remove("a", ch)
+	if c.Notify("a") {
+		t.Error("removed waiter is still notified")
+	}
+	if len(c.waiters) != 1 {
+		t.Error("devices without waiters are kept")
+	}
+	c.Remove("b", other)
+	if len(c.accountWaiters) != 0 {
+		t.Error("accounts without waiters are kept")
+	}
+}
+
+func TestCommandWaitersLimit(t *testing.T) {
+	c := NewCommandWaiters(2, 0)
+	first, _ := c.Add("alice", "a")
+	c.Add("alice", "a")
+	if _, err := c.Add("alice", "a"); err != ErrTooManyWaiters {
+		t.Fatalf("limit was not enforced: %v", err)
+	}
+	if _, err := c.Add("alice", "b"); err != nil {
+		t.Errorf("limit of another device was applied: %v", err)
+	}
+	c.Remove("a", first)
+	if _, err := c.Add("alice", "a"); err != nil {
+		t.Errorf("removed waiter still counts: %v", err)
+	}
+}
+
+func TestCommandWaitersAccountLimit(t *testing.T) {
+	c := NewCommandWaiters(2, 3)
+	first, _ := c.Add("alice", "a")
+	c.Add("alice", "b")
+	c.Add("alice", "c")
+	if _, err := c.Add("alice", "d"); err != ErrTooManyWaiters {
+		t.Fatalf("account limit was not enforced: %v", err)
+	}
+	if _, err := c.Add("bob", "e"); err != nil {
+		t.Errorf("limit of another account was applied: %v", err)
+	}
+	c.Remove("a", first)
+	if _, err := c.Add("alice", "d"); err != nil {
+		t.Errorf("removed waiter still counts for the account: %v", err)
+	}
+	if c.accountWaiters["alice"] != 3 {
+		t.Errorf("%d waiters counted instead of 3", c.accountWaiters["alice"])
+	}
+}
+
+func TestWaitForCommandTimeout(t *testing.T) {
+	repo := newTestRepository(t, 0)
+	user, device := newTestUser(t, repo, "alice")
+
+	start := time.Now()
+	cmd, err := repo.WaitForCommand(context.Background(), user, device, 50*time.Millisecond)
+	if cmd != nil || err != nil {
+		t.Fatalf("expected no command, got %v %v", cmd, err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("returned before the timeout: %s", elapsed)
+	}
+	waitForWaiters(t, repo.Waiters, device.Key(), 0)
+}
+
+func TestWaitForCommandWakeUp(t *testing.T) {
+	repo := newTestRepository(t, 0)
+	user, device := newTestUser(t, repo, "alice")
+
+	result := waitInBackground(repo, user, device, 10*time.Second)
+	waitForWaiters(t, repo.Waiters, device.Key(), 1)
+	queued := repo.AddCommandToUser(user, device, "locate", 1, "sig")
+
+	select {
+	case r := <-result:
+		if r.err != nil || r.cmd == nil || r.cmd.Id != queued.Id {
+			t.Fatalf("expected the queued command, got %v %v", r.cmd, r.err)
+		}
+		if r.cmd.Status != CommandStatusDelivered {
+			t.Errorf("command was not marked as delivered: %s", r.cmd.Status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter was not woken up")
+	}
+}
+
+func TestWaitForCommandTooManyWaiters(t *testing.T) {
+	repo := newTestRepository(t, 1)
+	user, device := newTestUser(t, repo, "alice")
+
+	result := waitInBackground(repo, user, device, 10*time.Second)
+	waitForWaiters(t, repo.Waiters, device.Key(), 1)
+
+	_, err := repo.WaitForCommand(context.Background(), user, device, time.Second)
+	if err != ErrTooManyWaiters {
+		t.Errorf("expected ErrTooManyWaiters, got %v", err)
+	}
+
+	repo.Shutdown()
+	<-result
+}
+
+func TestWaitForCommandTooManyWaitersPerAccount(t *testing.T) {
+	repo := newTestRepository(t, 0)
+	repo.Waiters = NewCommandWaiters(0, 1)
+	user, device := newTestUser(t, repo, "alice")
+	other, err := repo.CreateDevice(user, "tablet")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := waitInBackground(repo, user, device, 10*time.Second)
+	waitForWaiters(t, repo.Waiters, device.Key(), 1)
+
+	_, err = repo.WaitForCommand(context.Background(), user, other, time.Second)
+	if err != ErrTooManyWaiters {
+		t.Errorf("expected ErrTooManyWaiters for another device of the account, got %v", err)
+	}
+
+	repo.Shutdown()
+	<-result
+}
+
+func TestWaitForCommandShutdown(t *testing.T) {
+	repo := newTestRepository(t, 0)
+	user, device := newTestUser(t, repo, "alice")
+
+	results := []<-chan waitResult{
+		waitInBackground(repo, user, device, time.Minute),
+		waitInBackground(repo, user, device, time.Minute),
+	}
+	waitForWaiters(t, repo.Waiters, device.Key(), 2)
+
+	repo.Shutdown()
+	repo.Shutdown()
+	for _, result := range results {
+		select {
+		case r := <-result:
+			if r.cmd != nil || r.err != nil {
+				t.Errorf("expected no command, got %v %v", r.cmd, r.err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("waiter was not released by the shutdown")
+		}
+	}
+	waitForWaiters(t, repo.Waiters, device.Key(), 0)
+
+	// Waiting after the shutdown returns right away
+	start := time.Now()
+	repo.WaitForCommand(context.Background(), user, device, time.Minute)
+	if time.Since(start) > 5*time.Second {
+		t.Error("waiting after the shutdown did not return")
+	}
+}
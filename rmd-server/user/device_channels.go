@@ -0,0 +1,126 @@
+package user
+
+import (
+	"rmd-server/metrics"
+	"sync"
+)
+
+// Registry of devices that hold a direct connection to the server (e.g., a WebSocket),
+// as an alternative to being woken up via UnifiedPush.
+//
+// Connections are keyed by Device.Key().
+// There is at most one connection per device. When a device reconnects,
+// the new connection supersedes the old one, and the old one is told to close.
+type DeviceChannels struct {
+	mu         sync.Mutex
+	conns      map[string]*DeviceConnection
+	isShutdown bool
+}
+
+type DeviceConnection struct {
+	Key string // Device.Key()
+	// Receives a value when a new command has been queued.
+	// Notifications are coalesced: multiple new commands may result in a single wake-up.
+	Wake chan struct{}
+	// Closed when the server ends this connection,
+	// e.g., because the device reconnected or the account was deleted.
+	Closed chan struct{}
+}
+
+func NewDeviceChannels() *DeviceChannels {
+	return &DeviceChannels{
+		conns: make(map[string]*DeviceConnection),
+	}
+}
+
+func (d *DeviceChannels) Connect(key string) *DeviceConnection {
+	conn := &DeviceConnection{
+		Key:    key,
+		Wake:   make(chan struct{}, 1),
+		Closed: make(chan struct{}),
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.isShutdown {
+		// Not registered, the caller sees it as ended right away
+		close(conn.Closed)
+		return conn
+	}
+
+	old, exists := d.conns[key]
+	if exists {
+		close(old.Closed)
+	} else {
+		metrics.DeviceConnections.Inc()
+	}
+	d.conns[key] = conn
+
+	return conn
+}
+
+// Remove the connection from the registry.
+// Does nothing if the connection has already been superseded.
+func (d *DeviceChannels) Disconnect(conn *DeviceConnection) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conns[conn.Key] != conn {
+		return
+	}
+	delete(d.conns, conn.Key)
+	metrics.DeviceConnections.Dec()
+}
+
+// End the connection of the device, if there is one.
+func (d *DeviceChannels) DisconnectDevice(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	conn, exists := d.conns[key]
+	if !exists {
+		return
+	}
+	close(conn.Closed)
+	delete(d.conns, key)
+	metrics.DeviceConnections.Dec()
+}
+
+// Wake up the device, if it is connected.
+// Returns false if the device is not connected.
+func (d *DeviceChannels) Notify(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	conn, exists := d.conns[key]
+	if !exists {
+		return false
+	}
+	select {
+	case conn.Wake <- struct{}{}:
+	default:
+		// a wake-up is already pending
+	}
+	return true
+}
+
+// End all connections, because the server is shutting down.
+// Later connections are ended right away.
+func (d *DeviceChannels) Shutdown() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.isShutdown = true
+	for key, conn := range d.conns {
+		close(conn.Closed)
+		delete(d.conns, key)
+		metrics.DeviceConnections.Dec()
+	}
+}
+
+func (d *DeviceChannels) IsShutdown() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.isShutdown
+}
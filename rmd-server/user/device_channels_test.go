@@ -0,0 +1,65 @@
+package user
+
+import (
+	"testing"
+)
+
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestDeviceChannelsSupersede(t *testing.T) {
+	d := NewDeviceChannels()
+	old := d.Connect("1/a")
+	conn := d.Connect("1/a")
+	if !isClosed(old.Closed) {
+		t.Error("superseded connection was not closed")
+	}
+
+	// The superseded connection must not remove the new one
+	d.Disconnect(old)
+	if !d.Notify("1/a") {
+		t.Fatal("new connection was removed")
+	}
+	if !d.Notify("1/a") || len(conn.Wake) != 1 {
+		t.Error("wake-ups were not coalesced")
+	}
+
+	d.DisconnectDevice("1/a")
+	if !isClosed(conn.Closed) {
+		t.Error("disconnected connection was not closed")
+	}
+	if d.Notify("1/a") {
+		t.Error("disconnected device is still notified")
+	}
+}
+
+func TestDeviceChannelsShutdown(t *testing.T) {
+	d := NewDeviceChannels()
+	conns := []*DeviceConnection{d.Connect("1/a"), d.Connect("1/b")}
+
+	d.Shutdown()
+	d.Shutdown()
+	if !d.IsShutdown() {
+		t.Error("IsShutdown returned false after the shutdown")
+	}
+	for _, conn := range conns {
+		if !isClosed(conn.Closed) {
+			t.Errorf("connection of %s was not closed", conn.Key)
+		}
+		d.Disconnect(conn)
+	}
+
+	late := d.Connect("1/a")
+	if !isClosed(late.Closed) {
+		t.Error("connection after the shutdown was not closed")
+	}
+	if d.Notify("1/a") {
+		t.Error("connection after the shutdown was registered")
+	}
+}
@@ -0,0 +1,98 @@
+package user
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The scopes of sessions created with a DeviceCredential.
+// This is what the device needs to act as the device, but not to read the data or to manage the account.
+var DeviceCredentialScopes = []Scope{
+	ScopeDeviceUpload,
+}
+
+var ErrDeviceCredentialInvalid = errors.New("invalid device credential")
+var ErrDeviceCredentialNotFound = errors.New("device credential not found")
+
+// ------- Database -------
+
+func (db *RMDDB) GetDeviceCredentialByHash(user *RMDUser, tokenHash string) *DeviceCredential {
+	var cred DeviceCredential
+	db.DB.Where("user_id = ? AND token_hash = ?", user.Id, tokenHash).Limit(1).Find(&cred)
+	if cred.Id == 0 {
+		return nil
+	}
+	return &cred
+}
+
+func (db *RMDDB) GetDeviceCredential(device *Device) *DeviceCredential {
+	var cred DeviceCredential
+	db.DB.Where("device_id = ?", device.Id).Limit(1).Find(&cred)
+	if cred.Id == 0 {
+		return nil
+	}
+	return &cred
+}
+
+func (db *RMDDB) DeleteDeviceCredential(device *Device) bool {
+	res := db.DB.Where("device_id = ?", device.Id).Delete(&DeviceCredential{})
+	return res.RowsAffected > 0
+}
+
+func (db *RMDDB) SetDeviceCredentialLastUsedTime(cred *DeviceCredential, lastUsed int64) {
+	db.DB.Model(cred).Update("last_used_time", lastUsed)
+}
+
+// ------- Repository -------
+
+// Create a credential for the device, replacing its previous credential.
+// Returns the credential in plaintext. Only its hash is stored, thus it cannot be shown again.
+func (u *UserRepository) CreateDeviceCredential(user *RMDUser, device *Device) (string, *DeviceCredential) {
+	u.UB.DeleteDeviceCredential(device)
+
+	token := genRandomString(32)
+	scopes := []string{}
+	for _, scope := range DeviceCredentialScopes {
+		scopes = append(scopes, string(scope))
+	}
+	cred := DeviceCredential{
+		UserID:      user.Id,
+		DeviceID:    device.Id,
+		TokenHash:   hashAccessToken(token),
+		Scopes:      strings.Join(scopes, " "),
+		CreatedTime: time.Now().Unix(),
+	}
+	u.UB.Create(&cred)
+
+	log.Info().Str("userid", user.UID).Str("deviceId", device.DeviceId).Msg("created device credential")
+	return token, &cred
+}
+
+func (u *UserRepository) HasDeviceCredential(device *Device) bool {
+	return u.UB.GetDeviceCredential(device) != nil
+}
+
+func (u *UserRepository) DeleteDeviceCredential(user *RMDUser, device *Device) error {
+	if !u.UB.DeleteDeviceCredential(device) {
+		return ErrDeviceCredentialNotFound
+	}
+	log.Info().Str("userid", user.UID).Str("deviceId", device.DeviceId).Msg("deleted device credential")
+	return nil
+}
+
+// Check the credential and restrict the requested scopes to the credential's scopes.
+func (u *UserRepository) checkDeviceCredential(user *RMDUser, token string, requestedScopes string) (string, error) {
+	cred := u.UB.GetDeviceCredentialByHash(user, hashAccessToken(token))
+	if cred == nil {
+		return "", ErrDeviceCredentialInvalid
+	}
+	scopes, err := RestrictScopes(requestedScopes, cred.Scopes)
+	if err != nil {
+		return "", err
+	}
+	u.UB.SetDeviceCredentialLastUsedTime(cred, time.Now().Unix())
+	return scopes, nil
+}
@@ -0,0 +1,166 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The public id of the device that every account has.
+// Requests without a device selector refer to this device.
+const DEFAULT_DEVICE_ID = "default"
+
+const DEVICE_NAME_MAX_LENGTH = 64
+const MAX_DEVICES_PER_ACCOUNT = 20
+
+var ErrDeviceNotFound = errors.New("device not found")
+var ErrDeviceNameTooLong = errors.New("the device name must be <= 64 characters")
+var ErrTooManyDevices = errors.New("too many devices for this account")
+var ErrDeviceIsDefault = errors.New("the default device cannot be deleted")
+
+// Key to identify the device in DeviceChannels and CommandWaiters.
+func (d *Device) Key() string {
+	return fmt.Sprintf("%d/%s", d.UserID, d.DeviceId)
+}
+
+// ------- Database -------
+
+func (db *RMDDB) GetDevice(user *RMDUser, deviceId string) *Device {
+	var device Device
+	db.DB.Where("user_id = ? AND device_id = ?", user.Id, deviceId).Limit(1).Find(&device)
+	if device.Id == 0 {
+		return nil
+	}
+	return &device
+}
+
+func (db *RMDDB) GetDeviceByID(id uint64) *Device {
+	var device Device
+	db.DB.Where("id = ?", id).Limit(1).Find(&device)
+	if device.Id == 0 {
+		return nil
+	}
+	return &device
+}
+
+// Returns the devices of the user, oldest (i.e., the default device) first.
+func (db *RMDDB) GetDevices(user *RMDUser) []Device {
+	devices := []Device{}
+	db.DB.Where("user_id = ?", user.Id).Order("id ASC").Find(&devices)
+	return devices
+}
+
+func (db *RMDDB) CountDevices(user *RMDUser) int64 {
+	var count int64
+	db.DB.Model(&Device{}).Where("user_id = ?", user.Id).Count(&count)
+	return count
+}
+
+// Only updates the database row, the device may be used concurrently (e.g., by a WebSocket's reader and writer).
+func (db *RMDDB) SetDeviceLastSeenTime(device *Device, lastSeen int64) {
+	db.DB.Model(&Device{}).Where("id = ?", device.Id).Update("last_seen_time", lastSeen)
+}
+
+// Return the blob names of all pictures of the device.
+func (db *RMDDB) GetDevicePictureBlobNames(device *Device) []string {
+	names := []string{}
+	db.DB.Model(&Picture{}).Where("device_id = ? AND blob_name <> ''", device.Id).Pluck("blob_name", &names)
+	return names
+}
+
+func (db *RMDDB) GetDevicePictureUploads(device *Device) []PictureUpload {
+	uploads := []PictureUpload{}
+	db.DB.Where("device_id = ?", device.Id).Find(&uploads)
+	return uploads
+}
+
+// Delete the device and all its locations, pictures (only the rows, not the blobs), uploads, commands and its credential.
+func (db *RMDDB) DeleteDevice(device *Device) {
+	db.DB.Where("device_id = ?", device.Id).Delete(&Location{})
+	db.DB.Where("device_id = ?", device.Id).Delete(&Picture{})
+	db.DB.Where("device_id = ?", device.Id).Delete(&PictureUpload{})
+	db.DB.Where("device_id = ?", device.Id).Delete(&Command{})
+	db.DB.Where("device_id = ?", device.Id).Delete(&DeviceCredential{})
+	db.DB.Delete(device)
+}
+
+// ------- Repository -------
+
+// Returns the device with the given public id.
+// An empty deviceId selects the default device.
+func (u *UserRepository) GetDevice(user *RMDUser, deviceId string) (*Device, error) {
+	if deviceId == "" {
+		deviceId = DEFAULT_DEVICE_ID
+	}
+	device := u.UB.GetDevice(user, deviceId)
+	if device == nil {
+		return nil, ErrDeviceNotFound
+	}
+	return device, nil
+}
+
+func (u *UserRepository) GetDevices(user *RMDUser) []Device {
+	return u.UB.GetDevices(user)
+}
+
+// Add a device to the account. The device gets a random public id.
+func (u *UserRepository) CreateDevice(user *RMDUser, name string) (*Device, error) {
+	if len(name) > DEVICE_NAME_MAX_LENGTH {
+		return nil, ErrDeviceNameTooLong
+	}
+	if u.UB.CountDevices(user) >= MAX_DEVICES_PER_ACCOUNT {
+		return nil, ErrTooManyDevices
+	}
+
+	device := Device{
+		UserID:      user.Id,
+		DeviceId:    genRandomString(8),
+		Name:        name,
+		CreatedTime: time.Now().Unix(),
+	}
+	u.UB.Create(&device)
+
+	log.Info().Str("userid", user.UID).Str("deviceId", device.DeviceId).Msg("added device")
+	return &device, nil
+}
+
+// Delete a device and all its data. The default device cannot be deleted.
+func (u *UserRepository) DeleteDevice(user *RMDUser, deviceId string) error {
+	if deviceId == "" || deviceId == DEFAULT_DEVICE_ID {
+		return ErrDeviceIsDefault
+	}
+	device := u.UB.GetDevice(user, deviceId)
+	if device == nil {
+		return ErrDeviceNotFound
+	}
+
+	pictureBlobs := u.UB.GetDevicePictureBlobNames(device)
+	uploads := u.UB.GetDevicePictureUploads(device)
+
+	u.UB.DeleteDevice(device)
+
+	for _, name := range pictureBlobs {
+		err := u.UB.Pictures.Delete(name)
+		if err != nil {
+			log.Error().Err(err).Str("blobName", name).Msg("failed to delete picture blob")
+		}
+	}
+	for _, upload := range uploads {
+		u.UB.Pictures.DeleteUpload(upload.Id)
+	}
+
+	initializeUserMetrics(u.UB)
+	UpdatePushServerMetrics(device.PushUrl, "")
+	u.Devices.DisconnectDevice(device.Key())
+
+	log.Info().Str("userid", user.UID).Str("deviceId", device.DeviceId).Msg("deleted device")
+	return nil
+}
+
+// Record that the device itself contacted the server.
+// The device struct is not changed, such that it can be shared between goroutines.
+func (u *UserRepository) touchDevice(device *Device) {
+	u.UB.SetDeviceLastSeenTime(device, time.Now().Unix())
+}
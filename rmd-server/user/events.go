@@ -0,0 +1,239 @@
+package user
+
+import (
+	"encoding/json"
+	"errors"
+	"rmd-server/metrics"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// In-process publish/subscribe hub for account events.
+//
+// Subscribers (e.g., an open Server-Sent Events stream of the web portal) are keyed by user id.
+// Publishing never blocks: if a subscriber is too slow and its buffer is full, the event is dropped.
+type EventHub struct {
+	mu          sync.Mutex
+	subscribers map[string]map[*EventSubscription]struct{}
+	isShutdown  bool
+}
+
+type Event struct {
+	Type  string // one of the EVENT_* values
+	Data  string // JSON-encoded payload
+	Scope Scope  // the scope that a subscriber needs to receive the event
+}
+
+type EventSubscription struct {
+	UserId string
+	C      <-chan Event // closed when the subscription ends
+	c      chan Event
+}
+
+const EVENT_LOCATION = "location"
+const EVENT_PICTURE = "picture"
+const EVENT_COMMAND = "command"
+
+// The scope that is needed for each type of event
+var eventScopes = map[string]Scope{
+	EVENT_LOCATION: ScopeLocationsRead,
+	EVENT_PICTURE:  ScopePicturesRead,
+	EVENT_COMMAND:  ScopeCommandsSend,
+}
+
+const EVENT_BUFFER_SIZE = 16
+
+// Event payloads
+
+type locationEvent struct {
+	Id           uint64
+	ReceivedTime int64
+	Device       string // Device.DeviceId
+}
+
+type pictureEvent struct {
+	Id     uint64
+	Device string // Device.DeviceId
+}
+
+// The command and its result are not included, such that they are only readable with commands:send.
+// The client fetches them from /commandStatus.
+type commandEvent struct {
+	CmdId  uint64
+	Status string
+	Device string // Device.DeviceId
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{
+		subscribers: make(map[string]map[*EventSubscription]struct{}),
+	}
+}
+
+func (h *EventHub) Subscribe(userId string) *EventSubscription {
+	c := make(chan Event, EVENT_BUFFER_SIZE)
+	sub := &EventSubscription{UserId: userId, C: c, c: c}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.isShutdown {
+		// Not registered, the caller sees it as ended right away
+		close(c)
+		return sub
+	}
+
+	subs, exists := h.subscribers[userId]
+	if !exists {
+		subs = make(map[*EventSubscription]struct{})
+		h.subscribers[userId] = subs
+	}
+	subs[sub] = struct{}{}
+	metrics.EventSubscribers.Inc()
+
+	return sub
+}
+
+// Remove the subscription and close its channel.
+// It is safe to call this multiple times.
+func (h *EventHub) Unsubscribe(sub *EventSubscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	subs, exists := h.subscribers[sub.UserId]
+	if !exists {
+		return
+	}
+	if _, exists := subs[sub]; !exists {
+		return
+	}
+
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(h.subscribers, sub.UserId)
+	}
+	close(sub.c)
+	metrics.EventSubscribers.Dec()
+}
+
+// End all subscriptions of the user, e.g., because the account was deleted.
+func (h *EventHub) UnsubscribeAll(userId string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subscribers[userId] {
+		close(sub.c)
+		metrics.EventSubscribers.Dec()
+	}
+	delete(h.subscribers, userId)
+}
+
+// End all subscriptions, because the server is shutting down.
+// Later subscriptions are ended right away.
+func (h *EventHub) Shutdown() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.isShutdown = true
+	for userId, subs := range h.subscribers {
+		for sub := range subs {
+			close(sub.c)
+			metrics.EventSubscribers.Dec()
+		}
+		delete(h.subscribers, userId)
+	}
+}
+
+// Send an event to all subscribers of the user.
+// The data is encoded as JSON.
+func (h *EventHub) Publish(userId string, eventType string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Error().Err(err).Str("eventType", eventType).Msg("failed to encode event")
+		return
+	}
+	event := Event{Type: eventType, Data: string(payload), Scope: eventScopes[eventType]}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subscribers[userId] {
+		select {
+		case sub.c <- event:
+		default:
+			log.Warn().Str("userid", userId).Str("eventType", eventType).Msg("event subscriber is too slow, dropping event")
+		}
+	}
+}
+
+// ------- Tickets -------
+
+// Browsers' EventSource cannot send the access token in a header or body.
+// Instead of putting the long-lived access token into the URL (and thus into proxy logs),
+// the client exchanges it for a ticket, which is only valid briefly and only once.
+
+const EVENT_TICKET_VALID_SECS = 30
+
+// Tickets can be requested by every logged-in client, thus limit the memory they can use.
+const EVENT_MAX_TICKETS = 10000
+
+var ErrTooManyEventTickets = errors.New("too many pending event tickets, try again later")
+
+type eventTicket struct {
+	expirationTime int64
+	accessToken    string
+}
+
+type EventTickets struct {
+	mu      sync.Mutex
+	tickets map[string]*eventTicket
+	now     func() time.Time
+}
+
+func NewEventTickets() *EventTickets {
+	return &EventTickets{
+		tickets: make(map[string]*eventTicket),
+		now:     time.Now,
+	}
+}
+
+func (t *EventTickets) Create(accessToken string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now().Unix()
+	for id, ticket := range t.tickets {
+		if ticket.expirationTime < now {
+			delete(t.tickets, id)
+		}
+	}
+	if len(t.tickets) >= EVENT_MAX_TICKETS {
+		return "", ErrTooManyEventTickets
+	}
+
+	id := genRandomString(32)
+	t.tickets[id] = &eventTicket{
+		expirationTime: now + EVENT_TICKET_VALID_SECS,
+		accessToken:    accessToken,
+	}
+	return id, nil
+}
+
+// Remove the ticket and return the access token that it was created for.
+// Returns false if the ticket does not exist or is expired.
+func (t *EventTickets) Take(id string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ticket, ok := t.tickets[id]
+	if !ok {
+		return "", false
+	}
+	delete(t.tickets, id)
+	if ticket.expirationTime < t.now().Unix() {
+		return "", false
+	}
+	return ticket.accessToken, true
+}
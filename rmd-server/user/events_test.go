@@ -0,0 +1,190 @@
+package user
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Receive from the channel until it is closed, fail if that takes too long
+func drainUntilClosed(t *testing.T, c <-chan Event) int {
+	t.Helper()
+	count := 0
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-c:
+			if !ok {
+				return count
+			}
+			count++
+		case <-timeout:
+			t.Fatal("subscription was not ended")
+		}
+	}
+}
+
+func TestEventHubDropsWhenFull(t *testing.T) {
+	hub := NewEventHub()
+	sub := hub.Subscribe("alice")
+	other := hub.Subscribe("bob")
+
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < EVENT_BUFFER_SIZE+5; i++ {
+			hub.Publish("alice", EVENT_LOCATION, locationEvent{Id: uint64(i)})
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing to a full subscriber blocked")
+	}
+
+	if len(sub.C) != EVENT_BUFFER_SIZE {
+		t.Errorf("expected %d buffered events, got %d", EVENT_BUFFER_SIZE, len(sub.C))
+	}
+	if len(other.C) != 0 {
+		t.Error("event was sent to another user")
+	}
+	event := <-sub.C
+	if event.Type != EVENT_LOCATION || event.Scope != ScopeLocationsRead || event.Data != `{"Id":0,"ReceivedTime":0,"Device":""}` {
+		t.Errorf("unexpected event: %+v", event)
+	}
+
+	// There is space again
+	hub.Publish("alice", EVENT_PICTURE, pictureEvent{Id: 1})
+	if len(sub.C) != EVENT_BUFFER_SIZE {
+		t.Error("event was dropped although the buffer had space")
+	}
+
+	hub.Unsubscribe(sub)
+	hub.Unsubscribe(sub)
+	if drainUntilClosed(t, sub.C) != EVENT_BUFFER_SIZE {
+		t.Error("buffered events were lost when unsubscribing")
+	}
+}
+
+func TestEventHubConcurrent(t *testing.T) {
+	hub := NewEventHub()
+	users := []string{"alice", "bob", "carol"}
+	stop := make(chan struct{})
+
+	var publishers sync.WaitGroup
+	for _, userId := range users {
+		publishers.Add(1)
+		go func() {
+			defer publishers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					hub.Publish(userId, EVENT_COMMAND, commandEvent{CmdId: 1})
+				}
+			}
+		}()
+	}
+
+	var subscribers sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		subscribers.Add(1)
+		go func() {
+			defer subscribers.Done()
+			sub := hub.Subscribe(users[i%len(users)])
+			for j := 0; j < 10; j++ {
+				<-sub.C
+			}
+			hub.Unsubscribe(sub)
+			for range sub.C {
+			}
+			hub.Unsubscribe(sub)
+		}()
+	}
+	// Meanwhile, end all subscriptions of one user repeatedly
+	for i := 0; i < 20; i++ {
+		hub.UnsubscribeAll("carol")
+		time.Sleep(time.Millisecond)
+	}
+
+	subscribers.Wait()
+	close(stop)
+	publishers.Wait()
+
+	if len(hub.subscribers) != 0 {
+		t.Errorf("subscriptions are left: %v", hub.subscribers)
+	}
+}
+
+func TestEventHubUnsubscribeAll(t *testing.T) {
+	hub := NewEventHub()
+	subs := []*EventSubscription{hub.Subscribe("alice"), hub.Subscribe("alice")}
+	other := hub.Subscribe("bob")
+
+	hub.UnsubscribeAll("alice")
+	for _, sub := range subs {
+		drainUntilClosed(t, sub.C)
+		// Unsubscribing afterwards must not close the channel again
+		hub.Unsubscribe(sub)
+	}
+	hub.Publish("alice", EVENT_LOCATION, locationEvent{})
+
+	hub.Publish("bob", EVENT_LOCATION, locationEvent{})
+	if len(other.C) != 1 {
+		t.Error("subscription of another user was ended")
+	}
+}
+
+func TestDeleteUserEndsEventSubscriptions(t *testing.T) {
+	repo := newTestRepository(t, 0)
+	user, _ := newTestUser(t, repo, "alice")
+	sub := repo.Events.Subscribe(user.UID)
+
+	repo.DeleteUser(user)
+	drainUntilClosed(t, sub.C)
+	repo.Events.Unsubscribe(sub)
+}
+
+func TestEventHubShutdown(t *testing.T) {
+	hub := NewEventHub()
+	subs := make([]*EventSubscription, 0)
+	for i := 0; i < 3; i++ {
+		subs = append(subs, hub.Subscribe(fmt.Sprint(i)))
+	}
+
+	hub.Shutdown()
+	hub.Shutdown()
+	for _, sub := range subs {
+		drainUntilClosed(t, sub.C)
+		hub.Unsubscribe(sub)
+	}
+	drainUntilClosed(t, hub.Subscribe("late").C)
+}
+
+func TestEventTickets(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1_000_000, 0)}
+	tickets := NewEventTickets()
+	tickets.now = clock.Now
+
+	ticket, err := tickets.Create("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token, ok := tickets.Take(ticket); !ok || token != "token" {
+		t.Fatalf("valid ticket was rejected: %q %v", token, ok)
+	}
+	if _, ok := tickets.Take(ticket); ok {
+		t.Error("ticket was accepted twice")
+	}
+
+	expired, _ := tickets.Create("token")
+	clock.Advance(EVENT_TICKET_VALID_SECS*time.Second + time.Second)
+	if _, ok := tickets.Take(expired); ok {
+		t.Error("expired ticket was accepted")
+	}
+	if _, ok := tickets.Take("unknown"); ok {
+		t.Error("unknown ticket was accepted")
+	}
+}
@@ -0,0 +1,161 @@
+package user
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+var ErrGrantNotFound = errors.New("grant not found")
+var ErrGrantToSelf = errors.New("cannot grant access to the own account")
+var ErrGrantWrappedKeyMissing = errors.New("the wrapped key is missing")
+
+// ------- Database -------
+
+func (db *RMDDB) SaveGrant(grant *Grant) {
+	db.DB.Save(grant)
+}
+
+func (db *RMDDB) GetGrant(ownerUid string, granteeId uint64) *Grant {
+	var grant Grant
+	db.DB.Where("owner_uid = ? AND grantee_id = ?", ownerUid, granteeId).Limit(1).Find(&grant)
+	if grant.Id == 0 {
+		return nil
+	}
+	return &grant
+}
+
+func (db *RMDDB) GetGrantsByOwner(ownerId uint64) []Grant {
+	grants := []Grant{}
+	db.DB.Where("owner_id = ?", ownerId).Order("id").Find(&grants)
+	return grants
+}
+
+func (db *RMDDB) GetGrantsForGrantee(granteeId uint64) []Grant {
+	grants := []Grant{}
+	db.DB.Where("grantee_id = ?", granteeId).Order("id").Find(&grants)
+	return grants
+}
+
+// Delete the grant if the user is its owner or its grantee.
+func (db *RMDDB) DeleteGrant(userId uint64, grantId uint64) *Grant {
+	var grant Grant
+	db.DB.Where("id = ? AND (owner_id = ? OR grantee_id = ?)", grantId, userId, userId).Limit(1).Find(&grant)
+	if grant.Id == 0 {
+		return nil
+	}
+	db.DB.Delete(&grant)
+	return &grant
+}
+
+// ------- Repository -------
+
+// Grant the grantee access to the owner's data, or replace the existing grant to that grantee.
+//
+// wrappedKey is the owner's private key, wrapped by the owner's client for the grantee's public key.
+// The server only stores it and hands it to the grantee.
+func (u *UserRepository) CreateGrant(owner *RMDUser, granteeId string, scopes []string, wrappedKey string) (*Grant, error) {
+	encodedScopes, err := EncodeGrantScopes(scopes)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(wrappedKey) == "" {
+		return nil, ErrGrantWrappedKeyMissing
+	}
+	grantee, err := u.UB.GetByID(granteeId)
+	if err != nil {
+		return nil, err
+	}
+	if grantee.Id == owner.Id {
+		return nil, ErrGrantToSelf
+	}
+
+	grant := u.UB.GetGrant(owner.UID, grantee.Id)
+	if grant == nil {
+		grant = &Grant{
+			OwnerID:     owner.Id,
+			OwnerUID:    owner.UID,
+			GranteeID:   grantee.Id,
+			GranteeUID:  grantee.UID,
+			CreatedTime: u.ACC.now().Unix(),
+		}
+	} else {
+		// The grantee's existing sessions still have the old scopes
+		u.ACC.RevokeGrantSessions(owner.UID, grant.Id)
+	}
+	grant.Scopes = encodedScopes
+	grant.WrappedKey = wrappedKey
+	u.UB.SaveGrant(grant)
+
+	log.Info().
+		Str("userid", owner.UID).
+		Str("granteeId", grantee.UID).
+		Str("scopes", encodedScopes).
+		Msg("granted access")
+	return grant, nil
+}
+
+// Returns the grants that the user has given to other accounts.
+func (u *UserRepository) GetGrantsByOwner(user *RMDUser) []Grant {
+	return u.UB.GetGrantsByOwner(user.Id)
+}
+
+// Returns the grants that other accounts have given to the user.
+func (u *UserRepository) GetGrantsForGrantee(user *RMDUser) []Grant {
+	return u.UB.GetGrantsForGrantee(user.Id)
+}
+
+// Revoke a grant. Both the owner and the grantee can revoke it.
+// This also revokes the grantee's sessions on the owner's account.
+func (u *UserRepository) RevokeGrant(user *RMDUser, grantId uint64) error {
+	grant := u.UB.DeleteGrant(user.Id, grantId)
+	if grant == nil {
+		return ErrGrantNotFound
+	}
+	count := u.ACC.RevokeGrantSessions(grant.OwnerUID, grant.Id)
+
+	log.Info().
+		Str("userid", user.UID).
+		Str("ownerId", grant.OwnerUID).
+		Str("granteeId", grant.GranteeUID).
+		Int("revokedSessions", count).
+		Msg("revoked grant")
+	return nil
+}
+
+// Create a session on the owner's account for the grantee.
+//
+// The session has the scopes of the grant and no refresh token.
+// It does not outlive the grantee's own session (the session of granteeToken),
+// and it is revoked together with it.
+func (u *UserRepository) CreateDelegatedAccess(grantee *RMDUser, granteeToken string, ownerId string, request SessionRequest) (*AccessToken, *Grant, error) {
+	grant := u.UB.GetGrant(ownerId, grantee.Id)
+	if grant == nil {
+		return nil, nil, ErrGrantNotFound
+	}
+	granteeSession := u.ACC.GetSession(granteeToken)
+	if granteeSession == nil {
+		return nil, nil, ErrTokenNotFound
+	}
+
+	remaining := granteeSession.ExpirationTime - u.ACC.now().Unix()
+	if remaining <= 0 {
+		return nil, nil, ErrTokenExpired
+	}
+	if clampSessionDuration(request.DurationSeconds) > remaining {
+		request.DurationSeconds = uint64(remaining)
+	}
+	request.WithRefreshToken = false
+	request.Scopes = grant.Scopes
+	request.GrantId = grant.Id
+	request.ParentTokenHash = granteeSession.TokenHash
+
+	token := u.ACC.CreateNewAccessToken(grant.OwnerUID, request)
+
+	log.Info().
+		Str("userid", grant.OwnerUID).
+		Str("granteeId", grantee.UID).
+		Msg("delegated access")
+	return &token, grant, nil
+}
@@ -0,0 +1,184 @@
+package user
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// Invites to register an account.
+//
+// If RegistrationInviteOnly is set, registering needs a valid invite code.
+// Otherwise, an invite is optional (e.g., to reserve a username for someone).
+// Invites are managed by the admins, with the CLI ("rmd-server invite") or the admin API (/admin/invites).
+
+const INVITE_CODE_LENGTH = 20
+const INVITE_NOTE_MAX_LENGTH = 256
+
+var ErrInviteInvalid = errors.New("invite code not valid")
+var ErrInviteUsernameMismatch = errors.New("this invite is for another username")
+var ErrInviteMaxUsesInvalid = errors.New("the maximum number of uses must be at least 1")
+var ErrInviteNoteTooLong = errors.New("the note must be <= 256 characters")
+var ErrInviteNotFound = errors.New("invite not found")
+
+func (i *Invite) IsExpired(now time.Time) bool {
+	return i.ExpirationTime != 0 && i.ExpirationTime <= now.Unix()
+}
+
+// Whether the invite can still be used
+func (i *Invite) IsValid(now time.Time) bool {
+	return !i.IsExpired(now) && i.Uses < i.MaxUses
+}
+
+// ------- Database -------
+
+func (db *RMDDB) GetInvites() []Invite {
+	invites := []Invite{}
+	db.DB.Order("id ASC").Find(&invites)
+	return invites
+}
+
+func (db *RMDDB) GetInviteByHash(codeHash string) *Invite {
+	var invite Invite
+	db.DB.Where("code_hash = ?", codeHash).Limit(1).Find(&invite)
+	if invite.Id == 0 {
+		return nil
+	}
+	return &invite
+}
+
+func (db *RMDDB) DeleteInvite(id uint64) bool {
+	res := db.DB.Where("id = ?", id).Delete(&Invite{})
+	return res.RowsAffected > 0
+}
+
+// Atomically count a use of the invite. Returns false if it is used up or expired.
+func (db *RMDDB) UseInvite(invite *Invite, now int64) bool {
+	res := db.DB.Model(&Invite{}).
+		Where("id = ? AND uses < max_uses AND (expiration_time = 0 OR expiration_time > ?)", invite.Id, now).
+		Update("uses", gorm.Expr("uses + 1"))
+	if res.RowsAffected == 0 {
+		return false
+	}
+	invite.Uses++
+	return true
+}
+
+func (db *RMDDB) UnuseInvite(invite *Invite) {
+	db.DB.Model(&Invite{}).Where("id = ? AND uses > 0", invite.Id).Update("uses", gorm.Expr("uses - 1"))
+	invite.Uses--
+}
+
+// Returns the ids of the accounts registered with the invite
+func (db *RMDDB) GetInviteUsers(invite *Invite) []string {
+	ids := []string{}
+	db.DB.Model(&RMDUser{}).Where("invite_id = ?", invite.Id).Order("id ASC").Pluck("uid", &ids)
+	return ids
+}
+
+// ------- Repository -------
+
+// Whether the account is listed in AdminUsers
+func (u *UserRepository) IsAdmin(user *RMDUser) bool {
+	return slices.Contains(u.Admins, user.UID)
+}
+
+// Create an invite. A validFor of 0 creates an invite that does not expire.
+// Returns the code. Only its hash is stored, thus it cannot be shown again.
+func (u *UserRepository) CreateInvite(maxUses int64, validFor time.Duration, username string, note string) (string, *Invite, error) {
+	if maxUses < 1 {
+		return "", nil, ErrInviteMaxUsesInvalid
+	}
+	if username != "" {
+		if !IsUserIdValid(username) {
+			return "", nil, ErrUsernameInvalid
+		}
+		if len(username) > USERNAME_MAX_LENGTH {
+			return "", nil, ErrUsernameTooLong
+		}
+	}
+	if len(note) > INVITE_NOTE_MAX_LENGTH {
+		return "", nil, ErrInviteNoteTooLong
+	}
+
+	now := time.Now()
+	code := genRandomString(INVITE_CODE_LENGTH)
+	invite := Invite{
+		CodeHash:    hashAccessToken(code),
+		Username:    username,
+		Note:        note,
+		MaxUses:     maxUses,
+		CreatedTime: now.Unix(),
+	}
+	if validFor > 0 {
+		invite.ExpirationTime = now.Add(validFor).Unix()
+	}
+	u.UB.Create(&invite)
+
+	log.Info().Uint64("inviteId", invite.Id).Int64("maxUses", maxUses).Str("username", username).Msg("created invite")
+	return code, &invite, nil
+}
+
+func (u *UserRepository) GetInvites() []Invite {
+	return u.UB.GetInvites()
+}
+
+func (u *UserRepository) GetInviteUsers(invite *Invite) []string {
+	return u.UB.GetInviteUsers(invite)
+}
+
+func (u *UserRepository) DeleteInvite(id uint64) error {
+	if !u.UB.DeleteInvite(id) {
+		return ErrInviteNotFound
+	}
+	log.Info().Uint64("inviteId", id).Msg("deleted invite")
+	return nil
+}
+
+// Use the invite for registering the requested username.
+// Returns the invite and the username to register (the invite's username, if it has one).
+// If the registration fails afterwards, the use must be returned with ReleaseInvite.
+func (u *UserRepository) RedeemInvite(code string, requestedUsername string) (*Invite, string, error) {
+	invite := u.UB.GetInviteByHash(hashAccessToken(strings.TrimSpace(code)))
+	if invite == nil {
+		return nil, "", ErrInviteInvalid
+	}
+	if invite.Username != "" {
+		if requestedUsername != "" && requestedUsername != invite.Username {
+			return nil, "", ErrInviteUsernameMismatch
+		}
+		requestedUsername = invite.Username
+	}
+	if !u.UB.UseInvite(invite, time.Now().Unix()) {
+		return nil, "", ErrInviteInvalid
+	}
+	return invite, requestedUsername, nil
+}
+
+func (u *UserRepository) ReleaseInvite(invite *Invite) {
+	u.UB.UnuseInvite(invite)
+}
+
+// Turn the deprecated RegistrationToken into an invite with unlimited uses,
+// such that clients that know the token can still register.
+// Does nothing if the invite exists already.
+func (u *UserRepository) MigrateRegistrationToken(token string) {
+	codeHash := hashAccessToken(strings.TrimSpace(token))
+	if u.UB.GetInviteByHash(codeHash) != nil {
+		return
+	}
+
+	invite := Invite{
+		CodeHash:    codeHash,
+		Note:        "RegistrationToken",
+		MaxUses:     math.MaxInt64,
+		CreatedTime: time.Now().Unix(),
+	}
+	u.UB.Create(&invite)
+	log.Info().Uint64("inviteId", invite.Id).Msg("migrated the RegistrationToken to an invite")
+}
@@ -0,0 +1,127 @@
+package user
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRedeemInvite(t *testing.T) {
+	repo := newTestRepository(t, 0)
+	code, invite, err := repo.CreateInvite(2, 0, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := repo.RedeemInvite("wrong", "alice"); err != ErrInviteInvalid {
+		t.Errorf("unknown code: expected ErrInviteInvalid, got %v", err)
+	}
+	redeemed, username, err := repo.RedeemInvite(" "+code+"\n", "alice")
+	if err != nil || redeemed.Id != invite.Id || username != "alice" {
+		t.Fatalf("expected the invite for alice, got %v %q %v", redeemed, username, err)
+	}
+	if _, _, err := repo.RedeemInvite(code, "bob"); err != nil {
+		t.Fatalf("second use failed: %v", err)
+	}
+	if _, _, err := repo.RedeemInvite(code, "carol"); err != ErrInviteInvalid {
+		t.Errorf("used up invite: expected ErrInviteInvalid, got %v", err)
+	}
+
+	// A failed registration returns the use
+	repo.ReleaseInvite(redeemed)
+	if stored := repo.UB.GetInviteByHash(invite.CodeHash); stored.Uses != 1 {
+		t.Errorf("released invite has %d uses instead of 1", stored.Uses)
+	}
+	if _, _, err := repo.RedeemInvite(code, "carol"); err != nil {
+		t.Errorf("released use cannot be redeemed again: %v", err)
+	}
+}
+
+func TestRedeemInviteWithUsername(t *testing.T) {
+	repo := newTestRepository(t, 0)
+	code, _, err := repo.CreateInvite(3, 0, "alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := repo.RedeemInvite(code, "bob"); err != ErrInviteUsernameMismatch {
+		t.Errorf("expected ErrInviteUsernameMismatch, got %v", err)
+	}
+	for _, requested := range []string{"alice", ""} {
+		_, username, err := repo.RedeemInvite(code, requested)
+		if err != nil || username != "alice" {
+			t.Errorf("requested %q: expected alice, got %q %v", requested, username, err)
+		}
+	}
+	invite := repo.UB.GetInviteByHash(hashAccessToken(code))
+	if invite.Uses != 2 {
+		t.Errorf("the mismatch was counted as a use: %d uses", invite.Uses)
+	}
+}
+
+func TestRedeemInviteExpired(t *testing.T) {
+	repo := newTestRepository(t, 0)
+	code, invite, err := repo.CreateInvite(1, time.Hour, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if invite.IsExpired(now) || !invite.IsValid(now) {
+		t.Fatal("new invite is not valid")
+	}
+
+	expired := now.Add(-time.Minute).Unix()
+	repo.UB.DB.Model(&Invite{}).Where("id = ?", invite.Id).Update("expiration_time", expired)
+	invite.ExpirationTime = expired
+	if !invite.IsExpired(now) || invite.IsValid(now) {
+		t.Error("expired invite is still valid")
+	}
+	if _, _, err := repo.RedeemInvite(code, "alice"); err != ErrInviteInvalid {
+		t.Errorf("expected ErrInviteInvalid, got %v", err)
+	}
+	if repo.UB.GetInviteByHash(hashAccessToken(code)).Uses != 0 {
+		t.Error("use of the expired invite was counted")
+	}
+}
+
+func TestUseInvite(t *testing.T) {
+	repo := newTestRepository(t, 0)
+	_, invite, err := repo.CreateInvite(1, 0, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both hold a copy that still has uses left, only one of them may use it
+	first := *invite
+	second := *invite
+	if !repo.UB.UseInvite(&first, time.Now().Unix()) {
+		t.Fatal("first use failed")
+	}
+	if repo.UB.UseInvite(&second, time.Now().Unix()) {
+		t.Error("invite was used beyond its maximum")
+	}
+	if first.Uses != 1 || second.Uses != 0 {
+		t.Errorf("wrong uses: %d and %d", first.Uses, second.Uses)
+	}
+
+	repo.UB.UnuseInvite(&first)
+	repo.UB.UnuseInvite(&first)
+	if stored := repo.UB.GetInviteByHash(invite.CodeHash); stored.Uses != 0 {
+		t.Errorf("uses went below 0: %d", stored.Uses)
+	}
+}
+
+func TestMigrateRegistrationToken(t *testing.T) {
+	repo := newTestRepository(t, 0)
+	repo.MigrateRegistrationToken("token")
+	repo.MigrateRegistrationToken("token")
+
+	invites := repo.GetInvites()
+	if len(invites) != 1 {
+		t.Fatalf("expected 1 invite, got %d", len(invites))
+	}
+	for _, username := range []string{"alice", "bob"} {
+		if _, _, err := repo.RedeemInvite("token", username); err != nil {
+			t.Errorf("token cannot be used by %s: %v", username, err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package user
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"rmd-server/migrations"
@@ -11,11 +12,11 @@ import (
 	"gorm.io/gorm"
 )
 
-const CurrentSqlVersion = 3
+const CurrentSqlVersion = 22
 
 const KeyVersion = "rmd_db_version"
 
-func migrateDatabase(db *gorm.DB) {
+func migrateDatabase(db *gorm.DB, pictures *PictureStore) {
 	log.Info().Msg("migrating database...")
 
 	// This initial migration MUST be idempotent.
@@ -52,28 +53,92 @@ func migrateDatabase(db *gorm.DB) {
 		return
 	}
 
-	if actualVersion < 2 {
-		err := runMigration("000002_add_last_seen_time", db)
+	runMigrationSteps(db, actualVersion, migrationSteps(pictures))
+
+	if actualVersion < 9 {
+		// Give the space of the pictures that were moved into files back to the file system.
+		// This cannot run inside the transaction of the step.
+		err := db.Exec("VACUUM").Error
 		if err != nil {
-			log.Fatal().Err(err).Msg("failed migration=000002_add_last_seen_time")
-			return
+			log.Warn().Err(err).Msg("failed to vacuum database")
 		}
 	}
 
-	if actualVersion < 3 {
-		migrateToV2Passwords(db)
-	}
-
 	// Use this to let GORM write a migration. Then inspect the created SQLite schema,
 	// and write an "up" migration from hand.
 	// db.AutoMigrate(&DBSetting{})
 
-	// Set this at the end. This way, if the migrations are interrupted
-	// (e.g., the program cancelled), they are re-run upon the next start.
-	db.Model(&dbSetting).Update("Value", fmt.Sprint(CurrentSqlVersion))
 	log.Info().Msg("database successfully migrated")
 }
 
+// A step that migrates the database to the given schema version.
+type migrationStep struct {
+	version int
+	name    string         // SQL migration in the migrations package, empty if the step has none
+	migrate func(*gorm.DB) // data migration that runs after the SQL, nil if the step has none
+}
+
+func migrationSteps(pictures *PictureStore) []migrationStep {
+	return []migrationStep{
+		{version: 2, name: "000002_add_last_seen_time"},
+		{version: 3, migrate: migrateToV2Passwords},
+		{version: 4, name: "000003_add_pending_commands"},
+		{version: 5, name: "000004_add_command_status"},
+		{version: 6, name: "000005_add_command_logs"},
+		{version: 7, name: "000006_add_location_received_time"},
+		{version: 8, name: "000007_add_location_size", migrate: migrateLocationsStripAccessToken},
+		{version: 9, name: "000008_add_picture_files", migrate: func(tx *gorm.DB) {
+			migratePicturesToFiles(tx, pictures)
+		}},
+		{version: 10, name: "000009_add_picture_received_time"},
+		{version: 11, name: "000010_add_quotas"},
+		{version: 12, name: "000011_add_sessions"},
+		{version: 13, name: "000012_add_session_info"},
+		{version: 14, name: "000013_add_refresh_tokens"},
+		{version: 15, name: "000014_add_session_scopes"},
+		{version: 16, name: "000015_add_grants"},
+		{version: 17, name: "000016_add_devices"},
+		{version: 18, name: "000017_add_totp"},
+		{version: 19, name: "000018_add_passkeys"},
+		{version: 20, name: "000019_add_invites"},
+		{version: 21, name: "000020_add_account_lock"},
+		{version: CurrentSqlVersion, name: "000021_add_session_parent"},
+	}
+}
+
+// Run the steps that are newer than actualVersion.
+//
+// Most SQL migrations are not idempotent (e.g., ADD COLUMN). Thus each step and the update
+// of the schema version run in one transaction: if the migrations are interrupted
+// (e.g., the program cancelled), the current step is rolled back and re-run upon the next start.
+func runMigrationSteps(db *gorm.DB, actualVersion int, steps []migrationStep) {
+	for _, step := range steps {
+		if actualVersion >= step.version {
+			continue
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if step.name != "" {
+				err := runMigration(step.name, tx)
+				if err != nil {
+					return err
+				}
+			}
+			if step.migrate != nil {
+				step.migrate(tx)
+			}
+			return tx.Model(&DBSetting{}).
+				Where("setting = ?", KeyVersion).
+				Update("value", fmt.Sprint(step.version)).
+				Error
+		})
+		if err != nil {
+			log.Fatal().Err(err).Int("version", step.version).Str("name", step.name).Msg("failed migration")
+			return
+		}
+	}
+}
+
 func runMigration(name string, db *gorm.DB) error {
 	log.Info().Str("name", name).Msg("running sql")
 	sql, err := migrations.MigrationFS.ReadFile(fmt.Sprintf("%s.up.sql", name))
@@ -108,3 +173,84 @@ func migrateToV2Passwords(db *gorm.DB) {
 		db.Save(u)
 	}
 }
+
+// DB Version 8
+
+// Locations used to be stored as the full JSON DataPackage sent by the device,
+// including the access token (IDT). Rewrite them to only contain the encrypted location.
+func migrateLocationsStripAccessToken(db *gorm.DB) {
+	var locations []Location
+	var migrated int
+
+	// Idempotence: only JSON rows need to be migrated, encrypted locations are base64.
+	res := db.Where("position LIKE ?", "{%").FindInBatches(&locations, 100, func(tx *gorm.DB, batch int) error {
+		for _, loc := range locations {
+			var pkg struct {
+				IDT  string
+				Data string
+			}
+			err := json.Unmarshal([]byte(loc.Position), &pkg)
+			if err != nil {
+				log.Warn().Err(err).Uint64("locationId", loc.Id).Msg("failed to parse stored location, skipping")
+				continue
+			}
+
+			err = tx.Model(&Location{}).
+				Where("id = ?", loc.Id).
+				Updates(map[string]interface{}{"position": pkg.Data, "size": len(pkg.Data)}).
+				Error
+			if err != nil {
+				return err
+			}
+			migrated++
+		}
+
+		log.Info().Int("migrated", migrated).Msg("migrating locations")
+		return nil
+	})
+	if res.Error != nil {
+		log.Fatal().Err(res.Error).Msg("failed to strip access tokens from locations")
+		return
+	}
+
+	// Locations that were already in the new format only need their size
+	db.Exec("UPDATE `locations` SET `size` = length(`position`) WHERE `size` = 0")
+}
+
+// DB Version 9
+
+// Pictures used to be stored in the pictures.content column.
+// Move them into the PictureStore, and only keep the blob name in the database.
+// If the step is rolled back, the pictures are written to the store again when it is re-run.
+func migratePicturesToFiles(db *gorm.DB, pictures *PictureStore) {
+	var pics []Picture
+	var migrated int
+
+	// Idempotence: only pictures that still have content need to be migrated.
+	res := db.Where("content <> '' AND blob_name = ''").FindInBatches(&pics, 10, func(tx *gorm.DB, batch int) error {
+		for _, pic := range pics {
+			size := int64(len(pic.Content))
+			name, err := pictures.Put(strings.NewReader(pic.Content), size)
+			if err != nil {
+				return err
+			}
+
+			err = tx.Model(&Picture{}).
+				Where("id = ?", pic.Id).
+				Updates(map[string]interface{}{"content": "", "blob_name": name, "size": size}).
+				Error
+			if err != nil {
+				pictures.Delete(name)
+				return err
+			}
+			migrated++
+		}
+
+		log.Info().Int("migrated", migrated).Msg("moving pictures to the picture store")
+		return nil
+	})
+	if res.Error != nil {
+		log.Fatal().Err(res.Error).Msg("failed to move pictures to the picture store")
+		return
+	}
+}
@@ -0,0 +1,267 @@
+package user
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"rmd-server/blobstore"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Empty database in a temporary directory
+func newEmptyTestDB(t *testing.T) (*gorm.DB, *PictureStore) {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "rmd.sqlite")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs, err := blobstore.NewLocalBlobStore(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, NewPictureStore(blobs, filepath.Join(dir, "uploads"))
+}
+
+// Database with the layout of version 7 (before the locations were stripped
+// and the pictures were moved into files), and one user.
+func newLegacyTestDB(t *testing.T) (*gorm.DB, *PictureStore) {
+	t.Helper()
+	db, pictures := newEmptyTestDB(t)
+	for _, name := range []string{
+		"000001_create_tables",
+		"000002_add_last_seen_time",
+		"000003_add_pending_commands",
+		"000004_add_command_status",
+		"000005_add_command_logs",
+		"000006_add_location_received_time",
+	} {
+		if err := runMigration(name, db); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	db.Create(&DBSetting{Setting: KeyVersion, Value: "7"})
+	db.Exec("INSERT INTO `rmd_users` (`id`, `uid`, `hashed_password`) VALUES (1, 'alice', ?)", PwPrefixV2)
+	return db, pictures
+}
+
+// Run the migrations, then run them again to check that nothing changes
+func migrateTwice(t *testing.T, db *gorm.DB, pictures *PictureStore, check func()) {
+	t.Helper()
+	migrateDatabase(db, pictures)
+	check()
+
+	var version DBSetting
+	db.First(&version, "setting = ?", KeyVersion)
+	if version.Value != fmt.Sprint(CurrentSqlVersion) {
+		t.Errorf("database was not migrated to the current version: %s", version.Value)
+	}
+
+	// Second start: the version is current, nothing is run
+	migrateDatabase(db, pictures)
+	check()
+}
+
+func TestMigrateLocationsStripAccessToken(t *testing.T) {
+	db, pictures := newLegacyTestDB(t)
+	db.Exec("INSERT INTO `locations` (`id`, `user_id`, `position`) VALUES (1, 1, ?), (2, 1, ?), (3, 1, ?)",
+		`{"IDT":"secret-token","Data":"ZW5jcnlwdGVk"}`,
+		"YWxyZWFkeSBtaWdyYXRlZA==",
+		"{not json",
+	)
+
+	expected := []Location{
+		{Id: 1, Position: "ZW5jcnlwdGVk", Size: 12},
+		{Id: 2, Position: "YWxyZWFkeSBtaWdyYXRlZA==", Size: 24},
+		// Broken rows are kept as they are
+		{Id: 3, Position: "{not json", Size: 9},
+	}
+	check := func() {
+		t.Helper()
+		var locations []Location
+		db.Order("id").Find(&locations)
+		if len(locations) != len(expected) {
+			t.Fatalf("expected %d locations, got %d", len(expected), len(locations))
+		}
+		for i, loc := range locations {
+			// Only compare the columns of this migration
+			loc = Location{Id: loc.Id, Position: loc.Position, Size: loc.Size}
+			if loc != expected[i] {
+				t.Errorf("unexpected location: %+v, expected %+v", loc, expected[i])
+			}
+		}
+	}
+	migrateTwice(t, db, pictures, check)
+
+	// The data migration itself is idempotent, too
+	migrateLocationsStripAccessToken(db)
+	check()
+}
+
+func TestMigratePicturesToFiles(t *testing.T) {
+	db, pictures := newLegacyTestDB(t)
+	contents := []string{"first picture", "second picture"}
+	for i, content := range contents {
+		db.Exec("INSERT INTO `pictures` (`id`, `user_id`, `content`) VALUES (?, 1, ?)", i+1, content)
+	}
+
+	var blobNames []string
+	check := func() {
+		t.Helper()
+		var pics []Picture
+		db.Order("id").Find(&pics)
+		if len(pics) != len(contents) {
+			t.Fatalf("expected %d pictures, got %d", len(contents), len(pics))
+		}
+		for i, pic := range pics {
+			if pic.Content != "" || pic.BlobName == "" || pic.Size != int64(len(contents[i])) {
+				t.Errorf("picture was not moved: %+v", pic)
+				continue
+			}
+			stored, err := pictures.Read(pic.BlobName)
+			if err != nil || stored != contents[i] {
+				t.Errorf("unexpected stored picture: %q %v", stored, err)
+			}
+			// Pictures must not be moved twice
+			if len(blobNames) < len(pics) {
+				blobNames = append(blobNames, pic.BlobName)
+			} else if pic.BlobName != blobNames[i] {
+				t.Errorf("picture was moved again: %s, before %s", pic.BlobName, blobNames[i])
+			}
+		}
+	}
+	migrateTwice(t, db, pictures, check)
+
+	// The data migration itself is idempotent, too
+	migratePicturesToFiles(db, pictures)
+	check()
+
+	// The moved pictures count towards the quota with their size
+	rmdDB := &RMDDB{DB: db, Pictures: pictures}
+	if sum := rmdDB.SumPictureSizes(&RMDUser{Id: 1}); sum != int64(len(contents[0])+len(contents[1])) {
+		t.Errorf("moved pictures have a total size of %d", sum)
+	}
+}
+
+func getSchemaVersion(db *gorm.DB) string {
+	var version DBSetting
+	db.First(&version, "setting = ?", KeyVersion)
+	return version.Value
+}
+
+// Run the steps like migrateDatabase, but stop like a crash at the end of the step to the given version
+func runMigrationStepsInterrupted(t *testing.T, db *gorm.DB, pictures *PictureStore, actualVersion int, interruptedVersion int) {
+	t.Helper()
+	steps := migrationSteps(pictures)
+	for i, step := range steps {
+		if step.version == interruptedVersion {
+			migrate := step.migrate
+			steps[i].migrate = func(tx *gorm.DB) {
+				if migrate != nil {
+					migrate(tx)
+				}
+				panic("interrupted")
+			}
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("step to version %d was not run", interruptedVersion)
+		}
+	}()
+	runMigrationSteps(db, actualVersion, steps)
+}
+
+// Interrupting any step leaves the database at the previous version, and the next start continues from there
+func TestMigrateDatabaseInterrupted(t *testing.T) {
+	for _, step := range migrationSteps(nil) {
+		t.Run(fmt.Sprint(step.version), func(t *testing.T) {
+			t.Parallel()
+			db, pictures := newEmptyTestDB(t)
+			runMigration("000001_create_tables", db)
+			db.Create(&DBSetting{Setting: KeyVersion, Value: "0"})
+
+			runMigrationStepsInterrupted(t, db, pictures, 0, step.version)
+			previous := step.version - 1
+			if step.version == 2 {
+				previous = 0
+			}
+			if version := getSchemaVersion(db); version != fmt.Sprint(previous) {
+				t.Fatalf("expected version %d after the interruption, got %s", previous, version)
+			}
+
+			// Failing SQL would stop the test binary with log.Fatal
+			migrateDatabase(db, pictures)
+			if version := getSchemaVersion(db); version != fmt.Sprint(CurrentSqlVersion) {
+				t.Errorf("database was not migrated to the current version: %s", version)
+			}
+		})
+	}
+}
+
+// Interrupting the picture migration rolls back the pictures that were already moved
+func TestMigratePicturesToFilesInterrupted(t *testing.T) {
+	db, pictures := newLegacyTestDB(t)
+	db.Exec("INSERT INTO `pictures` (`id`, `user_id`, `content`) VALUES (1, 1, 'picture')")
+	db.Exec("INSERT INTO `locations` (`id`, `user_id`, `position`) VALUES (1, 1, ?)", `{"IDT":"secret-token","Data":"ZW5jcnlwdGVk"}`)
+
+	runMigrationStepsInterrupted(t, db, pictures, 7, 9)
+	if version := getSchemaVersion(db); version != "8" {
+		t.Fatalf("expected version 8 after the interruption, got %s", version)
+	}
+	var content string
+	db.Raw("SELECT `content` FROM `pictures` WHERE `id` = 1").Scan(&content)
+	if content != "picture" {
+		t.Fatalf("moving the picture was not rolled back: %q", content)
+	}
+
+	migrateDatabase(db, pictures)
+	var pic Picture
+	db.First(&pic, 1)
+	if stored, err := pictures.Read(pic.BlobName); err != nil || stored != "picture" || pic.Content != "" {
+		t.Errorf("picture was not moved: %+v %q %v", pic, stored, err)
+	}
+	var loc Location
+	db.First(&loc, 1)
+	if loc.Position != "ZW5jcnlwdGVk" {
+		t.Errorf("location of the completed step was changed: %q", loc.Position)
+	}
+}
+
+func TestMigrateBackfillsReceivedTime(t *testing.T) {
+	db, pictures := newLegacyTestDB(t)
+	db.Exec("INSERT INTO `locations` (`id`, `user_id`, `position`) VALUES (1, 1, 'a'), (2, 1, 'b')")
+	before := time.Now().Unix()
+	migrateDatabase(db, pictures)
+	after := time.Now().Unix()
+
+	rmdDB := &RMDDB{DB: db, Pictures: pictures}
+	device := rmdDB.GetDevice(&RMDUser{Id: 1}, DEFAULT_DEVICE_ID)
+	if device == nil {
+		t.Fatal("default device was not created")
+	}
+	for _, loc := range rmdDB.GetLocations(device, 0, -1, 0, 0) {
+		if loc.ReceivedTime < before || loc.ReceivedTime > after {
+			t.Errorf("location %d: received time %d is not the time of the migration", loc.Id, loc.ReceivedTime)
+		}
+	}
+
+	// The migrated locations are found by a time range that contains the migration
+	if locations := rmdDB.GetLocations(device, 0, -1, before, after); len(locations) != 2 {
+		t.Errorf("expected 2 locations in the time range, got %d", len(locations))
+	}
+	if locations := rmdDB.GetLocations(device, 0, -1, 1, before-1); len(locations) != 0 {
+		t.Errorf("expected no locations before the migration, got %d", len(locations))
+	}
+	if locations := rmdDB.GetLocations(device, 1, -1, before, 0); len(locations) != 1 || locations[0].Id != 2 {
+		t.Errorf("expected location 2 after the cursor, got %v", locations)
+	}
+}
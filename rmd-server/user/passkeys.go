@@ -0,0 +1,346 @@
+package user
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"rmd-server/webauthn"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Passkeys (WebAuthn credentials) to log in to the web interface without typing the password.
+//
+// Registration (logged in):
+//  1. BeginPasskeyRegistration returns a challenge for navigator.credentials.create().
+//  2. FinishPasskeyRegistration verifies the browser's response and stores the passkey.
+//
+// Login:
+//  1. BeginPasskeyLogin returns a challenge and the account's credential ids for navigator.credentials.get().
+//  2. FinishPasskeyLogin verifies the assertion and creates the access token.
+//
+// A passkey replaces both the password and the TOTP code for the login.
+// It does not replace the password for decrypting the data: the private key is wrapped with the password.
+// Sessions of a passkey can only read the wrapped private key if the passkey was registered with ReleaseKey.
+
+const PASSKEY_NAME_MAX_LENGTH = 64
+const MAX_PASSKEYS_PER_ACCOUNT = 20
+
+const PASSKEY_CHALLENGE_VALID_SECS = 5 * 60
+
+// Login challenges can be requested without authentication, thus limit the memory they can use.
+const PASSKEY_MAX_CHALLENGES = 10000
+
+var ErrPasskeysDisabled = errors.New("passkeys are not enabled on this server")
+var ErrPasskeyChallengeInvalid = errors.New("passkey challenge not found or expired")
+var ErrPasskeyNotFound = errors.New("passkey not found")
+var ErrPasskeyExists = errors.New("passkey is already registered")
+var ErrPasskeyNameTooLong = errors.New("the passkey name must be <= 64 characters")
+var ErrTooManyPasskeys = errors.New("too many passkeys for this account")
+var ErrTooManyPasskeyChallenges = errors.New("too many pending passkey challenges, try again later")
+
+// ------- Challenges -------
+
+type passkeyChallenge struct {
+	expirationTime int64
+	userId         string
+	registration   bool
+}
+
+// The pending registrations and logins, in memory.
+// Each challenge can only be used once.
+type PasskeyChallenges struct {
+	mu         sync.Mutex
+	challenges map[string]*passkeyChallenge
+	now        func() time.Time
+}
+
+func NewPasskeyChallenges() *PasskeyChallenges {
+	return &PasskeyChallenges{
+		challenges: make(map[string]*passkeyChallenge),
+		now:        time.Now,
+	}
+}
+
+func (c *PasskeyChallenges) Create(userId string, registration bool) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now().Unix()
+	for id, challenge := range c.challenges {
+		if challenge.expirationTime < now {
+			delete(c.challenges, id)
+		}
+	}
+	if len(c.challenges) >= PASSKEY_MAX_CHALLENGES {
+		return "", ErrTooManyPasskeyChallenges
+	}
+
+	id := webauthn.NewChallenge()
+	c.challenges[id] = &passkeyChallenge{
+		expirationTime: now + PASSKEY_CHALLENGE_VALID_SECS,
+		userId:         userId,
+		registration:   registration,
+	}
+	return id, nil
+}
+
+// Remove the challenge and return its user id.
+// Returns false if the challenge does not exist, is expired, or is of the other kind.
+func (c *PasskeyChallenges) Take(id string, registration bool) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	challenge, ok := c.challenges[id]
+	if !ok {
+		return "", false
+	}
+	delete(c.challenges, id)
+	if challenge.expirationTime < c.now().Unix() || challenge.registration != registration {
+		return "", false
+	}
+	return challenge.userId, true
+}
+
+// ------- Database -------
+
+func (db *RMDDB) GetPasskeys(user *RMDUser) []Passkey {
+	passkeys := []Passkey{}
+	db.DB.Where("user_id = ?", user.Id).Order("id ASC").Find(&passkeys)
+	return passkeys
+}
+
+func (db *RMDDB) GetPasskey(user *RMDUser, credentialId string) *Passkey {
+	var passkey Passkey
+	db.DB.Where("user_id = ? AND credential_id = ?", user.Id, credentialId).Limit(1).Find(&passkey)
+	if passkey.Id == 0 {
+		return nil
+	}
+	return &passkey
+}
+
+func (db *RMDDB) CountPasskeys(user *RMDUser) int64 {
+	var count int64
+	db.DB.Model(&Passkey{}).Where("user_id = ?", user.Id).Count(&count)
+	return count
+}
+
+func (db *RMDDB) IsPasskeyRegistered(credentialId string) bool {
+	var count int64
+	db.DB.Model(&Passkey{}).Where("credential_id = ?", credentialId).Count(&count)
+	return count > 0
+}
+
+func (db *RMDDB) DeletePasskey(user *RMDUser, credentialId string) bool {
+	res := db.DB.Where("user_id = ? AND credential_id = ?", user.Id, credentialId).Delete(&Passkey{})
+	return res.RowsAffected > 0
+}
+
+// Atomically store the new signature counter. Returns false if a concurrent login already stored a newer one.
+func (db *RMDDB) UsePasskey(passkey *Passkey, signCount int64, lastUsed int64) bool {
+	res := db.DB.Model(&Passkey{}).
+		Where("id = ? AND sign_count = ?", passkey.Id, passkey.SignCount).
+		Updates(map[string]any{"sign_count": signCount, "last_used_time": lastUsed})
+	return res.RowsAffected > 0
+}
+
+// ------- Repository -------
+
+func (u *UserRepository) PasskeysEnabled() bool {
+	return u.WebAuthn != nil
+}
+
+func (u *UserRepository) GetPasskeys(user *RMDUser) []Passkey {
+	return u.UB.GetPasskeys(user)
+}
+
+// Start registering a passkey.
+// Returns the challenge and the account's existing passkeys (to exclude them).
+func (u *UserRepository) BeginPasskeyRegistration(user *RMDUser) (string, []Passkey, error) {
+	if !u.PasskeysEnabled() {
+		return "", nil, ErrPasskeysDisabled
+	}
+	if u.UB.CountPasskeys(user) >= MAX_PASSKEYS_PER_ACCOUNT {
+		return "", nil, ErrTooManyPasskeys
+	}
+	challenge, err := u.PasskeyChallenges.Create(user.UID, true)
+	if err != nil {
+		return "", nil, err
+	}
+	return challenge, u.UB.GetPasskeys(user), nil
+}
+
+func (u *UserRepository) FinishPasskeyRegistration(
+	user *RMDUser,
+	challenge string,
+	name string,
+	releaseKey bool,
+	clientDataJSON []byte,
+	attestationObject []byte,
+) (*Passkey, error) {
+	if !u.PasskeysEnabled() {
+		return nil, ErrPasskeysDisabled
+	}
+	if len(name) > PASSKEY_NAME_MAX_LENGTH {
+		return nil, ErrPasskeyNameTooLong
+	}
+	userId, ok := u.PasskeyChallenges.Take(challenge, true)
+	if !ok || userId != user.UID {
+		return nil, ErrPasskeyChallengeInvalid
+	}
+
+	cred, err := u.WebAuthn.VerifyRegistration(challenge, clientDataJSON, attestationObject)
+	if err != nil {
+		return nil, err
+	}
+
+	passkey := Passkey{
+		UserID:       user.Id,
+		CredentialId: base64.RawURLEncoding.EncodeToString(cred.ID),
+		PublicKey:    base64.StdEncoding.EncodeToString(cred.PublicKey),
+		Algorithm:    cred.Algorithm,
+		SignCount:    int64(cred.SignCount),
+		Name:         name,
+		ReleaseKey:   releaseKey,
+		CreatedTime:  time.Now().Unix(),
+	}
+	if u.UB.IsPasskeyRegistered(passkey.CredentialId) {
+		return nil, ErrPasskeyExists
+	}
+	u.UB.Create(&passkey)
+
+	log.Info().Str("userid", user.UID).Bool("releaseKey", releaseKey).Msg("registered passkey")
+	return &passkey, nil
+}
+
+func (u *UserRepository) DeletePasskey(user *RMDUser, credentialId string) error {
+	if !u.UB.DeletePasskey(user, credentialId) {
+		return ErrPasskeyNotFound
+	}
+	log.Info().Str("userid", user.UID).Msg("deleted passkey")
+	return nil
+}
+
+// Start a passkey login for the account.
+// Returns the challenge and the account's passkeys (to allow them).
+// For unknown accounts, this also returns a challenge (but no passkeys), such that the reply does not reveal
+// whether the account exists.
+func (u *UserRepository) BeginPasskeyLogin(id string) (string, []Passkey, error) {
+	if !u.PasskeysEnabled() {
+		return "", nil, ErrPasskeysDisabled
+	}
+	challenge, err := u.PasskeyChallenges.Create(id, false)
+	if err != nil {
+		return "", nil, err
+	}
+	user, err := u.UB.GetByID(id)
+	if err != nil {
+		return challenge, []Passkey{}, nil
+	}
+	return challenge, u.UB.GetPasskeys(user), nil
+}
+
+// Finish a passkey login (see BeginPasskeyLogin).
+// Like with a wrong password, failed attempts count towards locking the account.
+func (u *UserRepository) FinishPasskeyLogin(
+	challenge string,
+	credentialId string,
+	clientDataJSON []byte,
+	authenticatorData []byte,
+	signature []byte,
+	request SessionRequest,
+) (*AccessToken, error) {
+	if !u.PasskeysEnabled() {
+		return nil, ErrPasskeysDisabled
+	}
+	id, ok := u.PasskeyChallenges.Take(challenge, false)
+	if !ok {
+		return nil, ErrPasskeyChallengeInvalid
+	}
+	user, err := u.UB.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if u.isLoginBlocked(user) {
+		log.Warn().
+			Str("userid", user.UID).
+			Str("remoteIp", request.RemoteIp).
+			Msg("blocked login attempt")
+		return nil, ErrAccountLocked
+	}
+
+	passkey, err := u.verifyPasskeyAssertion(user, challenge, credentialId, clientDataJSON, authenticatorData, signature)
+	if err != nil {
+		u.ACC.IncrementLock(id)
+		// Same message as for a wrong password, such that fail2ban catches both (see docs/fail2ban.md)
+		log.Warn().
+			Err(err).
+			Str("userid", user.UID).
+			Str("remoteIp", request.RemoteIp).
+			Str("factor", "passkey").
+			Msg("failed login attempt")
+		return nil, err
+	}
+
+	scopes, err := passkeyScopes(passkey, request.Scopes)
+	if err != nil {
+		return nil, err
+	}
+	request.Scopes = scopes
+
+	token := u.finishLogin(user, request)
+	return &token, nil
+}
+
+func (u *UserRepository) verifyPasskeyAssertion(
+	user *RMDUser,
+	challenge string,
+	credentialId string,
+	clientDataJSON []byte,
+	authenticatorData []byte,
+	signature []byte,
+) (*Passkey, error) {
+	passkey := u.UB.GetPasskey(user, credentialId)
+	if passkey == nil {
+		return nil, ErrPasskeyNotFound
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(passkey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	cred := webauthn.Credential{
+		PublicKey: publicKey,
+		Algorithm: passkey.Algorithm,
+		SignCount: uint32(passkey.SignCount),
+	}
+	signCount, err := u.WebAuthn.VerifyAssertion(challenge, &cred, clientDataJSON, authenticatorData, signature)
+	if err != nil {
+		return nil, err
+	}
+	if !u.UB.UsePasskey(passkey, int64(signCount), time.Now().Unix()) {
+		return nil, webauthn.ErrSignCountInvalid
+	}
+	return passkey, nil
+}
+
+// Sessions of a passkey have the requested scopes, except reading the private key if the passkey does not release it.
+// The web interface always requests all scopes, thus key:read is dropped instead of rejecting the login.
+func passkeyScopes(passkey *Passkey, requested string) (string, error) {
+	if passkey.ReleaseKey {
+		return requested, nil
+	}
+	scopes := []string{}
+	for _, scope := range (&Session{Scopes: requested}).GetScopes() {
+		if scope != ScopeKeyRead {
+			scopes = append(scopes, string(scope))
+		}
+	}
+	if len(scopes) == 0 {
+		// "" would mean all scopes
+		return "", ErrScopeInvalid
+	}
+	return strings.Join(scopes, " "), nil
+}
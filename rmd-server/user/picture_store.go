@@ -0,0 +1,165 @@
+package user
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"rmd-server/blobstore"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+var ErrUploadOffsetMismatch = errors.New("upload offset does not match the received bytes")
+var ErrUploadTooLarge = errors.New("upload exceeds the announced size")
+var ErrUploadBusy = errors.New("another chunk of this upload is being received")
+
+// Stores the encrypted pictures in a BlobStore (by default, as files in the DatabaseDir),
+// so that they do not bloat the SQLite database.
+// The database only holds the names (Picture.BlobName).
+//
+// Each blob contains the encrypted picture exactly as the device sent it.
+// Unfinished uploads are always kept in a local directory until they are complete.
+type PictureStore struct {
+	blobs     blobstore.BlobStore
+	uploadDir string
+
+	mu            sync.Mutex
+	activeUploads map[string]struct{}
+}
+
+func NewPictureStore(blobs blobstore.BlobStore, uploadDir string) *PictureStore {
+	err := os.MkdirAll(uploadDir, 0770)
+	if err != nil {
+		log.Fatal().Err(err).Str("dir", uploadDir).Msg("failed to create upload directory")
+	}
+	return &PictureStore{blobs: blobs, uploadDir: uploadDir, activeUploads: make(map[string]struct{})}
+}
+
+func pictureKey(name string) string {
+	return "pictures/" + name
+}
+
+func (s *PictureStore) uploadPath(uploadId string) string {
+	// IDs are generated by the server, but be defensive anyway.
+	return filepath.Join(s.uploadDir, filepath.Base(uploadId))
+}
+
+// Store a new picture of the given size. Returns the name of the new blob.
+func (s *PictureStore) Put(r io.Reader, size int64) (string, error) {
+	name := genRandomString(32)
+	err := s.blobs.Put(pictureKey(name), r, size)
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func (s *PictureStore) Open(name string) (io.ReadCloser, error) {
+	return s.blobs.Get(pictureKey(name))
+}
+
+func (s *PictureStore) Read(name string) (string, error) {
+	r, err := s.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	content, err := io.ReadAll(r)
+	return string(content), err
+}
+
+// Delete the picture. Deleting a picture that does not exist is not an error.
+func (s *PictureStore) Delete(name string) error {
+	return s.blobs.Delete(pictureKey(name))
+}
+
+// ------- Chunked uploads -------
+
+// Return how many bytes of the upload have been received so far.
+func (s *PictureStore) UploadOffset(uploadId string) (int64, error) {
+	info, err := os.Stat(s.uploadPath(uploadId))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Append a chunk to the upload. The offset must equal the number of bytes received so far.
+// At most maxBytes are accepted. Returns the new offset.
+func (s *PictureStore) AppendUpload(uploadId string, offset int64, r io.Reader, maxBytes int64) (int64, error) {
+	// Only one chunk per upload at a time, otherwise the offsets would get mixed up.
+	s.mu.Lock()
+	_, busy := s.activeUploads[uploadId]
+	if !busy {
+		s.activeUploads[uploadId] = struct{}{}
+	}
+	s.mu.Unlock()
+	if busy {
+		return 0, ErrUploadBusy
+	}
+	defer func() {
+		s.mu.Lock()
+		delete(s.activeUploads, uploadId)
+		s.mu.Unlock()
+	}()
+
+	f, err := os.OpenFile(s.uploadPath(uploadId), os.O_WRONLY|os.O_CREATE, 0660)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	current, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if current != offset {
+		return current, ErrUploadOffsetMismatch
+	}
+
+	// Read one more byte than allowed to detect chunks that are too large.
+	written, err := io.Copy(f, io.LimitReader(r, maxBytes+1))
+	if written > maxBytes {
+		f.Truncate(current)
+		return current, ErrUploadTooLarge
+	}
+	if err != nil {
+		// Keep what was received. The client can resume from the new offset.
+		return current + written, err
+	}
+	err = f.Sync()
+	return current + written, err
+}
+
+// Move the finished upload into the store. Returns the name of the new blob.
+func (s *PictureStore) CompleteUpload(uploadId string) (string, error) {
+	f, err := os.Open(s.uploadPath(uploadId))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	name, err := s.Put(f, info.Size())
+	if err != nil {
+		return "", err
+	}
+	s.DeleteUpload(uploadId)
+	return name, nil
+}
+
+func (s *PictureStore) DeleteUpload(uploadId string) error {
+	err := os.Remove(s.uploadPath(uploadId))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
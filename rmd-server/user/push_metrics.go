@@ -24,33 +24,33 @@ const PUSH_URL_NTFY_SH = "https://ntfy.sh/"
 func InitializePushServerMetrics(db *RMDDB) {
 	// Conversations
 	var conversationsCount int64
-	db.DB.Model(&RMDUser{}).Where(fmt.Sprintf("push_url LIKE '%s%%'", PUSH_URL_CONVERSATIONS)).Count(&conversationsCount)
+	db.DB.Model(&Device{}).Where(fmt.Sprintf("push_url LIKE '%s%%'", PUSH_URL_CONVERSATIONS)).Count(&conversationsCount)
 	metrics.PushServers.WithLabelValues(LABEL_PUSH_CONVERSATIONS).Set(float64(conversationsCount))
 
 	// FCM
 	var fcmCount int64
-	db.DB.Model(&RMDUser{}).Where(fmt.Sprintf("push_url LIKE '%s%%'", PUSH_URL_FCM)).Count(&fcmCount)
+	db.DB.Model(&Device{}).Where(fmt.Sprintf("push_url LIKE '%s%%'", PUSH_URL_FCM)).Count(&fcmCount)
 	metrics.PushServers.WithLabelValues(LABEL_PUSH_FCM).Set(float64(fcmCount))
 
 	// Mozilla
 	var mozillaCount int64
-	db.DB.Model(&RMDUser{}).Where(fmt.Sprintf("push_url LIKE '%s%%'", PUSH_URL_MOZILLA)).Count(&mozillaCount)
+	db.DB.Model(&Device{}).Where(fmt.Sprintf("push_url LIKE '%s%%'", PUSH_URL_MOZILLA)).Count(&mozillaCount)
 	metrics.PushServers.WithLabelValues(LABEL_PUSH_MOZILLA).Set(float64(mozillaCount))
 
 	// Nextcloud
 	var nextcloudCount int64
-	db.DB.Model(&RMDUser{}).Where(fmt.Sprintf("push_url LIKE '%%%s%%'", PUSH_URL_NEXTCLOUD)).Count(&nextcloudCount) // sic
+	db.DB.Model(&Device{}).Where(fmt.Sprintf("push_url LIKE '%%%s%%'", PUSH_URL_NEXTCLOUD)).Count(&nextcloudCount) // sic
 	metrics.PushServers.WithLabelValues(LABEL_PUSH_NEXTCLOUD).Set(float64(nextcloudCount))
 
 	// ntfy.sh
 	var ntfyShCount int64
-	db.DB.Model(&RMDUser{}).Where(fmt.Sprintf("push_url LIKE '%s%%'", PUSH_URL_NTFY_SH)).Count(&ntfyShCount)
+	db.DB.Model(&Device{}).Where(fmt.Sprintf("push_url LIKE '%s%%'", PUSH_URL_NTFY_SH)).Count(&ntfyShCount)
 	metrics.PushServers.WithLabelValues(LABEL_PUSH_NTFYSH).Set(float64(ntfyShCount))
 
 	// Total
 	// Note that we don't set the total count as a metric. This is discouraged by Prometheus.
 	var totalCount int64
-	db.DB.Model(&RMDUser{}).Where("push_url IS NOT NULL AND push_URL <> ''").Count(&totalCount)
+	db.DB.Model(&Device{}).Where("push_url IS NOT NULL AND push_URL <> ''").Count(&totalCount)
 
 	// Other
 	otherCount := totalCount - conversationsCount - fcmCount - mozillaCount - nextcloudCount - ntfyShCount
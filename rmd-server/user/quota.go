@@ -0,0 +1,92 @@
+package user
+
+import "errors"
+
+var ErrPayloadTooLarge = errors.New("payload is larger than the maximum upload size")
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// Server-wide storage limits, in bytes. 0 means unlimited.
+type StorageLimits struct {
+	MaxUploadSize int64 // per location or picture
+	LocationQuota int64 // default per account, can be overridden with RMDUser.LocationQuota
+	PictureQuota  int64 // default per account, can be overridden with RMDUser.PictureQuota
+}
+
+// Special values for the per-account quota overrides
+const QuotaDefault = 0
+const QuotaUnlimited = -1
+
+type StorageUsage struct {
+	Locations     int64
+	LocationBytes int64
+	LocationQuota int64 // 0 means unlimited
+	Pictures      int64
+	PictureBytes  int64 // including unfinished uploads
+	PictureQuota  int64 // 0 means unlimited
+	MaxUploadSize int64 // 0 means unlimited
+}
+
+func effectiveQuota(override int64, serverDefault int64) int64 {
+	switch {
+	case override == QuotaUnlimited:
+		return 0
+	case override > 0:
+		return override
+	default:
+		return serverDefault
+	}
+}
+
+func (u *UserRepository) GetStorageUsage(user *RMDUser) StorageUsage {
+	return StorageUsage{
+		Locations:     u.UB.CountLocations(user),
+		LocationBytes: u.UB.SumLocationSizes(user),
+		LocationQuota: effectiveQuota(user.LocationQuota, u.Limits.LocationQuota),
+		Pictures:      u.UB.CountPictures(user),
+		PictureBytes:  u.UB.SumPictureSizes(user) + u.UB.SumPictureUploadSizes(user),
+		PictureQuota:  effectiveQuota(user.PictureQuota, u.Limits.PictureQuota),
+		MaxUploadSize: u.Limits.MaxUploadSize,
+	}
+}
+
+func (u *UserRepository) checkUploadSize(size int64) error {
+	if u.Limits.MaxUploadSize > 0 && size > u.Limits.MaxUploadSize {
+		return ErrPayloadTooLarge
+	}
+	return nil
+}
+
+// Check whether a new location of the given size fits into the quota of the user.
+func (u *UserRepository) checkLocationQuota(user *RMDUser, size int64) error {
+	err := u.checkUploadSize(size)
+	if err != nil {
+		return err
+	}
+	quota := effectiveQuota(user.LocationQuota, u.Limits.LocationQuota)
+	if quota > 0 && u.UB.SumLocationSizes(user)+size > quota {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// Check whether a new picture of the given size fits into the quota of the user.
+// Unfinished uploads count towards the quota with their announced size.
+func (u *UserRepository) checkPictureQuota(user *RMDUser, size int64) error {
+	err := u.checkUploadSize(size)
+	if err != nil {
+		return err
+	}
+	quota := effectiveQuota(user.PictureQuota, u.Limits.PictureQuota)
+	if quota > 0 && u.UB.SumPictureSizes(user)+u.UB.SumPictureUploadSizes(user)+size > quota {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// Override the quotas of the user (in bytes).
+// Use QuotaDefault for the server default, and QuotaUnlimited for no limit.
+func (u *UserRepository) SetQuotas(user *RMDUser, locationQuota int64, pictureQuota int64) {
+	user.LocationQuota = locationQuota
+	user.PictureQuota = pictureQuota
+	u.UB.DB.Model(user).Updates(map[string]interface{}{"location_quota": locationQuota, "picture_quota": pictureQuota})
+}
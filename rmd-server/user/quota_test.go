@@ -0,0 +1,105 @@
+package user
+
+import (
+	"strings"
+	"testing"
+)
+
+func checkPictureUsage(t *testing.T, repo *UserRepository, user *RMDUser, pictures int64, bytes int64) {
+	t.Helper()
+	usage := repo.GetStorageUsage(user)
+	if usage.Pictures != pictures || usage.PictureBytes != bytes {
+		t.Errorf("usage is %d pictures with %d bytes, expected %d with %d bytes", usage.Pictures, usage.PictureBytes, pictures, bytes)
+	}
+}
+
+func TestPictureQuota(t *testing.T) {
+	repo := newTestRepository(t, 0)
+	repo.Limits = StorageLimits{PictureQuota: 100, MaxUploadSize: 80}
+	user, device := newTestUser(t, repo, "alice")
+
+	if err := repo.AddPicture(user, device, strings.Repeat("a", 60)); err != nil {
+		t.Fatal(err)
+	}
+	// The picture is stored as a blob, only its size is in the database
+	pic := repo.UB.GetPictureAt(device, 0)
+	if pic.Content != "" || pic.BlobName == "" || pic.Size != 60 {
+		t.Errorf("picture is not stored as a blob: %+v", pic)
+	}
+	checkPictureUsage(t, repo, user, 1, 60)
+
+	if err := repo.AddPicture(user, device, strings.Repeat("b", 41)); err != ErrQuotaExceeded {
+		t.Errorf("expected ErrQuotaExceeded, got %v", err)
+	}
+	if err := repo.AddPicture(user, device, strings.Repeat("b", 81)); err != ErrPayloadTooLarge {
+		t.Errorf("expected ErrPayloadTooLarge, got %v", err)
+	}
+	checkPictureUsage(t, repo, user, 1, 60)
+	if pictures := repo.GetAllPictures(device); len(pictures) != 1 {
+		t.Errorf("rejected pictures were stored: %d pictures", len(pictures))
+	}
+
+	// Unfinished uploads count with their announced size
+	upload, err := repo.StartPictureUpload(user, device, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPictureUsage(t, repo, user, 1, 90)
+	if _, err := repo.StartPictureUpload(user, device, 11); err != ErrQuotaExceeded {
+		t.Errorf("upload: expected ErrQuotaExceeded, got %v", err)
+	}
+	if _, err := repo.StartPictureUpload(user, device, 81); err != ErrPayloadTooLarge {
+		t.Errorf("upload: expected ErrPayloadTooLarge, got %v", err)
+	}
+
+	_, completed, err := repo.AppendPictureUpload(user, upload.Id, 0, strings.NewReader(strings.Repeat("c", 30)))
+	if err != nil || completed == nil {
+		t.Fatalf("upload was not completed: %v", err)
+	}
+	checkPictureUsage(t, repo, user, 2, 90)
+
+	// The per-account override lifts the server default
+	repo.SetQuotas(user, QuotaDefault, QuotaUnlimited)
+	if err := repo.AddPicture(user, device, strings.Repeat("d", 80)); err != nil {
+		t.Errorf("unlimited account: %v", err)
+	}
+	checkPictureUsage(t, repo, user, 3, 170)
+	if usage := repo.GetStorageUsage(user); usage.PictureQuota != 0 {
+		t.Errorf("unlimited account has a quota of %d", usage.PictureQuota)
+	}
+}
+
+func TestPictureQuotaAfterPruning(t *testing.T) {
+	repo := newTestRepository(t, 0)
+	repo.Limits = StorageLimits{PictureQuota: 300}
+	user, device := newTestUser(t, repo, "alice")
+	repo.maxSavedPic = 2
+
+	// Each picture only fits because the pruned pictures do not count
+	for i := 0; i < 5; i++ {
+		if err := repo.AddPicture(user, device, strings.Repeat("a", 100)); err != nil {
+			t.Fatalf("picture %d: %v", i, err)
+		}
+	}
+	checkPictureUsage(t, repo, user, 2, 200)
+}
+
+func TestLocationQuota(t *testing.T) {
+	repo := newTestRepository(t, 0)
+	repo.Limits = StorageLimits{LocationQuota: 10}
+	user, device := newTestUser(t, repo, "alice")
+
+	if err := repo.AddLocation(user, device, "123456"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AddLocation(user, device, "12345"); err != ErrQuotaExceeded {
+		t.Errorf("expected ErrQuotaExceeded, got %v", err)
+	}
+	if err := repo.AddLocation(user, device, "1234"); err != nil {
+		t.Errorf("location within the quota was rejected: %v", err)
+	}
+	usage := repo.GetStorageUsage(user)
+	if usage.Locations != 2 || usage.LocationBytes != 10 || usage.LocationQuota != 10 {
+		t.Errorf("unexpected usage: %+v", usage)
+	}
+}
@@ -0,0 +1,86 @@
+package user
+
+import (
+	"rmd-server/metrics"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Age-based retention: in addition to the count-based limits (MaxSavedLoc, MaxSavedPic),
+// regularly delete all locations and pictures that are older than a maximum age.
+
+const RETENTION_INTERVAL = 1 * time.Hour
+
+// Delete in batches to avoid holding the database lock for a long time.
+const RETENTION_BATCH_SIZE = 500
+
+// Start the background job that deletes old locations and pictures.
+// A maximum age of 0 keeps the data forever.
+func (u *UserRepository) StartRetention(maxLocationAge time.Duration, maxPictureAge time.Duration) {
+	if maxLocationAge <= 0 && maxPictureAge <= 0 {
+		return
+	}
+	log.Info().
+		Str("maxLocationAge", maxLocationAge.String()).
+		Str("maxPictureAge", maxPictureAge.String()).
+		Msg("starting age-based retention")
+
+	go func() {
+		u.pruneByAge(maxLocationAge, maxPictureAge)
+		for range time.Tick(RETENTION_INTERVAL) {
+			u.pruneByAge(maxLocationAge, maxPictureAge)
+		}
+	}()
+}
+
+func (u *UserRepository) pruneByAge(maxLocationAge time.Duration, maxPictureAge time.Duration) {
+	now := time.Now()
+
+	if maxLocationAge > 0 {
+		deleted := u.pruneLocationsOlderThan(now.Add(-maxLocationAge).Unix())
+		if deleted > 0 {
+			log.Info().Int64("deleted", deleted).Msg("deleted old locations")
+		}
+	}
+
+	if maxPictureAge > 0 {
+		deleted := u.prunePicturesOlderThan(now.Add(-maxPictureAge).Unix())
+		if deleted > 0 {
+			log.Info().Int64("deleted", deleted).Msg("deleted old pictures")
+		}
+	}
+}
+
+func (u *UserRepository) pruneLocationsOlderThan(before int64) int64 {
+	var total int64
+	for {
+		deleted := u.UB.DeleteLocationsReceivedBefore(before, RETENTION_BATCH_SIZE)
+		metrics.Locations.Sub(float64(deleted))
+		total += deleted
+		if deleted < RETENTION_BATCH_SIZE {
+			return total
+		}
+	}
+}
+
+func (u *UserRepository) prunePicturesOlderThan(before int64) int64 {
+	var total int64
+	for {
+		pictures := u.UB.GetPicturesReceivedBefore(before, RETENTION_BATCH_SIZE)
+		deleted := u.UB.DeletePictures(pictures)
+		if len(pictures) > 0 && deleted == 0 {
+			log.Error().Msg("failed to delete old pictures")
+			return total
+		}
+		metrics.Pictures.Sub(float64(deleted))
+		total += deleted
+
+		for i := range pictures {
+			u.deletePictureBlob(&pictures[i])
+		}
+		if len(pictures) < RETENTION_BATCH_SIZE {
+			return total
+		}
+	}
+}
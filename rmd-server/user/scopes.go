@@ -0,0 +1,118 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// A Scope is a capability of an access token.
+//
+// A session either has all scopes (the default, e.g., for the web interface),
+// or only the scopes requested at login (e.g., a read-only viewer, or the device itself).
+type Scope string
+
+const (
+	ScopeLocationsRead Scope = "locations:read" // read locations and receive live events
+	ScopePicturesRead  Scope = "pictures:read"  // read pictures
+	ScopeCommandsSend  Scope = "commands:send"  // send commands and read their status and the command logs
+	ScopeDeviceUpload  Scope = "device:upload"  // act as the device: upload locations and pictures, fetch commands, report their status
+	ScopeKeyRead       Scope = "key:read"       // read the (password-wrapped) private key
+	ScopeAccountAdmin  Scope = "account:admin"  // change the password, manage sessions, export and delete the account
+
+	// No specific scope is needed, any valid token is sufficient
+	ScopeAny Scope = ""
+)
+
+var AllScopes = []Scope{
+	ScopeLocationsRead,
+	ScopePicturesRead,
+	ScopeCommandsSend,
+	ScopeDeviceUpload,
+	ScopeKeyRead,
+	ScopeAccountAdmin,
+}
+
+// The scopes that an owner can grant to another account (see Grant)
+var GrantableScopes = []Scope{
+	ScopeLocationsRead,
+	ScopePicturesRead,
+	ScopeCommandsSend,
+}
+
+var ErrScopeInvalid = errors.New("invalid scope")
+var ErrScopeMissing = errors.New("access token lacks the required scope")
+
+// Validate the requested scopes and encode them for storing them in the Session.
+// No scopes means all scopes, and is encoded as "".
+func EncodeScopes(requested []string) (string, error) {
+	scopes := []string{}
+	for _, s := range requested {
+		if !slices.Contains(AllScopes, Scope(s)) {
+			return "", fmt.Errorf("%w: %s", ErrScopeInvalid, s)
+		}
+		if !slices.Contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	if len(scopes) == len(AllScopes) {
+		return "", nil
+	}
+	return strings.Join(scopes, " "), nil
+}
+
+// Validate the scopes of a grant and encode them for storing them in the Grant.
+// No scopes means all GrantableScopes. Unlike EncodeScopes, the scopes are always listed explicitly,
+// because the encoded value is also used for the sessions of the grantee.
+func EncodeGrantScopes(requested []string) (string, error) {
+	scopes := []string{}
+	for _, s := range requested {
+		if !slices.Contains(GrantableScopes, Scope(s)) {
+			return "", fmt.Errorf("%w: %s", ErrScopeInvalid, s)
+		}
+		if !slices.Contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	if len(scopes) == 0 {
+		for _, scope := range GrantableScopes {
+			scopes = append(scopes, string(scope))
+		}
+	}
+	return strings.Join(scopes, " "), nil
+}
+
+// Restrict the requested scopes (encoded with EncodeScopes) to the allowed scopes (encoded, never "").
+// No requested scopes means all allowed scopes.
+func RestrictScopes(requested string, allowed string) (string, error) {
+	if requested == "" {
+		return allowed, nil
+	}
+	allowedScopes := strings.Fields(allowed)
+	for _, s := range strings.Fields(requested) {
+		if !slices.Contains(allowedScopes, s) {
+			return "", fmt.Errorf("%w: %s", ErrScopeInvalid, s)
+		}
+	}
+	return requested, nil
+}
+
+// Returns the scopes of the session
+func (s *Session) GetScopes() []Scope {
+	if s.Scopes == "" {
+		return AllScopes
+	}
+	scopes := []Scope{}
+	for _, scope := range strings.Fields(s.Scopes) {
+		scopes = append(scopes, Scope(scope))
+	}
+	return scopes
+}
+
+func (s *Session) HasScope(scope Scope) bool {
+	if scope == ScopeAny || s.Scopes == "" {
+		return true
+	}
+	return slices.Contains(strings.Fields(s.Scopes), string(scope))
+}
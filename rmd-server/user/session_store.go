@@ -0,0 +1,95 @@
+package user
+
+// Persistent storage for the AccessController.
+// It is implemented by RMDDB. Tests can use an in-memory implementation.
+type SessionStore interface {
+	GetSessions() []Session
+	SaveSession(session *Session)
+	DeleteSession(tokenHash string)
+	DeleteSessionsOfUser(userId string)
+	DeleteSessionsOfUserExcept(userId string, keepTokenHash string)
+	DeleteSessionsExpiredBefore(before int64) int64
+
+	GetRefreshToken(tokenHash string) *RefreshToken
+	SaveRefreshToken(token *RefreshToken)
+	DeleteRefreshTokensOfSession(sessionId string)
+	DeleteRefreshTokensOfUser(userId string)
+	DeleteRefreshTokensExpiredBefore(before int64) int64
+
+	GetLoginLocks() []LoginLock
+	SaveLoginLock(lock *LoginLock)
+	DeleteLoginLock(userId string)
+	DeleteLoginLocksExpiredBefore(before int64) int64
+}
+
+func (db *RMDDB) GetSessions() []Session {
+	sessions := []Session{}
+	db.DB.Find(&sessions)
+	return sessions
+}
+
+func (db *RMDDB) SaveSession(session *Session) {
+	db.DB.Save(session)
+}
+
+func (db *RMDDB) DeleteSession(tokenHash string) {
+	db.DB.Where("token_hash = ?", tokenHash).Delete(&Session{})
+}
+
+func (db *RMDDB) DeleteSessionsOfUser(userId string) {
+	db.DB.Where("user_id = ?", userId).Delete(&Session{})
+}
+
+func (db *RMDDB) DeleteSessionsOfUserExcept(userId string, keepTokenHash string) {
+	db.DB.Where("user_id = ? AND token_hash != ?", userId, keepTokenHash).Delete(&Session{})
+}
+
+// Delete sessions whose access token and refresh token have both expired
+func (db *RMDDB) DeleteSessionsExpiredBefore(before int64) int64 {
+	return db.DB.
+		Where("expiration_time < ? AND refresh_expiration_time < ?", before, before).
+		Delete(&Session{}).RowsAffected
+}
+
+func (db *RMDDB) GetRefreshToken(tokenHash string) *RefreshToken {
+	token := RefreshToken{}
+	res := db.DB.Where("token_hash = ?", tokenHash).Limit(1).Find(&token)
+	if res.RowsAffected == 0 {
+		return nil
+	}
+	return &token
+}
+
+func (db *RMDDB) SaveRefreshToken(token *RefreshToken) {
+	db.DB.Save(token)
+}
+
+func (db *RMDDB) DeleteRefreshTokensOfSession(sessionId string) {
+	db.DB.Where("session_id = ?", sessionId).Delete(&RefreshToken{})
+}
+
+func (db *RMDDB) DeleteRefreshTokensOfUser(userId string) {
+	db.DB.Where("user_id = ?", userId).Delete(&RefreshToken{})
+}
+
+func (db *RMDDB) DeleteRefreshTokensExpiredBefore(before int64) int64 {
+	return db.DB.Where("expiration_time < ?", before).Delete(&RefreshToken{}).RowsAffected
+}
+
+func (db *RMDDB) GetLoginLocks() []LoginLock {
+	locks := []LoginLock{}
+	db.DB.Find(&locks)
+	return locks
+}
+
+func (db *RMDDB) SaveLoginLock(lock *LoginLock) {
+	db.DB.Save(lock)
+}
+
+func (db *RMDDB) DeleteLoginLock(userId string) {
+	db.DB.Where("user_id = ?", userId).Delete(&LoginLock{})
+}
+
+func (db *RMDDB) DeleteLoginLocksExpiredBefore(before int64) int64 {
+	return db.DB.Where("expiration_time < ?", before).Delete(&LoginLock{}).RowsAffected
+}
@@ -0,0 +1,489 @@
+package user
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// TOTP (RFC 6238) as optional second factor for logins with the password.
+//
+// Login with TOTP enabled:
+//  1. RequestAccess checks the password and returns a TotpChallenge instead of an access token.
+//  2. VerifyTotp checks the code (or a recovery code) for the challenge and creates the access token.
+//
+// A device can skip the second step by logging in with the password and its DeviceCredential.
+
+const TOTP_ISSUER = "RMD"
+const TOTP_PERIOD_SECS = 30
+const TOTP_DIGITS = 6
+
+// Also accept the codes of the previous and the next time step, to tolerate clock drift.
+const TOTP_SKEW_STEPS = 1
+const TOTP_SECRET_BYTES = 20 // 160 bits, as recommended by RFC 4226
+
+const RECOVERY_CODE_COUNT = 10
+const RECOVERY_CODE_LENGTH = 10
+
+const TOTP_CHALLENGE_VALID_SECS = 5 * 60
+const TOTP_CHALLENGE_MAX_ATTEMPTS = 5
+
+var ErrTotpInvalid = errors.New("invalid TOTP code")
+var ErrTotpNotSetUp = errors.New("TOTP is not set up")
+var ErrTotpAlreadyEnabled = errors.New("TOTP is already enabled")
+var ErrTotpNotEnabled = errors.New("TOTP is not enabled")
+var ErrTotpChallengeInvalid = errors.New("login challenge not found or expired")
+
+// ------- Secret encryption -------
+
+// Encrypts the TOTP secrets with a key that is kept outside the database,
+// such that a leaked database (or backup) does not leak the secrets.
+type TotpCipher struct {
+	aead cipher.AEAD
+}
+
+// Load the key from the key file, or create a new random key if the file does not exist.
+// The file contains the base64-encoded 256-bit AES key.
+func LoadTotpCipher(keyFile string) (*TotpCipher, error) {
+	content, err := os.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		log.Info().Str("keyFile", keyFile).Msg("no TOTP key found, creating one")
+		key := make([]byte, 32)
+		_, err = rand.Read(key)
+		if err != nil {
+			return nil, err
+		}
+		content = []byte(base64.StdEncoding.EncodeToString(key) + "\n")
+		err = os.MkdirAll(filepath.Dir(keyFile), 0770)
+		if err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(keyFile, content, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid TOTP key file: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid TOTP key file: expected 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &TotpCipher{aead: aead}, nil
+}
+
+// Returns base64(nonce || ciphertext)
+func (c *TotpCipher) encrypt(plaintext []byte) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, plaintext, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (c *TotpCipher) decrypt(encoded string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < c.aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	return c.aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// ------- TOTP -------
+
+// The HOTP value (RFC 4226) for the counter.
+func totpCode(secret []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < TOTP_DIGITS; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%mod)
+}
+
+// Check the code against the time steps around now.
+// Codes of time steps <= lastCounter were already used and are rejected.
+// Returns the time step of the matching code.
+func verifyTotp(secret []byte, code string, now time.Time, lastCounter int64) (int64, bool) {
+	if len(code) != TOTP_DIGITS {
+		return 0, false
+	}
+	current := now.Unix() / TOTP_PERIOD_SECS
+	for counter := current - TOTP_SKEW_STEPS; counter <= current+TOTP_SKEW_STEPS; counter++ {
+		if counter <= lastCounter {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, counter)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// The URI for authenticator apps (usually shown as QR code)
+func totpUri(userId string, secret string) string {
+	label := url.PathEscape(TOTP_ISSUER + ":" + userId)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", TOTP_ISSUER)
+	params.Set("period", fmt.Sprint(TOTP_PERIOD_SECS))
+	params.Set("digits", fmt.Sprint(TOTP_DIGITS))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+var totpBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Recovery codes only use lowercase letters and digits (without 0, o, l, and 1), to be easy to type.
+// They are shown as "xxxxx-xxxxx", but spaces, dashes and case are ignored.
+func genRecoveryCode() string {
+	letters := "abcdefghijkmnpqrstuvwxyz23456789"
+	buf := make([]byte, RECOVERY_CODE_LENGTH)
+	_, err := rand.Read(buf)
+	if err != nil {
+		panic(err)
+	}
+	for i := range buf {
+		// len(letters) divides 256, thus there is no modulo bias
+		buf[i] = letters[int(buf[i])%len(letters)]
+	}
+	half := RECOVERY_CODE_LENGTH / 2
+	return string(buf[:half]) + "-" + string(buf[half:])
+}
+
+func normalizeSecondFactorCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer(" ", "", "-", "").Replace(code)
+}
+
+// ------- Login challenges -------
+
+// A login that passed the password check and waits for the TOTP code.
+type TotpChallenge struct {
+	Id             string
+	ExpirationTime int64 // unix time in seconds
+
+	userId   string
+	request  SessionRequest
+	attempts int
+}
+
+// The pending logins, in memory.
+// After a restart, users simply have to enter their password again.
+type TotpChallenges struct {
+	mu         sync.Mutex
+	challenges map[string]*TotpChallenge
+	now        func() time.Time
+}
+
+func NewTotpChallenges() *TotpChallenges {
+	return &TotpChallenges{
+		challenges: make(map[string]*TotpChallenge),
+		now:        time.Now,
+	}
+}
+
+func (c *TotpChallenges) Create(userId string, request SessionRequest) *TotpChallenge {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now().Unix()
+	for id, challenge := range c.challenges {
+		if challenge.ExpirationTime < now {
+			delete(c.challenges, id)
+		}
+	}
+
+	challenge := &TotpChallenge{
+		Id:             genRandomString(32),
+		ExpirationTime: now + TOTP_CHALLENGE_VALID_SECS,
+		userId:         userId,
+		request:        request,
+	}
+	c.challenges[challenge.Id] = challenge
+	return challenge
+}
+
+// Returns a copy of the challenge, or nil if it does not exist or is expired.
+func (c *TotpChallenges) Get(id string) *TotpChallenge {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	challenge, ok := c.challenges[id]
+	if !ok {
+		return nil
+	}
+	if challenge.ExpirationTime < c.now().Unix() {
+		delete(c.challenges, id)
+		return nil
+	}
+	result := *challenge
+	return &result
+}
+
+// Record a wrong code. After too many wrong codes, the challenge is deleted.
+func (c *TotpChallenges) Fail(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	challenge, ok := c.challenges[id]
+	if !ok {
+		return
+	}
+	challenge.attempts++
+	if challenge.attempts >= TOTP_CHALLENGE_MAX_ATTEMPTS {
+		delete(c.challenges, id)
+	}
+}
+
+// Remove the challenge. Returns false if it was already removed (e.g., by a concurrent request).
+func (c *TotpChallenges) Remove(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.challenges[id]
+	delete(c.challenges, id)
+	return ok
+}
+
+// ------- Database -------
+
+func (db *RMDDB) SetTotp(user *RMDUser, secret string, enabledTime int64, lastCounter int64) {
+	user.TotpSecret = secret
+	user.TotpEnabledTime = enabledTime
+	user.TotpLastCounter = lastCounter
+	db.DB.Model(user).Updates(map[string]any{
+		"totp_secret":       secret,
+		"totp_enabled_time": enabledTime,
+		"totp_last_counter": lastCounter,
+	})
+}
+
+// Atomically advance the last used time step. Returns false if the time step was already used.
+func (db *RMDDB) UseTotpCounter(user *RMDUser, counter int64) bool {
+	res := db.DB.Model(&RMDUser{}).
+		Where("id = ? AND totp_last_counter < ?", user.Id, counter).
+		Update("totp_last_counter", counter)
+	if res.RowsAffected == 0 {
+		return false
+	}
+	user.TotpLastCounter = counter
+	return true
+}
+
+func (db *RMDDB) ReplaceRecoveryCodes(user *RMDUser, codeHashes []string) {
+	db.DB.Where("user_id = ?", user.Id).Delete(&RecoveryCode{})
+	for _, hash := range codeHashes {
+		db.DB.Create(&RecoveryCode{UserID: user.Id, CodeHash: hash})
+	}
+}
+
+// Atomically mark the unused recovery code as used. Returns false if there is no such unused code.
+func (db *RMDDB) UseRecoveryCode(user *RMDUser, codeHash string) bool {
+	res := db.DB.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_time = 0", user.Id, codeHash).
+		Update("used_time", time.Now().Unix())
+	return res.RowsAffected > 0
+}
+
+func (db *RMDDB) CountUnusedRecoveryCodes(user *RMDUser) int64 {
+	var count int64
+	db.DB.Model(&RecoveryCode{}).Where("user_id = ? AND used_time = 0", user.Id).Count(&count)
+	return count
+}
+
+// ------- Repository -------
+
+func (u *UserRepository) IsTotpEnabled(user *RMDUser) bool {
+	return user.TotpEnabledTime != 0
+}
+
+func (u *UserRepository) CountRecoveryCodes(user *RMDUser) int64 {
+	return u.UB.CountUnusedRecoveryCodes(user)
+}
+
+// Generate a new TOTP secret for the user. TOTP is only enabled once EnableTotp confirms a code.
+// Returns the base32-encoded secret and the otpauth:// URI for authenticator apps.
+func (u *UserRepository) SetupTotp(user *RMDUser) (string, string, error) {
+	if u.IsTotpEnabled(user) {
+		return "", "", ErrTotpAlreadyEnabled
+	}
+	secret := make([]byte, TOTP_SECRET_BYTES)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", "", err
+	}
+	encrypted, err := u.Totp.encrypt(secret)
+	if err != nil {
+		return "", "", err
+	}
+	u.UB.SetTotp(user, encrypted, 0, 0)
+
+	encoded := totpBase32.EncodeToString(secret)
+	return encoded, totpUri(user.UID, encoded), nil
+}
+
+// Enable TOTP after the user proved with a code that the authenticator app has the secret.
+// Returns new recovery codes.
+func (u *UserRepository) EnableTotp(user *RMDUser, code string) ([]string, error) {
+	if u.IsTotpEnabled(user) {
+		return nil, ErrTotpAlreadyEnabled
+	}
+	if user.TotpSecret == "" {
+		return nil, ErrTotpNotSetUp
+	}
+	if !u.checkTotpCode(user, normalizeSecondFactorCode(code)) {
+		return nil, ErrTotpInvalid
+	}
+	u.UB.SetTotp(user, user.TotpSecret, time.Now().Unix(), user.TotpLastCounter)
+	codes := u.newRecoveryCodes(user)
+
+	log.Info().Str("userid", user.UID).Msg("enabled TOTP")
+	return codes, nil
+}
+
+// Disable TOTP. This needs a valid TOTP code or recovery code.
+func (u *UserRepository) DisableTotp(user *RMDUser, code string) error {
+	if !u.IsTotpEnabled(user) {
+		return ErrTotpNotEnabled
+	}
+	err := u.checkSecondFactorOrLock(user, code)
+	if err != nil {
+		return err
+	}
+	u.UB.SetTotp(user, "", 0, 0)
+	u.UB.ReplaceRecoveryCodes(user, nil)
+
+	log.Info().Str("userid", user.UID).Msg("disabled TOTP")
+	return nil
+}
+
+// Replace the recovery codes. This needs a valid TOTP code or recovery code.
+func (u *UserRepository) RegenerateRecoveryCodes(user *RMDUser, code string) ([]string, error) {
+	if !u.IsTotpEnabled(user) {
+		return nil, ErrTotpNotEnabled
+	}
+	err := u.checkSecondFactorOrLock(user, code)
+	if err != nil {
+		return nil, err
+	}
+	return u.newRecoveryCodes(user), nil
+}
+
+// Finish a login that is waiting for the TOTP code (see RequestAccess).
+// The code can also be a recovery code.
+func (u *UserRepository) VerifyTotp(challengeId string, code string) (*AccessToken, error) {
+	challenge := u.TotpChallenges.Get(challengeId)
+	if challenge == nil {
+		return nil, ErrTotpChallengeInvalid
+	}
+	user, err := u.UB.GetByID(challenge.userId)
+	if err != nil {
+		return nil, err
+	}
+
+	err = u.checkSecondFactorOrLock(user, code)
+	if errors.Is(err, ErrTotpInvalid) {
+		u.TotpChallenges.Fail(challengeId)
+		// Same message as for a wrong password, such that fail2ban catches both (see docs/fail2ban.md)
+		log.Warn().
+			Str("userid", user.UID).
+			Str("remoteIp", challenge.request.RemoteIp).
+			Str("factor", "totp").
+			Msg("failed login attempt")
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !u.TotpChallenges.Remove(challengeId) {
+		return nil, ErrTotpChallengeInvalid
+	}
+
+	token := u.finishLogin(user, challenge.request)
+	return &token, nil
+}
+
+// Check the TOTP code or recovery code.
+// Wrong codes count as failed login attempts, such that codes cannot be guessed.
+func (u *UserRepository) checkSecondFactorOrLock(user *RMDUser, code string) error {
+	if u.isLoginBlocked(user) {
+		return ErrAccountLocked
+	}
+	code = normalizeSecondFactorCode(code)
+	if u.checkTotpCode(user, code) {
+		return nil
+	}
+	if len(code) == RECOVERY_CODE_LENGTH && u.UB.UseRecoveryCode(user, hashAccessToken(code)) {
+		log.Info().Str("userid", user.UID).Msg("used recovery code")
+		return nil
+	}
+	u.ACC.IncrementLock(user.UID)
+	return ErrTotpInvalid
+}
+
+func (u *UserRepository) checkTotpCode(user *RMDUser, code string) bool {
+	if user.TotpSecret == "" {
+		return false
+	}
+	secret, err := u.Totp.decrypt(user.TotpSecret)
+	if err != nil {
+		log.Error().Err(err).Str("userid", user.UID).Msg("failed to decrypt TOTP secret, was the TOTP key changed?")
+		return false
+	}
+	counter, ok := verifyTotp(secret, code, time.Now(), user.TotpLastCounter)
+	if !ok {
+		return false
+	}
+	return u.UB.UseTotpCounter(user, counter)
+}
+
+func (u *UserRepository) newRecoveryCodes(user *RMDUser) []string {
+	codes := make([]string, RECOVERY_CODE_COUNT)
+	hashes := make([]string, RECOVERY_CODE_COUNT)
+	for i := range codes {
+		codes[i] = genRecoveryCode()
+		hashes[i] = hashAccessToken(normalizeSecondFactorCode(codes[i]))
+	}
+	u.UB.ReplaceRecoveryCodes(user, hashes)
+	return codes
+}
@@ -0,0 +1,100 @@
+package user
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Test vectors of RFC 6238 (SHA-1), truncated to 6 digits
+func TestTotpCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unixTime, expected := range vectors {
+		if code := totpCode(secret, unixTime/TOTP_PERIOD_SECS); code != expected {
+			t.Errorf("time=%d: code=%s, expected %s", unixTime, code, expected)
+		}
+	}
+}
+
+func TestVerifyTotp(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / TOTP_PERIOD_SECS
+
+	if counter, ok := verifyTotp(secret, totpCode(secret, current-1), now, 0); !ok || counter != current-1 {
+		t.Errorf("code of the previous time step should be accepted")
+	}
+	if _, ok := verifyTotp(secret, totpCode(secret, current-2), now, 0); ok {
+		t.Errorf("code outside of the allowed skew should be rejected")
+	}
+	if _, ok := verifyTotp(secret, totpCode(secret, current), now, current); ok {
+		t.Errorf("already used code should be rejected")
+	}
+	if _, ok := verifyTotp(secret, "", now, 0); ok {
+		t.Errorf("empty code should be rejected")
+	}
+}
+
+func TestTotpCipher(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "totp.key")
+	c, err := LoadTotpCipher(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, _ := c.encrypt([]byte("secret"))
+
+	// The key is persisted
+	c, err = LoadTotpCipher(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := c.decrypt(encrypted); err != nil || string(plain) != "secret" {
+		t.Errorf("decrypted=%s, err=%v", plain, err)
+	}
+
+	other, _ := LoadTotpCipher(filepath.Join(t.TempDir(), "other.key"))
+	if _, err := other.decrypt(encrypted); err == nil {
+		t.Errorf("decrypting with another key should fail")
+	}
+}
+
+func TestTotpChallenges(t *testing.T) {
+	c := NewTotpChallenges()
+	now := time.Unix(1000, 0)
+	c.now = func() time.Time { return now }
+
+	challenge := c.Create("alice", SessionRequest{Scopes: "locations:read"})
+	for i := 0; i < TOTP_CHALLENGE_MAX_ATTEMPTS-1; i++ {
+		c.Fail(challenge.Id)
+	}
+	if got := c.Get(challenge.Id); got == nil || got.userId != "alice" || got.request.Scopes != "locations:read" {
+		t.Fatalf("challenge should still be valid")
+	}
+	c.Fail(challenge.Id)
+	if c.Get(challenge.Id) != nil {
+		t.Errorf("challenge should be removed after too many attempts")
+	}
+
+	challenge = c.Create("alice", SessionRequest{})
+	now = now.Add((TOTP_CHALLENGE_VALID_SECS + 1) * time.Second)
+	if c.Get(challenge.Id) != nil {
+		t.Errorf("challenge should be expired")
+	}
+}
+
+func TestRecoveryCode(t *testing.T) {
+	code := genRecoveryCode()
+	if len(normalizeSecondFactorCode(code)) != RECOVERY_CODE_LENGTH {
+		t.Errorf("code=%s", code)
+	}
+	if normalizeSecondFactorCode(" ABCDE-fghij ") != "abcdefghij" {
+		t.Errorf("normalization failed")
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
+	"rmd-server/blobstore"
+	"time"
 
 	"github.com/glebarez/sqlite"
 	"github.com/rs/zerolog/log"
@@ -13,48 +15,116 @@ import (
 )
 
 type RMDDB struct {
-	DB *gorm.DB
+	DB       *gorm.DB
+	Pictures *PictureStore
 }
 
 // For GORM (SQL)
 // User Table
 type RMDUser struct {
-	Id             uint64 `gorm:"primaryKey"`
-	UID            string `gorm:"uniqueIndex"`
-	Salt           string // salt for the inner password hash performed by the client. This is stored for returning it to the client. It is not used by the server.
-	HashedPassword string
-	PrivateKey     string
-	PublicKey      string
-	CommandToUser  string
-	CommandTime    uint64
-	CommandSig     string
-	PushUrl        string
-	LastSeenTime   int64
-	Locations      []Location `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
-	Pictures       []Picture  `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
-	//CommandLogs    []CommandLogEntry `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+	Id                uint64 `gorm:"primaryKey"`
+	UID               string `gorm:"uniqueIndex"`
+	Salt              string // salt for the inner password hash performed by the client. This is stored for returning it to the client. It is not used by the server.
+	HashedPassword    string
+	PrivateKey        string
+	PublicKey         string
+	PushUrl           string             // legacy: migrated to the default Device
+	LastSeenTime      int64              // last request with an access token of this account
+	LocationQuota     int64              // in bytes. QuotaDefault: use the server default, QuotaUnlimited: no limit
+	PictureQuota      int64              // same as LocationQuota
+	TotpSecret        string             // encrypted with the server's TOTP key (see TotpCipher), empty if TOTP was never set up
+	TotpEnabledTime   int64              // unix time in seconds when TOTP was enabled, 0 if TOTP is disabled (or only set up)
+	TotpLastCounter   int64              // the last accepted TOTP time step, to prevent replaying a code
+	InviteID          uint64             // Invite.Id of the invite used for registering, 0 if none
+	LockedTime        int64              // unix time in seconds when an admin locked the account, 0 if it is not locked
+	LockReason        string             // optional note of the admin who locked the account
+	Devices           []Device           `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+	Locations         []Location         `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+	Pictures          []Picture          `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+	Commands          []Command          `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+	CommandLogs       []CommandLogEntry  `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+	PictureUploads    []PictureUpload    `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+	Grants            []Grant            `gorm:"foreignKey:OwnerID;constraint:OnDelete:CASCADE;"`
+	ReceivedGrants    []Grant            `gorm:"foreignKey:GranteeID;constraint:OnDelete:CASCADE;"`
+	RecoveryCodes     []RecoveryCode     `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+	DeviceCredentials []DeviceCredential `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+	Passkeys          []Passkey          `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+
+	// The legacy columns command_to_user, command_time and command_sig are no longer used.
+	// They were migrated into the commands table.
+}
+
+// Devices of the Users.
+// Every account has at least the default device. All devices of an account share the account's key pair.
+type Device struct {
+	Id           uint64 `gorm:"primaryKey"`
+	UserID       uint64 `gorm:"uniqueIndex:idx_devices_user_device,priority:1"`
+	DeviceId     string `gorm:"uniqueIndex:idx_devices_user_device,priority:2"` // public id, unique per account, DEFAULT_DEVICE_ID for the default device
+	Name         string // display name chosen by the user
+	PushUrl      string
+	LastSeenTime int64 // unix time in seconds of the last upload or command fetch of the device
+	CreatedTime  int64 // unix time in seconds
 }
 
 // Location Table of the Users
 type Location struct {
-	Id       uint64 `gorm:"primaryKey"`
-	UserID   uint64 `gorm:"index"`
-	Position string // elements must be string-encoded JSON structures
+	Id           uint64 `gorm:"primaryKey"`
+	UserID       uint64 `gorm:"index;index:idx_locations_user_id_received_time,priority:1"`
+	DeviceID     uint64 `gorm:"index"`
+	Position     string // encrypted location (base64), as sent by the device
+	ReceivedTime int64  `gorm:"index;index:idx_locations_user_id_received_time,priority:2"` // unix time in seconds when the server received the location (for old locations: when the database was migrated)
+	Size         int    // size of Position in bytes
 }
 
 // Picture Table for the Users
 type Picture struct {
-	Id      uint64 `gorm:"primaryKey"`
-	UserID  uint64 `gorm:"index"`
-	Content string // elements are base64 encoded encrypted images
+	Id           uint64 `gorm:"primaryKey"`
+	UserID       uint64 `gorm:"index"`
+	DeviceID     uint64 `gorm:"index"`
+	Content      string // legacy: pictures used to be stored here, they are now in the PictureStore
+	BlobName     string // name of the blob in the PictureStore
+	Size         int64  // size of the blob in bytes
+	ReceivedTime int64  `gorm:"index"` // unix time in seconds when the server received the picture (for old pictures: when the database was migrated)
 }
 
-/*
-// Location Table of the Users
+// Unfinished chunked picture uploads.
+// The received bytes are in the PictureStore's upload directory.
+type PictureUpload struct {
+	Id          string `gorm:"primaryKey"`
+	UserID      uint64 `gorm:"index"`
+	DeviceID    uint64 `gorm:"index"`
+	Size        int64  // announced total size in bytes
+	CreatedTime int64  // unix time in seconds
+}
+
+// Commands sent to the device.
+// Queued commands are delivered in FIFO order (by ascending Id).
+// After delivery, the command is kept to track its status.
+type Command struct {
+	Id          uint64 `gorm:"primaryKey"`
+	UserID      uint64 `gorm:"index"`
+	DeviceID    uint64 `gorm:"index"`
+	Command     string // plaintext command
+	CommandTime uint64 // unix time in milliseconds, as provided by the sender
+	CommandSig  string // base64-encoded signature over "CommandTime:Command"
+	Status      string `gorm:"index"` // one of the CommandStatus* values
+	Result      string // optional result message reported by the device
+	CreatedTime int64  // unix time in seconds when the server queued the command
+	UpdatedTime int64  // unix time in seconds of the last status change
+}
+
+const CommandStatusQueued = "queued"
+const CommandStatusDelivered = "delivered"
+const CommandStatusAcknowledged = "acknowledged"
+const CommandStatusExecuted = "executed"
+const CommandStatusFailed = "failed"
+
+// Command Log Table of the Users
 type CommandLogEntry struct {
-	Id      uint64 `gorm:"primaryKey"`
-	UserID  uint64 `gorm:"index"`
-	Content string // encrypted CommandLogEntryContent
+	Id        uint64 `gorm:"primaryKey"`
+	UserID    uint64 `gorm:"index"`
+	Timestamp int64  `gorm:"index"` // unix time in seconds, in plaintext to allow filtering by time range
+	Content   string // encrypted CommandLogEntryContent
 }
 
 // Content of the CommandLogEntry
@@ -62,7 +132,106 @@ type CommandLogEntryContent struct {
 	Timestamp int64
 	Log       string
 }
-*/
+
+// Sessions Table.
+// The token itself is never stored, only its hash.
+// Sessions reference the UID (not RMDUser.Id), because the AccessController works with UIDs.
+type Session struct {
+	TokenHash      string `gorm:"primaryKey"` // hex-encoded SHA-256 of the access token
+	Id             string // random public id, to refer to the session without knowing the token
+	UserID         string `gorm:"index"`
+	CreationTime   int64  // unix time in seconds
+	ExpirationTime int64  `gorm:"index"` // unix time in seconds
+	RemoteIp       string // client IP that logged in
+	UserAgent      string // User-Agent of the client that logged in
+
+	RefreshExpirationTime int64 // unix time in seconds until which the session can be refreshed, 0 if it has no refresh token
+
+	Scopes string // space-separated Scope values, empty means all scopes
+
+	GrantId         uint64 // if this is a grantee's session on the owner's account: the Grant.Id, otherwise 0
+	ParentTokenHash string // if GrantId is set: the TokenHash of the grantee's own session, the session is revoked together with it
+}
+
+// Refresh tokens of the sessions.
+// Each refresh replaces the session's access token and refresh token.
+// The old refresh token is marked as used and kept until it expires, to detect its reuse.
+type RefreshToken struct {
+	TokenHash      string `gorm:"primaryKey"` // hex-encoded SHA-256 of the refresh token
+	SessionId      string `gorm:"index"`      // Session.Id, this is the same for all refresh tokens of the session
+	UserID         string `gorm:"index"`
+	Used           bool
+	CreationTime   int64 // unix time in seconds
+	ExpirationTime int64 `gorm:"index"` // unix time in seconds
+}
+
+// Delegated access: the owner allows the grantee to access the owner's data.
+//
+// The server cannot decrypt the data, so the owner's client wraps the owner's private key
+// for the grantee's PublicKey. The grantee's client unwraps it with the grantee's private key.
+type Grant struct {
+	Id          uint64 `gorm:"primaryKey"`
+	OwnerID     uint64 `gorm:"uniqueIndex:idx_grants_owner_grantee,priority:1"`
+	OwnerUID    string
+	GranteeID   uint64 `gorm:"index;uniqueIndex:idx_grants_owner_grantee,priority:2"`
+	GranteeUID  string
+	Scopes      string // space-separated Scope values, a subset of GrantableScopes
+	WrappedKey  string // the owner's private key, wrapped for the grantee (opaque to the server)
+	CreatedTime int64  // unix time in seconds
+}
+
+// Single-use codes to log in if the TOTP app is lost
+type RecoveryCode struct {
+	Id       uint64 `gorm:"primaryKey"`
+	UserID   uint64 `gorm:"index"`
+	CodeHash string // hex-encoded SHA-256 of the normalized code
+	UsedTime int64  // unix time in seconds, 0 if the code is unused
+}
+
+// A device can log in with the password and its credential instead of a TOTP code.
+// The session then only has the credential's scopes.
+type DeviceCredential struct {
+	Id           uint64 `gorm:"primaryKey"`
+	UserID       uint64 `gorm:"index"`
+	DeviceID     uint64 `gorm:"uniqueIndex"` // Device.Id, one credential per device
+	TokenHash    string // hex-encoded SHA-256 of the credential
+	Scopes       string // encoded like Session.Scopes
+	CreatedTime  int64  // unix time in seconds
+	LastUsedTime int64  // unix time in seconds, 0 if never used
+}
+
+// A WebAuthn credential to log in without the password (see webauthn.Credential)
+type Passkey struct {
+	Id           uint64 `gorm:"primaryKey"`
+	UserID       uint64 `gorm:"index"`
+	CredentialId string `gorm:"uniqueIndex"` // base64url-encoded, as used by the browser
+	PublicKey    string // base64-encoded PKIX
+	Algorithm    int64  // COSE algorithm identifier
+	SignCount    int64  // the authenticator's signature counter, to detect cloned credentials
+	Name         string
+	ReleaseKey   bool  // whether sessions of this passkey may read the (password-wrapped) private key
+	CreatedTime  int64 // unix time in seconds
+	LastUsedTime int64 // unix time in seconds, 0 if never used
+}
+
+// A code to register an account (see RegistrationInviteOnly)
+type Invite struct {
+	Id             uint64 `gorm:"primaryKey"`
+	CodeHash       string `gorm:"uniqueIndex"` // hex-encoded SHA-256 of the code
+	Username       string // if set, the invite can only register this username
+	Note           string // for the admin, e.g., whom the invite was sent to
+	MaxUses        int64
+	Uses           int64
+	CreatedTime    int64 // unix time in seconds
+	ExpirationTime int64 // unix time in seconds, 0 if the invite does not expire
+}
+
+// Failed login attempts per account (keyed by UID)
+type LoginLock struct {
+	UserID         string `gorm:"primaryKey"`
+	FailedCount    int
+	ExpirationTime int64 // unix time in seconds
+}
 
 // Settings Table GORM (SQL)
 type DBSetting struct {
@@ -71,7 +240,7 @@ type DBSetting struct {
 	Value   string
 }
 
-func NewRMDDB(dbDir string) *RMDDB {
+func NewRMDDB(dbDir string, blobs blobstore.BlobStore) *RMDDB {
 	dbFile := filepath.Join(dbDir, "rmd.sqlite")
 
 	// Check if SQL Database exists
@@ -91,10 +260,11 @@ func NewRMDDB(dbDir string) *RMDDB {
 			log.Fatal().Err(err).Msg("failed to create database file")
 		}
 	}
-	return initSQLite(dbFile)
+	pictures := NewPictureStore(blobs, filepath.Join(dbDir, "pictures", "uploads"))
+	return initSQLite(dbFile, pictures)
 }
 
-func initSQLite(path string) *RMDDB {
+func initSQLite(path string, pictures *PictureStore) *RMDDB {
 	newLogger := logger.New(
 		&log.Logger, // io writer
 		logger.Config{
@@ -121,9 +291,9 @@ func initSQLite(path string) *RMDDB {
 		return nil
 	}
 
-	migrateDatabase(db)
+	migrateDatabase(db, pictures)
 
-	return &RMDDB{DB: db}
+	return &RMDDB{DB: db, Pictures: pictures}
 }
 
 func (db *RMDDB) GetLastID() int {
@@ -145,12 +315,310 @@ func (db *RMDDB) GetByID(id string) (*RMDUser, error) {
 	return &user, nil
 }
 
-func (db *RMDDB) PreloadLocations(user *RMDUser) {
-	db.DB.Preload("Locations").Where(&user).Find(&user)
+func (db *RMDDB) SetLastSeenTime(user *RMDUser, lastSeen int64) {
+	db.DB.Model(user).Update("last_seen_time", lastSeen)
+}
+
+func (db *RMDDB) CountLocations(user *RMDUser) int64 {
+	var count int64
+	db.DB.Model(&Location{}).Where("user_id = ?", user.Id).Count(&count)
+	return count
+}
+
+func (db *RMDDB) SumLocationSizes(user *RMDUser) int64 {
+	var sum int64
+	db.DB.Model(&Location{}).Select("COALESCE(SUM(size), 0)").Where("user_id = ?", user.Id).Scan(&sum)
+	return sum
+}
+
+func (db *RMDDB) CountDeviceLocations(device *Device) int64 {
+	var count int64
+	db.DB.Model(&Location{}).Where("device_id = ?", device.Id).Count(&count)
+	return count
+}
+
+// Return the idx-th location of the device (ordered by ID), or nil if it does not exist.
+func (db *RMDDB) GetLocationAt(device *Device, idx int) *Location {
+	var loc Location
+	db.DB.Where("device_id = ?", device.Id).Order("id ASC").Offset(idx).Limit(1).Find(&loc)
+	if loc.Id == 0 {
+		return nil
+	}
+	return &loc
+}
+
+// Return a page of the locations of the device, oldest first.
+//
+// Only locations with an ID greater than cursor are returned.
+// If since/until > 0, only locations with since <= ReceivedTime <= until are returned.
+// If limit < 0, all matching locations are returned.
+func (db *RMDDB) GetLocations(device *Device, cursor uint64, limit int, since int64, until int64) []Location {
+	query := db.DB.Where("device_id = ? AND id > ?", device.Id, cursor)
+	if since > 0 {
+		query = query.Where("received_time >= ?", since)
+	}
+	if until > 0 {
+		query = query.Where("received_time <= ?", until)
+	}
+
+	locations := []Location{}
+	query.Order("id ASC").Limit(limit).Find(&locations)
+	return locations
+}
+
+// Delete the oldest locations of the device, such that at most keep locations remain.
+// Returns the number of deleted locations.
+func (db *RMDDB) PruneLocations(device *Device, keep int) int64 {
+	res := db.DB.
+		Where("device_id = ?", device.Id).
+		Where("id NOT IN (?)", db.DB.Model(&Location{}).Select("id").Where("device_id = ?", device.Id).Order("id DESC").Limit(keep)).
+		Delete(&Location{})
+	return res.RowsAffected
+}
+
+// Delete up to limit locations (of all users) that were received before the given unix time.
+// Returns the number of deleted locations.
+func (db *RMDDB) DeleteLocationsReceivedBefore(before int64, limit int) int64 {
+	res := db.DB.
+		Where("id IN (?)", db.DB.Model(&Location{}).Select("id").Where("received_time < ?", before).Limit(limit)).
+		Delete(&Location{})
+	return res.RowsAffected
+}
+
+// Return up to limit pictures (of all users) that were received before the given unix time.
+func (db *RMDDB) GetPicturesReceivedBefore(before int64, limit int) []Picture {
+	pictures := []Picture{}
+	db.DB.Where("received_time < ?", before).Order("id ASC").Limit(limit).Find(&pictures)
+	return pictures
+}
+
+// Delete the pictures (only the rows, not the blobs).
+// Returns the number of deleted pictures.
+func (db *RMDDB) DeletePictures(pictures []Picture) int64 {
+	if len(pictures) == 0 {
+		return 0
+	}
+	ids := make([]uint64, len(pictures))
+	for i := range pictures {
+		ids[i] = pictures[i].Id
+	}
+	res := db.DB.Where("id IN ?", ids).Delete(&Picture{})
+	return res.RowsAffected
+}
+
+// Return a page of the pictures of the device, oldest first.
+// Only pictures with an ID greater than cursor are returned.
+func (db *RMDDB) GetPictures(device *Device, cursor uint64, limit int) []Picture {
+	pictures := []Picture{}
+	db.DB.Where("device_id = ? AND id > ?", device.Id, cursor).Order("id ASC").Limit(limit).Find(&pictures)
+	return pictures
+}
+
+func (db *RMDDB) CountPictures(user *RMDUser) int64 {
+	var count int64
+	db.DB.Model(&Picture{}).Where("user_id = ?", user.Id).Count(&count)
+	return count
+}
+
+func (db *RMDDB) CountDevicePictures(device *Device) int64 {
+	var count int64
+	db.DB.Model(&Picture{}).Where("device_id = ?", device.Id).Count(&count)
+	return count
+}
+
+func (db *RMDDB) SumPictureSizes(user *RMDUser) int64 {
+	var sum int64
+	db.DB.Model(&Picture{}).Select("COALESCE(SUM(size), 0)").Where("user_id = ?", user.Id).Scan(&sum)
+	return sum
+}
+
+func (db *RMDDB) SumPictureUploadSizes(user *RMDUser) int64 {
+	var sum int64
+	db.DB.Model(&PictureUpload{}).Select("COALESCE(SUM(size), 0)").Where("user_id = ?", user.Id).Scan(&sum)
+	return sum
+}
+
+// Return the idx-th picture of the device (ordered by ID), or nil if it does not exist.
+func (db *RMDDB) GetPictureAt(device *Device, idx int) *Picture {
+	var pic Picture
+	db.DB.Where("device_id = ?", device.Id).Order("id ASC").Offset(idx).Limit(1).Find(&pic)
+	if pic.Id == 0 {
+		return nil
+	}
+	return &pic
+}
+
+// Return the oldest pictures of the device, such that at most keep pictures remain if they are deleted.
+func (db *RMDDB) GetPicturesToPrune(device *Device, keep int) []Picture {
+	pictures := []Picture{}
+	db.DB.
+		Where("device_id = ?", device.Id).
+		Where("id NOT IN (?)", db.DB.Model(&Picture{}).Select("id").Where("device_id = ?", device.Id).Order("id DESC").Limit(keep)).
+		Find(&pictures)
+	return pictures
+}
+
+// Return the blob names of all pictures of the user.
+func (db *RMDDB) GetPictureBlobNames(user *RMDUser) []string {
+	names := []string{}
+	db.DB.Model(&Picture{}).Where("user_id = ? AND blob_name <> ''", user.Id).Pluck("blob_name", &names)
+	return names
+}
+
+func (db *RMDDB) GetPictureUpload(user *RMDUser, uploadId string) *PictureUpload {
+	var upload PictureUpload
+	db.DB.Where("user_id = ? AND id = ?", user.Id, uploadId).Find(&upload)
+	if upload.Id == "" {
+		return nil
+	}
+	return &upload
+}
+
+// Return the uploads that were started before the given unix time.
+func (db *RMDDB) GetPictureUploadsBefore(before int64) []PictureUpload {
+	uploads := []PictureUpload{}
+	db.DB.Where("created_time < ?", before).Find(&uploads)
+	return uploads
+}
+
+func (db *RMDDB) GetPictureUploads(user *RMDUser) []PictureUpload {
+	uploads := []PictureUpload{}
+	db.DB.Where("user_id = ?", user.Id).Find(&uploads)
+	return uploads
+}
+
+func (db *RMDDB) CountQueuedCommands(device *Device) int64 {
+	var count int64
+	db.DB.Model(&Command{}).Where("device_id = ? AND status = ?", device.Id, CommandStatusQueued).Count(&count)
+	return count
+}
+
+// Whether a command with this content is queued for the device.
+func (db *RMDDB) HasQueuedCommand(device *Device, cmd string) bool {
+	var count int64
+	db.DB.Model(&Command{}).
+		Where("device_id = ? AND status = ? AND command = ?", device.Id, CommandStatusQueued, cmd).
+		Count(&count)
+	return count > 0
+}
+
+// Mark the oldest queued commands of the device as failed, such that at most keep commands remain queued.
+// Returns the number of dropped commands.
+func (db *RMDDB) DropQueuedCommands(device *Device, keep int, result string) int64 {
+	newest := db.DB.Model(&Command{}).
+		Select("id").
+		Where("device_id = ? AND status = ?", device.Id, CommandStatusQueued).
+		Order("id DESC").
+		Limit(keep)
+	res := db.DB.Model(&Command{}).
+		Where("device_id = ? AND status = ?", device.Id, CommandStatusQueued).
+		Where("id NOT IN (?)", newest).
+		Updates(map[string]interface{}{"status": CommandStatusFailed, "result": result, "updated_time": time.Now().Unix()})
+	return res.RowsAffected
+}
+
+// Mark the queued commands of the device as delivered and return them, oldest first.
+// If limit > 0, at most limit commands are delivered.
+func (db *RMDDB) DeliverQueuedCommands(device *Device, limit int) []Command {
+	var cmds []Command
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		query := tx.Where("device_id = ? AND status = ?", device.Id, CommandStatusQueued).Order("id ASC")
+		if limit > 0 {
+			query = query.Limit(limit)
+		}
+		res := query.Find(&cmds)
+		if res.Error != nil || len(cmds) == 0 {
+			return res.Error
+		}
+
+		now := time.Now().Unix()
+		ids := make([]uint64, len(cmds))
+		for i := range cmds {
+			ids[i] = cmds[i].Id
+			cmds[i].Status = CommandStatusDelivered
+			cmds[i].UpdatedTime = now
+		}
+		return tx.Model(&Command{}).
+			Where("id IN ?", ids).
+			Updates(map[string]interface{}{"status": CommandStatusDelivered, "updated_time": now}).
+			Error
+	})
+	if err != nil {
+		log.Error().Err(err).Uint64("deviceId", device.Id).Msg("failed to deliver queued commands")
+		return []Command{}
+	}
+	return cmds
+}
+
+// Set delivered commands back to queued.
+// Returns the number of requeued commands.
+func (db *RMDDB) RequeueCommands(device *Device, cmds []Command) int64 {
+	if len(cmds) == 0 {
+		return 0
+	}
+	ids := make([]uint64, len(cmds))
+	for i := range cmds {
+		ids[i] = cmds[i].Id
+	}
+	res := db.DB.Model(&Command{}).
+		Where("device_id = ? AND status = ? AND id IN ?", device.Id, CommandStatusDelivered, ids).
+		Updates(map[string]interface{}{"status": CommandStatusQueued, "updated_time": time.Now().Unix()})
+	return res.RowsAffected
+}
+
+func (db *RMDDB) GetCommandByID(user *RMDUser, id uint64) *Command {
+	var cmd Command
+	db.DB.Where("user_id = ? AND id = ?", user.Id, id).Find(&cmd)
+	if cmd.Id == 0 {
+		return nil
+	}
+	return &cmd
+}
+
+// Return the latest commands of the user, newest first.
+func (db *RMDDB) GetRecentCommands(user *RMDUser, limit int) []Command {
+	cmds := []Command{}
+	db.DB.Where("user_id = ?", user.Id).Order("id DESC").Limit(limit).Find(&cmds)
+	return cmds
+}
+
+// Delete the oldest commands of the user that are no longer queued,
+// such that at most keep commands remain.
+// Queued commands are never deleted, because the device has not yet seen them.
+func (db *RMDDB) PruneCommands(user *RMDUser, keep int) {
+	db.DB.
+		Where("user_id = ? AND status <> ?", user.Id, CommandStatusQueued).
+		Where("id NOT IN (?)", db.DB.Model(&Command{}).Select("id").Where("user_id = ?", user.Id).Order("id DESC").Limit(keep)).
+		Delete(&Command{})
+}
+
+// Return a page of the command log of the user, newest first.
+//
+// If cursor > 0, only entries older than the entry with this ID are returned.
+// If since/until > 0, only entries with since <= Timestamp <= until are returned.
+func (db *RMDDB) GetCommandLogEntries(user *RMDUser, cursor uint64, limit int, since int64, until int64) []CommandLogEntry {
+	query := db.DB.Where("user_id = ?", user.Id)
+	if cursor > 0 {
+		query = query.Where("id < ?", cursor)
+	}
+	if since > 0 {
+		query = query.Where("timestamp >= ?", since)
+	}
+	if until > 0 {
+		query = query.Where("timestamp <= ?", until)
+	}
+
+	entries := []CommandLogEntry{}
+	query.Order("id DESC").Limit(limit).Find(&entries)
+	return entries
 }
 
-func (db *RMDDB) PreloadPictures(user *RMDUser) {
-	db.DB.Preload("Pictures").Where(&user).Find(&user)
+// Delete the oldest command log entries of the user, such that at most keep entries remain.
+func (db *RMDDB) PruneCommandLog(user *RMDUser, keep int) {
+	db.DB.
+		Where("user_id = ?", user.Id).
+		Where("id NOT IN (?)", db.DB.Model(&CommandLogEntry{}).Select("id").Where("user_id = ?", user.Id).Order("id DESC").Limit(keep)).
+		Delete(&CommandLogEntry{})
 }
 
 func (db *RMDDB) Save(value interface{}) {
@@ -16,6 +16,6 @@ func initializeUserMetrics(db *RMDDB) {
 	metrics.Pictures.Set(float64(pictureCount))
 
 	var pendingCommandCount int64
-	db.DB.Model(&RMDUser{}).Where("command_to_user IS NOT NULL AND command_to_user <> ''").Count(&pendingCommandCount)
+	db.DB.Model(&Command{}).Where("status = ?", CommandStatusQueued).Count(&pendingCommandCount)
 	metrics.PendingCommands.Set(float64(pendingCommandCount))
 }
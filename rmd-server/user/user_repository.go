@@ -2,14 +2,20 @@ package user
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"math/big"
 	"net/http"
 	"regexp"
+	"rmd-server/blobstore"
 	"rmd-server/metrics"
+	"rmd-server/utils"
 	"rmd-server/version"
+	"rmd-server/webauthn"
 	"strings"
 	"time"
 
@@ -17,15 +23,26 @@ import (
 )
 
 type UserRepository struct {
-	userIDLength int
-	maxSavedLoc  int
-	maxSavedPic  int
-	ACC          AccessController
-	UB           *RMDDB
-}
-
-func NewUserRepository(dbDir string, userIDLength int, maxSavedLoc int, maxSavedPic int) UserRepository {
-	db := NewRMDDB(dbDir)
+	userIDLength        int
+	maxSavedLoc         int
+	maxSavedPic         int
+	maxSavedCommandLogs int
+	ACC                 *AccessController
+	UB                  *RMDDB
+	Events              *EventHub
+	EventTickets        *EventTickets
+	Devices             *DeviceChannels
+	Waiters             *CommandWaiters
+	Limits              StorageLimits
+	Totp                *TotpCipher // must be set before TOTP can be used (see LoadTotpCipher)
+	TotpChallenges      *TotpChallenges
+	WebAuthn            *webauthn.RelyingParty // nil if passkeys are disabled
+	PasskeyChallenges   *PasskeyChallenges
+	Admins              []string // the ids of the accounts that may use the admin API (see AdminUsers)
+}
+
+func NewUserRepository(dbDir string, blobs blobstore.BlobStore, userIDLength int, maxSavedLoc int, maxSavedPic int, maxSavedCommandLogs int, maxCommandWaiters int, maxCommandWaitersPerAccount int) UserRepository {
+	db := NewRMDDB(dbDir, blobs)
 
 	// Initialise all metrics. Later, they are kept up-to-date incrementally.
 	initializeUserMetrics(db)
@@ -33,16 +50,33 @@ func NewUserRepository(dbDir string, userIDLength int, maxSavedLoc int, maxSaved
 	InitializePushServerMetrics(db)
 
 	return UserRepository{
-		userIDLength: userIDLength,
-		maxSavedLoc:  maxSavedLoc,
-		maxSavedPic:  maxSavedPic,
-		ACC:          NewAccessController(),
-		UB:           db,
+		userIDLength:        userIDLength,
+		maxSavedLoc:         maxSavedLoc,
+		maxSavedPic:         maxSavedPic,
+		maxSavedCommandLogs: maxSavedCommandLogs,
+		ACC:                 NewAccessController(db),
+		UB:                  db,
+		Events:              NewEventHub(),
+		EventTickets:        NewEventTickets(),
+		Devices:             NewDeviceChannels(),
+		Waiters:             NewCommandWaiters(maxCommandWaiters, maxCommandWaitersPerAccount),
+		TotpChallenges:      NewTotpChallenges(),
+		PasskeyChallenges:   NewPasskeyChallenges(),
 	}
 }
 
-func (u *UserRepository) CheckAccessTokenAndGetUser(providedAccessToken string) (*RMDUser, error) {
-	userId, err := u.ACC.CheckAccessToken(providedAccessToken)
+// Stop all long-running operations: requests waiting for a command, event streams and device connections.
+// Otherwise, they would keep the HTTP server's graceful shutdown waiting until its timeout.
+func (u *UserRepository) Shutdown() {
+	u.Waiters.Shutdown()
+	u.Events.Shutdown()
+	u.Devices.Shutdown()
+}
+
+// Returns the user of the access token.
+// The token must have the scope, otherwise ErrScopeMissing is returned.
+func (u *UserRepository) CheckAccessTokenAndGetUser(providedAccessToken string, scope Scope) (*RMDUser, error) {
+	userId, err := u.ACC.CheckAccessTokenScope(providedAccessToken, scope)
 	if err != nil {
 		return nil, err
 	}
@@ -51,9 +85,14 @@ func (u *UserRepository) CheckAccessTokenAndGetUser(providedAccessToken string)
 	if err != nil {
 		return nil, err
 	}
+	if user.LockedTime != 0 {
+		// The sessions were revoked when locking, but the server may not have reloaded them yet
+		return nil, ErrAccountLocked
+	}
 
+	// Only update this column, such that concurrent changes of the user (e.g., enabling TOTP) are not overwritten
 	user.LastSeenTime = time.Now().Unix()
-	u.UB.Save(user)
+	u.UB.SetLastSeenTime(user, user.LastSeenTime)
 
 	return user, nil
 }
@@ -81,6 +120,7 @@ func (u *UserRepository) CreateNewUser(
 	innerSalt string,
 	innerPwHash string,
 	requestedUsername string,
+	inviteId uint64,
 ) (string, error) {
 	id := ""
 	if requestedUsername != "" {
@@ -108,12 +148,20 @@ func (u *UserRepository) CreateNewUser(
 	} else {
 		id = u.generateNewId()
 	}
+
+	// The server encrypts the command log with the public key
+	if _, err := utils.ParseRsaPublicKey(pubKey); err != nil {
+		log.Warn().Str("userid", id).Msg("public key is not valid")
+		return "", err
+	}
 	log.Info().Str("userid", requestedUsername).Msg("registering new user")
 
 	newUser := RMDUser{
 		UID:        id,
 		PrivateKey: privKey,
 		PublicKey:  pubKey,
+		InviteID:   inviteId,
+		Devices:    []Device{{DeviceId: DEFAULT_DEVICE_ID, CreatedTime: time.Now().Unix()}},
 	}
 	newUser.setPasswordData(innerSalt, innerPwHash)
 
@@ -131,49 +179,95 @@ func (u *UserRepository) UpdateUserPassword(user *RMDUser, privKey string, inner
 	u.UB.Save(user)
 }
 
-func (u *UserRepository) AddLocation(user *RMDUser, loc string) {
-	u.UB.Create(&Location{Position: loc, UserID: user.Id})
+func (u *UserRepository) AddLocation(user *RMDUser, device *Device, loc string) error {
+	err := u.checkLocationQuota(user, int64(len(loc)))
+	if err != nil {
+		return err
+	}
+	u.touchDevice(device)
+
+	location := Location{Position: loc, UserID: user.Id, DeviceID: device.Id, ReceivedTime: time.Now().Unix(), Size: len(loc)}
+	u.UB.Create(&location)
 	metrics.Locations.Inc()
-	u.pruneLocations(user)
+	u.pruneLocations(device)
+
+	u.Events.Publish(user.UID, EVENT_LOCATION, locationEvent{Id: location.Id, ReceivedTime: location.ReceivedTime, Device: device.DeviceId})
+	return nil
 }
 
-func (u *UserRepository) pruneLocations(user *RMDUser) {
-	// Preload needed to get the correct latest length
-	u.UB.PreloadLocations(user)
+func (u *UserRepository) pruneLocations(device *Device) {
+	deleted := u.UB.PruneLocations(device, u.maxSavedLoc)
+	metrics.Locations.Sub(float64(deleted))
+}
 
-	if len(user.Locations) > u.maxSavedLoc {
-		locationsToDelete := user.Locations[:(len(user.Locations) - u.maxSavedLoc)]
-		for _, locationToDelete := range locationsToDelete {
-			u.UB.Delete(&locationToDelete)
-			metrics.Locations.Dec()
-		}
+func (u *UserRepository) AddPicture(user *RMDUser, device *Device, pic string) error {
+	size := int64(len(pic))
+	err := u.checkPictureQuota(user, size)
+	if err != nil {
+		return err
 	}
+
+	name, err := u.UB.Pictures.Put(strings.NewReader(pic), size)
+	if err != nil {
+		log.Error().Err(err).Str("userid", user.UID).Msg("failed to store picture")
+		return err
+	}
+	u.addPictureBlob(user, device, name, size)
+	return nil
 }
 
-func (u *UserRepository) AddPicture(user *RMDUser, pic string) {
-	u.UB.Create(&Picture{Content: pic, UserID: user.Id})
+func (u *UserRepository) addPictureBlob(user *RMDUser, device *Device, name string, size int64) *Picture {
+	u.touchDevice(device)
+
+	picture := Picture{UserID: user.Id, DeviceID: device.Id, BlobName: name, Size: size, ReceivedTime: time.Now().Unix()}
+	u.UB.Create(&picture)
 	metrics.Pictures.Inc()
-	u.prunePictures(user)
+	u.prunePictures(device)
+
+	u.Events.Publish(user.UID, EVENT_PICTURE, pictureEvent{Id: picture.Id, Device: device.DeviceId})
+	return &picture
 }
 
-func (u *UserRepository) prunePictures(user *RMDUser) {
-	// Preload needed to get the correct latest length
-	u.UB.PreloadPictures(user)
+func (u *UserRepository) prunePictures(device *Device) {
+	picturesToDelete := u.UB.GetPicturesToPrune(device, u.maxSavedPic)
+	for _, pictureToDelete := range picturesToDelete {
+		u.UB.Delete(&pictureToDelete)
+		metrics.Pictures.Dec()
+		u.deletePictureBlob(&pictureToDelete)
+	}
+}
 
-	if len(user.Pictures) > u.maxSavedPic {
-		picturesToDelete := user.Pictures[:(len(user.Pictures) - u.maxSavedPic)]
-		for _, pictureToDelete := range picturesToDelete {
-			u.UB.Delete(&pictureToDelete)
-			metrics.Pictures.Dec()
-		}
+func (u *UserRepository) deletePictureBlob(pic *Picture) {
+	if pic.BlobName == "" {
+		return
+	}
+	err := u.UB.Pictures.Delete(pic.BlobName)
+	if err != nil {
+		log.Error().Err(err).Str("blobName", pic.BlobName).Msg("failed to delete picture blob")
 	}
 }
 
 func (u *UserRepository) DeleteUser(user *RMDUser) {
 	log.Info().Str("userid", user.UID).Msg("deleting user")
 
+	// Collect the blobs before the references are deleted from the database
+	pictureBlobs := u.UB.GetPictureBlobNames(user)
+	uploads := u.UB.GetPictureUploads(user)
+	receivedGrants := u.UB.GetGrantsForGrantee(user.Id)
+	devices := u.UB.GetDevices(user)
+
 	u.UB.Delete(&user)
 
+	for _, name := range pictureBlobs {
+		err := u.UB.Pictures.Delete(name)
+		if err != nil {
+			log.Error().Err(err).Str("blobName", name).Msg("failed to delete picture blob")
+		}
+	}
+	for _, upload := range uploads {
+		u.UB.Pictures.DeleteUpload(upload.Id)
+	}
+
 	// Reload the metrics by fully re-initializing them.
 	// These are simpler DB queries than JOIN-ing tables to find out how many
 	// locs/pics were deleted and then decrementing all metrics.
@@ -181,64 +275,213 @@ func (u *UserRepository) DeleteUser(user *RMDUser) {
 
 	u.ACC.ResetLock(user.UID)
 	u.ACC.ResetTokensForUser(user.UID)
+	for _, grant := range receivedGrants {
+		u.ACC.RevokeGrantSessions(grant.OwnerUID, grant.Id)
+	}
+	u.Events.UnsubscribeAll(user.UID)
+	for _, device := range devices {
+		UpdatePushServerMetrics(device.PushUrl, "")
+		u.Devices.DisconnectDevice(device.Key())
+	}
 }
 
-func (u *UserRepository) GetLocation(user *RMDUser, idx int) string {
-	u.UB.PreloadLocations(user)
-
-	if idx < 0 || idx >= len(user.Locations) {
+func (u *UserRepository) GetLocation(device *Device, idx int) string {
+	loc := u.UB.GetLocationAt(device, idx)
+	if loc == nil {
 		log.Warn().
 			Int("idx", idx).
-			Int("max", len(user.Locations)-1).
+			Int64("max", u.UB.CountDeviceLocations(device)-1).
 			Msg("requested location is out of bounds")
 		return ""
 	}
-	return user.Locations[idx].Position
+	return loc.Position
 }
 
-func (u *UserRepository) GetAllLocations(user *RMDUser) []string {
-	u.UB.PreloadLocations(user)
+const DEFAULT_LOCATION_PAGE_SIZE = 100
+const MAX_LOCATION_PAGE_SIZE = 1000
+
+// Return a page of locations, oldest first, and whether there are more (newer) locations after this page.
+// See RMDDB.GetLocations for the meaning of the parameters.
+func (u *UserRepository) GetLocationPage(device *Device, cursor uint64, limit int, since int64, until int64) ([]Location, bool) {
+	if limit <= 0 {
+		limit = DEFAULT_LOCATION_PAGE_SIZE
+	} else if limit > MAX_LOCATION_PAGE_SIZE {
+		limit = MAX_LOCATION_PAGE_SIZE
+	}
+
+	// Fetch one more location to find out whether there is a next page.
+	locations := u.UB.GetLocations(device, cursor, limit+1, since, until)
+	if len(locations) > limit {
+		return locations[:limit], true
+	}
+	return locations, false
+}
 
-	locations := make([]string, len(user.Locations))
-	for i, location := range user.Locations {
+func (u *UserRepository) GetAllLocations(device *Device) []string {
+	all := u.UB.GetLocations(device, 0, -1, 0, 0)
+
+	locations := make([]string, len(all))
+	for i, location := range all {
 		locations[i] = location.Position
 	}
 
 	return locations
 }
 
-func (u *UserRepository) GetPicture(user *RMDUser, idx int) string {
-	u.UB.PreloadPictures(user)
-
-	if len(user.Pictures) == 0 {
+func (u *UserRepository) GetPicture(device *Device, idx int) string {
+	pic := u.UB.GetPictureAt(device, idx)
+	if pic == nil {
 		return "Picture not found"
 	}
-	return user.Pictures[idx].Content
+	return u.readPicture(pic)
+}
+
+func (u *UserRepository) GetAllPictures(device *Device) []string {
+	pictures := []string{}
+	cursor := uint64(0)
+	for {
+		// Only hold the references in memory, read the blobs one by one.
+		page := u.UB.GetPictures(device, cursor, 100)
+		for i := range page {
+			pictures = append(pictures, u.readPicture(&page[i]))
+		}
+		if len(page) < 100 {
+			return pictures
+		}
+		cursor = page[len(page)-1].Id
+	}
+}
+
+// Open the encrypted picture for reading.
+func (u *UserRepository) OpenPicture(pic *Picture) (io.ReadCloser, error) {
+	if pic.BlobName == "" {
+		// Not yet migrated, should not happen
+		return io.NopCloser(strings.NewReader(pic.Content)), nil
+	}
+	return u.UB.Pictures.Open(pic.BlobName)
+}
+
+func (u *UserRepository) readPicture(pic *Picture) string {
+	if pic.BlobName == "" {
+		return pic.Content
+	}
+	content, err := u.UB.Pictures.Read(pic.BlobName)
+	if err != nil {
+		log.Error().Err(err).Uint64("pictureId", pic.Id).Msg("failed to read picture blob")
+		return ""
+	}
+	return content
+}
+
+// Return a page of pictures, oldest first, and whether there are more (newer) pictures after this page.
+func (u *UserRepository) GetPicturePage(device *Device, cursor uint64, limit int) ([]Picture, bool) {
+	// Fetch one more picture to find out whether there is a next page.
+	pictures := u.UB.GetPictures(device, cursor, limit+1)
+	if len(pictures) > limit {
+		return pictures[:limit], true
+	}
+	return pictures, false
+}
+
+// The number of pictures of the device. This is a COUNT query, the pictures are not loaded.
+func (u *UserRepository) GetPictureSize(device *Device) int {
+	return int(u.UB.CountDevicePictures(device))
+}
+
+// Unfinished uploads are deleted after this time
+const PICTURE_UPLOAD_EXPIRY = 24 * time.Hour
+
+var ErrUploadSizeInvalid = errors.New("upload size is invalid")
+var ErrUploadNotFound = errors.New("upload not found")
+
+// Start a chunked upload of a picture with the given total size in bytes.
+func (u *UserRepository) StartPictureUpload(user *RMDUser, device *Device, size int64) (*PictureUpload, error) {
+	if size <= 0 {
+		return nil, ErrUploadSizeInvalid
+	}
+	u.removeExpiredPictureUploads()
+
+	err := u.checkPictureQuota(user, size)
+	if err != nil {
+		return nil, err
+	}
+
+	upload := PictureUpload{
+		Id:          genRandomString(32),
+		UserID:      user.Id,
+		DeviceID:    device.Id,
+		Size:        size,
+		CreatedTime: time.Now().Unix(),
+	}
+	u.UB.Create(&upload)
+	return &upload, nil
 }
 
-func (u *UserRepository) GetAllPictures(user *RMDUser) []string {
-	u.UB.PreloadPictures(user)
+// Return the upload and how many bytes have been received so far.
+func (u *UserRepository) GetPictureUpload(user *RMDUser, uploadId string) (*PictureUpload, int64, error) {
+	upload := u.UB.GetPictureUpload(user, uploadId)
+	if upload == nil {
+		return nil, 0, ErrUploadNotFound
+	}
+	offset, err := u.UB.Pictures.UploadOffset(uploadId)
+	return upload, offset, err
+}
 
-	if len(user.Pictures) == 0 {
-		return []string{}
+// Append a chunk to the upload, starting at offset.
+// Once all bytes have been received, the picture is added, and returned.
+// Returns the new offset (on ErrUploadOffsetMismatch: the expected offset).
+func (u *UserRepository) AppendPictureUpload(user *RMDUser, uploadId string, offset int64, chunk io.Reader) (int64, *Picture, error) {
+	upload := u.UB.GetPictureUpload(user, uploadId)
+	if upload == nil {
+		return 0, nil, ErrUploadNotFound
 	}
 
-	pictures := make([]string, len(user.Pictures))
-	for i, picture := range user.Pictures {
-		pictures[i] = picture.Content
+	newOffset, err := u.UB.Pictures.AppendUpload(uploadId, offset, chunk, upload.Size-offset)
+	if err != nil {
+		return newOffset, nil, err
+	}
+	if newOffset < upload.Size {
+		return newOffset, nil, nil
 	}
 
-	return pictures
+	name, err := u.UB.Pictures.CompleteUpload(uploadId)
+	if err != nil {
+		return newOffset, nil, err
+	}
+	u.UB.Delete(upload)
+	device := u.UB.GetDeviceByID(upload.DeviceID)
+	if device == nil {
+		// The device was deleted during the upload
+		u.UB.Pictures.Delete(name)
+		return newOffset, nil, ErrDeviceNotFound
+	}
+	pic := u.addPictureBlob(user, device, name, upload.Size)
+	return newOffset, pic, nil
 }
 
-func (u *UserRepository) GetPictureSize(user *RMDUser) int {
-	u.UB.PreloadPictures(user)
-	return len(user.Pictures)
+func (u *UserRepository) CancelPictureUpload(user *RMDUser, uploadId string) error {
+	upload := u.UB.GetPictureUpload(user, uploadId)
+	if upload == nil {
+		return ErrUploadNotFound
+	}
+	u.UB.Delete(upload)
+	return u.UB.Pictures.DeleteUpload(uploadId)
+}
+
+func (u *UserRepository) removeExpiredPictureUploads() {
+	before := time.Now().Add(-PICTURE_UPLOAD_EXPIRY).Unix()
+	for _, upload := range u.UB.GetPictureUploadsBefore(before) {
+		u.UB.Delete(&upload)
+		err := u.UB.Pictures.DeleteUpload(upload.Id)
+		if err != nil {
+			log.Error().Err(err).Str("uploadId", upload.Id).Msg("failed to delete expired upload")
+		}
+	}
 }
 
-func (u *UserRepository) GetLocationSize(user *RMDUser) int {
-	u.UB.PreloadLocations(user)
-	return len(user.Locations)
+// The number of locations of the device. This is a COUNT query, the locations are not loaded.
+func (u *UserRepository) GetLocationSize(device *Device) int {
+	return int(u.UB.CountDeviceLocations(device))
 }
 
 func (u *UserRepository) GetPrivateKey(user *RMDUser) string {
@@ -255,87 +498,263 @@ func (u *UserRepository) GetPublicKey(user *RMDUser) string {
 	return user.PublicKey
 }
 
-func (u *UserRepository) SetPublicKey(user *RMDUser, key string) {
+// Returns utils.ErrPublicKeyInvalid if the key cannot be used to encrypt the command log.
+func (u *UserRepository) SetPublicKey(user *RMDUser, key string) error {
+	if _, err := utils.ParseRsaPublicKey(key); err != nil {
+		return err
+	}
 	log.Info().Str("userid", user.UID).Msg("changing public key for user")
 	user.PublicKey = key
 	u.UB.Save(user)
+	return nil
 }
 
-/*
 func (u *UserRepository) addCommandLogEntry(user *RMDUser, entry string) {
 	timestamp := time.Now().Unix()
 
 	logEntry := CommandLogEntryContent{Timestamp: timestamp, Log: entry}
 	jsonLog, _ := json.Marshal(logEntry)
 
-	logEntryEncrypted := utils.RsaEncrypt(user.PublicKey, jsonLog)
-	comLogEntry := CommandLogEntry{UserID: user.Id, Content: logEntryEncrypted}
+	logEntryEncrypted, err := utils.RsaEncrypt(user.PublicKey, jsonLog)
+	if err != nil {
+		log.Error().Err(err).Str("userid", user.UID).Msg("failed to encrypt command log entry")
+		return
+	}
+	comLogEntry := CommandLogEntry{UserID: user.Id, Timestamp: timestamp, Content: logEntryEncrypted}
 
 	u.UB.Create(&comLogEntry)
+	u.UB.PruneCommandLog(user, u.maxSavedCommandLogs)
+}
+
+// How many delivered/finished commands to keep per user for the status history.
+const MAX_SAVED_COMMANDS = 100
+
+// How many commands can be queued per device.
+// Beyond this, the oldest queued commands are dropped (marked as failed),
+// such that the queue of a device that never fetches its commands stays bounded.
+const MAX_QUEUED_COMMANDS = 50
+
+const COMMAND_DROPPED_RESULT = "dropped, too many commands were queued"
+
+// Sent to the devices when someone tries to log in to a locked account.
+// This is the only command that is not signed, because the server sends it.
+const COMMAND_LOGIN_BLOCKED = "423"
+
+var ErrCommandNotFound = errors.New("command not found")
+var ErrCommandStatusInvalid = errors.New("invalid command status")
+
+// Append a command to the queue of the device and wake it up.
+func (u *UserRepository) AddCommandToUser(user *RMDUser, device *Device, cmd string, cmdTime uint64, cmdSig string) *Command {
+	if cmd == "" {
+		return nil
+	}
+
+	now := time.Now().Unix()
+	command := Command{
+		UserID:      user.Id,
+		DeviceID:    device.Id,
+		Command:     cmd,
+		CommandTime: cmdTime,
+		CommandSig:  cmdSig,
+		Status:      CommandStatusQueued,
+		CreatedTime: now,
+		UpdatedTime: now,
+	}
+	u.UB.Create(&command)
+	dropped := u.UB.DropQueuedCommands(device, MAX_QUEUED_COMMANDS, COMMAND_DROPPED_RESULT)
+	metrics.PendingCommands.Add(float64(1 - dropped))
+	if dropped > 0 {
+		log.Warn().
+			Str("userid", user.UID).
+			Str("deviceId", device.DeviceId).
+			Int64("dropped", dropped).
+			Msg("too many queued commands, dropping the oldest")
+	}
+	u.UB.PruneCommands(user, MAX_SAVED_COMMANDS)
+
+	logEntry := fmt.Sprintf("Command \"%s\" sent to server!", cmd)
+	u.addCommandLogEntry(user, logEntry)
+
+	u.wakeUpDevice(user, device)
+	return &command
+}
+
+// Deliver the oldest queued command.
+// Returns nil if there is no queued command.
+func (u *UserRepository) GetCommandToUser(user *RMDUser, device *Device) *Command {
+	u.touchDevice(device)
+	cmds := u.UB.DeliverQueuedCommands(device, 1)
+	if len(cmds) == 0 {
+		return nil
+	}
+	metrics.PendingCommands.Dec()
+
+	logEntry := fmt.Sprintf("Command \"%s\" received by device!", cmds[0].Command)
+	u.addCommandLogEntry(user, logEntry)
+	u.publishCommandEvent(user, device, &cmds[0])
+
+	// Wake the device up again so that it also fetches the remaining commands.
+	if u.UB.CountQueuedCommands(device) > 0 {
+		go u.wakeUpDevice(user, device)
+	}
+
+	return &cmds[0]
 }
-*/
 
-func (u *UserRepository) SetCommandToUser(user *RMDUser, cmd string, cmdTime uint64, cmdSig string) {
-	if cmd != "" {
-		// Only increment if this is not overwriting an existing pending command.
-		// TODO: Support delivering more than one command.
-		if user.CommandToUser == "" {
-			metrics.PendingCommands.Inc()
+// Deliver the oldest queued command.
+// If there is none, wait until a command is queued, the timeout ends, the context is cancelled,
+// or the server shuts down. Returns nil if no command was delivered.
+func (u *UserRepository) WaitForCommand(ctx context.Context, user *RMDUser, device *Device, timeout time.Duration) (*Command, error) {
+	// Register before checking the queue, so that a command queued in between is not missed.
+	wake, err := u.Waiters.Add(user.UID, device.Key())
+	if err != nil {
+		return nil, err
+	}
+	defer u.Waiters.Remove(device.Key(), wake)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		cmd := u.GetCommandToUser(user, device)
+		if cmd != nil {
+			return cmd, nil
+		}
+
+		select {
+		case <-wake:
+			// Another waiter may have taken the command already, so check the queue again.
+		case <-timer.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, nil
+		case <-u.Waiters.Done():
+			return nil, nil
 		}
 	}
+}
 
-	user.CommandToUser = cmd
-	user.CommandTime = cmdTime
-	user.CommandSig = cmdSig
+// Put delivered commands back into the queue,
+// e.g., because sending them to the device failed.
+func (u *UserRepository) RequeueCommands(device *Device, cmds []Command) {
+	requeued := u.UB.RequeueCommands(device, cmds)
+	metrics.PendingCommands.Add(float64(requeued))
+}
 
-	if cmd != "" {
-		//logEntry := fmt.Sprintf("Command \"%s\" sent to server!", cmd)
-		//u.addCommandLogEntry(user, logEntry)
+// Deliver all queued commands, oldest first.
+func (u *UserRepository) GetAllCommandsToUser(user *RMDUser, device *Device) []Command {
+	u.touchDevice(device)
+	cmds := u.UB.DeliverQueuedCommands(device, 0)
+	metrics.PendingCommands.Sub(float64(len(cmds)))
 
-		u.pushUser(user)
+	for i := range cmds {
+		logEntry := fmt.Sprintf("Command \"%s\" received by device!", cmds[i].Command)
+		u.addCommandLogEntry(user, logEntry)
+		u.publishCommandEvent(user, device, &cmds[i])
 	}
 
-	u.UB.Save(user)
+	return cmds
 }
 
-func (u *UserRepository) GetCommandToUser(user *RMDUser) (string, uint64, string) {
-	// if user.CommandToUser != "" {
-	// 	logEntry := fmt.Sprintf("Command \"%s\" received by device!", user.CommandToUser)
-	// 	u.addCommandLogEntry(user, logEntry)
-	// }
+func (u *UserRepository) GetCommandStatus(user *RMDUser, id uint64) (*Command, error) {
+	cmd := u.UB.GetCommandByID(user, id)
+	if cmd == nil {
+		return nil, ErrCommandNotFound
+	}
+	return cmd, nil
+}
+
+func (u *UserRepository) GetRecentCommands(user *RMDUser) []Command {
+	return u.UB.GetRecentCommands(user, MAX_SAVED_COMMANDS)
+}
 
-	c, t, s := user.CommandToUser, user.CommandTime, user.CommandSig
+// Record the status that the device reported for a delivered command.
+//
+// The status can only move forward:
+// delivered -> acknowledged -> executed/failed.
+// Executed and failed are final.
+func (u *UserRepository) SetCommandStatus(user *RMDUser, device *Device, id uint64, status string, result string) (*Command, error) {
+	cmd := u.UB.GetCommandByID(user, id)
+	if cmd == nil || cmd.DeviceID != device.Id {
+		return nil, ErrCommandNotFound
+	}
+	u.touchDevice(device)
 
-	if user.CommandToUser != "" {
-		metrics.PendingCommands.Dec()
+	if !isCommandStatusTransitionAllowed(cmd.Status, status) {
+		log.Warn().
+			Str("userid", user.UID).
+			Uint64("commandId", id).
+			Str("from", cmd.Status).
+			Str("to", status).
+			Msg("invalid command status transition")
+		return nil, ErrCommandStatusInvalid
 	}
 
-	// Clear the command so that the app only gets it once
-	u.SetCommandToUser(user, "", 0, "")
+	cmd.Status = status
+	cmd.Result = result
+	cmd.UpdatedTime = time.Now().Unix()
+	u.UB.Save(cmd)
+
+	logEntry := fmt.Sprintf("Command \"%s\" %s by device!", cmd.Command, status)
+	if result != "" {
+		logEntry = fmt.Sprintf("Command \"%s\" %s by device: %s", cmd.Command, status, result)
+	}
+	u.addCommandLogEntry(user, logEntry)
+	u.publishCommandEvent(user, device, cmd)
+
+	return cmd, nil
+}
+
+func (u *UserRepository) publishCommandEvent(user *RMDUser, device *Device, cmd *Command) {
+	u.Events.Publish(user.UID, EVENT_COMMAND, commandEvent{
+		CmdId:  cmd.Id,
+		Status: cmd.Status,
+		Device: device.DeviceId,
+	})
+}
 
-	return c, t, s
+func isCommandStatusTransitionAllowed(from string, to string) bool {
+	switch to {
+	case CommandStatusAcknowledged:
+		return from == CommandStatusDelivered
+	case CommandStatusExecuted, CommandStatusFailed:
+		return from == CommandStatusDelivered || from == CommandStatusAcknowledged
+	default:
+		return false
+	}
 }
 
-/*
-func (u *UserRepository) GetCommandLog(user *RMDUser) string {
-	commandLog := ""
-	for _, logEntry := range user.CommandLogs {
-		commandLog += logEntry.Content + "\n"
+const DEFAULT_COMMAND_LOG_PAGE_SIZE = 50
+const MAX_COMMAND_LOG_PAGE_SIZE = 500
+
+// Return a page of the encrypted command log, newest first,
+// and whether there are more (older) entries after this page.
+// See RMDDB.GetCommandLogEntries for the meaning of the parameters.
+func (u *UserRepository) GetCommandLog(user *RMDUser, cursor uint64, limit int, since int64, until int64) ([]CommandLogEntry, bool) {
+	if limit <= 0 {
+		limit = DEFAULT_COMMAND_LOG_PAGE_SIZE
+	} else if limit > MAX_COMMAND_LOG_PAGE_SIZE {
+		limit = MAX_COMMAND_LOG_PAGE_SIZE
 	}
-	return commandLog
+
+	// Fetch one more entry to find out whether there is a next page.
+	entries := u.UB.GetCommandLogEntries(user, cursor, limit+1, since, until)
+	if len(entries) > limit {
+		return entries[:limit], true
+	}
+	return entries, false
 }
-*/
 
-func (u *UserRepository) SetPushUrl(user *RMDUser, pushUrl string) {
-	old := user.PushUrl
+func (u *UserRepository) SetPushUrl(device *Device, pushUrl string) {
+	old := device.PushUrl
 	UpdatePushServerMetrics(old, pushUrl)
 
-	user.PushUrl = pushUrl
-	u.UB.Save(user)
+	device.PushUrl = pushUrl
+	u.UB.Save(device)
 }
 
-func (u *UserRepository) GetPushUrl(user *RMDUser) string {
-	return user.PushUrl
+func (u *UserRepository) GetPushUrl(device *Device) string {
+	return device.PushUrl
 }
 
 func (u *UserRepository) generateNewId() string {
@@ -374,63 +793,142 @@ func (u *UserRepository) GetSalt(id string) string {
 
 var ErrAccountLocked = errors.New("too many attempts, account locked")
 
-func (u *UserRepository) RequestAccess(id string, innerPwHash string, sessionDurationSeconds uint64, remoteIp string) (*AccessToken, error) {
+// Log in with the password.
+//
+// If the account has TOTP enabled, this returns a TotpChallenge instead of an access token,
+// and the login must be finished with VerifyTotp.
+// With a valid deviceCredential, the TOTP step is skipped, but the session only gets the credential's scopes.
+func (u *UserRepository) RequestAccess(id string, innerPwHash string, deviceCredential string, request SessionRequest) (*AccessToken, *TotpChallenge, error) {
 	user, err := u.UB.GetByID(id)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	if u.ACC.IsLocked(id) {
+	if u.isLoginBlocked(user) {
 		log.Warn().
 			Str("userid", user.UID).
-			Str("remoteIp", remoteIp).
+			Str("remoteIp", request.RemoteIp).
 			Msg("blocked login attempt")
 
 		// Cannot sign since the server sets this.
 		// This is the only "command" that is allowed to be unsigned.
-		u.SetCommandToUser(user, "423", 0, "")
-		return nil, ErrAccountLocked
+		for _, device := range u.UB.GetDevices(user) {
+			// Repeated attempts neither queue nor push the notification again, until the device fetched it.
+			if u.UB.HasQueuedCommand(&device, COMMAND_LOGIN_BLOCKED) {
+				continue
+			}
+			u.AddCommandToUser(user, &device, COMMAND_LOGIN_BLOCKED, 0, "")
+		}
+		return nil, nil, ErrAccountLocked
 	}
 
 	expected := user.HashedPassword
 	actual := hashPasswordForLogin(innerPwHash)
 
-	if actual == expected {
-		u.ACC.ResetLock(id)
-		token := u.ACC.CreateNewAccessToken(id, sessionDurationSeconds)
-
-		// Push user after login to make sure that they fetch the pending command
-		if user.CommandToUser != "" {
-			go func() {
-				time.Sleep(15 * time.Second)
-
-				// Get the latest user from the DB, since after the login
-				// e.g. the pushUrl may have changed.
-				user, err := u.UB.GetByID(id)
-				if err == nil {
-					if user.CommandToUser != "" {
-						u.pushUser(user)
-					}
-				}
-			}()
-		}
-
-		return &token, nil
-	} else {
+	if actual != expected {
 		u.ACC.IncrementLock(id)
 		log.Warn().
 			Str("userid", user.UID).
-			Str("remoteIp", remoteIp).
+			Str("remoteIp", request.RemoteIp).
 			Msg("failed login attempt")
-		return nil, errors.New("wrong password")
+		return nil, nil, errors.New("wrong password")
+	}
+
+	if deviceCredential != "" {
+		scopes, err := u.checkDeviceCredential(user, deviceCredential, request.Scopes)
+		if err != nil {
+			u.ACC.IncrementLock(id)
+			log.Warn().
+				Err(err).
+				Str("userid", user.UID).
+				Str("remoteIp", request.RemoteIp).
+				Str("factor", "deviceCredential").
+				Msg("failed login attempt")
+			return nil, nil, err
+		}
+		request.Scopes = scopes
+	} else if u.IsTotpEnabled(user) {
+		return nil, u.TotpChallenges.Create(user.UID, request), nil
+	}
+
+	token := u.finishLogin(user, request)
+	return &token, nil, nil
+}
+
+// Create the session after all login checks passed.
+func (u *UserRepository) finishLogin(user *RMDUser, request SessionRequest) AccessToken {
+	id := user.UID
+	u.ACC.ResetLock(id)
+	token := u.ACC.CreateNewAccessToken(id, request)
+
+	// Push the devices after login to make sure that they fetch the pending commands
+	go func() {
+		time.Sleep(15 * time.Second)
+
+		// Get the latest devices from the DB, since after the login
+		// e.g. the pushUrl may have changed.
+		user, err := u.UB.GetByID(id)
+		if err != nil {
+			return
+		}
+		for _, device := range u.UB.GetDevices(user) {
+			if u.UB.CountQueuedCommands(&device) > 0 {
+				u.wakeUpDevice(user, &device)
+			}
+		}
+	}()
+
+	return token
+}
+
+// Exchange a refresh token for a new access token and refresh token (see AccessController.RefreshAccessToken).
+func (u *UserRepository) RefreshAccess(refreshToken string, sessionDurationSeconds uint64, remoteIp string) (*AccessToken, error) {
+	token, err := u.ACC.RefreshAccessToken(refreshToken, sessionDurationSeconds)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("remoteIp", remoteIp).
+			Msg("failed to refresh access token")
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (u *UserRepository) GetSessions(user *RMDUser) []Session {
+	return u.ACC.GetSessionsOfUser(user.UID)
+}
+
+func (u *UserRepository) RevokeSession(user *RMDUser, sessionId string) bool {
+	revoked := u.ACC.RevokeSession(user.UID, sessionId)
+	if revoked {
+		log.Info().Str("userid", user.UID).Msg("revoked session")
+	}
+	return revoked
+}
+
+// Revoke all sessions of the user, except the session of currentToken.
+func (u *UserRepository) RevokeOtherSessions(user *RMDUser, currentToken string) int {
+	count := u.ACC.RevokeOtherSessions(user.UID, currentToken)
+	log.Info().Str("userid", user.UID).Int("count", count).Msg("revoked other sessions")
+	return count
+}
+
+// Tell the device to fetch its commands.
+// Prefer the direct connection or a waiting long-polling request, if there is one. Otherwise, use UnifiedPush.
+func (u *UserRepository) wakeUpDevice(user *RMDUser, device *Device) {
+	connected := u.Devices.Notify(device.Key())
+	waiting := u.Waiters.Notify(device.Key())
+	if connected || waiting {
+		return
 	}
+	u.pushDevice(user, device)
 }
 
-func (u *UserRepository) pushUser(user *RMDUser) {
-	pushUrl := strings.Replace(u.GetPushUrl(user), "/UP?", "/message?", -1)
+func (u *UserRepository) pushDevice(user *RMDUser, device *Device) {
+	pushUrl := strings.Replace(u.GetPushUrl(device), "/UP?", "/message?", -1)
 
 	if len(pushUrl) == 0 {
-		log.Warn().Str("userid", user.UID).Msg("cannot push user, no push URL, they need to install a UnifiedPush distributor app")
+		log.Warn().Str("userid", user.UID).Str("deviceId", device.DeviceId).Msg("cannot push device, no push URL, they need to install a UnifiedPush distributor app")
 		return
 	}
 
@@ -0,0 +1,442 @@
+package user
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"rmd-server/blobstore"
+	"rmd-server/metrics"
+	"rmd-server/utils"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var testKeyOnce sync.Once
+var testKey string
+
+// Base64-encoded PKIX public key, as the clients send it.
+// Generating RSA keys is slow, thus all tests share one.
+func testPublicKey(t *testing.T) string {
+	t.Helper()
+	testKeyOnce.Do(func() {
+		privKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			panic(err)
+		}
+		testKey = encodeTestPublicKey(t, &privKey.PublicKey)
+	})
+	return testKey
+}
+
+func encodeTestPublicKey(t *testing.T, pub any) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+// Repository with an empty database in a temporary directory
+func newTestRepository(t *testing.T, maxCommandWaiters int) *UserRepository {
+	t.Helper()
+	dir := t.TempDir()
+	blobs, err := blobstore.NewLocalBlobStore(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := NewUserRepository(dir, blobs, 8, 100, 100, 100, maxCommandWaiters, 0)
+	return &repo
+}
+
+func newTestUser(t *testing.T, repo *UserRepository, id string) (*RMDUser, *Device) {
+	t.Helper()
+	_, err := repo.CreateNewUser("privKey", testPublicKey(t), "salt", "pwHash", id, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := repo.UB.GetByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, err := repo.GetDevice(user, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, device
+}
+
+func TestCreateNewUserPublicKey(t *testing.T) {
+	repo := newTestRepository(t, 0)
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	smallKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	invalidKeys := map[string]string{
+		"empty":   "",
+		"garbage": "bm90IGEga2V5",
+		"ecdsa":   encodeTestPublicKey(t, &ecKey.PublicKey),
+		"small":   encodeTestPublicKey(t, &smallKey.PublicKey),
+	}
+	for name, key := range invalidKeys {
+		_, err := repo.CreateNewUser("privKey", key, "salt", "pwHash", "user-"+name, 0)
+		if !errors.Is(err, utils.ErrPublicKeyInvalid) {
+			t.Errorf("%s key: expected ErrPublicKeyInvalid, got %v", name, err)
+		}
+	}
+
+	user, _ := newTestUser(t, repo, "alice")
+	if err := repo.SetPublicKey(user, invalidKeys["ecdsa"]); !errors.Is(err, utils.ErrPublicKeyInvalid) {
+		t.Errorf("expected ErrPublicKeyInvalid, got %v", err)
+	}
+	if user.PublicKey != testPublicKey(t) {
+		t.Error("invalid public key was set")
+	}
+}
+
+// Accounts from before the keys were checked may have keys that cannot be used
+func TestCommandLogWithInvalidPublicKey(t *testing.T) {
+	repo := newTestRepository(t, 0)
+	user, device := newTestUser(t, repo, "alice")
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	user.PublicKey = encodeTestPublicKey(t, &ecKey.PublicKey)
+	repo.UB.Save(user)
+
+	if repo.AddCommandToUser(user, device, COMMAND_LOGIN_BLOCKED, 0, "") == nil {
+		t.Fatal("command was not queued")
+	}
+	if entries := repo.UB.GetCommandLogEntries(user, 0, 10, 0, 0); len(entries) != 0 {
+		t.Errorf("expected no log entries, got %d", len(entries))
+	}
+
+	user.PublicKey = testPublicKey(t)
+	repo.AddCommandToUser(user, device, "locate", 1, "sig")
+	if entries := repo.UB.GetCommandLogEntries(user, 0, 10, 0, 0); len(entries) != 1 {
+		t.Errorf("expected 1 log entry, got %d", len(entries))
+	}
+}
+
+// Run with -race: the device socket shares the device between its reader and writer
+func TestTouchDeviceConcurrent(t *testing.T) {
+	repo := newTestRepository(t, 0)
+	user, device := newTestUser(t, repo, "alice")
+	cmd := repo.AddCommandToUser(user, device, "locate", 1, "sig")
+	repo.GetAllCommandsToUser(user, device)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			repo.GetAllCommandsToUser(user, device)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			repo.SetCommandStatus(user, device, cmd.Id, CommandStatusAcknowledged, "")
+		}
+	}()
+	wg.Wait()
+
+	if device.LastSeenTime != 0 {
+		t.Error("the shared device was changed")
+	}
+	stored, _ := repo.GetDevice(user, device.DeviceId)
+	if stored.LastSeenTime == 0 {
+		t.Error("last seen time was not stored")
+	}
+}
+
+func checkPendingCommands(t *testing.T, repo *UserRepository, device *Device, expected int) {
+	t.Helper()
+	if count := repo.UB.CountQueuedCommands(device); count != int64(expected) {
+		t.Errorf("%d queued commands, expected %d", count, expected)
+	}
+	if gauge := testutil.ToFloat64(metrics.PendingCommands); gauge != float64(expected) {
+		t.Errorf("rmd_pending_commands is %v, expected %d", gauge, expected)
+	}
+}
+
+func TestCommandQueueFIFO(t *testing.T) {
+	repo := newTestRepository(t, 0)
+	user, device := newTestUser(t, repo, "alice")
+	for _, cmd := range []string{"locate", "ring", "lock", "camera"} {
+		repo.AddCommandToUser(user, device, cmd, 1, "sig")
+	}
+	checkPendingCommands(t, repo, device, 4)
+
+	if cmd := repo.GetCommandToUser(user, device); cmd == nil || cmd.Command != "locate" {
+		t.Fatalf("expected the oldest command, got %+v", cmd)
+	}
+	checkPendingCommands(t, repo, device, 3)
+
+	cmds := repo.GetAllCommandsToUser(user, device)
+	if len(cmds) != 3 || cmds[0].Command != "ring" || cmds[1].Command != "lock" || cmds[2].Command != "camera" {
+		t.Fatalf("commands were not delivered in order: %+v", cmds)
+	}
+	checkPendingCommands(t, repo, device, 0)
+
+	// Sending to the device failed
+	repo.RequeueCommands(device, cmds[1:])
+	checkPendingCommands(t, repo, device, 2)
+	if cmd := repo.GetCommandToUser(user, device); cmd == nil || cmd.Command != "lock" {
+		t.Errorf("expected the oldest requeued command, got %+v", cmd)
+	}
+	checkPendingCommands(t, repo, device, 1)
+}
+
+func TestCommandQueueLimit(t *testing.T) {
+	repo := newTestRepository(t, 0)
+	user, device := newTestUser(t, repo, "alice")
+	other, err := repo.CreateDevice(user, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < MAX_QUEUED_COMMANDS+5; i++ {
+		repo.AddCommandToUser(user, device, fmt.Sprint("cmd", i), 1, "sig")
+	}
+	checkPendingCommands(t, repo, device, MAX_QUEUED_COMMANDS)
+
+	// The limit is per device
+	repo.AddCommandToUser(user, other, "locate", 1, "sig")
+	if count := repo.UB.CountQueuedCommands(other); count != 1 {
+		t.Errorf("%d queued commands on the other device, expected 1", count)
+	}
+
+	for _, cmd := range repo.GetRecentCommands(user) {
+		if cmd.DeviceID != device.Id {
+			continue
+		}
+		dropped := cmd.Status == CommandStatusFailed
+		if expected := cmd.Id <= 5; dropped != expected {
+			t.Errorf("command %s: dropped=%t, expected %t", cmd.Command, dropped, expected)
+		}
+		if dropped && cmd.Result != COMMAND_DROPPED_RESULT {
+			t.Errorf("unexpected result: %s", cmd.Result)
+		}
+	}
+	if cmd := repo.GetCommandToUser(user, device); cmd == nil || cmd.Command != "cmd5" {
+		t.Errorf("expected the oldest command that was not dropped, got %+v", cmd)
+	}
+}
+
+func TestBlockedLoginNotification(t *testing.T) {
+	repo := newTestRepository(t, 0)
+	user, device := newTestUser(t, repo, "alice")
+	repo.LockUser(user, "")
+
+	for i := 0; i < 3; i++ {
+		_, _, err := repo.RequestAccess("alice", "pwHash", "", SessionRequest{})
+		if !errors.Is(err, ErrAccountLocked) {
+			t.Fatalf("expected ErrAccountLocked, got %v", err)
+		}
+	}
+	checkPendingCommands(t, repo, device, 1)
+
+	// Queued again once the device has fetched it
+	if cmd := repo.GetCommandToUser(user, device); cmd == nil || cmd.Command != COMMAND_LOGIN_BLOCKED {
+		t.Fatalf("expected the notification, got %+v", cmd)
+	}
+	repo.RequestAccess("alice", "pwHash", "", SessionRequest{})
+	checkPendingCommands(t, repo, device, 1)
+}
+
+func TestSetCommandStatus(t *testing.T) {
+	tests := []struct {
+		from    string
+		to      string
+		allowed bool
+	}{
+		{CommandStatusDelivered, CommandStatusAcknowledged, true},
+		{CommandStatusDelivered, CommandStatusExecuted, true},
+		{CommandStatusDelivered, CommandStatusFailed, true},
+		{CommandStatusAcknowledged, CommandStatusExecuted, true},
+		{CommandStatusAcknowledged, CommandStatusFailed, true},
+		{CommandStatusQueued, CommandStatusAcknowledged, false},
+		{CommandStatusQueued, CommandStatusExecuted, false},
+		{CommandStatusDelivered, CommandStatusQueued, false},
+		{CommandStatusDelivered, CommandStatusDelivered, false},
+		{CommandStatusAcknowledged, CommandStatusAcknowledged, false},
+		{CommandStatusAcknowledged, CommandStatusDelivered, false},
+		{CommandStatusExecuted, CommandStatusFailed, false},
+		{CommandStatusExecuted, CommandStatusAcknowledged, false},
+		{CommandStatusFailed, CommandStatusExecuted, false},
+		{CommandStatusDelivered, "done", false},
+		{CommandStatusDelivered, "", false},
+	}
+
+	repo := newTestRepository(t, 0)
+	user, device := newTestUser(t, repo, "alice")
+	for _, tt := range tests {
+		t.Run(tt.from+"->"+tt.to, func(t *testing.T) {
+			repo.AddCommandToUser(user, device, "locate", 1, "sig")
+			cmd := repo.GetCommandToUser(user, device)
+			cmd.Status = tt.from
+			repo.UB.Save(cmd)
+
+			updated, err := repo.SetCommandStatus(user, device, cmd.Id, tt.to, "result")
+			stored, _ := repo.GetCommandStatus(user, cmd.Id)
+			if tt.allowed {
+				if err != nil || updated.Status != tt.to {
+					t.Fatalf("expected %s, got %v %v", tt.to, updated, err)
+				}
+				if stored.Status != tt.to || stored.Result != "result" {
+					t.Errorf("status was not stored: %s %q", stored.Status, stored.Result)
+				}
+			} else {
+				if err != ErrCommandStatusInvalid {
+					t.Fatalf("expected ErrCommandStatusInvalid, got %v", err)
+				}
+				if stored.Status != tt.from {
+					t.Errorf("status changed to %s", stored.Status)
+				}
+			}
+		})
+	}
+}
+
+func TestSetCommandStatusOfOtherDevice(t *testing.T) {
+	repo := newTestRepository(t, 0)
+	user, device := newTestUser(t, repo, "alice")
+	other, err := repo.CreateDevice(user, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.AddCommandToUser(user, device, "locate", 1, "sig")
+	cmd := repo.GetCommandToUser(user, device)
+
+	if _, err := repo.SetCommandStatus(user, other, cmd.Id, CommandStatusExecuted, ""); err != ErrCommandNotFound {
+		t.Errorf("another device: expected ErrCommandNotFound, got %v", err)
+	}
+	if _, err := repo.SetCommandStatus(user, device, cmd.Id+1, CommandStatusExecuted, ""); err != ErrCommandNotFound {
+		t.Errorf("unknown command: expected ErrCommandNotFound, got %v", err)
+	}
+}
+
+func TestRequeueCommands(t *testing.T) {
+	repo := newTestRepository(t, 0)
+	user, device := newTestUser(t, repo, "alice")
+	other, err := repo.CreateDevice(user, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{"locate", "ring", "lock"} {
+		repo.AddCommandToUser(user, device, cmd, 1, "sig")
+	}
+	cmds := repo.GetAllCommandsToUser(user, device)
+	checkPendingCommands(t, repo, device, 0)
+
+	// The device acknowledged one command before the connection broke
+	if _, err := repo.SetCommandStatus(user, device, cmds[1].Id, CommandStatusAcknowledged, ""); err != nil {
+		t.Fatal(err)
+	}
+	repo.RequeueCommands(other, cmds)
+	checkPendingCommands(t, repo, device, 0)
+
+	repo.RequeueCommands(device, cmds)
+	repo.RequeueCommands(device, cmds)
+	checkPendingCommands(t, repo, device, 2)
+	for i, expected := range []string{CommandStatusQueued, CommandStatusAcknowledged, CommandStatusQueued} {
+		if stored, _ := repo.GetCommandStatus(user, cmds[i].Id); stored.Status != expected {
+			t.Errorf("command %s is %s, expected %s", stored.Command, stored.Status, expected)
+		}
+	}
+	repo.RequeueCommands(device, nil)
+	checkPendingCommands(t, repo, device, 2)
+}
+
+// Locations 1-5 of the device, received at 1000, 2000, ..., 5000
+func addTestLocations(repo *UserRepository, user *RMDUser, device *Device) {
+	for i := int64(1); i <= 5; i++ {
+		repo.UB.Create(&Location{UserID: user.Id, DeviceID: device.Id, Position: fmt.Sprint("loc", i), ReceivedTime: i * 1000})
+	}
+}
+
+func locationIds(locations []Location) []uint64 {
+	ids := []uint64{}
+	for _, loc := range locations {
+		ids = append(ids, loc.Id)
+	}
+	return ids
+}
+
+func TestGetLocationPage(t *testing.T) {
+	repo := newTestRepository(t, 0)
+	user, device := newTestUser(t, repo, "alice")
+	other, err := repo.CreateDevice(user, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestLocations(repo, user, device)
+	addTestLocations(repo, user, other)
+
+	// Each page starts right after the cursor, without gaps or duplicates
+	pages := [][]uint64{}
+	cursor := uint64(0)
+	for {
+		page, more := repo.GetLocationPage(device, cursor, 2, 0, 0)
+		pages = append(pages, locationIds(page))
+		if !more {
+			break
+		}
+		cursor = page[len(page)-1].Id
+	}
+	if fmt.Sprint(pages) != "[[1 2] [3 4] [5]]" {
+		t.Errorf("unexpected pages: %v", pages)
+	}
+
+	// A full last page has no next page
+	if page, more := repo.GetLocationPage(device, 1, 4, 0, 0); len(page) != 4 || more {
+		t.Errorf("expected 4 locations and no next page, got %v %t", locationIds(page), more)
+	}
+	// Past the last location
+	if page, more := repo.GetLocationPage(device, 5, 2, 0, 0); len(page) != 0 || more {
+		t.Errorf("expected an empty page, got %v %t", locationIds(page), more)
+	}
+}
+
+func TestGetLocationPageSinceUntil(t *testing.T) {
+	repo := newTestRepository(t, 0)
+	user, device := newTestUser(t, repo, "alice")
+	addTestLocations(repo, user, device)
+
+	tests := []struct {
+		cursor   uint64
+		since    int64
+		until    int64
+		expected string
+	}{
+		// The bounds are inclusive
+		{0, 2000, 4000, "[2 3 4]"},
+		{0, 2000, 0, "[2 3 4 5]"},
+		{0, 0, 2000, "[1 2]"},
+		{0, 2001, 3999, "[3]"},
+		{3, 2000, 4000, "[4]"},
+		{4, 2000, 4000, "[]"},
+		{0, 4000, 2000, "[]"},
+		{0, 6000, 0, "[]"},
+	}
+	for _, tt := range tests {
+		page, more := repo.GetLocationPage(device, tt.cursor, 10, tt.since, tt.until)
+		if ids := fmt.Sprint(locationIds(page)); ids != tt.expected || more {
+			t.Errorf("cursor %d, since %d, until %d: expected %s, got %s (more: %t)", tt.cursor, tt.since, tt.until, tt.expected, ids, more)
+		}
+	}
+
+	// Paging within a time range
+	page, more := repo.GetLocationPage(device, 0, 2, 2000, 0)
+	if fmt.Sprint(locationIds(page)) != "[2 3]" || !more {
+		t.Errorf("expected [2 3] and a next page, got %v %t", locationIds(page), more)
+	}
+}
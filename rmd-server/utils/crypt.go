@@ -9,8 +9,15 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
 )
 
+// Keys must be large enough to wrap the AES session key with RSA-OAEP (SHA-256)
+const RSA_MIN_KEY_BITS = 2048
+
+var ErrPublicKeyInvalid = errors.New("the public key must be an RSA key (base64-encoded PKIX) of at least 2048 bits")
+var ErrEncryptionFailed = errors.New("failed to encrypt")
+
 func encryptWithAESGCM(plaintext, key []byte) []byte {
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -57,25 +64,44 @@ func generateSecureRandomKey(size int) []byte {
 	return key
 }
 
-func RsaEncrypt(publicKeyString string, message []byte) string {
-	sessionKey := generateSecureRandomKey(32)
-	ivAndAesCiphertext := encryptWithAESGCM(message, sessionKey)
-
-	//pubKeyBytes := []byte(DecodeBase64(publicKeyString))
+// Parse a public key as it is stored for an account (base64-encoded PKIX, without the PEM armor).
+// Returns ErrPublicKeyInvalid if it is not an RSA key that RsaEncrypt can use.
+func ParseRsaPublicKey(publicKeyString string) (*rsa.PublicKey, error) {
 	publicKeyString = "-----BEGIN PUBLIC KEY-----\n" + publicKeyString + "\n-----END PUBLIC KEY-----"
 	block, _ := pem.Decode([]byte(publicKeyString))
 	if block == nil {
-		return ""
+		return nil, ErrPublicKeyInvalid
 	}
 	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
 	if err != nil {
-		return ""
+		return nil, ErrPublicKeyInvalid
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok || rsaPub.N.BitLen() < RSA_MIN_KEY_BITS {
+		return nil, ErrPublicKeyInvalid
+	}
+	return rsaPub, nil
+}
+
+func RsaEncrypt(publicKeyString string, message []byte) (string, error) {
+	pub, err := ParseRsaPublicKey(publicKeyString)
+	if err != nil {
+		return "", err
+	}
+
+	sessionKey := generateSecureRandomKey(32)
+	ivAndAesCiphertext := encryptWithAESGCM(message, sessionKey)
+	if sessionKey == nil || ivAndAesCiphertext == nil {
+		return "", ErrEncryptionFailed
 	}
 
-	sessionKeyPacket, _ := wrapSessionKeyOAEP(pub.(*rsa.PublicKey), sessionKey)
+	sessionKeyPacket, err := wrapSessionKeyOAEP(pub, sessionKey)
+	if err != nil {
+		return "", err
+	}
 	res := concatByteArrays(sessionKeyPacket, ivAndAesCiphertext)
 
-	return EncodeBase64(res)
+	return EncodeBase64(res), nil
 }
 
 func DecodeBase64(encoded string) []byte {
@@ -1,7 +1,7 @@
 // RMD Server API v1
 // TODO: move more network APIs here, and leave logic.js for business and UI logic.
 
-async function getPushUrl(accessToken) {
+async function getPushUrl(accessToken, device) {
     if (!accessToken) {
         console.log("Missing accessToken!");
         throw new Error("Missing accessToken!");
@@ -12,6 +12,7 @@ async function getPushUrl(accessToken) {
         body: JSON.stringify({
             IDT: accessToken,
             Data: "",
+            Device: device || "",
         }),
         headers: {
             'Content-type': 'application/json'
@@ -28,3 +29,481 @@ async function getPushUrl(accessToken) {
     const pushUrl = await response.text();
     return pushUrl;
 }
+
+// Returns the status of the command with the given ID,
+// or a list of the recent commands if cmdId is empty.
+async function getCommandStatus(accessToken, cmdId) {
+    if (!accessToken) {
+        console.log("Missing accessToken!");
+        throw new Error("Missing accessToken!");
+    }
+
+    const response = await fetch("api/v1/commandStatus", {
+        method: 'PUT',
+        body: JSON.stringify({
+            IDT: accessToken,
+            Data: cmdId ? cmdId.toString() : "",
+        }),
+        headers: {
+            'Content-type': 'application/json'
+        }
+    });
+    if (response.status == 401) {
+        tokenExpiredRedirect();
+        throw new Error("Token expired");
+    }
+    if (!response.ok) {
+        throw response.status;
+    }
+
+    return await response.json();
+}
+
+// Returns the storage usage and quotas of the account (in bytes, a quota of 0 means unlimited).
+async function getStorageUsage(accessToken) {
+    if (!accessToken) {
+        console.log("Missing accessToken!");
+        throw new Error("Missing accessToken!");
+    }
+
+    const response = await fetch("api/v1/usage", {
+        method: 'PUT',
+        body: JSON.stringify({
+            IDT: accessToken,
+            Data: "",
+        }),
+        headers: {
+            'Content-type': 'application/json'
+        }
+    });
+    if (response.status == 401) {
+        tokenExpiredRedirect();
+        throw new Error("Token expired");
+    }
+    if (!response.ok) {
+        throw response.status;
+    }
+
+    return await response.json();
+}
+
+// Returns a single-use ticket for opening the event stream (EventSource cannot send the access token).
+async function getEventTicket(accessToken) {
+    if (!accessToken) {
+        console.log("Missing accessToken!");
+        throw new Error("Missing accessToken!");
+    }
+
+    const response = await fetch("api/v1/events/ticket", {
+        method: 'POST',
+        body: JSON.stringify({
+            IDT: accessToken,
+            Data: "",
+        }),
+        headers: {
+            'Content-type': 'application/json'
+        }
+    });
+    if (response.status == 401) {
+        tokenExpiredRedirect();
+        throw new Error("Token expired");
+    }
+    if (!response.ok) {
+        throw response.status;
+    }
+
+    const json = await response.json();
+    return json.Ticket;
+}
+
+// Returns the active sessions of the account.
+async function getSessions(accessToken) {
+    if (!accessToken) {
+        console.log("Missing accessToken!");
+        throw new Error("Missing accessToken!");
+    }
+
+    const response = await fetch("api/v1/sessions", {
+        method: 'PUT',
+        body: JSON.stringify({
+            IDT: accessToken,
+            Data: "",
+        }),
+        headers: {
+            'Content-type': 'application/json'
+        }
+    });
+    if (response.status == 401) {
+        tokenExpiredRedirect();
+        throw new Error("Token expired");
+    }
+    if (!response.ok) {
+        throw response.status;
+    }
+
+    return await response.json();
+}
+
+// Revokes the session with the given id. If sessionId is empty, revokes all other sessions.
+async function revokeSessions(accessToken, sessionId) {
+    if (!accessToken) {
+        console.log("Missing accessToken!");
+        throw new Error("Missing accessToken!");
+    }
+
+    const response = await fetch(sessionId ? "api/v1/sessions" : "api/v1/sessions/others", {
+        method: 'POST',
+        body: JSON.stringify({
+            IDT: accessToken,
+            Data: sessionId || "",
+        }),
+        headers: {
+            'Content-type': 'application/json'
+        }
+    });
+    if (response.status == 401) {
+        tokenExpiredRedirect();
+        throw new Error("Token expired");
+    }
+    if (!response.ok) {
+        throw response.status;
+    }
+}
+
+// Returns the grants that this account has given ("Given") and received ("Received").
+async function getGrants(accessToken) {
+    if (!accessToken) {
+        console.log("Missing accessToken!");
+        throw new Error("Missing accessToken!");
+    }
+
+    const response = await fetch("api/v1/grants", {
+        method: 'PUT',
+        body: JSON.stringify({
+            IDT: accessToken,
+            Data: "",
+        }),
+        headers: {
+            'Content-type': 'application/json'
+        }
+    });
+    if (response.status == 401) {
+        tokenExpiredRedirect();
+        throw new Error("Token expired");
+    }
+    if (!response.ok) {
+        throw response.status;
+    }
+
+    return await response.json();
+}
+
+// Returns the public key of the account that access should be granted to.
+async function getGranteePublicKey(accessToken, granteeId) {
+    if (!accessToken) {
+        console.log("Missing accessToken!");
+        throw new Error("Missing accessToken!");
+    }
+
+    const response = await fetch("api/v1/grants/publicKey", {
+        method: 'PUT',
+        body: JSON.stringify({
+            IDT: accessToken,
+            Data: granteeId,
+        }),
+        headers: {
+            'Content-type': 'application/json'
+        }
+    });
+    if (response.status == 401) {
+        tokenExpiredRedirect();
+        throw new Error("Token expired");
+    }
+    if (!response.ok) {
+        throw response.status;
+    }
+
+    const json = await response.json();
+    return json.Data;
+}
+
+// Grants another account access. wrappedKey is this account's private key, wrapped for the grantee.
+async function createGrant(accessToken, granteeId, scopes, wrappedKey) {
+    if (!accessToken) {
+        console.log("Missing accessToken!");
+        throw new Error("Missing accessToken!");
+    }
+
+    const response = await fetch("api/v1/grants", {
+        method: 'POST',
+        body: JSON.stringify({
+            IDT: accessToken,
+            GranteeId: granteeId,
+            Scopes: scopes,
+            WrappedKey: wrappedKey,
+        }),
+        headers: {
+            'Content-type': 'application/json'
+        }
+    });
+    if (response.status == 401) {
+        tokenExpiredRedirect();
+        throw new Error("Token expired");
+    }
+    if (!response.ok) {
+        throw response.status;
+    }
+
+    return await response.json();
+}
+
+// Revokes a grant, either given or received.
+async function revokeGrant(accessToken, grantId) {
+    if (!accessToken) {
+        console.log("Missing accessToken!");
+        throw new Error("Missing accessToken!");
+    }
+
+    const response = await fetch("api/v1/grants/revoke", {
+        method: 'POST',
+        body: JSON.stringify({
+            IDT: accessToken,
+            Data: String(grantId),
+        }),
+        headers: {
+            'Content-type': 'application/json'
+        }
+    });
+    if (response.status == 401) {
+        tokenExpiredRedirect();
+        throw new Error("Token expired");
+    }
+    if (!response.ok) {
+        throw response.status;
+    }
+}
+
+// Returns an access token for the owner's account (limited to the scopes of the grant) and the wrapped key.
+async function getDelegatedAccess(accessToken, ownerId) {
+    if (!accessToken) {
+        console.log("Missing accessToken!");
+        throw new Error("Missing accessToken!");
+    }
+
+    const response = await fetch("api/v1/grants/access", {
+        method: 'PUT',
+        body: JSON.stringify({
+            IDT: accessToken,
+            Data: ownerId,
+        }),
+        headers: {
+            'Content-type': 'application/json'
+        }
+    });
+    if (response.status == 401) {
+        tokenExpiredRedirect();
+        throw new Error("Token expired");
+    }
+    if (!response.ok) {
+        throw response.status;
+    }
+
+    return await response.json();
+}
+
+// Returns the devices of the account, the default device first.
+async function getDevices(accessToken) {
+    if (!accessToken) {
+        console.log("Missing accessToken!");
+        throw new Error("Missing accessToken!");
+    }
+
+    const response = await fetch("api/v1/devices", {
+        method: 'PUT',
+        body: JSON.stringify({
+            IDT: accessToken,
+            Data: "",
+        }),
+        headers: {
+            'Content-type': 'application/json'
+        }
+    });
+    if (response.status == 401) {
+        tokenExpiredRedirect();
+        throw new Error("Token expired");
+    }
+    if (!response.ok) {
+        throw response.status;
+    }
+
+    return await response.json();
+}
+
+// Finish a login that needs a TOTP code (or a recovery code).
+// Returns the access token reply, like /requestAccess.
+async function verifyTotp(challenge, code) {
+    const response = await fetch("api/v1/verifyTotp", {
+        method: 'PUT',
+        body: JSON.stringify({
+            Challenge: challenge,
+            Code: code,
+        }),
+        headers: {
+            'Content-type': 'application/json'
+        }
+    });
+    if (!response.ok) {
+        throw response.status;
+    }
+
+    return await response.json();
+}
+
+// Returns whether TOTP is enabled ("Enabled") and the number of unused recovery codes ("RecoveryCodes").
+async function getTotpStatus(accessToken) {
+    if (!accessToken) {
+        console.log("Missing accessToken!");
+        throw new Error("Missing accessToken!");
+    }
+
+    const response = await fetch("api/v1/totp", {
+        method: 'PUT',
+        body: JSON.stringify({
+            IDT: accessToken,
+            Data: "",
+        }),
+        headers: {
+            'Content-type': 'application/json'
+        }
+    });
+    if (response.status == 401) {
+        tokenExpiredRedirect();
+        throw new Error("Token expired");
+    }
+    if (!response.ok) {
+        throw response.status;
+    }
+
+    return await response.json();
+}
+
+// Manage TOTP. The action is "setup", "enable", "disable" or "recoveryCodes".
+// Returns the JSON reply, or null if there is none.
+async function postTotp(accessToken, action, code) {
+    if (!accessToken) {
+        console.log("Missing accessToken!");
+        throw new Error("Missing accessToken!");
+    }
+
+    const response = await fetch("api/v1/totp/" + action, {
+        method: 'POST',
+        body: JSON.stringify({
+            IDT: accessToken,
+            Data: code || "",
+        }),
+        headers: {
+            'Content-type': 'application/json'
+        }
+    });
+    if (response.status == 401) {
+        tokenExpiredRedirect();
+        throw new Error("Token expired");
+    }
+    if (!response.ok) {
+        throw response.status;
+    }
+
+    const text = await response.text();
+    return text ? JSON.parse(text) : null;
+}
+
+// Returns the options for navigator.credentials.get() (see backend/passkeys.go).
+async function beginPasskeyLogin(rmdid) {
+    const response = await fetch("api/v1/passkeyLogin/begin", {
+        method: 'PUT',
+        body: JSON.stringify({
+            IDT: rmdid,
+            Data: "",
+        }),
+        headers: {
+            'Content-type': 'application/json'
+        }
+    });
+    if (!response.ok) {
+        throw response.status;
+    }
+
+    return await response.json();
+}
+
+// Returns the access token, like /requestAccess
+async function finishPasskeyLogin(assertion) {
+    const response = await fetch("api/v1/passkeyLogin/finish", {
+        method: 'PUT',
+        body: JSON.stringify(assertion),
+        headers: {
+            'Content-type': 'application/json'
+        }
+    });
+    if (!response.ok) {
+        throw response.status;
+    }
+
+    return await response.json();
+}
+
+async function getPasskeys(accessToken) {
+    if (!accessToken) {
+        console.log("Missing accessToken!");
+        throw new Error("Missing accessToken!");
+    }
+
+    const response = await fetch("api/v1/passkeys", {
+        method: 'PUT',
+        body: JSON.stringify({
+            IDT: accessToken,
+            Data: "",
+        }),
+        headers: {
+            'Content-type': 'application/json'
+        }
+    });
+    if (response.status == 401) {
+        tokenExpiredRedirect();
+        throw new Error("Token expired");
+    }
+    if (!response.ok) {
+        throw response.status;
+    }
+
+    return await response.json();
+}
+
+// action is "register/begin", "register/finish" or "delete"
+async function postPasskeys(accessToken, action, body) {
+    if (!accessToken) {
+        console.log("Missing accessToken!");
+        throw new Error("Missing accessToken!");
+    }
+
+    const response = await fetch("api/v1/passkeys/" + action, {
+        method: 'POST',
+        body: JSON.stringify({
+            IDT: accessToken,
+            ...body,
+        }),
+        headers: {
+            'Content-type': 'application/json'
+        }
+    });
+    if (response.status == 401) {
+        tokenExpiredRedirect();
+        throw new Error("Token expired");
+    }
+    if (!response.ok) {
+        throw response.status;
+    }
+
+    const text = await response.text();
+    return text ? JSON.parse(text) : null;
+}
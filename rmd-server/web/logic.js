@@ -7,6 +7,8 @@ let currentId;
 let globalPrivateKey;
 let globalPrivateSigKey;
 let globalAccessToken = "";
+// The selected device of the account (see /devices). Empty for the default device.
+let currentDevice = "";
 
 let newestPictureIndex;
 let currentPictureIndex;
@@ -68,6 +70,12 @@ function setupOnClicks() {
         return false;
     });
 
+    document.getElementById("passkeyLoginButton").addEventListener("click", async () => {
+        let rmdid = document.getElementById("rmdid").value;
+        let useLongSession = document.getElementById("useLongSession").checked;
+        await doPasskeyLogin(rmdid, useLongSession);
+    });
+
 const bindings = [
         ["locateOlder", () => locateOlder()],
         ["locateNewer", () => locateNewer()],
@@ -89,7 +97,11 @@ const bindings = [
         ["pushSave", () => savePushEndpoint()],
         ["pushRefresh", () => refreshPushStatus()],
         ["deleteAccount", () => deleteAccount()],
-        ["exportData", () => exportData()]
+        ["exportData", () => exportData()],
+        ["showSessions", () => showSessionsDialog()],
+        ["showGrants", () => showGrantsDialog()],
+        ["showTotp", () => showTotpDialog()],
+        ["showPasskeys", () => showPasskeysDialog()]
     ];
     bindings.forEach(([id, fn]) => {
         const el = document.getElementById(id);
@@ -144,7 +156,7 @@ function showRegisterDialog() {
     dialog.appendChild(pwInput);
 
     const tokenInput = document.createElement("input");
-    tokenInput.placeholder = "Registration token (optional)";
+    tokenInput.placeholder = "Invite code (if required by the server)";
     tokenInput.id = "registerToken";
     dialog.appendChild(tokenInput);
 
@@ -305,7 +317,9 @@ async function doLogin(rmdid, password, useLongSession) {
         if (statusCode == 423) {
             alert("Too many attempts. Try again in 10 minutes.");
         } else if (statusCode == 403) {
-            alert("Wrong ID or wrong password.");
+            alert("Wrong ID, wrong password or wrong code.");
+        } else if (statusCode == 401) {
+            alert("The login took too long, please try again.");
         } else {
             alert("Unhandled error: " + statusCode);
         }
@@ -321,13 +335,645 @@ async function doLogin(rmdid, password, useLongSession) {
         return;
     }
 
+    await startAuthedSession();
+}
+
+// Log in with a passkey instead of the password.
+// The password is still needed to decrypt the private key, if the passkey may read it.
+async function doPasskeyLogin(rmdid, useLongSession) {
+    if (!window.PublicKeyCredential) {
+        alert("This browser does not support passkeys.");
+        return;
+    }
+    if (rmdid == "") {
+        alert("Enter your RMD ID first.");
+        return;
+    }
+    currentId = rmdid;
+
+    let tokenJson;
+    try {
+        const options = await beginPasskeyLogin(rmdid);
+        const credential = await navigator.credentials.get({
+            publicKey: {
+                challenge: base64UrlDecode(options.Challenge),
+                rpId: options.RpId,
+                allowCredentials: options.AllowCredentials.map(id => ({ type: "public-key", id: base64UrlDecode(id) })),
+                userVerification: "required",
+                timeout: options.Timeout,
+            }
+        });
+        tokenJson = await finishPasskeyLogin({
+            Challenge: options.Challenge,
+            CredentialId: base64UrlEncode(credential.rawId),
+            ClientDataJSON: base64UrlEncode(credential.response.clientDataJSON),
+            AuthenticatorData: base64UrlEncode(credential.response.authenticatorData),
+            Signature: base64UrlEncode(credential.response.signature),
+            SessionDurationSeconds: useLongSession ? DURATION_LONG_SECS : DURATION_DEFAULT_SECS,
+        });
+    } catch (error) {
+        if (error == 404) {
+            alert("Passkeys are not enabled on this server.");
+        } else if (error == 423) {
+            alert("Too many attempts. Try again in 10 minutes.");
+        } else if (error == 403) {
+            alert("Wrong ID or unknown passkey.");
+        } else if (error == 401) {
+            alert("The login took too long, please try again.");
+        } else {
+            alert("Passkey login failed: " + (error.message || error));
+        }
+        return;
+    }
+    globalAccessToken = tokenJson.Data;
+
+    if (tokenJson.Scopes && tokenJson.Scopes.includes("key:read")) {
+        const password = document.getElementById("password").value
+            || prompt("Enter your password to decrypt your data:");
+        if (password) {
+            try {
+                await getPrivateKey(password);
+            } catch (error) {
+                console.log(error.message, error.code);
+                alert("Failed to decrypt the private key. Was the password correct?");
+            }
+        }
+    } else {
+        alert("This passkey cannot read the private key. "
+            + "Locations and pictures cannot be decrypted, and commands cannot be sent. "
+            + "Log in with your password to use them.");
+    }
+
+    await startAuthedSession();
+}
+
+async function startAuthedSession() {
     setupPushWarning();
 
     showAuthedUi();
 
+    subscribeToEvents();
+
+    showStorageUsage();
+
     await locate(-1);
 }
 
+// Section: Storage usage
+
+function formatMB(bytes) {
+    return (bytes / (1024 * 1024)).toFixed(1) + " MB";
+}
+
+function formatUsage(usedBytes, quotaBytes) {
+    if (quotaBytes > 0) {
+        return `${formatMB(usedBytes)} of ${formatMB(quotaBytes)} used`;
+    }
+    return `${formatMB(usedBytes)} used`;
+}
+
+async function showStorageUsage() {
+    const el = document.getElementById("storageUsage");
+    if (!el || !globalAccessToken) return;
+    try {
+        const usage = await getStorageUsage(globalAccessToken);
+        el.textContent = `Locations: ${formatUsage(usage.LocationBytes, usage.LocationQuota)} · `
+            + `Photos: ${formatUsage(usage.PictureBytes, usage.PictureQuota)}`;
+    } catch (e) {
+        console.warn("Failed to get storage usage", e);
+    }
+}
+
+// Section: Sessions
+
+async function showSessionsDialog() {
+    let sessions;
+    try {
+        sessions = await getSessions(globalAccessToken);
+    } catch (e) {
+        alert("Failed to get sessions: " + e);
+        return;
+    }
+
+    const existing = document.getElementById("sessionsDialog");
+    if (existing) existing.remove();
+
+    const overlay = document.createElement("div");
+    overlay.id = "sessionsDialog";
+    overlay.className = "overlay";
+
+    const dialog = document.createElement("div");
+    dialog.className = "dialog";
+    overlay.appendChild(dialog);
+
+    const title = document.createElement("h3");
+    title.textContent = "Sessions";
+    dialog.appendChild(title);
+
+    sessions.forEach(session => {
+        const row = document.createElement("div");
+        row.className = "mono subtle";
+        const created = new Date(session.CreationTime * 1000).toLocaleString();
+        const expires = new Date(session.ExpirationTime * 1000).toLocaleString();
+        row.textContent = `${session.Current ? "(this session) " : ""}${session.GrantId ? "(shared access) " : ""}`
+            + `${session.UserAgent || "Unknown client"} · `
+            + `${session.RemoteIp} · since ${created} · expires ${expires}`;
+
+        if (!session.Current) {
+            const revoke = document.createElement("button");
+            revoke.textContent = "Revoke";
+            revoke.type = "button";
+            revoke.className = "btn danger";
+            revoke.addEventListener("click", async () => {
+                await revokeSessions(globalAccessToken, session.Id);
+                overlay.remove();
+                showSessionsDialog();
+            });
+            row.appendChild(revoke);
+        }
+        dialog.appendChild(row);
+    });
+
+    const buttons = document.createElement("div");
+    buttons.className = "dialog-actions";
+    dialog.appendChild(buttons);
+
+    const close = document.createElement("button");
+    close.textContent = "Close";
+    close.type = "button";
+    close.addEventListener("click", () => overlay.remove());
+    buttons.appendChild(close);
+
+    const revokeOthers = document.createElement("button");
+    revokeOthers.textContent = "Log out all other sessions";
+    revokeOthers.type = "button";
+    revokeOthers.addEventListener("click", async () => {
+        await revokeSessions(globalAccessToken, "");
+        overlay.remove();
+        showSessionsDialog();
+    });
+    buttons.appendChild(revokeOthers);
+
+    document.body.appendChild(overlay);
+}
+
+// Section: Two-factor login (TOTP)
+
+async function showTotpDialog() {
+    let status;
+    try {
+        status = await getTotpStatus(globalAccessToken);
+    } catch (e) {
+        alert("Failed to get the two-factor status: " + e);
+        return;
+    }
+
+    const existing = document.getElementById("totpDialog");
+    if (existing) existing.remove();
+
+    const overlay = document.createElement("div");
+    overlay.id = "totpDialog";
+    overlay.className = "overlay";
+
+    const dialog = document.createElement("div");
+    dialog.className = "dialog";
+    overlay.appendChild(dialog);
+
+    const title = document.createElement("h3");
+    title.textContent = "Two-factor login";
+    dialog.appendChild(title);
+
+    const info = document.createElement("div");
+    info.className = "subtle";
+    dialog.appendChild(info);
+
+    const details = document.createElement("div");
+    details.className = "mono subtle";
+    dialog.appendChild(details);
+
+    const form = document.createElement("form");
+    form.innerHTML = `
+        <input name="code" type="text" placeholder="Code" autocomplete="one-time-code" required>
+        <button type="submit" class="btn"></button>`;
+    const codeInput = form.querySelector("[name=code]");
+    const submit = form.querySelector("button");
+    dialog.appendChild(form);
+
+    const showRecoveryCodes = (reply) => {
+        info.textContent = "Save these recovery codes in a safe place. Each code can be used once instead of a code from the app.";
+        details.textContent = reply.RecoveryCodes.join("\n");
+        details.style.whiteSpace = "pre";
+        form.classList.add("hidden");
+    };
+
+    const buttons = document.createElement("div");
+    buttons.className = "dialog-actions";
+
+    if (status.Enabled) {
+        info.textContent = `Two-factor login is enabled. ${status.RecoveryCodes} unused recovery codes left.`;
+        submit.textContent = "Disable";
+        form.addEventListener("submit", async (event) => {
+            event.preventDefault();
+            try {
+                await postTotp(globalAccessToken, "disable", codeInput.value);
+            } catch (e) {
+                alert("Failed to disable: " + (e == 403 ? "wrong code." : e));
+                return;
+            }
+            overlay.remove();
+            showTotpDialog();
+        });
+
+        const regenerate = document.createElement("button");
+        regenerate.textContent = "New recovery codes";
+        regenerate.type = "button";
+        regenerate.addEventListener("click", async () => {
+            if (!codeInput.value) {
+                alert("Enter a code first.");
+                return;
+            }
+            try {
+                showRecoveryCodes(await postTotp(globalAccessToken, "recoveryCodes", codeInput.value));
+            } catch (e) {
+                alert("Failed to create recovery codes: " + (e == 403 ? "wrong code." : e));
+            }
+        });
+        buttons.appendChild(regenerate);
+    } else {
+        info.textContent = "Two-factor login is disabled. "
+            + "Add the secret below to your authenticator app and enter the code it shows to enable it.";
+        submit.textContent = "Enable";
+        let setup;
+        try {
+            setup = await postTotp(globalAccessToken, "setup");
+        } catch (e) {
+            alert("Failed to set up two-factor login: " + e);
+            return;
+        }
+        details.textContent = `Secret: ${setup.Secret}\n${setup.Uri}`;
+        details.style.whiteSpace = "pre-wrap";
+        form.addEventListener("submit", async (event) => {
+            event.preventDefault();
+            try {
+                showRecoveryCodes(await postTotp(globalAccessToken, "enable", codeInput.value));
+            } catch (e) {
+                alert("Failed to enable: " + (e == 403 ? "wrong code." : e));
+            }
+        });
+    }
+
+    dialog.appendChild(buttons);
+
+    const close = document.createElement("button");
+    close.textContent = "Close";
+    close.type = "button";
+    close.addEventListener("click", () => overlay.remove());
+    buttons.appendChild(close);
+
+    document.body.appendChild(overlay);
+}
+
+// Section: Passkeys
+
+async function showPasskeysDialog() {
+    let passkeys;
+    try {
+        passkeys = await getPasskeys(globalAccessToken);
+    } catch (e) {
+        if (e == 404) {
+            alert("Passkeys are not enabled on this server.");
+        } else {
+            alert("Failed to get the passkeys: " + e);
+        }
+        return;
+    }
+
+    const existing = document.getElementById("passkeysDialog");
+    if (existing) existing.remove();
+
+    const overlay = document.createElement("div");
+    overlay.id = "passkeysDialog";
+    overlay.className = "overlay";
+
+    const dialog = document.createElement("div");
+    dialog.className = "dialog";
+    overlay.appendChild(dialog);
+
+    const title = document.createElement("h3");
+    title.textContent = "Passkeys";
+    dialog.appendChild(title);
+
+    const info = document.createElement("div");
+    info.className = "subtle";
+    info.textContent = "Log in with a passkey instead of typing your password. "
+        + "The password is still needed to decrypt your data.";
+    dialog.appendChild(info);
+
+    const list = document.createElement("div");
+    dialog.appendChild(list);
+
+    if (passkeys.length == 0) {
+        const empty = document.createElement("div");
+        empty.className = "subtle";
+        empty.textContent = "No passkeys.";
+        list.appendChild(empty);
+    }
+    for (const passkey of passkeys) {
+        const row = document.createElement("div");
+        row.className = "row-space";
+
+        const text = document.createElement("div");
+        const lastUsed = passkey.LastUsedTime ? new Date(passkey.LastUsedTime * 1000).toLocaleString() : "never";
+        text.textContent = `${passkey.Name || "Passkey"} (last used: ${lastUsed}${passkey.ReleaseKey ? ", can read the private key" : ""})`;
+        row.appendChild(text);
+
+        const remove = document.createElement("button");
+        remove.className = "btn";
+        remove.textContent = "Delete";
+        remove.addEventListener("click", async () => {
+            try {
+                await postPasskeys(globalAccessToken, "delete", { Data: passkey.Id });
+            } catch (e) {
+                alert("Failed to delete the passkey: " + e);
+                return;
+            }
+            overlay.remove();
+            showPasskeysDialog();
+        });
+        row.appendChild(remove);
+
+        list.appendChild(row);
+    }
+
+    const form = document.createElement("form");
+    form.innerHTML = `
+        <input name="name" type="text" placeholder="Name, e.g. YubiKey" maxlength="64">
+        <div class="row-inline">
+            <input type="checkbox" id="passkeyReleaseKey" name="releaseKey" checked>
+            <label for="passkeyReleaseKey">Allow reading the encrypted private key (the password is still needed to decrypt it)</label>
+        </div>
+        <button type="submit" class="btn primary">Add passkey</button>`;
+    form.addEventListener("submit", async (event) => {
+        event.preventDefault();
+        try {
+            await registerPasskey(form.querySelector("[name=name]").value, form.querySelector("[name=releaseKey]").checked);
+        } catch (e) {
+            alert("Failed to add the passkey: " + (e.message || e));
+            return;
+        }
+        overlay.remove();
+        showPasskeysDialog();
+    });
+    dialog.appendChild(form);
+
+    const buttons = document.createElement("div");
+    buttons.className = "dialog-actions";
+    dialog.appendChild(buttons);
+
+    const close = document.createElement("button");
+    close.textContent = "Close";
+    close.type = "button";
+    close.addEventListener("click", () => overlay.remove());
+    buttons.appendChild(close);
+
+    document.body.appendChild(overlay);
+}
+
+async function registerPasskey(name, releaseKey) {
+    if (!window.PublicKeyCredential) {
+        throw new Error("This browser does not support passkeys.");
+    }
+    const options = await postPasskeys(globalAccessToken, "register/begin", {});
+    const credential = await navigator.credentials.create({
+        publicKey: {
+            challenge: base64UrlDecode(options.Challenge),
+            rp: { id: options.RpId, name: "RMD" },
+            user: {
+                id: base64UrlDecode(options.UserHandle),
+                name: options.UserName,
+                displayName: options.UserName,
+            },
+            pubKeyCredParams: options.Algorithms.map(alg => ({ type: "public-key", alg: alg })),
+            excludeCredentials: options.ExcludeCredentials.map(id => ({ type: "public-key", id: base64UrlDecode(id) })),
+            authenticatorSelection: { userVerification: "required", residentKey: "preferred" },
+            attestation: "none",
+            timeout: options.Timeout,
+        }
+    });
+    await postPasskeys(globalAccessToken, "register/finish", {
+        Challenge: options.Challenge,
+        Name: name,
+        ReleaseKey: releaseKey,
+        ClientDataJSON: base64UrlEncode(credential.response.clientDataJSON),
+        AttestationObject: base64UrlEncode(credential.response.attestationObject),
+    });
+}
+
+// Section: Delegated access (grants)
+
+const GRANTABLE_SCOPES = [
+    ["locations:read", "Locations"],
+    ["pictures:read", "Pictures"],
+    ["commands:send", "Commands"],
+];
+
+async function showGrantsDialog() {
+    let grants;
+    try {
+        grants = await getGrants(globalAccessToken);
+    } catch (e) {
+        alert("Failed to get shared devices: " + e);
+        return;
+    }
+
+    const existing = document.getElementById("grantsDialog");
+    if (existing) existing.remove();
+
+    const overlay = document.createElement("div");
+    overlay.id = "grantsDialog";
+    overlay.className = "overlay";
+
+    const dialog = document.createElement("div");
+    dialog.className = "dialog";
+    overlay.appendChild(dialog);
+
+    const title = document.createElement("h3");
+    title.textContent = "Sharing";
+    dialog.appendChild(title);
+
+    const addGrantRow = (grant, text, actionLabel, action) => {
+        const row = document.createElement("div");
+        row.className = "mono subtle";
+        row.textContent = `${text} · ${grant.Scopes.join(", ")} · since ${new Date(grant.CreatedTime * 1000).toLocaleString()}`;
+        const button = document.createElement("button");
+        button.textContent = actionLabel;
+        button.type = "button";
+        button.className = "btn";
+        button.addEventListener("click", action);
+        row.appendChild(button);
+
+        const revoke = document.createElement("button");
+        revoke.textContent = "Revoke";
+        revoke.type = "button";
+        revoke.className = "btn danger";
+        revoke.addEventListener("click", async () => {
+            await revokeGrant(globalAccessToken, grant.Id);
+            overlay.remove();
+            showGrantsDialog();
+        });
+        row.appendChild(revoke);
+        dialog.appendChild(row);
+    };
+
+    grants.Received.forEach(grant => {
+        addGrantRow(grant, `Shared with you by ${grant.OwnerId}`, "Open", async () => {
+            overlay.remove();
+            await openSharedDevice(grant.OwnerId);
+        });
+    });
+    grants.Given.forEach(grant => {
+        addGrantRow(grant, `Shared by you with ${grant.GranteeId}`, "Change", () => {
+            form.querySelector("[name=granteeId]").value = grant.GranteeId;
+        });
+    });
+
+    // Share this device with another account
+    const form = document.createElement("form");
+    form.innerHTML = `
+        <input name="granteeId" type="text" placeholder="ID of the other account" autocomplete="off" required>
+        ${GRANTABLE_SCOPES.map(([scope, label]) =>
+        `<label><input name="scope" type="checkbox" value="${scope}" checked> ${label}</label>`).join("")}
+        <input name="password" type="password" placeholder="Your password" autocomplete="current-password" required>
+        <button type="submit" class="btn">Share</button>`;
+    form.addEventListener("submit", async (event) => {
+        event.preventDefault();
+        const granteeId = form.querySelector("[name=granteeId]").value;
+        const password = form.querySelector("[name=password]").value;
+        const scopes = Array.from(form.querySelectorAll("[name=scope]:checked")).map(el => el.value);
+        if (scopes.length == 0) {
+            alert("Select at least one permission.");
+            return;
+        }
+        try {
+            await shareDevice(granteeId, scopes, password);
+        } catch (e) {
+            alert("Failed to share: " + (e == 404 ? "this account does not exist." : e));
+            return;
+        }
+        overlay.remove();
+        showGrantsDialog();
+    });
+    dialog.appendChild(form);
+
+    const buttons = document.createElement("div");
+    buttons.className = "dialog-actions";
+    dialog.appendChild(buttons);
+
+    const close = document.createElement("button");
+    close.textContent = "Close";
+    close.type = "button";
+    close.addEventListener("click", () => overlay.remove());
+    buttons.appendChild(close);
+
+    document.body.appendChild(overlay);
+}
+
+// Wrap our private key for the grantee and store it with the grant.
+// The server cannot read the wrapped key, only the grantee can.
+async function shareDevice(granteeId, scopes, password) {
+    const granteePublicKey = await getGranteePublicKey(globalAccessToken, granteeId);
+    const keyData = await fetchWrappedPrivateKey();
+    const wrappedKey = await wrapPrivateKeyForGrantee(password, keyData, granteePublicKey);
+    await createGrant(globalAccessToken, granteeId, scopes, wrappedKey);
+}
+
+// Switch to the device that another account shared with us.
+// To switch back, log in again.
+async function openSharedDevice(ownerId) {
+    let access;
+    try {
+        access = await getDelegatedAccess(globalAccessToken, ownerId);
+    } catch (e) {
+        alert("Failed to open the shared device: " + e);
+        return;
+    }
+    const [rsaEncKey, rsaSigKey] = await unwrapGrantedPrivateKey(globalPrivateKey, access.WrappedKey);
+
+    globalAccessToken = access.Data;
+    globalPrivateKey = rsaEncKey;
+    globalPrivateSigKey = rsaSigKey;
+    currentId = access.IDT;
+    currentDevice = "";
+
+    showAuthedUi();
+    subscribeToEvents();
+    await locate(-1);
+}
+
+// Section: Live events
+
+let eventSource = null;
+
+// Listen for new locations, pictures and command status changes,
+// instead of polling the server after sending a command.
+async function subscribeToEvents() {
+    if (eventSource) {
+        eventSource.close();
+        eventSource = null;
+    }
+    let ticket;
+    try {
+        ticket = await getEventTicket(globalAccessToken);
+    } catch (error) {
+        console.log("Failed to get an event ticket:", error);
+        return;
+    }
+    if (eventSource) {
+        // A concurrent call was faster
+        eventSource.close();
+    }
+    eventSource = new EventSource("api/v1/events?ticket=" + encodeURIComponent(ticket));
+
+    // The ticket can only be used once, thus EventSource's automatic reconnect would fail.
+    // Instead, reconnect with a new ticket.
+    eventSource.onerror = () => {
+        eventSource.close();
+        eventSource = null;
+        setTimeout(() => {
+            if (!eventSource && globalAccessToken) subscribeToEvents();
+        }, 5000);
+    };
+
+    eventSource.addEventListener("location", async (event) => {
+        if (!isCurrentDevice(JSON.parse(event.data).Device)) return;
+        await locate(-1);
+        showStorageUsage();
+    });
+    eventSource.addEventListener("picture", async (event) => {
+        if (!isCurrentDevice(JSON.parse(event.data).Device)) return;
+        await showLatestPicture();
+        showStorageUsage();
+    });
+    eventSource.addEventListener("command", async (event) => {
+        // The event only has the id, the command and its result are fetched separately
+        const cmdStatus = await getCommandStatus(globalAccessToken, JSON.parse(event.data).CmdId);
+        const toasted = new Toasted({
+            position: 'top-center',
+            duration: 3000
+        });
+        let message = `Command "${cmdStatus.Data}" ${cmdStatus.Status}`;
+        if (cmdStatus.Result) {
+            message += `: ${cmdStatus.Result}`;
+        }
+        toasted.show(message);
+    });
+    eventSource.addEventListener("expired", (event) => {
+        eventSource.close();
+        eventSource = null;
+        tokenExpiredRedirect();
+    });
+}
+
 function showAuthedUi() {
     const dv = document.getElementById("dataView");
     if (dv) dv.classList.remove("hidden");
@@ -341,6 +987,46 @@ function showAuthedUi() {
     if (pushPanel) pushPanel.classList.remove("hidden");
     refreshPushStatus();
     updatePushStatusFooter();
+    loadDevices();
+}
+
+// Section: Devices
+
+// Events of servers without devices have no Device field
+function isCurrentDevice(deviceId) {
+    return !deviceId || deviceId == (currentDevice || "default");
+}
+
+// Fill the device selector. It is only shown if the account has more than one device.
+async function loadDevices() {
+    const select = document.getElementById("deviceSelect");
+    if (!select) return;
+    let devices;
+    try {
+        devices = await getDevices(globalAccessToken);
+    } catch (e) {
+        console.log("Failed to load devices", e);
+        return;
+    }
+    select.innerHTML = "";
+    for (const device of devices) {
+        const option = document.createElement("option");
+        option.value = device.DeviceId;
+        option.textContent = device.Name || device.DeviceId;
+        select.appendChild(option);
+    }
+    select.value = currentDevice || "default";
+    select.onchange = () => selectDevice(select.value);
+    select.classList.toggle("hidden", devices.length < 2);
+}
+
+async function selectDevice(deviceId) {
+    currentDevice = deviceId == "default" ? "" : deviceId;
+    currentLocIdx = -1;
+    locCache.length = 0;
+    refreshPushStatus();
+    await locate(-1);
+    await showLatestPicture();
 }
 
 async function tryLoginWithHash(rmdid, passwordHash, sessionDurationSeconds) {
@@ -355,6 +1041,17 @@ async function tryLoginWithHash(rmdid, passwordHash, sessionDurationSeconds) {
             'Content-type': 'application/json'
         }
     });
+    if (response.status == 401) {
+        // TOTP is enabled for this account
+        const challengeJson = await response.json();
+        const code = prompt("Enter the code from your authenticator app (or a recovery code):");
+        if (code === null || code.trim() == "") {
+            throw 403;
+        }
+        const tokenJson = await verifyTotp(challengeJson.Challenge, code);
+        globalAccessToken = tokenJson.Data;
+        return globalAccessToken;
+    }
     if (response.ok) {
         const tokenJson = await response.json()
         globalAccessToken = tokenJson.Data;
@@ -365,6 +1062,15 @@ async function tryLoginWithHash(rmdid, passwordHash, sessionDurationSeconds) {
 }
 
 async function getPrivateKey(password) {
+    const keyData = await fetchWrappedPrivateKey();
+
+    const [rsaEncKey, rsaSigKey] = await unwrapPrivateKey(password, keyData);
+    globalPrivateKey = rsaEncKey;
+    globalPrivateSigKey = rsaSigKey;
+}
+
+// Returns the password-wrapped private key of the account
+async function fetchWrappedPrivateKey() {
     const response = await fetch("api/v1/key", {
         method: 'PUT',
         body: JSON.stringify({
@@ -379,10 +1085,7 @@ async function getPrivateKey(password) {
         throw response.status;
     }
     const keyData = await response.json();
-
-    const [rsaEncKey, rsaSigKey] = await unwrapPrivateKey(password, keyData.Data);
-    globalPrivateKey = rsaEncKey;
-    globalPrivateSigKey = rsaSigKey;
+    return keyData.Data;
 }
 
 async function redirectToLogin(toastMessage) {
@@ -404,7 +1107,7 @@ async function tokenExpiredRedirect() {
 // Section: Push Warning
 
 async function setupPushWarning() {
-    const pushUrl = await getPushUrl(globalAccessToken);
+    const pushUrl = await getPushUrl(globalAccessToken, currentDevice);
     const ele = document.getElementById("pushWarning");
     const statusEl = document.getElementById("pushStatus");
     if (!ele) return;
@@ -432,7 +1135,7 @@ async function refreshPushStatus() {
     const statusEl = document.getElementById("pushStatus");
     if (!statusEl || !globalAccessToken) return;
     try {
-        const pushUrl = await getPushUrl(globalAccessToken);
+        const pushUrl = await getPushUrl(globalAccessToken, currentDevice);
         if (pushUrl && pushUrl.trim() !== "") {
             statusEl.textContent = "Configured";
             statusEl.style.color = "var(--foam)";
@@ -473,6 +1176,7 @@ async function savePushEndpoint() {
         body: JSON.stringify({
             IDT: globalAccessToken,
             Data: endpoint,
+            Device: currentDevice,
         }),
         headers: {
             'Content-type': 'application/json'
@@ -506,6 +1210,7 @@ async function locate(requestedIndex) {
         body: JSON.stringify({
             IDT: globalAccessToken,
             Data: "unused",
+            Device: currentDevice,
         }),
         headers: {
             'Content-type': 'application/json'
@@ -545,7 +1250,8 @@ async function locate(requestedIndex) {
         method: 'PUT',
         body: JSON.stringify({
             IDT: globalAccessToken,
-            Data: currentLocIdx.toString()
+            Data: currentLocIdx.toString(),
+            Device: currentDevice,
         }),
         headers: {
             'Content-type': 'application/json'
@@ -645,6 +1351,7 @@ async function sendToPhone(message) {
             Data: message,
             UnixTime: time,
             CmdSig: sig,
+            Device: currentDevice,
         }),
         headers: {
             'Content-type': 'application/json'
@@ -724,7 +1431,8 @@ async function showLatestPicture() {
         method: 'PUT',
         body: JSON.stringify({
             IDT: globalAccessToken,
-            Data: ""
+            Data: "",
+            Device: currentDevice,
         }),
         headers: {
             'Content-type': 'application/json'
@@ -757,7 +1465,8 @@ async function loadPicture(index) {
         method: 'PUT',
         body: JSON.stringify({
             IDT: globalAccessToken,
-            Data: index.toString()
+            Data: index.toString(),
+            Device: currentDevice,
         }),
         headers: {
             'Content-type': 'application/json'
@@ -941,8 +1650,8 @@ async function exportData() {
         return;
     }
 
-    // Locations
-    let response = await fetch("api/v1/locations", {
+    // The server streams a ZIP archive with all (encrypted) data of the account
+    const response = await fetch("api/v1/export", {
         method: 'POST',
         body: JSON.stringify({
             IDT: globalAccessToken,
@@ -959,54 +1668,7 @@ async function exportData() {
     if (!response.ok) {
         throw response.status;
     }
-    let locationsCSV = "Date,Provider,Battery Percentage,Longitude,Latitude\n";
-    const locationsAsJSON = await response.json();
-    for (let locationJSON of locationsAsJSON) {
-        const loc = await parseLocation(globalPrivateKey, JSON.parse(locationJSON))
-        locationsCSV += new Date(loc.time).toISOString() + "," + loc.provider + "," + loc.bat + "," + loc.lon + "," + loc.lat + "\n"
-    }
-
-    // Pictures
-    response = await fetch("api/v1/pictures", {
-        method: 'POST',
-        body: JSON.stringify({
-            IDT: globalAccessToken,
-            Data: ""
-        }),
-        headers: {
-            'Content-type': 'application/json'
-        }
-    });
-    if (response.status == 401) {
-        tokenExpiredRedirect();
-        return
-    }
-    if (!response.ok) {
-        throw response.status;
-    }
-    const picturesAsJSON = await response.json();
-    const pictures = [];
-    for (let picture of picturesAsJSON) {
-        const pic = await parsePicture(globalPrivateKey, picture);
-        pictures.push(pic);
-    }
-
-    // General info
-    const pushUrl = await getPushUrl(globalAccessToken);
-    const generalInfo = {
-        "rmdId": currentId,
-        "pushUrl": pushUrl,
-    };
-
-    // ZIP everything
-    const zip = new JSZip();
-    zip.file("info.json", JSON.stringify(generalInfo));
-    zip.file("locations.csv", locationsCSV);
-    const picturesFolder = zip.folder("pictures");
-    for (let [index, pic] of pictures.entries()) {
-        picturesFolder.file(String(index) + ".png", pic, { base64: true });
-    }
-    const content = await zip.generateAsync({ type: "blob" });
+    const content = await response.blob();
 
     const formattedDate = new Date().toISOString().split('T')[0];
 
@@ -1020,4 +1682,5 @@ async function exportData() {
 
     // Clean up
     link.remove();
+    URL.revokeObjectURL(link.href);
 }
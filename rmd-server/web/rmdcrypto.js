@@ -56,6 +56,13 @@ async function hashPasswordArgon2(password, salt) {
 // Section: Asymmetric crypto (key wrap)
 
 async function unwrapPrivateKey(password, keyData) { // -> (CryptoKey, CryptoKey)
+    const binaryDer = await decryptPrivateKeyBytes(password, keyData);
+    return await importPrivateKey(binaryDer);
+}
+
+// Returns the raw PKCS#8 DER bytes of the password-wrapped private key.
+// Only needed to share the private key (see wrapPrivateKeyForGrantee), otherwise use unwrapPrivateKey.
+async function decryptPrivateKeyBytes(password, keyData) { // -> Uint8Array
     const concatBytes = base64Decode(keyData);
     const saltBytes = concatBytes.slice(0, ARGON2_SALT_LENGTH);
     const ivBytes = concatBytes.slice(ARGON2_SALT_LENGTH, ARGON2_SALT_LENGTH + AES_GCM_IV_SIZE_BYTES);
@@ -65,9 +72,11 @@ async function unwrapPrivateKey(password, keyData) { // -> (CryptoKey, CryptoKey
     const unwrappingCryptoKey = await window.crypto.subtle.importKey("raw", rawAesKey, "AES-GCM", false, ["decrypt"]);
     const decryptedBytes = new Uint8Array(await window.crypto.subtle.decrypt({ name: "AES-GCM", iv: ivBytes }, unwrappingCryptoKey, wrappedKeyBytes));
 
-    // Server-side wrap stores raw PKCS#8 DER bytes. Import directly.
-    const binaryDer = decryptedBytes;
+    // Server-side wrap stores raw PKCS#8 DER bytes.
+    return decryptedBytes;
+}
 
+async function importPrivateKey(binaryDer) { // -> (CryptoKey, CryptoKey)
     // XXX: It would be nice to use unwrapKey instead of decrypt+importKey
     // XXX: If redesigned from scratch, there should be key separation between encryption and signing.
     const rsaEncKey = await window.crypto.subtle.importKey(
@@ -99,6 +108,12 @@ async function sign(rsaCryptoKey, msg) {
 // Section: Symmetric crypto
 
 async function decryptPacket(rsaCryptoKey, packetBase64) {
+    const plaintext = await decryptPacketBytes(rsaCryptoKey, packetBase64);
+    const plaintextString = new TextDecoder().decode(plaintext);
+    return plaintextString
+}
+
+async function decryptPacketBytes(rsaCryptoKey, packetBase64) { // -> Uint8Array
     const concatBytes = base64Decode(packetBase64);
     const sessionKeyPacketBytes = concatBytes.slice(0, RSA_KEY_SIZE_BYTES);
     const ivBytes = concatBytes.slice(RSA_KEY_SIZE_BYTES, RSA_KEY_SIZE_BYTES + AES_GCM_IV_SIZE_BYTES);
@@ -109,9 +124,45 @@ async function decryptPacket(rsaCryptoKey, packetBase64) {
     const sessionKeyCryptoKey = await window.crypto.subtle.importKey("raw", sessionKeyBytes, "AES-GCM", false, ["decrypt"]);
 
     const plaintext = await window.crypto.subtle.decrypt({ name: "AES-GCM", iv: ivBytes }, sessionKeyCryptoKey, ctBytes);
+    return new Uint8Array(plaintext);
+}
 
-    const plaintextString = new TextDecoder().decode(plaintext);
-    return plaintextString
+// The inverse of decryptPacketBytes: encrypt for the holder of the private key of publicKeyBase64 (SPKI).
+async function encryptPacketBytes(publicKeyBase64, plaintextBytes) { // -> base64 string
+    const rsaPublicKey = await window.crypto.subtle.importKey(
+        "spki",
+        base64Decode(publicKeyBase64),
+        { name: "RSA-OAEP", hash: "SHA-256" },
+        false,
+        ["encrypt"]
+    );
+
+    const sessionKeyBytes = window.crypto.getRandomValues(new Uint8Array(32));
+    const sessionKeyCryptoKey = await window.crypto.subtle.importKey("raw", sessionKeyBytes, "AES-GCM", false, ["encrypt"]);
+    const ivBytes = window.crypto.getRandomValues(new Uint8Array(AES_GCM_IV_SIZE_BYTES));
+
+    const sessionKeyPacketBytes = new Uint8Array(await window.crypto.subtle.encrypt({ name: "RSA-OAEP" }, rsaPublicKey, sessionKeyBytes));
+    const ctBytes = new Uint8Array(await window.crypto.subtle.encrypt({ name: "AES-GCM", iv: ivBytes }, sessionKeyCryptoKey, plaintextBytes));
+
+    const concat = new Uint8Array(sessionKeyPacketBytes.length + ivBytes.length + ctBytes.length);
+    concat.set(sessionKeyPacketBytes, 0);
+    concat.set(ivBytes, sessionKeyPacketBytes.length);
+    concat.set(ctBytes, sessionKeyPacketBytes.length + ivBytes.length);
+    return base64Encode(concat);
+}
+
+// Section: Delegated access (grants)
+
+// Wrap the owner's private key for the grantee, so that the grantee can decrypt the owner's data.
+async function wrapPrivateKeyForGrantee(password, keyData, granteePublicKeyBase64) { // -> base64 string
+    const binaryDer = await decryptPrivateKeyBytes(password, keyData);
+    return await encryptPacketBytes(granteePublicKeyBase64, binaryDer);
+}
+
+// Unwrap the owner's private key with the grantee's private key.
+async function unwrapGrantedPrivateKey(rsaCryptoKey, wrappedKey) { // -> (CryptoKey, CryptoKey)
+    const binaryDer = await decryptPacketBytes(rsaCryptoKey, wrappedKey);
+    return await importPrivateKey(binaryDer);
 }
 
 // Section: Key generation and wrapping
@@ -153,3 +204,14 @@ async function generateKeysAndWrap(password) {
         wrappedPrivKey: base64Encode(concat)
     };
 }
+
+// WebAuthn uses base64url without padding
+
+function base64UrlDecode(encodedString) {
+    const base64 = encodedString.replace(/-/g, "+").replace(/_/g, "/");
+    return base64Decode(base64 + "=".repeat((4 - base64.length % 4) % 4));
+}
+
+function base64UrlEncode(bytesToEncode) {
+    return base64Encode(new Uint8Array(bytesToEncode)).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+}
@@ -0,0 +1,152 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// A minimal CBOR (RFC 8949) decoder, sufficient for attestation objects and COSE keys.
+//
+// Decoded values are: int64 (for both major types 0 and 1), []byte, string, []any, map[any]any,
+// bool, nil, and float64. Indefinite lengths are not supported, authenticators do not use them.
+
+var errCborInvalid = errors.New("invalid CBOR")
+
+// Limit the nesting, such that crafted input cannot exhaust the stack
+const cborMaxDepth = 16
+
+// Decode one CBOR item. Returns the item and the remaining bytes.
+func decodeCbor(data []byte) (any, []byte, error) {
+	return decodeCborItem(data, 0)
+}
+
+func decodeCborItem(data []byte, depth int) (any, []byte, error) {
+	if depth > cborMaxDepth || len(data) == 0 {
+		return nil, nil, errCborInvalid
+	}
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	if major == 7 {
+		return decodeCborSimple(info, data)
+	}
+
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24 && len(data) >= 1:
+		arg, data = uint64(data[0]), data[1:]
+	case info == 25 && len(data) >= 2:
+		arg, data = uint64(binary.BigEndian.Uint16(data)), data[2:]
+	case info == 26 && len(data) >= 4:
+		arg, data = uint64(binary.BigEndian.Uint32(data)), data[4:]
+	case info == 27 && len(data) >= 8:
+		arg, data = binary.BigEndian.Uint64(data), data[8:]
+	default:
+		return nil, nil, errCborInvalid
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCborInvalid
+		}
+		return int64(arg), data, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCborInvalid
+		}
+		return -1 - int64(arg), data, nil
+	case 2, 3:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCborInvalid
+		}
+		value := data[:arg]
+		if major == 3 {
+			return string(value), data[arg:], nil
+		}
+		return append([]byte{}, value...), data[arg:], nil
+	case 4:
+		if arg > uint64(len(data)) {
+			// Every item needs at least one byte
+			return nil, nil, errCborInvalid
+		}
+		items := make([]any, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item any
+			var err error
+			item, data, err = decodeCborItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, data, nil
+	case 5:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCborInvalid
+		}
+		items := make(map[any]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value any
+			var err error
+			key, data, err = decodeCborItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errCborInvalid
+			}
+			value, data, err = decodeCborItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items[key] = value
+		}
+		return items, data, nil
+	case 6:
+		// Tags are ignored, only the tagged item is returned
+		return decodeCborItem(data, depth+1)
+	}
+	return nil, nil, errCborInvalid
+}
+
+func decodeCborSimple(info byte, data []byte) (any, []byte, error) {
+	switch {
+	case info == 20:
+		return false, data, nil
+	case info == 21:
+		return true, data, nil
+	case info == 22 || info == 23:
+		return nil, data, nil
+	case info == 25 && len(data) >= 2:
+		return float64(float16ToFloat32(binary.BigEndian.Uint16(data))), data[2:], nil
+	case info == 26 && len(data) >= 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), data[4:], nil
+	case info == 27 && len(data) >= 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), data[8:], nil
+	}
+	return nil, nil, errCborInvalid
+}
+
+func float16ToFloat32(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h) & 0x3ff
+	switch exp {
+	case 0:
+		f := float32(mant) / (1 << 24)
+		if sign != 0 {
+			return -f
+		}
+		return f
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mant<<13)
+	}
+	return math.Float32frombits(sign | (exp+112)<<23 | mant<<13)
+}
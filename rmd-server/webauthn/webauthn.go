@@ -0,0 +1,297 @@
+// Package webauthn verifies WebAuthn (passkey) registrations and assertions.
+//
+// It only implements what RMD Server needs:
+// "none" attestation (the attestation statement is not verified, the authenticator is not trusted any more
+// than the logged-in user who registers it), user verification is required,
+// and the public key algorithms ES256, EdDSA (Ed25519) and RS256.
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+)
+
+// COSE algorithm identifiers
+const (
+	AlgES256 int64 = -7
+	AlgEdDSA int64 = -8
+	AlgRS256 int64 = -257
+)
+
+// In order of preference, for PublicKeyCredentialCreationOptions.pubKeyCredParams
+var SupportedAlgorithms = []int64{AlgES256, AlgEdDSA, AlgRS256}
+
+// Authenticator data flags
+const (
+	flagUserPresent            = 0x01
+	flagUserVerified           = 0x04
+	flagAttestedCredentialData = 0x40
+)
+
+const CHALLENGE_BYTES = 32
+
+var ErrClientDataInvalid = errors.New("invalid client data")
+var ErrAuthenticatorDataInvalid = errors.New("invalid authenticator data")
+var ErrAttestationInvalid = errors.New("invalid attestation object")
+var ErrAlgorithmUnsupported = errors.New("unsupported public key algorithm")
+var ErrUserNotVerified = errors.New("user verification is required")
+var ErrSignatureInvalid = errors.New("invalid signature")
+var ErrSignCountInvalid = errors.New("signature counter did not increase, the credential may be cloned")
+
+// The relying party is the RMD Server instance, identified by the origin of the web interface.
+type RelyingParty struct {
+	ID     string // the domain of the origin
+	Origin string // scheme://host[:port]
+}
+
+// Origins must be HTTPS, except for localhost (which browsers treat as secure context).
+func NewRelyingParty(origin string) (*RelyingParty, error) {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" || (u.Scheme != "https" && !(u.Scheme == "http" && u.Hostname() == "localhost")) {
+		return nil, fmt.Errorf("invalid WebAuthn origin %q, expected https://<domain>", origin)
+	}
+	return &RelyingParty{ID: u.Hostname(), Origin: u.Scheme + "://" + u.Host}, nil
+}
+
+// Returns a new random challenge, base64url-encoded (as the browser returns it in the client data).
+func NewChallenge() string {
+	challenge := make([]byte, CHALLENGE_BYTES)
+	_, err := rand.Read(challenge)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(challenge)
+}
+
+// A registered public key credential
+type Credential struct {
+	ID        []byte
+	PublicKey []byte // DER-encoded PKIX (SubjectPublicKeyInfo)
+	Algorithm int64  // COSE algorithm identifier
+	SignCount uint32
+}
+
+// Verify the response of navigator.credentials.create() and return the new credential.
+func (rp *RelyingParty) VerifyRegistration(challenge string, clientDataJSON []byte, attestationObject []byte) (*Credential, error) {
+	err := rp.verifyClientData(clientDataJSON, "webauthn.create", challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded, _, err := decodeCbor(attestationObject)
+	if err != nil {
+		return nil, ErrAttestationInvalid
+	}
+	attestation, ok := decoded.(map[any]any)
+	if !ok {
+		return nil, ErrAttestationInvalid
+	}
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, ErrAttestationInvalid
+	}
+
+	authData, err := rp.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if authData.flags&flagAttestedCredentialData == 0 {
+		return nil, ErrAttestationInvalid
+	}
+
+	// aaguid (16 bytes), credential id length (2 bytes), credential id, COSE key
+	rest := authData.rest
+	if len(rest) < 18 {
+		return nil, ErrAttestationInvalid
+	}
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLength == 0 || len(rest) < idLength {
+		return nil, ErrAttestationInvalid
+	}
+	credentialId := append([]byte{}, rest[:idLength]...)
+
+	coseKey, _, err := decodeCbor(rest[idLength:])
+	if err != nil {
+		return nil, ErrAttestationInvalid
+	}
+	publicKey, alg, err := parseCoseKey(coseKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		ID:        credentialId,
+		PublicKey: publicKey,
+		Algorithm: alg,
+		SignCount: authData.signCount,
+	}, nil
+}
+
+// Verify the response of navigator.credentials.get() for the credential.
+// Returns the new signature counter, which must be stored for the next assertion.
+func (rp *RelyingParty) VerifyAssertion(challenge string, cred *Credential, clientDataJSON []byte, rawAuthData []byte, signature []byte) (uint32, error) {
+	err := rp.verifyClientData(clientDataJSON, "webauthn.get", challenge)
+	if err != nil {
+		return 0, err
+	}
+	authData, err := rp.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return 0, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	err = verifySignature(cred, signed, signature)
+	if err != nil {
+		return 0, err
+	}
+
+	// Authenticators that do not implement a counter always return 0
+	if (authData.signCount != 0 || cred.SignCount != 0) && authData.signCount <= cred.SignCount {
+		return 0, ErrSignCountInvalid
+	}
+	return authData.signCount, nil
+}
+
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+func (rp *RelyingParty) verifyClientData(raw []byte, expectedType string, challenge string) error {
+	var data clientData
+	err := json.Unmarshal(raw, &data)
+	if err != nil {
+		return ErrClientDataInvalid
+	}
+	if data.Type != expectedType || data.Origin != rp.Origin || data.CrossOrigin {
+		return ErrClientDataInvalid
+	}
+	if challenge == "" || subtle.ConstantTimeCompare([]byte(data.Challenge), []byte(challenge)) != 1 {
+		return ErrClientDataInvalid
+	}
+	return nil
+}
+
+type authenticatorData struct {
+	flags     byte
+	signCount uint32
+	rest      []byte // attested credential data and extensions
+}
+
+func (rp *RelyingParty) parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, ErrAuthenticatorDataInvalid
+	}
+	rpIdHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(data[:32], rpIdHash[:]) {
+		return nil, ErrAuthenticatorDataInvalid
+	}
+	authData := &authenticatorData{
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+		rest:      data[37:],
+	}
+	if authData.flags&flagUserPresent == 0 || authData.flags&flagUserVerified == 0 {
+		return nil, ErrUserNotVerified
+	}
+	return authData, nil
+}
+
+// Convert the COSE key (RFC 9053) to PKIX.
+func parseCoseKey(decoded any) ([]byte, int64, error) {
+	key, ok := decoded.(map[any]any)
+	if !ok {
+		return nil, 0, ErrAttestationInvalid
+	}
+	kty, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+
+	var publicKey any
+	switch {
+	case alg == AlgES256 && kty == 2:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, ErrAttestationInvalid
+		}
+		// Validates that the point is on the curve
+		ecdhKey, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...))
+		if err != nil {
+			return nil, 0, ErrAttestationInvalid
+		}
+		publicKey = ecdhKey
+	case alg == AlgEdDSA && kty == 1:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, ErrAttestationInvalid
+		}
+		publicKey = ed25519.PublicKey(x)
+	case alg == AlgRS256 && kty == 3:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, ErrAttestationInvalid
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		publicKey = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}
+	default:
+		return nil, 0, ErrAlgorithmUnsupported
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, 0, ErrAttestationInvalid
+	}
+	return der, alg, nil
+}
+
+func verifySignature(cred *Credential, signed []byte, signature []byte) error {
+	publicKey, err := x509.ParsePKIXPublicKey(cred.PublicKey)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(signed)
+
+	valid := false
+	switch pub := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		valid = cred.Algorithm == AlgES256 && ecdsa.VerifyASN1(pub, digest[:], signature)
+	case ed25519.PublicKey:
+		valid = cred.Algorithm == AlgEdDSA && ed25519.Verify(pub, signed, signature)
+	case *rsa.PublicKey:
+		valid = cred.Algorithm == AlgRS256 && rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) == nil
+	default:
+		return ErrAlgorithmUnsupported
+	}
+	if !valid {
+		return ErrSignatureInvalid
+	}
+	return nil
+}
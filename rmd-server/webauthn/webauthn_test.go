@@ -0,0 +1,231 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// Minimal CBOR encoder for the test authenticator
+
+func cborHead(major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg <= 0xff:
+		return []byte{major<<5 | 24, byte(arg)}
+	default:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(arg))
+	}
+}
+
+func cborEncode(value any) []byte {
+	switch v := value.(type) {
+	case int:
+		if v >= 0 {
+			return cborHead(0, uint64(v))
+		}
+		return cborHead(1, uint64(-1-v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case [][2]any: // map with ordered entries
+		out := cborHead(5, uint64(len(v)))
+		for _, entry := range v {
+			out = append(out, cborEncode(entry[0])...)
+			out = append(out, cborEncode(entry[1])...)
+		}
+		return out
+	}
+	panic("unsupported type")
+}
+
+type testAuthenticator struct {
+	rp           *RelyingParty
+	credentialId []byte
+	ecKey        *ecdsa.PrivateKey
+	edKey        ed25519.PrivateKey
+	signCount    uint32
+}
+
+func newTestAuthenticator(t *testing.T, rp *RelyingParty) *testAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testAuthenticator{rp: rp, credentialId: []byte("test-credential"), ecKey: key}
+}
+
+func (a *testAuthenticator) clientData(typ string, challenge string) []byte {
+	data, _ := json.Marshal(clientData{Type: typ, Challenge: challenge, Origin: a.rp.Origin})
+	return data
+}
+
+func (a *testAuthenticator) authData(flags byte, attested []byte) []byte {
+	rpIdHash := sha256.Sum256([]byte(a.rp.ID))
+	data := append(rpIdHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, attested...)
+}
+
+func (a *testAuthenticator) coseKey() []byte {
+	if a.edKey != nil {
+		return cborEncode([][2]any{{1, 1}, {3, -8}, {-1, 6}, {-2, []byte(a.edKey.Public().(ed25519.PublicKey))}})
+	}
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.ecKey.X.FillBytes(x)
+	a.ecKey.Y.FillBytes(y)
+	return cborEncode([][2]any{{1, 2}, {3, -7}, {-1, 1}, {-2, x}, {-3, y}})
+}
+
+func (a *testAuthenticator) create(challenge string) ([]byte, []byte) {
+	attested := make([]byte, 16) // aaguid
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialId)))
+	attested = append(attested, a.credentialId...)
+	attested = append(attested, a.coseKey()...)
+
+	attestationObject := cborEncode([][2]any{
+		{"fmt", "none"},
+		{"attStmt", [][2]any{}},
+		{"authData", a.authData(flagUserPresent|flagUserVerified|flagAttestedCredentialData, attested)},
+	})
+	return a.clientData("webauthn.create", challenge), attestationObject
+}
+
+func (a *testAuthenticator) get(challenge string) ([]byte, []byte, []byte) {
+	a.signCount++
+	clientDataJSON := a.clientData("webauthn.get", challenge)
+	authData := a.authData(flagUserPresent|flagUserVerified, nil)
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authData...), clientDataHash[:]...)
+	if a.edKey != nil {
+		return clientDataJSON, authData, ed25519.Sign(a.edKey, signed)
+	}
+	digest := sha256.Sum256(signed)
+	signature, _ := ecdsa.SignASN1(rand.Reader, a.ecKey, digest[:])
+	return clientDataJSON, authData, signature
+}
+
+func TestNewRelyingParty(t *testing.T) {
+	rp, err := NewRelyingParty("https://rmd.example.com:8443/web/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rp.ID != "rmd.example.com" || rp.Origin != "https://rmd.example.com:8443" {
+		t.Errorf("unexpected relying party %+v", rp)
+	}
+	if _, err := NewRelyingParty("http://localhost:8080"); err != nil {
+		t.Errorf("localhost should be allowed without HTTPS: %v", err)
+	}
+	for _, origin := range []string{"", "rmd.example.com", "http://rmd.example.com"} {
+		if _, err := NewRelyingParty(origin); err == nil {
+			t.Errorf("origin %q should be rejected", origin)
+		}
+	}
+}
+
+func TestRegistrationAndAssertion(t *testing.T) {
+	rp, _ := NewRelyingParty("https://rmd.example.com")
+
+	for _, name := range []string{"ES256", "EdDSA"} {
+		authenticator := newTestAuthenticator(t, rp)
+		if name == "EdDSA" {
+			_, authenticator.edKey, _ = ed25519.GenerateKey(rand.Reader)
+		}
+
+		challenge := NewChallenge()
+		clientDataJSON, attestationObject := authenticator.create(challenge)
+		cred, err := rp.VerifyRegistration(challenge, clientDataJSON, attestationObject)
+		if err != nil {
+			t.Fatalf("%s: registration failed: %v", name, err)
+		}
+		if string(cred.ID) != string(authenticator.credentialId) {
+			t.Errorf("%s: unexpected credential id %q", name, cred.ID)
+		}
+
+		challenge = NewChallenge()
+		clientDataJSON, authData, signature := authenticator.get(challenge)
+		signCount, err := rp.VerifyAssertion(challenge, cred, clientDataJSON, authData, signature)
+		if err != nil {
+			t.Fatalf("%s: assertion failed: %v", name, err)
+		}
+		if signCount != 1 {
+			t.Errorf("%s: signCount=%d, expected 1", name, signCount)
+		}
+	}
+}
+
+func TestAssertionRejected(t *testing.T) {
+	rp, _ := NewRelyingParty("https://rmd.example.com")
+	authenticator := newTestAuthenticator(t, rp)
+
+	challenge := NewChallenge()
+	clientDataJSON, attestationObject := authenticator.create(challenge)
+	if _, err := rp.VerifyRegistration(NewChallenge(), clientDataJSON, attestationObject); !errors.Is(err, ErrClientDataInvalid) {
+		t.Errorf("registration with another challenge: err=%v", err)
+	}
+	cred, err := rp.VerifyRegistration(challenge, clientDataJSON, attestationObject)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge = NewChallenge()
+	clientDataJSON, authData, signature := authenticator.get(challenge)
+
+	// Another challenge
+	if _, err := rp.VerifyAssertion(NewChallenge(), cred, clientDataJSON, authData, signature); !errors.Is(err, ErrClientDataInvalid) {
+		t.Errorf("other challenge: err=%v", err)
+	}
+	// Another origin
+	otherRp, _ := NewRelyingParty("https://evil.example.com")
+	if _, err := otherRp.VerifyAssertion(challenge, cred, clientDataJSON, authData, signature); !errors.Is(err, ErrClientDataInvalid) {
+		t.Errorf("other origin: err=%v", err)
+	}
+	// Tampered signature
+	tampered := append([]byte{}, signature...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := rp.VerifyAssertion(challenge, cred, clientDataJSON, authData, tampered); !errors.Is(err, ErrSignatureInvalid) {
+		t.Errorf("tampered signature: err=%v", err)
+	}
+	// Without user verification
+	unverified := append([]byte{}, authData...)
+	unverified[32] = flagUserPresent
+	if _, err := rp.VerifyAssertion(challenge, cred, clientDataJSON, unverified, signature); !errors.Is(err, ErrUserNotVerified) {
+		t.Errorf("without user verification: err=%v", err)
+	}
+	// Counter did not increase
+	cred.SignCount = 5
+	if _, err := rp.VerifyAssertion(challenge, cred, clientDataJSON, authData, signature); !errors.Is(err, ErrSignCountInvalid) {
+		t.Errorf("sign count regression: err=%v", err)
+	}
+}
+
+func TestDecodeCborInvalid(t *testing.T) {
+	inputs := [][]byte{
+		{},
+		{0x5a, 0xff, 0xff, 0xff, 0xff}, // byte string longer than the input
+		{0xbf},                         // indefinite map
+		{0xa1, 0x41, 0x00, 0x00},       // map with a byte string key
+		{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, // huge array
+	}
+	nested := make([]byte, 100)
+	for i := range nested {
+		nested[i] = 0x81 // array of one item
+	}
+	inputs = append(inputs, nested)
+
+	for _, input := range inputs {
+		if _, _, err := decodeCbor(input); err == nil {
+			t.Errorf("decoding %x should fail", input)
+		}
+	}
+}